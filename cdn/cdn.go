@@ -0,0 +1,64 @@
+// Package cdn signs the urls of stored files on a CDN, so downloads are served
+// by it rather than by the uploader.
+package cdn
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Signer signs the url of key on the CDN, valid until expires
+type Signer interface {
+	Sign(key string, expires time.Time) (string, error)
+}
+
+// Config selects and configures a provider. The origin of the distribution
+// must serve the stored files by their storage key.
+type Config struct {
+	Provider string `mapstructure:"provider"`
+	// scheme and host (and path) the keys are appended to
+	BaseURL string `mapstructure:"base_url"`
+	// cloudfront: id of the public key and the file of its RSA private key
+	KeyPairId      string `mapstructure:"key_pair_id"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	// cloudflare: HMAC secret and ttl of the token authentication rule
+	Secret   string        `mapstructure:"secret"`
+	Lifetime time.Duration `mapstructure:"lifetime"`
+}
+
+type Factory func(config Config) (Signer, error)
+
+var providers = map[string]Factory{
+	"cloudfront": func(config Config) (Signer, error) { return NewCloudFront(config) },
+	"cloudflare": func(config Config) (Signer, error) { return NewCloudflare(config) },
+}
+
+// Register makes a provider available to New
+func Register(provider string, factory Factory) {
+	providers[provider] = factory
+}
+
+func New(config Config) (Signer, error) {
+	factory, ok := providers[config.Provider]
+	if !ok {
+		return nil, fmt.Errorf("cdn: unknown provider %q", config.Provider)
+	}
+	if config.BaseURL == "" {
+		return nil, fmt.Errorf("cdn: %s provider needs a base_url", config.Provider)
+	}
+	return factory(config)
+}
+
+// objectURL is the unsigned url of key under baseURL
+func objectURL(baseURL string, key string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("cdn: invalid base_url: %w", err)
+	}
+	u.Path = path.Join("/", u.Path, key)
+	u.RawPath = ""
+	return u, nil
+}
@@ -0,0 +1,79 @@
+package cdn_test
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/cdn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudFront(t *testing.T) {
+	assert := assert.New(t)
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	signer, err := cdn.New(cdn.Config{Provider: "cloudfront", BaseURL: "https://d111.cloudfront.net/files/", KeyPairId: "K2JC", PrivateKeyFile: keyFile})
+	if !assert.NoError(err) {
+		return
+	}
+	expires := time.Unix(1900000000, 0)
+	signed, err := signer.Sign("videos/a b.mp4", expires)
+	if !assert.NoError(err) {
+		return
+	}
+	u, _ := url.Parse(signed)
+	assert.Equal("/files/videos/a b.mp4", u.Path)
+	assert.Equal("1900000000", u.Query().Get("Expires"))
+	assert.Equal("K2JC", u.Query().Get("Key-Pair-Id"))
+
+	resource := strings.Split(signed, "?")[0]
+	policy := `{"Statement":[{"Resource":"` + resource + `","Condition":{"DateLessThan":{"AWS:EpochTime":1900000000}}}]}`
+	digest := sha1.Sum([]byte(policy))
+	signature, _ := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(u.Query().Get("Signature")))
+	assert.NoError(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], signature))
+}
+
+func TestCloudflare(t *testing.T) {
+	assert := assert.New(t)
+	signer, err := cdn.New(cdn.Config{Provider: "cloudflare", BaseURL: "https://cdn.example.com", Secret: "s3cret", Lifetime: time.Minute})
+	if !assert.NoError(err) {
+		return
+	}
+	expires := time.Now().Add(30 * time.Second)
+	signed, err := signer.Sign("photos/cat.jpg", expires)
+	if !assert.NoError(err) {
+		return
+	}
+	path, token, _ := strings.Cut(strings.TrimPrefix(signed, "https://cdn.example.com"), "?verify=")
+	assert.Equal("/photos/cat.jpg", path)
+	token, _ = url.QueryUnescape(token)
+	timestamp, given, _ := strings.Cut(token, "-")
+	// the token is accepted until expires
+	assert.Equal(strconv.FormatInt(expires.Add(-time.Minute).Unix(), 10), timestamp)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(path + timestamp))
+	assert.Equal(base64.StdEncoding.EncodeToString(mac.Sum(nil)), given)
+}
+
+func TestUnknownProvider(t *testing.T) {
+	_, err := cdn.New(cdn.Config{Provider: "akamai", BaseURL: "https://cdn.example.com"})
+	assert.Error(t, err)
+	_, err = cdn.New(cdn.Config{Provider: "cloudflare", Secret: "s3cret", Lifetime: time.Minute})
+	assert.Error(t, err)
+}
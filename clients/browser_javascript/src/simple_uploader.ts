@@ -28,8 +28,9 @@ interface FileMeta {
   chunkSize: number;
   prefix: string;
   createdAt: number;
-  status: number;
+  state: string;
   slices: { [key: string]: Slice };
+  fingerprint?: string;
 }
 
 export class UserCanceledUploading extends Error {
@@ -57,6 +58,16 @@ function sha1File(file: Blob): Promise<string> {
   });
 }
 
+async function sha256Hex(text: string): Promise<string> {
+  const res = await crypto.subtle.digest(
+    "SHA-256",
+    new TextEncoder().encode(text)
+  );
+  return Array.from(new Uint8Array(res))
+    .map((b) => b.toString(16).padStart(2, "0"))
+    .join("");
+}
+
 type SimpleUploaderOptions = {
   chunkSize: number;
   endpoint: string;
@@ -115,7 +126,36 @@ export default class SimpleUploader {
     this.halt = true;
   }
 
+  // name + size + mtime + hash of the first MB identify the local file well
+  // enough to find its sessions on the server again
+  async fingerprint(): Promise<string> {
+    const headSha1 = await sha1File(this.file.slice(0, 1024 * 1024));
+    const mtime = Math.floor(this.file.lastModified / 1000);
+    return sha256Hex(`${this.file.name}:${this.file.size}:${mtime}:${headSha1}`);
+  }
+
+  async resume(): Promise<FileMeta | null> {
+    const response = await axios.get<Response<FileMeta[]>>(
+      `${this.options.endpoint}/resume`,
+      {
+        ...this.options.requestOptions,
+        params: { fingerprint: await this.fingerprint() },
+      }
+    );
+    if (response.status !== 200 || response.data.data.length === 0) {
+      return null;
+    }
+    return camecaseKeys(response.data.data[0], { deep: true });
+  }
+
   async upload() {
+    if (!this.meta) {
+      this.meta = await this.resume();
+      if (this.meta) {
+        this.saveMeta();
+      }
+    }
+
     if (!this.meta) {
       const response = await axios.post<Response<FileMeta>>(
         this.options.endpoint,
@@ -124,7 +164,8 @@ export default class SimpleUploader {
           file_type: this.file.type,
           file_size: this.file.size,
           chunk_size: this.options.chunkSize,
-          prefix: this.options.prefix
+          prefix: this.options.prefix,
+          fingerprint: await this.fingerprint(),
         },
         this.options.requestOptions
       );
@@ -182,8 +223,8 @@ export default class SimpleUploader {
     formData.append(
       "file",
       this.file.slice(
-        sliceIdInt * this.options.chunkSize,
-        (sliceIdInt + 1) * this.options.chunkSize
+        sliceIdInt * this.meta!.chunkSize,
+        (sliceIdInt + 1) * this.meta!.chunkSize
       ),
       this.file.name
     );
@@ -192,7 +233,7 @@ export default class SimpleUploader {
     formData.append("file_name", this.meta!.fileName);
     formData.append("file_type", this.meta!.fileType);
     formData.append("file_size", this.meta!.fileSize.toString());
-    formData.append("chunk_size", this.options.chunkSize.toString());
+    formData.append("chunk_size", this.meta!.chunkSize.toString());
 
     const response = await axios.post<Response<string>>(
       `${this.options.endpoint}/${this.meta!.fileId}/upload${this.options.useV2 ? '_v2' : ''}`,
@@ -230,8 +271,8 @@ export default class SimpleUploader {
       const slice = this.meta!.slices[sliceId];
       const sliceIdInt = parseInt(slice.sliceId);
       const file = this.file.slice(
-        sliceIdInt * this.options.chunkSize,
-        (sliceIdInt + 1) * this.options.chunkSize
+        sliceIdInt * this.meta!.chunkSize,
+        (sliceIdInt + 1) * this.meta!.chunkSize
       );
       const sha1 = await sha1File(file);
 
@@ -0,0 +1,69 @@
+// Package uploader is the Go client of simple-uploader.
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+type Response struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+	// the name of the uploadererrors.Error of a failure, if any
+	Error string `json:"error"`
+}
+
+type FileMeta struct {
+	FileId    string `json:"file_id"`
+	FileName  string `json:"file_name"`
+	FileType  string `json:"file_type"`
+	FileSize  int64  `json:"file_size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Prefix    string `json:"prefix"`
+	CreatedAt int64  `json:"created_at"`
+	// created, uploading, merging, verifying, complete, failed or expired
+	State string `json:"state"`
+	// set once the file is completed
+	Sha256 string `json:"sha256"`
+	// content identifier on IPFS, when the server adds files to a node
+	CID string `json:"cid,omitempty"`
+	// the name of the local file, when the server named it with a name
+	// template
+	OriginalName string `json:"original_name,omitempty"`
+}
+
+type Client struct {
+	// the files endpoint, e.g. http://127.0.0.1:8080/files
+	Endpoint string
+	// extra headers of every request, such as X-Api-Key
+	Headers    map[string]string
+	HTTPClient *http.Client
+}
+
+func NewClient(endpoint string) *Client {
+	return &Client{Endpoint: endpoint, HTTPClient: http.DefaultClient}
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range c.Headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// Meta fetches the meta of a file
+func (c *Client) Meta(ctx context.Context, fileId string) (FileMeta, error) {
+	var meta FileMeta
+	req, err := c.newRequest(ctx, "GET", c.Endpoint+"/"+fileId+"/meta")
+	if err != nil {
+		return meta, err
+	}
+	err = c.do(req, &meta)
+	return meta, err
+}
@@ -0,0 +1,186 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	defaultSegmentSize = 8 * 1024 * 1024
+	defaultSegments    = 4
+)
+
+type DownloadOptions struct {
+	// bytes fetched by a single range request, 8 MiB by default
+	SegmentSize int64
+	// range requests running at the same time, 4 by default
+	Segments int
+	// called after every segment with the bytes downloaded so far
+	OnProgress func(downloaded int64, total int64)
+}
+
+// downloadState is kept next to the partial file as `<dest>.part.json`, so an
+// interrupted download only fetches the missing segments
+type downloadState struct {
+	FileId      string `json:"file_id"`
+	Sha256      string `json:"sha256"`
+	SegmentSize int64  `json:"segment_size"`
+	Done        []bool `json:"done"`
+}
+
+// DownloadFile downloads a completed file to dest with parallel range
+// requests, resuming a previous attempt when one was interrupted. The result
+// is verified against the sha256 of the meta before it is renamed to dest.
+func (c *Client) DownloadFile(ctx context.Context, fileId string, dest string, options DownloadOptions) error {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = defaultSegmentSize
+	}
+	if options.Segments <= 0 {
+		options.Segments = defaultSegments
+	}
+
+	meta, err := c.Meta(ctx, fileId)
+	if err != nil {
+		return err
+	}
+	if meta.Sha256 == "" {
+		return fmt.Errorf("file %s is not completed", fileId)
+	}
+
+	partFile := dest + ".part"
+	stateFile := partFile + ".json"
+	state := loadDownloadState(stateFile)
+	// a different file, or the file changed since
+	if state.FileId != fileId || state.Sha256 != meta.Sha256 || state.SegmentSize != options.SegmentSize {
+		state = downloadState{
+			FileId:      fileId,
+			Sha256:      meta.Sha256,
+			SegmentSize: options.SegmentSize,
+			Done:        make([]bool, (meta.FileSize+options.SegmentSize-1)/options.SegmentSize),
+		}
+		os.Remove(partFile)
+	}
+
+	file, err := os.OpenFile(partFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(meta.FileSize); err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	var downloaded int64
+	for _, done := range state.Done {
+		if done {
+			downloaded += options.SegmentSize
+		}
+	}
+	segments := make(chan int)
+	errs := make(chan error, options.Segments)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < options.Segments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for segment := range segments {
+				start := int64(segment) * options.SegmentSize
+				end := min(start+options.SegmentSize, meta.FileSize)
+				if err := c.downloadRange(ctx, fileId, file, start, end); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+
+				lock.Lock()
+				state.Done[segment] = true
+				downloaded += end - start
+				saveDownloadState(stateFile, state)
+				if options.OnProgress != nil {
+					options.OnProgress(min(downloaded, meta.FileSize), meta.FileSize)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for segment, done := range state.Done {
+		if done {
+			continue
+		}
+		select {
+		case segments <- segment:
+		case <-ctx.Done():
+		}
+	}
+	close(segments)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Sha256 {
+		// start over next time
+		os.Remove(partFile)
+		os.Remove(stateFile)
+		return fmt.Errorf("checksum mismatch of %s", fileId)
+	}
+	file.Close()
+	os.Remove(stateFile)
+	return os.Rename(partFile, dest)
+}
+
+func (c *Client) downloadRange(ctx context.Context, fileId string, file *os.File, start int64, end int64) error {
+	req, err := c.newRequest(ctx, "GET", c.Endpoint+"/"+fileId+"/download")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("failed to download bytes %d-%d of %s: %s", start, end-1, fileId, resp.Status)
+	}
+
+	n, err := io.Copy(io.NewOffsetWriter(file, start), io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return err
+	}
+	if n != end-start {
+		return fmt.Errorf("short read of bytes %d-%d of %s", start, end-1, fileId)
+	}
+	return nil
+}
+
+func loadDownloadState(name string) downloadState {
+	var state downloadState
+	if content, err := os.ReadFile(name); err == nil {
+		json.Unmarshal(content, &state)
+	}
+	return state
+}
+
+func saveDownloadState(name string, state downloadState) {
+	content, _ := json.Marshal(state)
+	os.WriteFile(name, content, 0644)
+}
@@ -0,0 +1,133 @@
+package uploader_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/clients/golang/uploader"
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// upload content through the server as a single slice
+func upload(t *testing.T, server *httptest.Server, content []byte) string {
+	params, _ := json.Marshal(controllers.CreateParams{
+		FileName:  "download-" + strconv.Itoa(len(content)),
+		FileType:  "application/octet-stream",
+		FileSize:  int64(len(content)),
+		ChunkSize: int64(len(content)),
+	})
+	resp, err := http.Post(server.URL+"/files", "application/json", bytes.NewReader(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	json.Unmarshal(response.Data, &meta)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("file_name", meta.FileName)
+	writer.WriteField("file_type", meta.FileType)
+	writer.WriteField("file_size", strconv.FormatInt(meta.FileSize, 10))
+	writer.WriteField("chunk_size", strconv.FormatInt(meta.ChunkSize, 10))
+	writer.WriteField("file_id", meta.FileId)
+	writer.WriteField("slice_id", "0")
+	fileWriter, _ := writer.CreateFormFile("file", meta.FileName)
+	fileWriter.Write(content)
+	writer.Close()
+	resp, err = http.Post(server.URL+"/files/"+meta.FileId+"/upload_v2", writer.FormDataContentType(), body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to upload: %v %v", err, resp)
+	}
+	resp.Body.Close()
+	return meta.FileId
+}
+
+func TestDownloadFile(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	viper.Set("uploader.slice_cache_dir", path.Join(root, "cache"))
+	viper.Set("uploader.upload_dir", path.Join(root, "data"))
+	viper.Set("uploader.metafile_dir", path.Join(root, "meta"))
+	for _, dir := range []string{"cache", "data", "meta"} {
+		os.MkdirAll(path.Join(root, dir), 0755)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	controllers.Attach(r, "/")
+	var ranges atomic.Int32
+	var failAfter atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/download") {
+			if n := ranges.Add(1); failAfter.Load() > 0 && n > failAfter.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	content := make([]byte, 1000*1000)
+	rand.Read(content)
+	fileId := upload(t, server, content)
+
+	client := uploader.NewClient(server.URL + "/files")
+	dest := path.Join(root, "downloaded")
+	options := uploader.DownloadOptions{SegmentSize: 100 * 1000, Segments: 1}
+
+	// interrupted after 4 segments
+	failAfter.Store(4)
+	assert.Error(client.DownloadFile(context.Background(), fileId, dest, options))
+	assert.NoFileExists(dest)
+
+	// only the remaining 6 are fetched
+	failAfter.Store(0)
+	ranges.Store(0)
+	options.Segments = 3
+	assert.NoError(client.DownloadFile(context.Background(), fileId, dest, options))
+	assert.Equal(int32(6), ranges.Load())
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(content, downloaded)
+	assert.NoFileExists(dest + ".part")
+	assert.NoFileExists(dest + ".part.json")
+}
+
+func TestResponseError(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	viper.Set("uploader.metafile_dir", path.Join(root, "meta"))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	controllers.Attach(r, "/")
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	client := uploader.NewClient(server.URL + "/files")
+	_, err := client.Meta(context.Background(), "missing")
+	assert.ErrorIs(err, uploadererrors.ErrSessionNotFound)
+	assert.NotErrorIs(err, uploadererrors.ErrSessionExpired)
+	var response *uploadererrors.ResponseError
+	if assert.ErrorAs(err, &response) {
+		assert.Equal(http.StatusNotFound, response.Status)
+		assert.Equal("session not found", response.Message)
+	}
+}
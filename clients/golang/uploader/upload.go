@@ -0,0 +1,231 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/louis-she/simple-uploader/uploadererrors"
+)
+
+const defaultChunkSize = 10 * 1024 * 1024
+
+type Slice struct {
+	Id     string `json:"slice_id"`
+	Status int    `json:"status"`
+	Sha1   string `json:"sha1"`
+}
+
+// Session is the meta of a file being uploaded
+type Session struct {
+	FileMeta
+	Fingerprint string           `json:"fingerprint"`
+	Slices      map[string]Slice `json:"slices"`
+	// only known to the client which created the session, servers with
+	// uploader.upload_token require it
+	UploadToken         string `json:"upload_token,omitempty"`
+	UploadTokenRequired bool   `json:"upload_token_required,omitempty"`
+}
+
+type UploadOptions struct {
+	// used when the server does not force one for the prefix
+	ChunkSize int64
+	Prefix    string
+	// names the file on the server instead of the name of the local file,
+	// e.g. "{date}/{uuid}_{orig_name}"
+	NameTemplate string
+	// called after every slice with the slices uploaded so far
+	OnProgress func(uploaded int, total int)
+}
+
+// Fingerprint identifies a local file to find its unfinished sessions on the
+// server again, the same way the other clients do
+func Fingerprint(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	head := sha1.New()
+	if _, err := io.CopyN(head, file, 1024*1024); err != nil && err != io.EOF {
+		return "", err
+	}
+	raw := fmt.Sprintf("%s:%d:%d:%s", filepath.Base(name), info.Size(), info.ModTime().Unix(), hex.EncodeToString(head.Sum(nil)))
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// UploadFile uploads a local file with UploadV2, carrying on with the
+// unfinished session of the same file when there is one
+func (c *Client) UploadFile(ctx context.Context, name string, options UploadOptions) (Session, error) {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = defaultChunkSize
+	}
+	fingerprint, err := Fingerprint(name)
+	if err != nil {
+		return Session{}, err
+	}
+	session, found, err := c.resume(ctx, fingerprint)
+	if err != nil {
+		return session, err
+	}
+	if !found {
+		if session, err = c.create(ctx, name, fingerprint, options); err != nil {
+			return session, err
+		}
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return session, err
+	}
+	defer file.Close()
+
+	uploaded := 0
+	for _, slice := range session.Slices {
+		if slice.Status == 1 {
+			uploaded++
+		}
+	}
+	for i := 0; i < len(session.Slices); i++ {
+		sliceId := strconv.Itoa(i)
+		if session.Slices[sliceId].Status == 1 {
+			continue
+		}
+		data := make([]byte, min(session.ChunkSize, session.FileSize-int64(i)*session.ChunkSize))
+		if _, err := file.ReadAt(data, int64(i)*session.ChunkSize); err != nil {
+			return session, err
+		}
+		if err := c.uploadSlice(ctx, session, sliceId, data); err != nil {
+			return session, err
+		}
+		session.Slices[sliceId] = Slice{Id: sliceId, Status: 1}
+		uploaded++
+		if options.OnProgress != nil {
+			options.OnProgress(uploaded, len(session.Slices))
+		}
+	}
+	return session, nil
+}
+
+// resume finds the newest unfinished session of the fingerprint, sessions
+// requiring the upload token can't be resumed as it is lost
+func (c *Client) resume(ctx context.Context, fingerprint string) (Session, bool, error) {
+	var sessions []Session
+	req, err := c.newRequest(ctx, "GET", c.Endpoint+"/resume?fingerprint="+url.QueryEscape(fingerprint))
+	if err != nil {
+		return Session{}, false, err
+	}
+	if err := c.do(req, &sessions); err != nil {
+		return Session{}, false, err
+	}
+	for _, session := range sessions {
+		if !session.UploadTokenRequired {
+			return session, true, nil
+		}
+	}
+	return Session{}, false, nil
+}
+
+func (c *Client) create(ctx context.Context, name string, fingerprint string, options UploadOptions) (Session, error) {
+	var session Session
+	info, err := os.Stat(name)
+	if err != nil {
+		return session, err
+	}
+	fileType := mime.TypeByExtension(filepath.Ext(name))
+	if fileType == "" {
+		fileType = "application/octet-stream"
+	}
+	params := map[string]interface{}{
+		"file_name":   filepath.Base(name),
+		"file_type":   fileType,
+		"file_size":   info.Size(),
+		"chunk_size":  options.ChunkSize,
+		"prefix":      options.Prefix,
+		"fingerprint": fingerprint,
+	}
+	if options.NameTemplate != "" {
+		params["name_template"] = options.NameTemplate
+	}
+	body, _ := json.Marshal(params)
+	req, err := c.newRequest(ctx, "POST", c.Endpoint)
+	if err != nil {
+		return session, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	err = c.do(req, &session)
+	return session, err
+}
+
+func (c *Client) uploadSlice(ctx context.Context, session Session, sliceId string, data []byte) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("file_id", session.FileId)
+	writer.WriteField("file_name", session.FileName)
+	writer.WriteField("file_type", session.FileType)
+	writer.WriteField("file_size", strconv.FormatInt(session.FileSize, 10))
+	writer.WriteField("chunk_size", strconv.FormatInt(session.ChunkSize, 10))
+	writer.WriteField("slice_id", sliceId)
+	fileWriter, _ := writer.CreateFormFile("file", session.FileName)
+	fileWriter.Write(data)
+	writer.Close()
+
+	req, err := c.newRequest(ctx, "POST", c.Endpoint+"/"+session.FileId+"/upload_v2")
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(body)
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if session.UploadToken != "" {
+		req.Header.Set("X-Upload-Token", session.UploadToken)
+	}
+	return c.do(req, nil)
+}
+
+// do sends the request and decodes the data of a 200 or 206 response into
+// data, other responses fail with an *uploadererrors.ResponseError
+func (c *Client) do(req *http.Request, data interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, &uploadererrors.ResponseError{
+			Status:  resp.StatusCode,
+			Code:    response.Code,
+			Name:    response.Error,
+			Message: response.Message,
+			Data:    response.Data,
+		})
+	}
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Data, data)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 
 	"github.com/gin-gonic/gin"
@@ -17,7 +18,20 @@ func main() {
 	os.MkdirAll(viper.GetString("uploader.upload_dir"), 0755)
 	os.MkdirAll(viper.GetString("uploader.metafile_dir"), 0755)
 
+	if dropFolder := viper.GetString("uploader.drop_folder"); dropFolder != "" {
+		if err := controllers.WatchDropFolder(context.Background(), dropFolder); err != nil {
+			panic(err)
+		}
+	}
+
 	r := gin.Default()
 	controllers.Attach(r, "/")
-	r.Run()
+
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	if err := controllers.NewServer(addr, r).ListenAndServe(); err != nil {
+		panic(err)
+	}
 }
@@ -39,8 +39,9 @@ class FileMeta:
     chunk_size: int
     prefix: str
     created_at: int
-    status: int
     slices: Dict[str, Slice]
+    fingerprint: str = ""
+    state: str = ""
 
 
 @dataclass
@@ -97,7 +98,36 @@ class SimpleUploader:
     def save_meta(self):
         self.meta_file.write_text(json.dumps(asdict(self.meta)))
 
+    def fingerprint(self) -> str:
+        # name + size + mtime + hash of the first MB identify the local file
+        # well enough to find its sessions on the server again
+        self.fh.seek(0)
+        head_sha1 = self._sha1(self.fh.read(1024 * 1024))
+        mtime = int(os.path.getmtime(self.file))
+        raw = f"{self.file.name}:{self.file_size}:{mtime}:{head_sha1}"
+        return hashlib.sha256(raw.encode()).hexdigest()
+
+    def resume(self) -> Optional[FileMeta]:
+        response = requests.get(
+            f"{self.options.endpoint}/resume",
+            params={"fingerprint": self.fingerprint()},
+            headers={
+                **(self.options.headers if self.options.headers is not None else {})
+            },
+        )
+        if response.status_code != 200:
+            return None
+        sessions = response.json()["data"]
+        if not sessions:
+            return None
+        return from_dict(FileMeta, sessions[0])
+
     def upload(self):
+        if not self.meta:
+            self.meta = self.resume()
+            if self.meta:
+                self.save_meta()
+
         if not self.meta:
             response = requests.post(
                 self.options.endpoint,
@@ -107,6 +137,7 @@ class SimpleUploader:
                     "file_size": self.file_size,
                     "chunk_size": self.options.chunk_size,
                     "prefix": self.options.prefix,
+                    "fingerprint": self.fingerprint(),
                 },
                 headers={
                     **(self.options.headers if self.options.headers is not None else {})
@@ -139,15 +170,15 @@ class SimpleUploader:
                     )
 
     def _upload_slice(self, slice_id: str) -> Response:
-        self.fh.seek(int(slice_id) * self.options.chunk_size)
-        bytes = self.fh.read(self.options.chunk_size)
+        self.fh.seek(int(slice_id) * self.meta.chunk_size)
+        bytes = self.fh.read(self.meta.chunk_size)
         form_data = {
             "slice_id": slice_id,
             "file_id": self.meta.file_id,
             "file_name": self.meta.file_name,
             "file_type": self.meta.file_type,
             "file_size": self.meta.file_size,
-            "chunk_size": self.options.chunk_size,
+            "chunk_size": self.meta.chunk_size,
         }
         response = requests.post(
             f"{self.options.endpoint}/{self.meta.file_id}/upload{'_v2' if self.options.use_v2 else ''}",
@@ -180,8 +211,8 @@ class SimpleUploader:
         server_meta = from_dict(FileMeta, response.json()["data"])
         check_result = CheckResult(0, 0, [])
         for slice_id, slice in server_meta.slices.items():
-            self.fh.seek(int(slice_id) * self.options.chunk_size)
-            blob = self.fh.read(self.options.chunk_size)
+            self.fh.seek(int(slice_id) * self.meta.chunk_size)
+            blob = self.fh.read(self.meta.chunk_size)
             sha1 = self._sha1(blob)
             if slice.sha1 == sha1:
                 check_result.success_count += 1
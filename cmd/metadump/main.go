@@ -0,0 +1,97 @@
+// Command metadump exports the metadata of the files and sessions of a
+// simple-uploader, configured as the server is, to json lines and imports
+// such a dump back, e.g. to move the metadata to another store:
+//
+//	metadump -config uploader.yaml export > metadata.jsonl
+//	metadump -config uploader.yaml import [-overwrite] metadata.jsonl
+//
+// Only the metadata is dumped, not the stored files nor the slice cache.
+// Run it while the server is stopped, or use the admin API of a running one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-config file] export [-o file] | import [-overwrite] [file]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	configFile := flag.String("config", "", "path of the config file")
+	flag.Usage = usage
+	flag.Parse()
+
+	viper.SetDefault("uploader.slice_cache_dir", "/var/lib/simple-uploader/cache")
+	viper.SetDefault("uploader.metafile_dir", "/var/lib/simple-uploader/meta")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	if *configFile != "" {
+		viper.SetConfigFile(*configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			logrus.Fatalf("failed to read config: %v", err)
+		}
+	}
+
+	defer controllers.CloseMetadata()
+	switch flag.Arg(0) {
+	case "export":
+		export(flag.Args()[1:])
+	case "import":
+		importDump(flag.Args()[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func export(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "file to write the dump to, stdout by default")
+	flags.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			logrus.Fatalf("failed to create %s: %v", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	n, err := controllers.ExportMetadata(w)
+	if err != nil {
+		logrus.Fatalf("failed to export metadata: %v", err)
+	}
+	logrus.Infof("exported %d records", n)
+}
+
+func importDump(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	overwrite := flags.Bool("overwrite", false, "replace the records already there")
+	flags.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			logrus.Fatalf("failed to open %s: %v", name, err)
+		}
+		defer file.Close()
+		r = file
+	}
+	result, err := controllers.ImportMetadata(r, *overwrite)
+	if err != nil {
+		logrus.Fatalf("failed to import metadata after %d files and %d sessions: %v", result.Files, result.Sessions, err)
+	}
+	logrus.Infof("imported %d files and %d sessions, skipped %d", result.Files, result.Sessions, result.Skipped)
+}
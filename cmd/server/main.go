@@ -0,0 +1,138 @@
+// Command server runs simple-uploader as a standalone server configured by a
+// yaml file (see the readme) and UPLOADER_* environment variables.
+//
+//	server -config uploader.yaml
+//	server -config uploader.yaml check
+//
+// check validates the configuration, the directories, the storage backends
+// and the metadata without serving, it exits with 1 when any check fails.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// requests still running after this long are cut at shutdown, unless
+// uploader.timeouts.shutdown says otherwise
+const defaultShutdownTimeout = 30 * time.Second
+
+func main() {
+	configFile := flag.String("config", "", "path of the config file")
+	flag.Parse()
+
+	viper.SetDefault("uploader.listen", ":8080")
+	viper.SetDefault("uploader.slice_cache_dir", "/var/lib/simple-uploader/cache")
+	viper.SetDefault("uploader.upload_dir", "/var/lib/simple-uploader/data")
+	viper.SetDefault("uploader.metafile_dir", "/var/lib/simple-uploader/meta")
+	// e.g. UPLOADER_UPLOAD_DIR for uploader.upload_dir
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	if *configFile != "" {
+		viper.SetConfigFile(*configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			logrus.Fatalf("failed to read config: %v", err)
+		}
+	}
+
+	if flag.Arg(0) == "check" {
+		check()
+		return
+	}
+
+	controllers.TuneGC()
+
+	if err := controllers.CreateDirs(); err != nil {
+		logrus.Fatal(err)
+	}
+	migrated, err := controllers.MigrateMetadata()
+	if err != nil {
+		logrus.Fatalf("failed to migrate metadata: %v", err)
+	}
+	if migrated.Files+migrated.Sessions > 0 {
+		logrus.Infof("migrated the metas of %d files and %d sessions into the metadata store", migrated.Files, migrated.Sessions)
+	}
+	// the metas of the patched files are in the metadata store once migrated
+	if err := controllers.RecoverPatches(); err != nil {
+		logrus.Fatalf("failed to recover patches: %v", err)
+	}
+
+	if dropFolder := viper.GetString("uploader.drop_folder"); dropFolder != "" {
+		if err := controllers.WatchDropFolder(context.Background(), dropFolder); err != nil {
+			logrus.Fatalf("failed to watch drop folder: %v", err)
+		}
+	}
+
+	controllers.StartCompaction(context.Background())
+	controllers.StartJanitor(context.Background())
+	controllers.StartReplication(context.Background())
+	controllers.StartUsageFlush(context.Background())
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	if err := controllers.TrustProxies(r); err != nil {
+		logrus.Fatalf("invalid trusted proxies: %v", err)
+	}
+	r.Use(gin.Logger(), gin.Recovery())
+	controllers.Attach(r, "/")
+
+	listener, err := controllers.Listen(viper.GetString("uploader.listen"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("listening on %s", viper.GetString("uploader.listen"))
+	server := controllers.NewServer(viper.GetString("uploader.listen"), r)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		<-ctx.Done()
+		logrus.Infof("shutting down")
+		timeout := viper.GetDuration("uploader.timeouts.shutdown")
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.Errorf("failed to shut down: %v", err)
+		}
+	}()
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		logrus.Fatal(err)
+	}
+	<-stopped
+	controllers.FlushUsage()
+	controllers.CloseMetadata()
+}
+
+func check() {
+	gin.SetMode(gin.ReleaseMode)
+	failed := 0
+	for _, result := range controllers.Check() {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n     %s\n", result.Name, result.Err, result.Detail)
+			continue
+		}
+		fmt.Printf("ok   %s: %s\n", result.Name, result.Detail)
+	}
+	if failed > 0 {
+		fmt.Printf("%d checks failed\n", failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,329 @@
+package controllers
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/security"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type AdminController struct {
+	BaseController
+}
+
+func (a *AdminController) AddRoutes(r gin.IRoutes, prefix string) {
+	if prefix == "" {
+		prefix = "/"
+	}
+	// the routes writing files or metas are refused in maintenance, as
+	// uploads are. Erasure is not: it only removes, and can't wait.
+	r.POST(prefix+"admin/files/:id/erase", a.Auth, a.Erase)
+	r.PATCH(prefix+"admin/files/:id/content", a.Auth, readOnlyGuard, a.Patch)
+	r.GET(prefix+"admin/files/:id/log", a.Auth, a.SessionLog)
+	r.GET(prefix+"admin/duplicates", a.Auth, a.Duplicates)
+	r.GET(prefix+"admin/sessions", a.Auth, a.Sessions)
+	r.GET(prefix+"admin/usage", a.Auth, a.Usage)
+	r.GET(prefix+"admin/metadata", a.Auth, a.ExportMetadata)
+	r.POST(prefix+"admin/metadata", a.Auth, readOnlyGuard, a.ImportMetadata)
+	r.POST(prefix+"admin/duplicates/deduplicate", a.Auth, readOnlyGuard, a.Deduplicate)
+	r.POST(prefix+"admin/compact", a.Auth, readOnlyGuard, a.Compact)
+	r.POST(prefix+"admin/replicate", a.Auth, readOnlyGuard, a.Replicate)
+	r.GET(prefix+"admin/download_cache", a.Auth, a.DownloadCache)
+	r.GET(prefix+"admin/storage_breakers", a.Auth, a.StorageBreakers)
+	r.GET(prefix+"admin/maintenance", a.Auth, a.Maintenance)
+	r.PUT(prefix+"admin/maintenance", a.Auth, a.SetMaintenance)
+	r.GET(prefix+"admin/debug/vars", a.Auth, a.Vars)
+	r.GET(prefix+"admin/debug/pprof/*name", a.Auth, a.Pprof)
+	r.POST(prefix+"admin/debug/pprof/*name", a.Auth, a.Pprof)
+}
+
+// adminKeys are `uploader.admin_token` and the rotatable
+// `uploader.admin_tokens`
+func adminKeys() []security.Key {
+	keys := keyring("uploader.admin_tokens")
+	if token := viper.GetString("uploader.admin_token"); token != "" {
+		keys = append(keys, security.Key{Id: "admin", Secret: token})
+	}
+	return keys
+}
+
+// Auth only lets requests carrying `Authorization: Bearer <token>` with one
+// of the admin tokens through, admin routes are disabled while no token is
+// configured
+func (a *AdminController) Auth(c *gin.Context) {
+	keys := adminKeys()
+	if len(keys) == 0 {
+		a.Write(c, nil, 404, 0, "")
+		c.Abort()
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	id, ok := security.Match(keys, token, time.Now())
+	if !ok {
+		logrus.Warningf("refused admin token %s from %s", security.Redact(token), c.ClientIP())
+		a.Write(c, nil, 401, 0, "")
+		c.Abort()
+		return
+	}
+	c.Set("admin_key_id", id)
+	c.Next()
+}
+
+type ErasureItem struct {
+	Kind   string `json:"kind"`
+	Bytes  int64  `json:"bytes"`
+	Method string `json:"method"`
+}
+
+// ErasureReport records what was destroyed, it intentionally holds nothing
+// about the content such as file name or prefix
+type ErasureReport struct {
+	FileId   string        `json:"file_id"`
+	ErasedAt int64         `json:"erased_at"`
+	Items    []ErasureItem `json:"items"`
+}
+
+// artifactErasers destroy what the features keep of a stored file besides
+// it, after the file at key of store is erased
+var artifactErasers = []func(meta *FileMeta, store storage.Storage, key string) ([]ErasureItem, error){
+	erasePreview,
+	eraseDownloadCache,
+	eraseDoneMarker,
+	erasePublished,
+	erasePatchJournal,
+}
+
+// eraseLocalFile overwrites and unlinks name when it exists
+func eraseLocalFile(kind string, name string) ([]ErasureItem, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, nil
+	}
+	storage.OverwriteFile(name)
+	if err := os.Remove(name); err != nil {
+		return nil, err
+	}
+	return []ErasureItem{{Kind: kind, Bytes: info.Size(), Method: "overwrite+unlink"}}, nil
+}
+
+// erasureMethod tells how storage.Erase destroys the files of store
+func erasureMethod(store storage.Storage) string {
+	switch storage.Unwrapped(store).(type) {
+	case *storage.Local:
+		return "overwrite+unlink"
+	case *storage.S3:
+		return "delete all versions"
+	}
+	return "delete"
+}
+
+// Erase destroys a file and everything known about it: the stored file,
+// the slice cache and the meta files are overwritten before unlinking
+func (a *AdminController) Erase(c *gin.Context) {
+	fileId := c.Param("id")
+	if fileId == "" || strings.ContainsAny(fileId, "/.") {
+		a.Write(c, nil, 400, 0, "")
+		return
+	}
+
+	session := lockSession(fileId)
+	defer session.Unlock()
+
+	cacheDir := path.Join(viper.GetString("uploader.slice_cache_dir"), fileId)
+	records := metas()
+	content, err := records.read(MetaRecordSession, fileId)
+	if err != nil {
+		content, err = records.read(MetaRecordFile, fileId)
+	}
+	if err != nil {
+		content, err = os.ReadFile(reclaimedMetaPath(fileId))
+	}
+	if err != nil {
+		a.Write(c, nil, 404, 0, "")
+		return
+	}
+	meta := &FileMeta{}
+	json.Unmarshal(content, meta)
+
+	report := ErasureReport{FileId: fileId, Items: []ErasureItem{}}
+	targetFiles.drop(meta.partialPath())
+
+	// the stored file only belongs to this session once all slices arrived
+	if meta.Uploaded() {
+		store, err := meta.storage()
+		if err != nil {
+			logrus.Errorf("failed to create storage of %s: %v", fileId, err)
+			a.Write(c, nil, 500, 0, "")
+			return
+		}
+		key := meta.StorageKey()
+		erase, method := storage.Erase, erasureMethod(store)
+		if sharesContent(meta) {
+			erase, method = func(s storage.Storage, key string) error { return s.Delete(key) }, "unlink (content shared with a duplicate)"
+		}
+		if info, err := store.Stat(key); err == nil {
+			if err := erase(store, key); err != nil {
+				if err == storage.ErrObjectLocked {
+					a.WriteError(c, nil, uploadererrors.ErrFileLocked)
+					return
+				}
+				logrus.Errorf("failed to erase file %s: %v", fileId, err)
+				a.Write(c, nil, 500, 0, "")
+				return
+			}
+			report.Items = append(report.Items, ErasureItem{Kind: "file", Bytes: info.Size(), Method: method})
+		}
+		for _, eraseArtifact := range artifactErasers {
+			items, err := eraseArtifact(meta, store, key)
+			if err != nil {
+				logrus.Errorf("failed to erase the artifacts of %s: %v", fileId, err)
+				a.Write(c, nil, 500, 0, "")
+				return
+			}
+			report.Items = append(report.Items, items...)
+		}
+		// the cid is only in the meta of the completed file, a duplicate has
+		// the same and keeps the pin
+		var completed FileMeta
+		if content, err := records.read(MetaRecordFile, fileId); err == nil {
+			json.Unmarshal(content, &completed)
+		}
+		if completed.CID != "" && !sharesContent(meta) {
+			if err := unpinFromIPFS(completed.CID); err != nil {
+				logrus.Errorf("failed to unpin %s from ipfs: %v", fileId, err)
+				a.Write(c, nil, 500, 0, "")
+				return
+			}
+			report.Items = append(report.Items, ErasureItem{Kind: "ipfs_pin", Bytes: meta.FileSize, Method: "unpin (copies fetched by other nodes remain)"})
+		}
+		for _, replica := range meta.Replicas {
+			replicaStore, err := newStorage(replica.Storage)
+			if err != nil {
+				logrus.Errorf("failed to create replica storage of %s: %v", fileId, err)
+				a.Write(c, nil, 500, 0, "")
+				return
+			}
+			info, err := replicaStore.Stat(key)
+			if err != nil {
+				continue
+			}
+			replicaMethod := erasureMethod(replicaStore)
+			if sharesContent(meta) {
+				replicaMethod = method
+			}
+			if err := erase(replicaStore, key); err != nil {
+				logrus.Errorf("failed to erase replica of %s: %v", fileId, err)
+				a.Write(c, nil, 500, 0, "")
+				return
+			}
+			report.Items = append(report.Items, ErasureItem{Kind: "replica", Bytes: info.Size(), Method: replicaMethod})
+		}
+		if name, ok := storage.LocalPath(store, key); ok {
+			sidecar := sidecarPath(name)
+			if info, err := os.Stat(sidecar); err == nil {
+				storage.OverwriteFile(sidecar)
+				if err := os.Remove(sidecar); err != nil {
+					logrus.Errorf("failed to remove sidecar of %s: %v", fileId, err)
+					a.Write(c, nil, 500, 0, "")
+					return
+				}
+				report.Items = append(report.Items, ErasureItem{Kind: "sidecar", Bytes: info.Size(), Method: "overwrite+unlink"})
+			}
+		}
+	}
+
+	var cacheBytes int64
+	filepath.Walk(cacheDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := storage.OverwriteFile(name); err != nil {
+			logrus.Errorf("failed to overwrite cache file of %s: %v", fileId, err)
+		}
+		cacheBytes += info.Size()
+		return nil
+	})
+	if _, err := os.Stat(cacheDir); err == nil {
+		if err := os.RemoveAll(cacheDir); err != nil {
+			logrus.Errorf("failed to remove cache dir of %s: %v", fileId, err)
+			a.Write(c, nil, 500, 0, "")
+			return
+		}
+		report.Items = append(report.Items, ErasureItem{Kind: "slice_cache", Bytes: cacheBytes, Method: "overwrite+unlink"})
+	}
+
+	// the target file of a session completed by now was moved to the file
+	if info, err := os.Stat(meta.TargetPath); meta.TargetPath != "" && err == nil {
+		storage.OverwriteFile(meta.TargetPath)
+		if err := os.Remove(meta.TargetPath); err != nil {
+			logrus.Errorf("failed to remove target file of %s: %v", fileId, err)
+			a.Write(c, nil, 500, 0, "")
+			return
+		}
+		report.Items = append(report.Items, ErasureItem{Kind: "target_file", Bytes: info.Size(), Method: "overwrite+unlink"})
+	}
+
+	// the meta of the session went with the slice cache unless the store
+	// keeps it elsewhere
+	for _, kind := range []string{MetaRecordSession, MetaRecordFile} {
+		content, err := records.read(kind, fileId)
+		if err != nil {
+			continue
+		}
+		if err := records.remove(kind, fileId); err != nil {
+			logrus.Errorf("failed to remove meta of %s: %v", fileId, err)
+			a.Write(c, nil, 500, 0, "")
+			return
+		}
+		report.Items = append(report.Items, ErasureItem{Kind: "meta", Bytes: int64(len(content)), Method: records.erasure()})
+	}
+	if info, err := os.Stat(reclaimedMetaPath(fileId)); err == nil {
+		storage.OverwriteFile(reclaimedMetaPath(fileId))
+		if err := os.Remove(reclaimedMetaPath(fileId)); err != nil {
+			logrus.Errorf("failed to remove meta file of %s: %v", fileId, err)
+			a.Write(c, nil, 500, 0, "")
+			return
+		}
+		report.Items = append(report.Items, ErasureItem{Kind: "meta", Bytes: info.Size(), Method: "overwrite+unlink"})
+	}
+	if logFile, ok := sessionLogPath(fileId); ok {
+		if info, err := os.Stat(logFile); err == nil {
+			storage.OverwriteFile(logFile)
+			if err := os.Remove(logFile); err != nil {
+				logrus.Errorf("failed to remove the log of %s: %v", fileId, err)
+				a.Write(c, nil, 500, 0, "")
+				return
+			}
+			report.Items = append(report.Items, ErasureItem{Kind: "session_log", Bytes: info.Size(), Method: "overwrite+unlink"})
+		}
+	}
+	if err := unindexFile(fileId); err != nil {
+		logrus.Errorf("failed to remove %s from the search index: %v", fileId, err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	session.forget()
+
+	report.ErasedAt = time.Now().Unix()
+	content, _ = json.Marshal(report)
+	reportFile := path.Join(viper.GetString("uploader.metafile_dir"), fileId+".erasure.json")
+	if err := permissions().WriteFile(reportFile, content); err != nil {
+		logrus.Errorf("failed to write erasure report of %s: %v", fileId, err)
+	}
+	a.Write(c, report, 200, 0, "")
+}
+
+// StorageBreakers tells the state of the breaker of every storage backend
+// used since start
+func (a *AdminController) StorageBreakers(c *gin.Context) {
+	a.Write(c, storage.Breakers(), 200, 0, "")
+}
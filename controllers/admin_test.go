@@ -0,0 +1,745 @@
+package controllers_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/louis-she/simple-uploader/storage/s3test"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanhpk/randstr"
+)
+
+func adminRequest(method string, url string) *http.Request {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+viper.GetString("uploader.admin_token"))
+	return req
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	assert := assert.New(t)
+
+	req, _ := http.NewRequest("POST", "/admin/files/xxx/erase", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+}
+
+func TestAdminTokenRotation(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_tokens", []map[string]string{
+		{"id": "ops", "key": "old-token", "expires": time.Now().Add(-time.Minute).Format(time.RFC3339)},
+		{"id": "ops", "key": "new-token"},
+		{"id": "ci", "key": "ci-token", "expires": time.Now().Add(time.Hour).Format(time.RFC3339)},
+	})
+	defer viper.Set("uploader.admin_tokens", nil)
+
+	for token, expected := range map[string]int{
+		"new-token": http.StatusOK,
+		"ci-token":  http.StatusOK,
+		"old-token": http.StatusUnauthorized,
+		"new-toke":  http.StatusUnauthorized,
+	} {
+		req, _ := http.NewRequest("GET", "/admin/usage", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(expected, w.Code, token)
+	}
+}
+
+func TestAdminErase(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	file, meta := createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v1")
+
+	destFilePath := path.Join(viper.GetString("uploader.upload_dir"), meta.FileName)
+	metaFilePath := path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".meta.json")
+	assert.FileExists(destFilePath)
+	assert.FileExists(metaFilePath)
+
+	c, w := prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+
+	var response controllers.Response
+	var report controllers.ErasureReport
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &report)
+	assert.Equal(meta.FileId, report.FileId)
+	assert.Len(report.Items, 2)
+	assert.Equal(int64(1024*1024), report.Items[0].Bytes)
+	assert.NotContains(w.Body.String(), meta.FileName)
+
+	assert.NoFileExists(destFilePath)
+	assert.NoFileExists(metaFilePath)
+
+	c, w = prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestAdminEraseArtifacts(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+	server := s3test.NewServer()
+	defer server.Close()
+	server.Versioning = true
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	hardlinkDir, cacheDir := t.TempDir(), t.TempDir()
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "erased", "publish": map[string]interface{}{"symlink": "latest", "hardlink_dir": hardlinkDir}},
+		{"prefix": "erased-s3", "storage": map[string]interface{}{"driver": "s3", "root": "bucket", "options": map[string]interface{}{"endpoint": server.URL}}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+	viper.Set("uploader.done_marker", true)
+	defer viper.Set("uploader.done_marker", false)
+	viper.Set("uploader.download_cache.dir", cacheDir)
+	defer viper.Set("uploader.download_cache.dir", nil)
+
+	upload := func(prefix string) controllers.FileMeta {
+		file := generateRandomLargeFile(1024 * 1024)
+		defer os.Remove(file.Name())
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  1024 * 1024,
+			ChunkSize: 1024 * 1024,
+			Prefix:    prefix,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		uploadSlice(0, meta, file, assert, "v2")
+		return meta
+	}
+	get := func(url string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code, url)
+	}
+	erase := func(meta controllers.FileMeta) controllers.ErasureReport {
+		c, w := prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var report controllers.ErasureReport
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &report)
+		return report
+	}
+	kinds := func(report controllers.ErasureReport) map[string]string {
+		methods := map[string]string{}
+		for _, item := range report.Items {
+			methods[item.Kind] = item.Method
+		}
+		return methods
+	}
+
+	meta := upload("erased")
+	get("/files/" + meta.FileId + "/preview")
+	// the journal of an interrupted patch keeps the bytes it overwrote
+	journalPath := path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".patch.journal")
+	os.WriteFile(journalPath, []byte(`{"file_id":"`+meta.FileId+`","offset":0,"size":4}`+"\n"+"data"), 0644)
+	filePath := path.Join(viper.GetString("uploader.upload_dir"), "erased", meta.FileName)
+	artifacts := []string{
+		filePath,
+		filePath + ".done",
+		journalPath,
+		path.Join(viper.GetString("uploader.upload_dir"), "erased", "latest"),
+		path.Join(hardlinkDir, "erased", meta.FileName),
+		path.Join(viper.GetString("uploader.metafile_dir"), "previews", meta.FileId+".txt"),
+	}
+	for _, name := range artifacts {
+		_, err := os.Lstat(name)
+		assert.NoError(err, name)
+	}
+	methods := kinds(erase(meta))
+	for _, name := range artifacts {
+		_, err := os.Lstat(name)
+		assert.True(os.IsNotExist(err), name)
+	}
+	assert.Equal("overwrite+unlink", methods["done_marker"])
+	assert.Equal("unlink", methods["published_link"])
+	assert.Equal("overwrite+unlink", methods["preview"])
+	assert.Equal("overwrite+unlink", methods["patch_journal"])
+
+	// the old versions of an object don't survive, nor its cached copy
+	viper.Set("uploader.done_marker", false)
+	meta = upload("erased-s3")
+	get("/files/" + meta.FileId + "/download")
+	assert.FileExists(path.Join(cacheDir, meta.FileId))
+	assert.Equal(1, server.Versions("bucket/erased-s3/"+meta.FileName))
+	methods = kinds(erase(meta))
+	assert.Equal("delete all versions", methods["file"])
+	assert.Equal("overwrite+unlink", methods["download_cache"])
+	assert.Equal(0, server.Versions("bucket/erased-s3/"+meta.FileName))
+	assert.NoFileExists(path.Join(cacheDir, meta.FileId))
+}
+
+func TestAdminDuplicates(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	file := generateRandomLargeFile(1024 * 1024)
+	defer os.Remove(file.Name())
+	original, _ := os.ReadFile(file.Name())
+	sum := sha256.Sum256(original)
+	var metas []controllers.FileMeta
+	for _, prefix := range []string{"dup1", "dup2"} {
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  1024 * 1024,
+			ChunkSize: 1024 * 1024,
+			Prefix:    prefix,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		uploadSlice(0, meta, file, assert, "v2")
+		metas = append(metas, meta)
+	}
+
+	group := func(method string, url string) controllers.DuplicateGroup {
+		c, w := prepareContext(adminRequest(method, url))
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var report controllers.DuplicateReport
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &report)
+		for _, group := range report.Groups {
+			if group.Sha256 == hex.EncodeToString(sum[:]) {
+				return group
+			}
+		}
+		return controllers.DuplicateGroup{}
+	}
+
+	duplicates := group("GET", "/admin/duplicates")
+	assert.Len(duplicates.Files, 2)
+	assert.Equal(int64(1024*1024), duplicates.WastedBytes)
+
+	duplicates = group("POST", "/admin/duplicates/deduplicate")
+	assert.Equal(int64(0), duplicates.WastedBytes)
+	assert.True(duplicates.Files[1].Linked)
+	first, _ := os.Stat(path.Join(viper.GetString("uploader.upload_dir"), "dup1", filepath.Base(file.Name())))
+	second, _ := os.Stat(path.Join(viper.GetString("uploader.upload_dir"), "dup2", filepath.Base(file.Name())))
+	assert.True(os.SameFile(first, second))
+
+	// erasing one of them leaves the content of the other
+	c, w := prepareContext(adminRequest("POST", "/admin/files/"+metas[1].FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	content, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), "dup1", filepath.Base(file.Name())))
+	assert.Equal(original, content)
+}
+
+func TestAdminUsage(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+	keyId := "team-" + randstr.Hex(8)
+	viper.Set("uploader.api_keys", []map[string]string{{"id": keyId, "key": "key-" + keyId}})
+	defer viper.Set("uploader.api_keys", nil)
+
+	file, meta := createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	req := newSliceRequest(0, meta, file, "v2")
+	req.Header.Set("X-Api-Key", "key-"+keyId)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	egress := int64(w.Body.Len())
+
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+	req.Header.Set("X-Api-Key", "key-"+keyId)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	egress += int64(w.Body.Len())
+
+	// the proxy sends offloaded downloads
+	viper.Set("uploader.offload.header", "X-Sendfile")
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+	req.Header.Set("X-Api-Key", "key-"+keyId)
+	req.Header.Set("Range", "bytes=100-")
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	viper.Set("uploader.offload.header", nil)
+	assert.NotEmpty(w.Header().Get("X-Sendfile"))
+	egress += int64(w.Body.Len()) + meta.FileSize - 100
+
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+	req.Header.Set("X-Api-Key", "wrong")
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	c, w = prepareContext(adminRequest("GET", "/admin/usage?key_id="+keyId))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	var response controllers.Response
+	var usages []controllers.Usage
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &usages)
+	if assert.Len(usages, 1) {
+		assert.Equal(int64(3), usages[0].Requests)
+		assert.Greater(usages[0].IngressBytes, int64(1024*1024))
+		assert.Equal(egress, usages[0].EgressBytes)
+	}
+}
+
+func TestAdminCompact(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+	viper.Set("uploader.manifest_completion", true)
+	defer viper.Set("uploader.manifest_completion", false)
+
+	file, meta := createRandomFile(2*1024*1024+100, 1024*1024)
+	defer os.Remove(file.Name())
+	original, _ := os.ReadFile(file.Name())
+	for i := int64(0); i < 3; i++ {
+		uploadSlice(i, meta, file, assert, "v1")
+	}
+	destFilePath := path.Join(viper.GetString("uploader.upload_dir"), meta.FileName)
+	assert.NoFileExists(destFilePath)
+
+	c, w := prepareContext(adminRequest("POST", "/admin/compact"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	var response controllers.Response
+	var compacted []string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &compacted)
+	assert.Contains(compacted, meta.FileId)
+
+	stored, _ := os.ReadFile(destFilePath)
+	assert.True(bytes.Equal(original, stored))
+	assert.NoDirExists(path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId))
+
+	req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	var compactedMeta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &compactedMeta)
+	sum := sha256.Sum256(original)
+	assert.False(compactedMeta.Manifest)
+	assert.Equal(hex.EncodeToString(sum[:]), compactedMeta.Sha256)
+}
+
+func TestAdminSessionLog(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+	viper.Set("uploader.session_log.enabled", true)
+	defer viper.Set("uploader.session_log.enabled", false)
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	uploadSlice(1, meta, file, assert, "v2")
+
+	c, w := prepareContext(adminRequest("GET", "/admin/files/"+meta.FileId+"/log"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("application/x-ndjson", w.Header().Get("Content-Type"))
+
+	var events []controllers.SessionEvent
+	lines := bufio.NewScanner(w.Body)
+	for lines.Scan() {
+		var event controllers.SessionEvent
+		assert.NoError(json.Unmarshal(lines.Bytes(), &event))
+		events = append(events, event)
+	}
+	var kinds []string
+	for _, event := range events {
+		kinds = append(kinds, event.Event)
+	}
+	assert.Equal("create", kinds[0])
+	assert.Equal(int64(2*1024*1024), events[0].Size)
+	assert.Contains(kinds, "slice")
+	assert.Equal(controllers.StateComplete, events[len(events)-1].State)
+
+	c, w = prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "session_log")
+
+	c, w = prepareContext(adminRequest("GET", "/admin/files/"+meta.FileId+"/log"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestAdminDebug(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	c, w := prepareContext(adminRequest("GET", "/admin/debug/vars"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	var vars struct {
+		Uploader struct {
+			Goroutines   int `json:"goroutines"`
+			OpenSessions int `json:"open_sessions"`
+		} `json:"uploader"`
+	}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &vars))
+	assert.Greater(vars.Uploader.Goroutines, 0)
+
+	c, w = prepareContext(adminRequest("GET", "/admin/debug/pprof/goroutine?debug=1"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "goroutine profile")
+
+	c, w = prepareContext(adminRequest("GET", "/admin/debug/pprof/"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "heap")
+
+	req, _ := http.NewRequest("GET", "/admin/debug/pprof/heap", nil)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+}
+
+func TestAdminDebugIdleSessions(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+	viper.Set("uploader.session_cache.idle", "50ms")
+	defer viper.Set("uploader.session_cache.idle", nil)
+
+	openSessions := func() int {
+		c, w := prepareContext(adminRequest("GET", "/admin/debug/vars"))
+		r.HandleContext(c)
+		var vars struct {
+			Uploader struct {
+				OpenSessions int `json:"open_sessions"`
+			} `json:"uploader"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &vars)
+		return vars.Uploader.OpenSessions
+	}
+
+	abandoned, abandonedMeta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(abandoned.Name())
+	uploadSlice(0, abandonedMeta, abandoned, assert, "v2")
+	assert.GreaterOrEqual(openSessions(), 1)
+
+	// the next session locked drops the ones idle since
+	time.Sleep(100 * time.Millisecond)
+	file, meta := createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	assert.Equal(0, openSessions())
+
+	// patches don't stay behind
+	viper.Set("uploader.session_cache.idle", "1h")
+	req, _ := http.NewRequest("PATCH", "/admin/files/"+meta.FileId+"/content", strings.NewReader("x"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Range", "bytes 0-0/1048576")
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(0, openSessions())
+
+	// the abandoned session resumes from its meta file
+	w = uploadSlice(1, abandonedMeta, abandoned, assert, "v2")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.FileExists(path.Join(viper.GetString("uploader.metafile_dir"), abandonedMeta.FileId+".meta.json"))
+}
+
+func TestAdminPatch(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v1")
+	uploadSlice(1, meta, file, assert, "v1")
+	content, _ := os.ReadFile(file.Name())
+	original := append([]byte{}, content...)
+
+	patch := func(contentRange string, body []byte) *httptest.ResponseRecorder {
+		req := adminRequest("PATCH", "/admin/files/"+meta.FileId+"/content")
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.Header.Set("Content-Range", contentRange)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	w := patch("bytes 1048570-1048579/2097152", []byte("0123456789"))
+	assert.Equal(http.StatusOK, w.Code)
+	copy(content[1048570:], "0123456789")
+
+	stored, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.Equal(content, stored)
+	var response controllers.Response
+	var patched controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &patched)
+	sum := sha256.Sum256(content)
+	assert.Equal(hex.EncodeToString(sum[:]), patched.Sha256)
+	// both pieces the patch overlaps are hashed again
+	for i, piece := range [][]byte{content[:1024*1024], content[1024*1024:]} {
+		sum := sha1.Sum(piece)
+		assert.Equal(hex.EncodeToString(sum[:]), patched.Slices[strconv.Itoa(i)].Sha1)
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/pieces/"+strconv.Itoa(i), nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(hex.EncodeToString(sum[:]), w.Header().Get("X-Piece-Sha1"))
+	}
+
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, patch("bytes 2097150-2097159/2097152", []byte("0123456789")).Code)
+	assert.Equal(http.StatusBadRequest, patch("bytes 0-9/2097152", []byte("01234")).Code)
+	stored, _ = os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.Equal(content, stored)
+
+	// a journal left behind by a crash puts the original bytes back
+	journal, _ := json.Marshal(map[string]interface{}{"file_id": meta.FileId, "offset": 1048570, "size": 10})
+	journal = append(append(journal, '\n'), original[1048570:1048580]...)
+	os.WriteFile(path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".patch.journal"), journal, 0644)
+	assert.NoError(controllers.RecoverPatches())
+	stored, _ = os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.Equal(original, stored)
+}
+
+func TestAdminMetadata(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	file, completed := createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, completed, file, assert, "v1")
+	file, active := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, active, file, assert, "v2")
+
+	c, w := prepareContext(adminRequest("GET", "/admin/metadata"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	dump := w.Body.Bytes()
+	kinds := map[string]string{}
+	lines := bufio.NewScanner(bytes.NewReader(dump))
+	for lines.Scan() {
+		var record controllers.MetaRecord
+		assert.NoError(json.Unmarshal(lines.Bytes(), &record))
+		kinds[record.Meta.FileId] = record.Kind
+	}
+	assert.Equal(controllers.MetaRecordFile, kinds[completed.FileId])
+	assert.Equal(controllers.MetaRecordSession, kinds[active.FileId])
+
+	// the records lost are imported again, the others are left alone
+	os.Remove(path.Join(viper.GetString("uploader.metafile_dir"), completed.FileId+".meta.json"))
+	os.Remove(path.Join(viper.GetString("uploader.slice_cache_dir"), active.FileId, "meta.json"))
+	importDump := func(query string, body []byte) controllers.MetadataImport {
+		req := adminRequest("POST", "/admin/metadata"+query)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var result controllers.MetadataImport
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &result)
+		return result
+	}
+	result := importDump("", dump)
+	assert.Equal(1, result.Files)
+	assert.Equal(1, result.Sessions)
+	assert.Equal(len(kinds)-2, result.Skipped)
+	result = importDump("?overwrite=true", dump)
+	assert.Equal(len(kinds), result.Files+result.Sessions)
+
+	for _, id := range []string{completed.FileId, active.FileId} {
+		req, _ := http.NewRequest("GET", "/files/"+id+"/meta", nil)
+		c, w = prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+	}
+	uploadSlice(1, active, file, assert, "v2")
+
+	req := adminRequest("POST", "/admin/metadata")
+	req.Body = io.NopCloser(strings.NewReader(`{"kind": "file", "meta": {"file_id": "../x"}}`))
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestAdminSessions(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	prefix := "sessions_" + randstr.Hex(4)
+	create := func(name string) controllers.FileMeta {
+		body, _ := json.Marshal(controllers.CreateParams{FileName: name, FileType: "text/plain", FileSize: 2 * 1024 * 1024, ChunkSize: 1024 * 1024, Prefix: prefix})
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return meta
+	}
+	idle := create("idle.bin")
+	busy := create("busy.bin")
+	c, w := prepareContext(newSliceDataRequest(0, busy, "busy.bin", make([]byte, 1024*1024), "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusPartialContent, w.Code)
+
+	list := func(query string) []controllers.SessionSummary {
+		c, w := prepareContext(adminRequest("GET", "/admin/sessions?"+query))
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var sessions []controllers.SessionSummary
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &sessions)
+		return sessions
+	}
+	sessions := list("prefix=" + prefix)
+	assert.Len(sessions, 2)
+	ids := []string{sessions[0].FileId, sessions[1].FileId}
+	assert.ElementsMatch([]string{idle.FileId, busy.FileId}, ids)
+
+	sessions = list("prefix=" + prefix + "&state=uploading")
+	assert.Len(sessions, 1)
+	assert.Equal(busy.FileId, sessions[0].FileId)
+	assert.Equal("busy.bin", sessions[0].FileName)
+	assert.Equal(int64(1024*1024), sessions[0].UploadedBytes)
+	assert.GreaterOrEqual(sessions[0].LastActivity, sessions[0].CreatedAt)
+
+	assert.Empty(list("prefix=" + prefix + "&key_id=team-a"))
+	c, w = prepareContext(adminRequest("GET", "/admin/sessions?state=complete"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+
+	setMaintenance := func(body string) *httptest.ResponseRecorder {
+		req := adminRequest("PUT", "/admin/maintenance")
+		req.Body = io.NopCloser(strings.NewReader(body))
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	w := setMaintenance(`{"enabled": true, "reason": "disk replacement", "retry_after": 600}`)
+	assert.Equal(http.StatusOK, w.Code)
+	defer setMaintenance(`{"enabled": false}`)
+
+	// new sessions and slices are refused
+	body, _ := json.Marshal(meta.CreateParams)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal("600", w.Header().Get("Retry-After"))
+	var response controllers.Response
+	var maintenance controllers.Maintenance
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &maintenance)
+	assert.Equal(5031, response.Code)
+	assert.True(maintenance.Enabled)
+	assert.Equal("disk replacement", maintenance.Reason)
+
+	c, w = prepareContext(newSliceRequest(1, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	// and so are the admin routes writing files or metas
+	req = adminRequest("POST", "/admin/compact")
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+
+	// reads keep working
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	req = adminRequest("GET", "/admin/maintenance")
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &maintenance)
+	assert.True(maintenance.Enabled)
+
+	assert.Equal(http.StatusOK, setMaintenance(`{"enabled": false}`).Code)
+	w = uploadSlice(1, meta, file, assert, "v2")
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestMaintenanceOfAnotherReplica(t *testing.T) {
+	assert := assert.New(t)
+	maintenanceFile := path.Join(viper.GetString("uploader.metafile_dir"), "maintenance.json")
+	defer os.Remove(maintenanceFile)
+	create := func() int {
+		req, _ := http.NewRequest("POST", "/files", strings.NewReader(`{}`))
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w.Code
+	}
+	assert.Equal(http.StatusBadRequest, create())
+
+	// another replica sharing metafile_dir enables it, the guard follows
+	// within a second
+	os.WriteFile(maintenanceFile, []byte(`{"enabled": true, "reason": "replica"}`), 0644)
+	assert.Eventually(func() bool { return create() == http.StatusServiceUnavailable }, 3*time.Second, 50*time.Millisecond)
+	os.WriteFile(maintenanceFile, []byte(`{"enabled": false}`), 0644)
+	assert.Eventually(func() bool { return create() == http.StatusBadRequest }, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/security"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultAffinityCookie = "uploader_affinity"
+
+// affinityInstance is `uploader.affinity.instance`, the name of this server
+// among the replicas behind the load balancer, empty unless affinity is on
+// (it needs `uploader.affinity.secret` too)
+func affinityInstance() string {
+	if viper.GetString("uploader.affinity.secret") == "" {
+		return ""
+	}
+	return viper.GetString("uploader.affinity.instance")
+}
+
+func affinityCookie() string {
+	if name := viper.GetString("uploader.affinity.cookie"); name != "" {
+		return name
+	}
+	return defaultAffinityCookie
+}
+
+// affinitySignature signs that the session fileId is served by instance
+func affinitySignature(instance string, fileId string) string {
+	mac := hmac.New(sha256.New, []byte(viper.GetString("uploader.affinity.secret")))
+	mac.Write([]byte(instance + "\n" + fileId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// affinityOwner is the instance the cookie value binds the session fileId
+// to, unless it isn't signed for the session
+func affinityOwner(fileId string, value string) (string, bool) {
+	dot := strings.LastIndex(value, ".")
+	if dot < 0 {
+		return "", false
+	}
+	instance, signature := value[:dot], value[dot+1:]
+	return instance, security.Equal(signature, affinitySignature(instance, fileId))
+}
+
+// setAffinity binds the session created to this instance with a cookie only
+// sent to the routes of the session, until its deadline
+func setAffinity(c *gin.Context, meta *FileMeta) {
+	instance := affinityInstance()
+	if instance == "" {
+		return
+	}
+	// the routes of the session are under the route the session was
+	// created with: files, files/resumable or files/:id/append
+	base := c.Request.URL.Path[:strings.LastIndex(c.Request.URL.Path, "/files")]
+	maxAge := 0
+	if meta.Deadline > 0 {
+		maxAge = int(meta.Deadline - time.Now().Unix())
+	}
+	// browser clients on another site only send SameSite=None cookies
+	secure := c.Request.TLS != nil || viper.GetBool("uploader.affinity.secure")
+	if secure {
+		c.SetSameSite(http.SameSiteNoneMode)
+	}
+	value := instance + "." + affinitySignature(instance, meta.FileId)
+	c.SetCookie(affinityCookie(), value, maxAge, base+"/files/"+meta.FileId, "", secure, true)
+}
+
+// Affinity sends the requests of a session bound to another instance by its
+// affinity cookie there, for replicas which don't share their metadata: with
+// a 307 to its url in `uploader.affinity.instances`, 421 when it has none.
+// Requests without the cookie, or with one not signed for the session, are
+// served here.
+func Affinity(c *gin.Context) {
+	fileId := c.Param("id")
+	instance := affinityInstance()
+	if fileId == "" || instance == "" {
+		c.Next()
+		return
+	}
+	value, err := c.Cookie(affinityCookie())
+	if err != nil {
+		c.Next()
+		return
+	}
+	owner, ok := affinityOwner(fileId, value)
+	if !ok {
+		logrus.Infof("ignored the affinity cookie of %s, it isn't signed for the session", fileId)
+		c.Next()
+		return
+	}
+	if owner == instance {
+		c.Next()
+		return
+	}
+	// viper keeps the keys of maps lower case
+	if url := viper.GetStringMapString("uploader.affinity.instances")[strings.ToLower(owner)]; url != "" {
+		c.Redirect(http.StatusTemporaryRedirect, strings.TrimSuffix(url, "/")+c.Request.URL.RequestURI())
+		c.Abort()
+		return
+	}
+	logrus.Warningf("session %s is bound to instance %s which has no url", fileId, owner)
+	(&BaseController{}).WriteError(c, gin.H{"instance": owner}, uploadererrors.ErrMisdirected)
+	c.Abort()
+}
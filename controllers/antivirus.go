@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// the engine version is asked again after this, signature updates usually
+// change it
+const engineVersionTTL = time.Hour
+
+// ScanVerdict is the antivirus verdict of a file, recorded in its meta as
+// `scan`
+type ScanVerdict struct {
+	// clean or infected
+	Verdict   string `json:"verdict"`
+	Signature string `json:"signature,omitempty"`
+	// output of uploader.antivirus.version_command
+	Engine    string `json:"engine,omitempty"`
+	ScannedAt int64  `json:"scanned_at"`
+	// the verdict of an identical file was reused
+	Cached bool `json:"cached,omitempty"`
+}
+
+var engineVersion struct {
+	sync.Mutex
+	version   string
+	checkedAt time.Time
+}
+
+// verdicts are cached by the sha256 of the file in metafile_dir, so an
+// identical file uploaded again isn't scanned again by the same engine
+func verdictPath(sha256Hex string) string {
+	return path.Join(viper.GetString("uploader.metafile_dir"), "verdicts", sha256Hex+".json")
+}
+
+// scan is the pre processor running `uploader.antivirus.command` on the
+// uploaded file, infected files are rejected like files violating the policy
+// of their prefix
+func scan(meta *FileMeta, name string) (bool, error) {
+	command := viper.GetString("uploader.antivirus.command")
+	if command == "" {
+		return false, nil
+	}
+	if meta.Sha256 == "" {
+		if err := digestFile(context.Background(), meta, name); err != nil {
+			return false, err
+		}
+	}
+
+	engine := antivirusEngine()
+	verdict, ok := cachedVerdict(meta.Sha256, engine)
+	if !ok {
+		var err error
+		if verdict, err = runScan(command, name); err != nil {
+			return false, err
+		}
+		verdict.Engine = engine
+		if err := cacheVerdict(meta.Sha256, verdict); err != nil {
+			logrus.Warningf("failed to cache the verdict of %s: %v", meta.FileId, err)
+		}
+	}
+	meta.Scan = &verdict
+	if verdict.Verdict == "infected" {
+		return false, &ValidationError{Rule: "antivirus", Detail: verdict.Signature}
+	}
+	return false, nil
+}
+
+// runScan runs the antivirus, exit status 0 means clean and 1 infected like
+// clamscan, the signature is read from its `<file>: <signature> FOUND` line
+func runScan(command string, name string) (ScanVerdict, error) {
+	output, err := toolOutput(command, map[string]string{"{input}": name})
+	verdict := ScanVerdict{Verdict: "clean", ScannedAt: time.Now().Unix()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		verdict.Verdict = "infected"
+		verdict.Signature = "unknown"
+		for _, line := range strings.Split(string(output), "\n") {
+			if found, ok := strings.CutSuffix(strings.TrimSpace(line), " FOUND"); ok {
+				_, signature, _ := strings.Cut(found, ": ")
+				verdict.Signature = signature
+				break
+			}
+		}
+		return verdict, nil
+	}
+	if err != nil {
+		return verdict, fmt.Errorf("failed to scan: %w", err)
+	}
+	return verdict, nil
+}
+
+// antivirusEngine is the version of the antivirus and its signatures, empty
+// when `uploader.antivirus.version_command` is not set
+func antivirusEngine() string {
+	command := viper.GetString("uploader.antivirus.version_command")
+	if command == "" {
+		return ""
+	}
+	engineVersion.Lock()
+	defer engineVersion.Unlock()
+	if time.Since(engineVersion.checkedAt) < engineVersionTTL {
+		return engineVersion.version
+	}
+	output, err := toolOutput(command, nil)
+	if err != nil {
+		logrus.Warningf("failed to get the antivirus version: %v", err)
+		return engineVersion.version
+	}
+	engineVersion.version = strings.TrimSpace(string(output))
+	engineVersion.checkedAt = time.Now()
+	return engineVersion.version
+}
+
+func cachedVerdict(sha256Hex string, engine string) (ScanVerdict, bool) {
+	var verdict ScanVerdict
+	content, err := os.ReadFile(verdictPath(sha256Hex))
+	if err != nil || json.Unmarshal(content, &verdict) != nil || verdict.Engine != engine {
+		return verdict, false
+	}
+	verdict.Cached = true
+	return verdict, true
+}
+
+func cacheVerdict(sha256Hex string, verdict ScanVerdict) error {
+	content, _ := json.Marshal(verdict)
+	return storage.WriteFile(verdictPath(sha256Hex), content)
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+)
+
+type AppendParams struct {
+	// bytes to append
+	FileSize  int64 `json:"file_size" binding:"required,numeric,min=1"`
+	ChunkSize int64 `json:"chunk_size" binding:"required,numeric,min=1024"`
+	Deadline  int64 `json:"deadline,omitempty"`
+}
+
+// Append starts a session whose file_size bytes are appended to the completed
+// file, e.g. a log growing every day, instead of uploading it whole again. It
+// answers like Create and the session is uploaded the same way; once complete
+// the file grows in place and the meta of the file (and of the session) tell
+// its new size and digests, the digests going on from where they stopped. An
+// append goes through only if the file is still as it was at Append, unless
+// If-Match or If-Unmodified-Since say otherwise.
+func (f *FileController) Append(c *gin.Context) {
+	params := AppendParams{}
+	if !f.bind(c, &params, c.ShouldBindJSON) {
+		return
+	}
+	base, err := readMeta(c.Param("id"))
+	// appending to an append appends to the file it grew
+	for err == nil && base.AppendTo != "" {
+		base, err = readMeta(base.AppendTo)
+	}
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	config := prefixConfig(base.Prefix)
+	if !base.stored() || base.Manifest || config.DirectUpload || len(config.Convert) > 0 || config.Sanitize.StripMetadata || config.Sanitize.Reencode {
+		// the file isn't there yet or what is stored isn't what was uploaded
+		f.WriteError(c, nil, uploadererrors.ErrNotAppendable)
+		return
+	}
+
+	result, ok := f.create(c, CreateParams{
+		FileName:  base.FileName,
+		FileType:  base.FileType,
+		FileSize:  params.FileSize,
+		ChunkSize: params.ChunkSize,
+		Prefix:    base.Prefix,
+		Tags:      base.Tags,
+		Deadline:  params.Deadline,
+	}, &base)
+	if !ok {
+		return
+	}
+	f.Write(c, result, 200, 0, "")
+}
+
+// appendOffset is the size of the stored file of base, which must be local.
+// Without a precondition the file must stay as it is until the append.
+func (f *FileController) appendOffset(c *gin.Context, store storage.Storage, base *FileMeta, precondition **Precondition) (int64, bool) {
+	if _, ok := storage.LocalPath(store, base.StorageKey()); !ok {
+		f.WriteError(c, nil, uploadererrors.ErrNotAppendable)
+		return 0, false
+	}
+	info, err := store.Stat(base.StorageKey())
+	if errors.Is(err, fs.ErrNotExist) {
+		f.Write(c, nil, 404, 0, "")
+		return 0, false
+	}
+	if err != nil {
+		logrus.Errorf("failed to stat %s: %v", base.StorageKey(), err)
+		f.Write(c, nil, 500, 0, "")
+		return 0, false
+	}
+	if *precondition == nil {
+		*precondition = &Precondition{IfMatch: []string{storedETag(info)}}
+	}
+	return info.Size(), true
+}
+
+// appendFile appends the local file src to the stored file meta appends to,
+// the file is cut back to its size when that fails
+func appendFile(ctx context.Context, meta *FileMeta, store storage.Storage, src string) error {
+	key := meta.StorageKey()
+	unlock := lockKey(key)
+	defer unlock()
+	if err := meta.Precondition.check(store, key); err != nil {
+		return err
+	}
+	name, ok := storage.LocalPath(store, key)
+	if !ok {
+		return uploadererrors.ErrNotAppendable
+	}
+
+	session := lockSession(meta.AppendTo)
+	defer session.Unlock()
+	base, err := readMeta(meta.AppendTo)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.Size() != meta.AppendOffset {
+		// the file changed since the session was created and the
+		// precondition let it through, the appended bytes would land
+		// elsewhere than the client meant
+		return uploadererrors.ErrPreconditionFailed
+	}
+	digest, err := resumeDigest(ctx, &base, name, meta.AppendOffset)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", key, err)
+	}
+
+	n, err := appendBytes(ctx, name, src, digest)
+	if err != nil {
+		if truncErr := os.Truncate(name, meta.AppendOffset); truncErr != nil {
+			logrus.Errorf("failed to cut %s back after a failed append: %v", name, truncErr)
+		}
+		return fmt.Errorf("failed to append to %s: %w", key, err)
+	}
+	os.Remove(src)
+
+	base.FileSize = meta.AppendOffset + n
+	digest.record(&base)
+	if err := rehashSlices(ctx, &base, name, meta.AppendOffset, base.FileSize); err != nil {
+		return fmt.Errorf("failed to hash the slices appended to %s: %w", key, err)
+	}
+	if err := writeCompletedMeta(&base); err != nil {
+		return err
+	}
+	meta.Sha256, meta.Md5, meta.DigestState = base.Sha256, base.Md5, base.DigestState
+	if err := meta.transition(StateComplete, ""); err != nil {
+		return err
+	}
+	if err := writeCompletedMeta(meta); err != nil {
+		return err
+	}
+	// the markers and links are about the whole file
+	for _, finisher := range finishers {
+		if err := finisher(&base, store, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rehashSlices hashes again the slices of base over the bytes from offset to
+// end of its file name, the ones a patch changed or an append added (the
+// last slice before offset grows with the bytes appended to it), so pieces
+// and the meta describe the whole file
+func rehashSlices(ctx context.Context, base *FileMeta, name string, offset int64, end int64) error {
+	if base.ChunkSize <= 0 {
+		return nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	first := offset / base.ChunkSize
+	if _, err := file.Seek(first*base.ChunkSize, io.SeekStart); err != nil {
+		return err
+	}
+	if base.Slices == nil {
+		base.Slices = make(map[string]Slice)
+	}
+	now := time.Now().Unix()
+	for i := first; i*base.ChunkSize < min(end, base.FileSize); i++ {
+		size := min(base.ChunkSize, base.FileSize-i*base.ChunkSize)
+		hash := sha1.New()
+		if _, err := fileio.CopyContext(ctx, hash, io.LimitReader(file, size)); err != nil {
+			return err
+		}
+		sliceId := strconv.FormatInt(i, 10)
+		base.Slices[sliceId] = Slice{Id: sliceId, Status: 1, Sha1: hex.EncodeToString(hash.Sum(nil)), ReceivedAt: now, Size: size}
+	}
+	return nil
+}
+
+// resumeDigest hashes the first size bytes of the file name of meta, from
+// the state kept in meta when it is there
+func resumeDigest(ctx context.Context, meta *FileMeta, name string, size int64) (*fileDigest, error) {
+	digest := newFileDigest()
+	if meta.DigestState != nil && digest.resume(meta.DigestState) == nil {
+		return digest, nil
+	}
+	// files completed before the state was kept are hashed once more
+	digest = newFileDigest()
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := fileio.CopyContext(ctx, digest, io.LimitReader(file, size)); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// appendBytes appends src to name through digest
+func appendBytes(ctx context.Context, name string, src string, digest *fileDigest) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fileio.CopyContext(ctx, io.MultiWriter(out, digest), in)
+	if err == nil && syncs("complete") {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
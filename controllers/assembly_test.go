@@ -0,0 +1,130 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/controllers"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanhpk/randstr"
+)
+
+type assemblySend struct {
+	slice int64
+	data  []byte
+	// the meta sent along does not match the session
+	mutated bool
+}
+
+// FuzzSliceAssembly sends the slices of a random file in random order, some
+// of them several times, with other content or with a mutated meta, and
+// checks that the stored file is exactly made of the slices accepted, which is
+// the source unless other content got in first, while everything else is
+// refused.
+//
+//	go test ./controllers -run '^$' -fuzz FuzzSliceAssembly
+func FuzzSliceAssembly(f *testing.F) {
+	f.Add(int64(1), uint32(1), uint8(0), false)
+	f.Add(int64(2), uint32(4096), uint8(0), true)
+	f.Add(int64(3), uint32(10000), uint8(2), false)
+	f.Add(int64(4), uint32(10000), uint8(2), true)
+	f.Add(int64(5), uint32(65535), uint8(15), false)
+	f.Add(int64(6), uint32(33333), uint8(3), true)
+
+	f.Fuzz(func(t *testing.T, seed int64, size uint32, chunk uint8, v2 bool) {
+		assert := assert.New(t)
+		fileSize := int64(size%(64*1024)) + 1
+		chunkSize := int64(chunk%16+1) * 1024
+		rng := mathrand.New(mathrand.NewSource(seed))
+		source := make([]byte, fileSize)
+		rng.Read(source)
+
+		params := controllers.CreateParams{
+			FileName:  "assembly-" + randstr.Hex(8),
+			FileType:  "application/octet-stream",
+			FileSize:  fileSize,
+			ChunkSize: chunkSize,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		if !assert.Equal(http.StatusOK, w.Code) {
+			return
+		}
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		stored := path.Join(viper.GetString("uploader.upload_dir"), meta.FileName)
+		defer os.Remove(stored)
+
+		slices := int64(len(meta.Slices))
+		var sends []assemblySend
+		for slice := int64(0); slice < slices; slice++ {
+			data := source[slice*chunkSize : min(fileSize, (slice+1)*chunkSize)]
+			sends = append(sends, assemblySend{slice: slice, data: data})
+			for rng.Intn(3) == 0 {
+				send := assemblySend{slice: slice, data: data}
+				switch rng.Intn(3) {
+				case 0:
+					send.data = bytes.Clone(data)
+					send.data[rng.Intn(len(data))]++
+				case 1:
+					send.mutated = true
+				}
+				sends = append(sends, send)
+			}
+		}
+		rng.Shuffle(len(sends), func(i, j int) { sends[i], sends[j] = sends[j], sends[i] })
+
+		v := "v1"
+		if v2 {
+			v = "v2"
+		}
+		accepted := map[int64][]byte{}
+		completed := false
+		for _, send := range sends {
+			sendMeta := meta
+			if send.mutated {
+				sendMeta.FileSize++
+			}
+			c, w := prepareContext(newSliceDataRequest(send.slice, sendMeta, meta.FileName, send.data, v))
+			r.HandleContext(c)
+
+			previous, uploaded := accepted[send.slice]
+			switch {
+			case completed:
+				assert.Equal(http.StatusConflict, w.Code)
+			case send.mutated:
+				assert.Equal(http.StatusUnprocessableEntity, w.Code)
+			case uploaded && !bytes.Equal(previous, send.data):
+				assert.Equal(http.StatusConflict, w.Code)
+			default:
+				accepted[send.slice] = send.data
+				if int64(len(accepted)) < slices {
+					assert.Equal(http.StatusPartialContent, w.Code)
+				} else if assert.Equal(http.StatusOK, w.Code) {
+					completed = true
+				}
+			}
+		}
+		if !assert.True(completed) {
+			return
+		}
+
+		expected := make([]byte, 0, fileSize)
+		for slice := int64(0); slice < slices; slice++ {
+			expected = append(expected, accepted[slice]...)
+		}
+		content, err := os.ReadFile(stored)
+		assert.NoError(err)
+		assert.True(bytes.Equal(expected, content), "stored file differs from the accepted slices")
+	})
+}
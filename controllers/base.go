@@ -2,37 +2,75 @@ package controllers
 
 import (
 	"encoding/json"
-	"net/http"
+	"errors"
 
 	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
 )
 
 type Response struct {
 	Code    int             `json:"code"`
 	Message string          `json:"message"`
 	Data    json.RawMessage `json:"data"`
+	// the name of the uploadererrors.Error answered, if any
+	Error string `json:"error,omitempty"`
 }
 
 func Attach(r gin.IRoutes, prefix string) {
+	r.Use(Accounting, Affinity, Compression)
 	fileController := &FileController{}
-	fileController.AddRoutes(r, prefix)
+	fileController.AddRoutes(withMiddlewares(r, GroupFiles), prefix)
+	adminController := &AdminController{}
+	adminController.AddRoutes(withMiddlewares(r, GroupAdmin), prefix)
 }
 
 type BaseController struct{}
 
+// Write answers with message as it is, the status text of httpStatus in the
+// language of c when it is empty
 func (b *BaseController) Write(c *gin.Context, data interface{}, httpStatus int, code int, message string) {
+	var err *uploadererrors.Error
+	if message != "" {
+		err = &uploadererrors.Error{Message: message}
+	}
+	b.write(c, data, httpStatus, code, err)
+}
+
+// WriteError answers err with the status, code and message of the
+// uploadererrors.Error it is or wraps, named in `error`. Other errors are
+// answered 500 without their details.
+func (b *BaseController) WriteError(c *gin.Context, data interface{}, err error) {
+	status, code, known := answer(err)
+	b.write(c, data, status, code, known)
+}
+
+// answer is the status and code answering err with the uploadererrors.Error
+// it is or wraps, nil when it is answered 500 without its details
+func answer(err error) (int, int, *uploadererrors.Error) {
+	var known *uploadererrors.Error
+	if !errors.As(err, &known) {
+		return 500, 500, nil
+	}
+	status, code := uploadererrors.Status(known)
+	return status, code, known
+}
+
+func (b *BaseController) write(c *gin.Context, data interface{}, httpStatus int, code int, err *uploadererrors.Error) {
 	if code == 0 {
 		code = httpStatus
 	}
-	if message == "" {
-		message = http.StatusText(httpStatus)
-	}
+	// code stays the same, the message is in the language asked for
+	c.Header("Content-Language", language(c))
 
-	c.JSON(httpStatus, gin.H{
+	response := gin.H{
 		"code":    code,
-		"message": message,
+		"message": localize(c, httpStatus, err),
 		"data":    data,
-	})
+	}
+	if err != nil && err.Name != "" {
+		response["error"] = err.Name
+	}
+	c.JSON(httpStatus, response)
 }
 
 func (b *BaseController) AddRoutes() {}
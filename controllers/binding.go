@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	// rules fail on the names clients send, not on the go ones
+	if validate, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		validate.RegisterTagNameFunc(fieldName)
+	}
+}
+
+func fieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "form"} {
+		if name, _, _ := strings.Cut(field.Tag.Get(tag), ","); name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// FieldError is a request field failing a rule, it is sent with the parameter
+// of the rule under the name of the rule, e.g.
+// `{"field": "chunk_size", "rule": "min", "min": 1024}`
+type FieldError struct {
+	Field string
+	Rule  string
+	Param string
+}
+
+func (e FieldError) MarshalJSON() ([]byte, error) {
+	fields := map[string]any{"field": e.Field, "rule": e.Rule}
+	if e.Param != "" {
+		fields[e.Rule] = ruleParam(e.Rule, e.Param)
+	}
+	return json.Marshal(fields)
+}
+
+// ruleParam is the parameter of a rule as a number or a list of values when
+// it is one
+func ruleParam(rule string, param string) any {
+	if rule == "oneof" {
+		return strings.Fields(param)
+	}
+	if number, err := strconv.ParseFloat(param, 64); err == nil {
+		return number
+	}
+	return param
+}
+
+// fieldErrors lists the fields of a failed binding, none when the body
+// couldn't be decoded at all
+func fieldErrors(err error) []FieldError {
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		fields := make([]FieldError, 0, len(invalid))
+		for _, field := range invalid {
+			fields = append(fields, FieldError{Field: field.Field(), Rule: field.Tag(), Param: field.Param()})
+		}
+		return fields
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return []FieldError{{Field: typeErr.Field, Rule: "type", Param: typeErr.Type.String()}}
+	}
+	return nil
+}
+
+// bind decodes the request into params with bind, one of the ShouldBind
+// methods of c, and answers 400 with the fields failing their rules when it
+// fails
+func (b *BaseController) bind(c *gin.Context, params any, bind func(any) error) bool {
+	err := bind(params)
+	if err == nil {
+		return true
+	}
+	logrus.Infof("failed to bind %s %s: %v", c.Request.Method, c.FullPath(), err)
+	b.WriteError(c, fieldErrors(err), uploadererrors.ErrInvalidRequest)
+	return false
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"path"
+	"strconv"
+
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var errCacheLimit = &sliceRejectedError{err: uploadererrors.ErrCacheLimit}
+
+const defaultCacheRatio = 1
+
+// cacheLimit is the most bytes of slices the session may hold in the slice
+// cache, `uploader.session_cache.max_ratio` times its file size (1 by
+// default, its slices can't add up to more than the file), 0 without limit
+func (m *FileMeta) cacheLimit() int64 {
+	ratio := float64(defaultCacheRatio)
+	if viper.IsSet("uploader.session_cache.max_ratio") {
+		ratio = viper.GetFloat64("uploader.session_cache.max_ratio")
+	}
+	if ratio <= 0 {
+		return 0
+	}
+	return int64(ratio * float64(m.FileSize))
+}
+
+// cachedSliceBytes is how many bytes of slices the session holds once size
+// bytes are stored as sliceId: the slice files of v1, the extent of the
+// target file of v2
+func (m *FileMeta) cachedSliceBytes(sliceId string, size int64, v2 bool) int64 {
+	if v2 {
+		index, _ := strconv.ParseInt(sliceId, 10, 64)
+		return max(m.FileSize, index*m.ChunkSize+size)
+	}
+	cached := size
+	for id, slice := range m.Slices {
+		if id != sliceId && slice.Status == 1 {
+			cached += slice.Size
+		}
+	}
+	return cached
+}
+
+// checkCacheLimit refuses a slice of size bytes taking the session past its
+// cache limit, e.g. a bogus slice far larger than the chunk size
+func checkCacheLimit(meta *FileMeta, sliceId string, size int64, v2 bool) error {
+	limit := meta.cacheLimit()
+	if limit == 0 {
+		return nil
+	}
+	if cached := meta.cachedSliceBytes(sliceId, size, v2); cached > limit {
+		logrus.Warningf("refused slice %s of %s: %d bytes cached, limit %d", sliceId, meta.FileId, cached, limit)
+		return errCacheLimit
+	}
+	return nil
+}
+
+// cacheUsage is the space the slice cache of the session takes on disk, 0
+// once it is gone
+func cacheUsage(fileId string) int64 {
+	usage, err := fileio.DiskUsage(path.Join(viper.GetString("uploader.slice_cache_dir"), fileId))
+	if err != nil {
+		logrus.Errorf("failed to measure the slice cache of %s: %v", fileId, err)
+	}
+	return usage
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// version of the Capabilities document, bumped when fields change meaning
+const capabilitiesVersion = 1
+
+// Capabilities describes what this deployment supports, so generic clients
+// can adapt to it instead of being configured for it
+type Capabilities struct {
+	Version   int        `json:"version"`
+	Protocols []Protocol `json:"protocols"`
+	Limits    Limits     `json:"limits"`
+	// algorithms of the checksums the server verifies or reports
+	Checksums []string `json:"checksums"`
+	// ways requests authenticate, see AuthMode
+	Auth     []AuthMode `json:"auth"`
+	Features []string   `json:"features"`
+}
+
+// Protocol is a way of uploading slices, paths are relative to the prefix
+// the routes are attached to. Protocols not listed (e.g. tus) are not
+// supported.
+type Protocol struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Path    string `json:"path"`
+}
+
+type Limits struct {
+	MinChunkSize int64 `json:"min_chunk_size"`
+	// 0 when there is no limit
+	MaxChunks int64 `json:"max_chunks"`
+	// bytes all files may take, 0 when there is no quota. Prefixes may have
+	// smaller ones, Create tells the quota left
+	Quota int64 `json:"quota"`
+	// bounds of the chunk size recommended by GET files/chunk_size
+	RecommendedChunkSize [2]int64 `json:"recommended_chunk_size"`
+}
+
+type AuthMode struct {
+	Name string `json:"name"`
+	// header carrying the credential
+	Header string `json:"header"`
+	// whether requests without it are refused
+	Required bool `json:"required"`
+}
+
+func capabilities() Capabilities {
+	limits := Limits{
+		MinChunkSize:         1024,
+		MaxChunks:            viper.GetInt64("uploader.max_chunks"),
+		Quota:                viper.GetInt64("uploader.quota"),
+		RecommendedChunkSize: [2]int64{defaultMinChunkSize, defaultMaxChunkSize},
+	}
+	if size := viper.GetInt64("uploader.adaptive_chunk.min"); size > 0 {
+		limits.RecommendedChunkSize[0] = size
+	}
+	if size := viper.GetInt64("uploader.adaptive_chunk.max"); size > 0 {
+		limits.RecommendedChunkSize[1] = size
+	}
+
+	// anonymous requests are accepted along with api keys
+	auth := []AuthMode{{Name: "upload_token", Header: uploadTokenHeader, Required: viper.GetBool("uploader.upload_token")}}
+	if len(keyring("uploader.api_keys")) > 0 {
+		auth = append(auth, AuthMode{Name: "api_key", Header: "X-Api-Key"})
+	}
+	if len(adminKeys()) > 0 {
+		auth = append(auth, AuthMode{Name: "admin_token", Header: "Authorization", Required: true})
+	}
+
+	features := []string{"resume", "multi_writer", "claims", "partial_download", "pieces", "archives"}
+	if viper.GetDuration("uploader.session_ttl") > 0 {
+		features = append(features, "session_ttl")
+	}
+	if viper.GetString("uploader.search.index_dir") != "" {
+		features = append(features, "search")
+	}
+	if viper.IsSet("uploader.preview.commands") {
+		features = append(features, "preview")
+	}
+	if viper.GetBool("uploader.staging") {
+		features = append(features, "staging")
+	}
+	for _, config := range prefixConfigs() {
+		if config.DirectUpload {
+			features = append(features, "direct_upload")
+			break
+		}
+	}
+	if viper.GetString("uploader.cdn.provider") != "" {
+		features = append(features, "share")
+	}
+	if viper.GetBool("uploader.manifest_completion") {
+		features = append(features, "manifest_completion")
+	}
+	if affinityInstance() != "" {
+		features = append(features, "session_affinity")
+	}
+
+	return Capabilities{
+		Version: capabilitiesVersion,
+		Protocols: []Protocol{
+			{Name: "slices", Version: 1, Path: "files/:id/upload"},
+			{Name: "slices", Version: 2, Path: "files/:id/upload_v2"},
+			{Name: "batch", Version: 1, Path: "files/:id/upload_batch"},
+			{Name: "stream", Version: 1, Path: "files/:id/stream"},
+			{Name: "content_range", Version: 1, Path: "files/:id/content"},
+			{Name: "google_resumable", Version: 1, Path: "files/resumable"},
+			{Name: "append", Version: 1, Path: "files/:id/append"},
+		},
+		Limits:    limits,
+		Checksums: []string{"sha1", "sha256"},
+		Auth:      auth,
+		Features:  features,
+	}
+}
+
+// Capabilities lists what this deployment supports
+func (f *FileController) Capabilities(c *gin.Context) {
+	f.Write(c, capabilities(), 200, 0, "")
+}
@@ -0,0 +1,344 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/processor"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/spf13/viper"
+)
+
+const defaultCheckMinFreeSpace = 1024 * 1024 * 1024
+
+// the key checkBackends stats, it doesn't need to exist
+const checkProbeKey = ".simple-uploader-check"
+
+// CheckResult is the outcome of one of the checks of Check
+type CheckResult struct {
+	Name string
+	// what was found, or what to do about it when Err is set
+	Detail string
+	Err    error
+}
+
+// Check validates the configuration, the directories, the storage backends
+// and the metadata, so a broken deployment fails before serving any request
+func Check() []CheckResult {
+	var results []CheckResult
+	for _, check := range []func() []CheckResult{checkConfig, checkDirs, checkBackends, checkIPFS, checkProcessors, checkWasmProcessors, checkMetadata} {
+		results = append(results, check()...)
+	}
+	return results
+}
+
+func checkConfig() []CheckResult {
+	var results []CheckResult
+	var prefixes []PrefixConfig
+	result := CheckResult{Name: "config uploader.prefixes"}
+	if err := viper.UnmarshalKey("uploader.prefixes", &prefixes); err != nil {
+		result.Err, result.Detail = err, "fix the types of the settings of the prefixes"
+	} else {
+		result.Detail = fmt.Sprintf("%d prefixes", len(prefixes))
+	}
+	results = append(results, result)
+	for _, prefix := range prefixes {
+		for _, pattern := range prefix.Names.Deny {
+			if _, err := path.Match(pattern, ""); err != nil {
+				results = append(results, CheckResult{Name: "config uploader.prefixes " + prefix.Prefix + " names", Err: err, Detail: "fix the deny pattern " + pattern})
+			}
+		}
+	}
+
+	result = CheckResult{Name: "config uploader.trusted_proxies", Detail: "none"}
+	if proxies := viper.GetStringSlice("uploader.trusted_proxies"); len(proxies) > 0 {
+		result.Detail = strings.Join(proxies, ", ")
+	}
+	if err := gin.New().SetTrustedProxies(viper.GetStringSlice("uploader.trusted_proxies")); err != nil {
+		result.Err, result.Detail = err, "use ip addresses or CIDRs"
+	}
+	results = append(results, result)
+
+	result = CheckResult{Name: "config uploader.partial_file.name", Detail: "file_name"}
+	if name := viper.GetString("uploader.partial_file.name"); name == "file_id" {
+		result.Detail = name
+	} else if name != "" && name != "file_name" {
+		result.Err, result.Detail = fmt.Errorf("unknown name %q", name), "use file_name or file_id"
+	}
+	results = append(results, result)
+
+	for _, key := range []string{"file_mode", "dir_mode"} {
+		value := viper.GetString("uploader.permissions." + key)
+		if value == "" {
+			continue
+		}
+		result = CheckResult{Name: "config uploader.permissions." + key, Detail: value}
+		if mode, err := strconv.ParseUint(value, 8, 32); err != nil || mode > uint64(fs.ModePerm) {
+			result.Err, result.Detail = fmt.Errorf("invalid mode %q", value), "use an octal mode such as 0640"
+		}
+		results = append(results, result)
+	}
+
+	if viper.IsSet("uploader.middlewares") {
+		result = CheckResult{Name: "config uploader.middlewares"}
+		configs, err := middlewareConfigs()
+		for i := 0; err == nil && i < len(configs); i++ {
+			if _, err = newMiddleware(configs[i]); err != nil {
+				err = fmt.Errorf("%s: %w", configs[i].Name, err)
+			}
+		}
+		if err != nil {
+			result.Err, result.Detail = err, "register the middlewares and fix their settings"
+		} else {
+			result.Detail = fmt.Sprintf("%d middlewares", len(configs))
+		}
+		results = append(results, result)
+	}
+
+	if instance := viper.GetString("uploader.affinity.instance"); instance != "" {
+		result = CheckResult{Name: "config uploader.affinity", Detail: instance}
+		if viper.GetString("uploader.affinity.secret") == "" {
+			result.Err, result.Detail = errors.New("no secret"), "set uploader.affinity.secret, the same on every instance"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func checkMinFreeSpace() int64 {
+	if viper.IsSet("uploader.check.min_free_space") {
+		return int64(viper.GetSizeInBytes("uploader.check.min_free_space"))
+	}
+	return defaultCheckMinFreeSpace
+}
+
+// checkDirs checks the directories of the server can be written and have
+// `uploader.check.min_free_space` (1GiB by default) free
+func checkDirs() []CheckResult {
+	var results []CheckResult
+	dirs := [][2]string{{"uploader.slice_cache_dir", viper.GetString("uploader.slice_cache_dir")}}
+	for _, dir := range UploadDirs() {
+		dirs = append(dirs, [2]string{"uploader.upload_dir", dir})
+	}
+	dirs = append(dirs, [2]string{"uploader.metafile_dir", viper.GetString("uploader.metafile_dir")})
+	for _, entry := range dirs {
+		key, dir := entry[0], entry[1]
+		result := CheckResult{Name: "dir " + key, Detail: dir}
+		if err := probeDir(dir); err != nil {
+			result.Err, result.Detail = err, "create "+dir+" writable by the user of the server"
+			results = append(results, result)
+			continue
+		}
+		free, err := fileio.FreeSpace(dir)
+		switch {
+		case err != nil:
+			result.Err, result.Detail = err, "the free space of "+dir+" is unknown"
+		case free < 0:
+			result.Detail += ", free space unknown"
+		case free < checkMinFreeSpace():
+			result.Err = fmt.Errorf("%d bytes free, less than %d", free, checkMinFreeSpace())
+			result.Detail = "free space on the disk of " + dir + " or lower uploader.check.min_free_space"
+		default:
+			result.Detail += fmt.Sprintf(", %d bytes free", free)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// probeDir creates dir unless it is there and writes a file into it
+func probeDir(dir string) error {
+	if dir == "" {
+		return errors.New("not set")
+	}
+	if err := permissions().MkdirAll(dir); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, checkProbeKey+"-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// checkBackends reaches every storage configured, without the retries and
+// breakers of the server so a backend down fails right away
+func checkBackends() []CheckResult {
+	var configs []storage.Config
+	for _, dir := range UploadDirs() {
+		config := storageConfig("", 0)
+		if config.Driver == "local" && config.Root == UploadDirs()[0] {
+			config.Root = dir
+		}
+		configs = append(configs, config)
+	}
+	var prefixes []PrefixConfig
+	viper.UnmarshalKey("uploader.prefixes", &prefixes)
+	for _, prefix := range prefixes {
+		configs = append(configs, prefix.Storage)
+		for _, rule := range prefix.Placement {
+			configs = append(configs, rule.Storage)
+		}
+		configs = append(configs, prefix.Replicas...)
+	}
+
+	var results []CheckResult
+	checked := map[string]bool{}
+	for _, config := range configs {
+		if config.Driver == "" {
+			continue
+		}
+		if config.Driver == "local" && config.Root == "" {
+			config.Root = UploadDirs()[0]
+		}
+		if checked[config.Backend()] {
+			continue
+		}
+		checked[config.Backend()] = true
+
+		result := CheckResult{Name: "storage " + config.Backend(), Detail: "reachable"}
+		store, err := storage.New(config)
+		if err != nil {
+			result.Err, result.Detail = err, "fix the storage settings"
+			results = append(results, result)
+			continue
+		}
+		if root, ok := storage.LocalPath(store, ""); ok {
+			err = probeDir(root)
+		} else if _, err = store.Stat(checkProbeKey); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			result.Err, result.Detail = err, "check the backend is up, its credentials and that the root exists"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkIPFS asks the version of the IPFS node of uploader.ipfs.api
+func checkIPFS() []CheckResult {
+	if ipfsAPI() == "" {
+		return nil
+	}
+	result := CheckResult{Name: "ipfs " + ipfsAPI()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	content, err := ipfsCall(ctx, "version", nil, "", nil)
+	var version struct{ Version string }
+	json.Unmarshal(content, &version)
+	result.Detail = "version " + version.Version
+	if err != nil {
+		result.Err, result.Detail = err, "check the node is up and its RPC API is reachable"
+	}
+	return []CheckResult{result}
+}
+
+// checkProcessors asks every processor of uploader.processors to describe
+// itself
+func checkProcessors() []CheckResult {
+	if !viper.IsSet("uploader.processors") {
+		return nil
+	}
+	configs, err := processorConfigs()
+	if err != nil {
+		return []CheckResult{{Name: "config uploader.processors", Err: err, Detail: "fix the settings of the processors"}}
+	}
+	var results []CheckResult
+	for _, config := range configs {
+		result := CheckResult{Name: "processor " + config.Name}
+		client, err := processor.NewClient(config.Endpoint)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			var description *processor.DescribeResponse
+			if description, err = client.Describe(ctx); err == nil {
+				result.Detail = strings.TrimSpace(description.Name + " " + description.Version)
+			}
+			cancel()
+			client.Close()
+		}
+		if err != nil {
+			result.Err, result.Detail = err, "check the processor is running at "+config.Endpoint
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkWasmProcessors compiles the module of every processor of
+// uploader.wasm_processors
+func checkWasmProcessors() []CheckResult {
+	if !viper.IsSet("uploader.wasm_processors") {
+		return nil
+	}
+	configs, err := wasmProcessorConfigs()
+	if err != nil {
+		return []CheckResult{{Name: "config uploader.wasm_processors", Err: err, Detail: "fix the settings of the wasm processors"}}
+	}
+	var results []CheckResult
+	for _, config := range configs {
+		result := CheckResult{Name: "wasm processor " + config.Name}
+		if _, version, err := loadWasmModule(config.Module); err != nil {
+			result.Err, result.Detail = err, "check "+config.Module+" is a wasm module"
+		} else {
+			result.Detail = version
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkMetadata reads every meta of the metadata store, the ones which can't
+// be read fail their file or session at the first request
+func checkMetadata() []CheckResult {
+	metaDir := viper.GetString("uploader.metafile_dir")
+	store := metas()
+	var invalid []string
+	counts := map[string]int{}
+	for _, kind := range []string{MetaRecordFile, MetaRecordSession} {
+		stored, err := store.list(kind)
+		if err != nil {
+			return []CheckResult{{Name: "metadata", Err: err, Detail: "check uploader.metadata"}}
+		}
+		counts[kind] = len(stored)
+		for fileId, content := range stored {
+			var meta FileMeta
+			err := decodeMeta(content, &meta)
+			if err == nil && meta.FileId != fileId {
+				err = fmt.Errorf("file id %q", meta.FileId)
+			}
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("%s %s (%v)", kind, fileId, err))
+			}
+		}
+	}
+	sort.Strings(invalid)
+	result := CheckResult{Name: "metadata", Detail: fmt.Sprintf("%d files, %d sessions", counts[MetaRecordFile], counts[MetaRecordSession])}
+	if len(invalid) > 0 {
+		shown := invalid[:min(len(invalid), 5)]
+		result.Err = fmt.Errorf("%d metas can't be read: %s", len(invalid), strings.Join(shown, ", "))
+		result.Detail = "restore them from a metadata dump (cmd/metadump) or remove them"
+	}
+	results := []CheckResult{result}
+
+	if _, err := readMaintenance(); err != nil {
+		results = append(results, CheckResult{Name: "metadata maintenance", Err: err, Detail: "remove " + maintenancePath() + " or set it through PUT /admin/maintenance"})
+	}
+	if journals, _ := filepath.Glob(path.Join(metaDir, "*.patch.journal")); len(journals) > 0 {
+		results = append(results, CheckResult{Name: "metadata patch journals", Detail: fmt.Sprintf("%d interrupted patches are rolled back at start", len(journals))})
+	}
+	return results
+}
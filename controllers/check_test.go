@@ -0,0 +1,44 @@
+package controllers_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func failedChecks() map[string]controllers.CheckResult {
+	failed := map[string]controllers.CheckResult{}
+	for _, result := range controllers.Check() {
+		if result.Err != nil {
+			failed[result.Name] = result
+		}
+	}
+	return failed
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.check.min_free_space", 1024)
+	defer viper.Set("uploader.check", nil)
+	assert.Empty(failedChecks())
+
+	viper.Set("uploader.affinity.instance", "uploader-a")
+	defer viper.Set("uploader.affinity", nil)
+	broken := path.Join(viper.GetString("uploader.metafile_dir"), "broken.meta.json")
+	os.WriteFile(broken, []byte("{"), 0644)
+	defer os.Remove(broken)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "nowhere", "storage": map[string]interface{}{"driver": "ftp"}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	failed := failedChecks()
+	assert.Len(failed, 3)
+	assert.Contains(failed, "config uploader.affinity")
+	assert.Contains(failed, "metadata")
+	assert.Contains(failed, "storage ftp:")
+}
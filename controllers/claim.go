@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/spf13/viper"
+)
+
+const defaultClaimTimeout = 5 * time.Minute
+
+// claimedByOther tells whether somebody other than client holds a live
+// claim on the slice
+func (s *Slice) claimedByOther(client string) bool {
+	return s.ClaimedBy != "" && s.ClaimedBy != client && time.Now().Unix() < s.ClaimExpiresAt
+}
+
+// Claim marks a slice as being uploaded by the client for
+// `uploader.slice_claim_timeout`, uploads of the slice from other clients are
+// refused until the claim expires, is released or the slice arrives
+func (f *FileController) Claim(c *gin.Context) {
+	writer := writerOf(c)
+	if writer.client == "" {
+		f.WriteError(c, nil, uploadererrors.ErrMissingClientId)
+		return
+	}
+
+	session := lockSession(c.Param("id"))
+	defer session.Unlock()
+	meta, err := session.loadMeta()
+	if expired, ok := sessionExpired(session.fileId, meta); ok {
+		f.WriteError(c, expired, uploadererrors.ErrSessionExpired)
+		return
+	}
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	if !meta.writerAllowed(writer.token) {
+		f.WriteError(c, nil, uploadererrors.ErrInvalidWriterToken)
+		return
+	}
+
+	sliceId := c.Param("slice_id")
+	slice, ok := meta.Slices[sliceId]
+	if !ok {
+		f.Write(c, nil, 404, 0, "")
+		return
+	}
+	if slice.Status == 1 {
+		f.WriteError(c, slice, uploadererrors.ErrSliceUploaded)
+		return
+	}
+	if slice.claimedByOther(writer.client) {
+		f.WriteError(c, slice, uploadererrors.ErrSliceClaimed)
+		return
+	}
+
+	timeout := viper.GetDuration("uploader.slice_claim_timeout")
+	if timeout <= 0 {
+		timeout = defaultClaimTimeout
+	}
+	slice.ClaimedBy = writer.client
+	slice.ClaimExpiresAt = time.Now().Add(timeout).Unix()
+	meta.Slices[sliceId] = slice
+	if err := session.saveMeta(); err != nil {
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	f.Write(c, slice, 200, 0, "")
+}
+
+// Release gives up the claim of the client on a slice
+func (f *FileController) Release(c *gin.Context) {
+	writer := writerOf(c)
+
+	session := lockSession(c.Param("id"))
+	defer session.Unlock()
+	meta, err := session.loadMeta()
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	if !meta.writerAllowed(writer.token) {
+		f.WriteError(c, nil, uploadererrors.ErrInvalidWriterToken)
+		return
+	}
+
+	sliceId := c.Param("slice_id")
+	slice, ok := meta.Slices[sliceId]
+	if !ok {
+		f.Write(c, nil, 404, 0, "")
+		return
+	}
+	if slice.claimedByOther(writer.client) {
+		f.WriteError(c, slice, uploadererrors.ErrSliceClaimed)
+		return
+	}
+
+	slice.ClaimedBy = ""
+	slice.ClaimExpiresAt = 0
+	meta.Slices[sliceId] = slice
+	if err := session.saveMeta(); err != nil {
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	f.Write(c, slice, 200, 0, "")
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultCompactionInterval = time.Hour
+
+// StartCompaction compacts the files completed with a manifest in the
+// background, every `uploader.compaction.interval` (1h by default) while the
+// time of day is within `uploader.compaction.window` ("01:00-05:00", any
+// time when empty). It runs until ctx is done.
+func StartCompaction(ctx context.Context) {
+	go func() {
+		for {
+			interval := viper.GetDuration("uploader.compaction.interval")
+			if interval <= 0 {
+				interval = defaultCompactionInterval
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+
+			inWindow, err := withinWindow(viper.GetString("uploader.compaction.window"), time.Now())
+			if err != nil {
+				logrus.Errorf("invalid uploader.compaction.window: %v", err)
+				continue
+			}
+			if !inWindow {
+				continue
+			}
+			if _, err := Compact(); err != nil {
+				logrus.Errorf("failed to compact: %v", err)
+			}
+		}
+	}()
+}
+
+// withinWindow tells whether the time of day of now is within window,
+// "15:04-15:04" in local time, the window may span midnight
+func withinWindow(window string, now time.Time) (bool, error) {
+	if window == "" {
+		return true, nil
+	}
+	first, last, ok := strings.Cut(window, "-")
+	if !ok {
+		return false, fmt.Errorf("%q is not start-end", window)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(first))
+	if err != nil {
+		return false, err
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(last))
+	if err != nil {
+		return false, err
+	}
+	minute := now.Hour()*60 + now.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute, nil
+	}
+	return minute >= startMinute || minute < endMinute, nil
+}
+
+// Compact rewrites every file completed with a manifest into a contiguous
+// file in storage, returns the ids of the compacted files. A file failing
+// to compact is left as it is and tried again next time.
+func Compact() ([]string, error) {
+	metas, err := completedMetas()
+	if err != nil {
+		return nil, err
+	}
+	compacted := []string{}
+	for _, meta := range metas {
+		if !meta.Manifest {
+			continue
+		}
+		if err := compactFile(meta.FileId); err != nil {
+			logrus.Errorf("failed to compact %s: %v", meta.FileId, err)
+			continue
+		}
+		compacted = append(compacted, meta.FileId)
+	}
+	return compacted, nil
+}
+
+// compactFile merges the slice files of the manifest of a file and places
+// the result into storage like a merged upload, the meta is only switched
+// from the manifest to the stored file once it is in place
+func compactFile(fileId string) error {
+	session := lockSession(fileId)
+	defer session.Unlock()
+	defer session.forget()
+
+	meta, err := readMeta(fileId)
+	if err != nil {
+		return err
+	}
+	if !meta.Manifest {
+		return nil
+	}
+	store, err := meta.storage()
+	if err != nil {
+		return err
+	}
+
+	reader, err := openManifest(fileId)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	merged := meta.partialPath()
+	mergedFile, err := permissions().CreateFile(merged, false)
+	if err != nil {
+		return fmt.Errorf("failed to create merged file: %w", err)
+	}
+	defer os.Remove(merged)
+	digest := newFileDigest()
+	n, err := fileio.Copy(io.MultiWriter(mergedFile, digest), reader)
+	if closeErr := mergedFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != meta.FileSize {
+		err = fmt.Errorf("merged %d bytes instead of %d", n, meta.FileSize)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to merge slice files: %w", err)
+	}
+
+	meta.Manifest = false
+	digest.record(&meta)
+	if err := place(context.Background(), &meta, store, merged); err != nil {
+		return err
+	}
+	os.RemoveAll(path.Dir(manifestPath(fileId)))
+	logrus.Infof("compacted %s", fileId)
+	return nil
+}
+
+// Compact runs the compaction right away, outside of its window, and returns
+// the ids of the compacted files
+func (a *AdminController) Compact(c *gin.Context) {
+	compacted, err := Compact()
+	if err != nil {
+		logrus.Errorf("failed to compact: %v", err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	a.Write(c, compacted, 200, 0, "")
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/viper"
+)
+
+const defaultCompressionMinSize = 1024
+
+// encoders are pooled, zstd ones are expensive to create
+var encoderPools = map[string]*sync.Pool{
+	"zstd": {New: func() any {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return encoder
+	}},
+	"gzip": {New: func() any {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Compression compresses the json responses with the first algorithm of
+// `uploader.compression.algorithms` the client accepts, responses smaller
+// than `uploader.compression.min_size` (1024 by default) are sent as they
+// are. Files and streams are never compressed.
+func Compression(c *gin.Context) {
+	algorithms := viper.GetStringSlice("uploader.compression.algorithms")
+	if len(algorithms) == 0 {
+		c.Next()
+		return
+	}
+	algorithm := negotiateEncoding(c.GetHeader("Accept-Encoding"), algorithms)
+	if algorithm == "" {
+		c.Next()
+		return
+	}
+	minSize := defaultCompressionMinSize
+	if viper.IsSet("uploader.compression.min_size") {
+		minSize = viper.GetInt("uploader.compression.min_size")
+	}
+
+	writer := &compressWriter{ResponseWriter: c.Writer, algorithm: algorithm, minSize: minSize}
+	c.Writer = writer
+	defer func() {
+		writer.close()
+		c.Writer = writer.ResponseWriter
+	}()
+	c.Next()
+}
+
+// negotiateEncoding picks the first of algorithms accepted by the client
+func negotiateEncoding(acceptEncoding string, algorithms []string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			quality, _ = strconv.ParseFloat(q, 64)
+		}
+		accepted[strings.ToLower(coding)] = quality > 0
+	}
+	for _, algorithm := range algorithms {
+		if _, ok := encoderPools[algorithm]; !ok {
+			continue
+		}
+		if ok, listed := accepted[algorithm]; ok || !listed && accepted["*"] {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// compressWriter holds the body back until it is known to be json of at least
+// minSize bytes, then compresses it, anything else goes through untouched
+type compressWriter struct {
+	gin.ResponseWriter
+	algorithm string
+	minSize   int
+	buffer    bytes.Buffer
+	encoder   encoder
+	// set once it is decided whether the body is compressed
+	passthrough bool
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(data)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	if !w.compressible() {
+		w.passthrough = true
+		return w.ResponseWriter.Write(data)
+	}
+	w.buffer.Write(data)
+	if w.buffer.Len() < w.minSize {
+		return len(data), nil
+	}
+	if err := w.startEncoder(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) compressible() bool {
+	header := w.Header()
+	// ranges of files are served on their bytes as they are
+	if header.Get("Content-Encoding") != "" || header.Get("Accept-Ranges") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+func (w *compressWriter) startEncoder() error {
+	header := w.Header()
+	header.Set("Content-Encoding", w.algorithm)
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	w.encoder = encoderPools[w.algorithm].Get().(encoder)
+	w.encoder.Reset(w.ResponseWriter)
+	_, err := w.encoder.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+	return err
+}
+
+// Flush sends what is held back, uncompressed unless compressing started
+// already as it is too late once part of the body is sent
+func (w *compressWriter) Flush() {
+	if w.encoder != nil {
+		w.encoder.Flush()
+	} else if !w.passthrough {
+		w.passthrough = true
+		w.ResponseWriter.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) close() {
+	if w.encoder != nil {
+		w.encoder.Close()
+		w.encoder.Reset(nil)
+		encoderPools[w.algorithm].Put(w.encoder)
+		w.encoder = nil
+		return
+	}
+	if w.buffer.Len() > 0 {
+		w.ResponseWriter.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+	}
+}
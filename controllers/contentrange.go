@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/louis-she/simple-uploader/utils"
+	"github.com/sirupsen/logrus"
+)
+
+type ContentRangeParams struct {
+	Mode string `form:"mode" binding:"omitempty,oneof=v1 v2"`
+}
+
+// contentRange is `Content-Range: bytes start-end/total`, end included.
+// `bytes */total` has no bytes and asks how much of the file is stored.
+type contentRange struct {
+	start, end int64
+	empty      bool
+}
+
+// parseContentRange parses header for a file of size bytes, total may be *
+func parseContentRange(header string, size int64) (contentRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return contentRange{}, uploadererrors.ErrInvalidContentRange
+	}
+	bytes, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return contentRange{}, uploadererrors.ErrInvalidContentRange
+	}
+	if total != "*" {
+		if n, err := strconv.ParseInt(total, 10, 64); err != nil || n != size {
+			return contentRange{}, uploadererrors.ErrInvalidContentRange
+		}
+	}
+	if bytes == "*" {
+		return contentRange{empty: true}, nil
+	}
+	first, last, ok := strings.Cut(bytes, "-")
+	if !ok {
+		return contentRange{}, uploadererrors.ErrInvalidContentRange
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return contentRange{}, uploadererrors.ErrInvalidContentRange
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || start < 0 || end < start || end >= size {
+		return contentRange{}, uploadererrors.ErrInvalidContentRange
+	}
+	return contentRange{start: start, end: end}, nil
+}
+
+// storedPrefix is how many bytes from the start of the file are stored, the
+// uploaded slices before the first missing one
+func (m *FileMeta) storedPrefix() int64 {
+	var n int64
+	for i := 0; m.Slices[strconv.Itoa(i)].Status == 1; i++ {
+		n += m.sliceSize(i)
+	}
+	return n
+}
+
+// UploadRange receives bytes of the file as the raw body of a PUT, at the
+// offsets of its Content-Range, so generic http tools and Google style
+// resumable clients can upload. Without Content-Range the body is the whole
+// file. Slices covered entirely by the range are stored, the bytes of the
+// slices it only partly covers are dropped. Until the file is complete it
+// answers 308 with `Range: bytes=0-<last byte stored>`, the client sends the
+// rest from there; `Content-Range: bytes */<size>` with an empty body only
+// asks for it.
+func (f *FileController) UploadRange(c *gin.Context) {
+	start := time.Now()
+	params := ContentRangeParams{}
+	if !f.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	v2 := params.Mode != "v1"
+
+	session := lockSession(c.Param("id"))
+	defer session.Unlock()
+
+	// a client which missed the answer completing the file asks again
+	if session.isCompleted() && strings.HasPrefix(c.GetHeader("Content-Range"), "bytes */") {
+		f.Write(c, nil, 200, 0, "")
+		return
+	}
+	// the body has no fields, only the file id and writer token tell the
+	// session
+	var createParams CreateParams
+	if meta, err := session.loadMeta(); err == nil {
+		createParams = meta.CreateParams
+	}
+	meta, ok := f.checkSessionMeta(c, session, createParams)
+	if !ok {
+		return
+	}
+
+	bytesRange := contentRange{start: 0, end: meta.FileSize - 1}
+	if header := c.GetHeader("Content-Range"); header != "" {
+		var err error
+		if bytesRange, err = parseContentRange(header, meta.FileSize); err != nil {
+			logrus.Infof("bad content range %q for %s", header, meta.FileId)
+			f.WriteError(c, gin.H{"detail": err.Error()}, uploadererrors.ErrInvalidContentRange)
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	var received int64
+	var sliceId string
+	var err error
+	for offset := bytesRange.start; !bytesRange.empty && offset <= bytesRange.end && err == nil; {
+		index := offset / meta.ChunkSize
+		sliceStart := index * meta.ChunkSize
+		sliceEnd := sliceStart + meta.sliceSize(int(index))
+		n := utils.Min(sliceEnd, bytesRange.end+1) - offset
+		sliceId = strconv.FormatInt(index, 10)
+		if offset != sliceStart || sliceEnd > bytesRange.end+1 {
+			// the client sends the whole slice again after the stored range
+			_, err = io.CopyN(io.Discard, c.Request.Body, n)
+		} else if slice := meta.Slices[sliceId]; slice.claimedByOther(writerOf(c).client) {
+			f.WriteError(c, slice, uploadererrors.ErrSliceClaimed)
+			return
+		} else {
+			data := make([]byte, n)
+			if _, err = io.ReadFull(c.Request.Body, data); err == nil {
+				if err = receiveSlice(ctx, session, sliceId, data, v2); err == nil {
+					received += n
+				}
+			}
+		}
+		offset += n
+	}
+	throughput.record(c.ClientIP(), received, time.Since(start), err != nil)
+
+	if ctx.Err() != nil {
+		logrus.Infof("dropped the range of %s, the client is gone", meta.FileId)
+		f.WriteError(c, nil, uploadererrors.ErrClientGone)
+		return
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		if errors.As(err, new(*sliceWriteError)) {
+			retryAfter(c, sliceRetryDelay)
+		}
+		data, err := sliceFailure(meta, sliceId, err)
+		f.WriteError(c, data, err)
+		return
+	}
+
+	if !meta.Uploaded() {
+		// a body cut short keeps the slices it brought
+		if stored := meta.storedPrefix(); stored > 0 {
+			c.Header("Range", fmt.Sprintf("bytes=0-%d", stored-1))
+		}
+		f.WriteError(c, nil, uploadererrors.ErrResumeIncomplete)
+		return
+	}
+	delay, err := complete(ctx, session, v2)
+	retryAfter(c, delay)
+	if err != nil {
+		f.WriteError(c, nil, err)
+		return
+	}
+	f.Write(c, nil, 200, 0, "")
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+// ConvertRule converts the files of a type (a path.Match pattern) into a
+// canonical format with an external command, {input} and {output} in the
+// command are replaced by the uploaded file and the file to write
+type ConvertRule struct {
+	Type      string `mapstructure:"type"`
+	Command   string `mapstructure:"command"`
+	Extension string `mapstructure:"extension"`
+	FileType  string `mapstructure:"file_type"`
+	// store the converted file next to the original instead of replacing it
+	KeepOriginal bool `mapstructure:"keep_original"`
+}
+
+// Conversion records the conversion of a file in its meta
+type Conversion struct {
+	OriginalName  string `json:"original_name"`
+	OriginalType  string `json:"original_type"`
+	ConvertedName string `json:"converted_name"`
+	ConvertedType string `json:"converted_type"`
+	KeptOriginal  bool   `json:"kept_original"`
+}
+
+func convertRule(meta *FileMeta) (ConvertRule, bool) {
+	for _, rule := range prefixConfig(meta.Prefix).Convert {
+		if ok, _ := path.Match(rule.Type, meta.FileType); ok {
+			return rule, true
+		}
+	}
+	return ConvertRule{}, false
+}
+
+// convert runs the first convert rule of the prefix matching the file type.
+// The converted file replaces the uploaded one, or is put into storage next
+// to it when the original is kept.
+func convert(meta *FileMeta, name string) (bool, error) {
+	rule, ok := convertRule(meta)
+	if !ok {
+		return false, nil
+	}
+	conversion := &Conversion{
+		OriginalName:  meta.FileName,
+		OriginalType:  meta.FileType,
+		ConvertedName: strings.TrimSuffix(meta.FileName, path.Ext(meta.FileName)) + rule.Extension,
+		ConvertedType: rule.FileType,
+		KeptOriginal:  rule.KeepOriginal,
+	}
+	if conversion.ConvertedType == "" {
+		conversion.ConvertedType = mime.TypeByExtension(rule.Extension)
+	}
+	if conversion.ConvertedName == meta.FileName {
+		return false, fmt.Errorf("conversion of %s would overwrite it", meta.FileName)
+	}
+
+	output := name + ".converted" + rule.Extension
+	defer os.Remove(output)
+	if err := runTool(rule.Command, map[string]string{"{input}": name, "{output}": output}); err != nil {
+		return false, fmt.Errorf("failed to convert %s: %w", meta.FileName, err)
+	}
+	meta.Conversion = conversion
+
+	if rule.KeepOriginal {
+		store, err := meta.storage()
+		if err != nil {
+			return false, err
+		}
+		if err := store.Put(path.Join(meta.Prefix, conversion.ConvertedName), output); err != nil {
+			return false, fmt.Errorf("failed to store converted file: %w", err)
+		}
+		return false, nil
+	}
+
+	if err := os.Rename(output, name); err != nil {
+		return false, err
+	}
+	meta.FileName = conversion.ConvertedName
+	meta.FileType = conversion.ConvertedType
+	return true, nil
+}
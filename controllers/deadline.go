@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultJanitorInterval = 10 * time.Minute
+
+// SessionExpired is the data of the 410 answered to writers of a session
+// past its deadline
+type SessionExpired struct {
+	FileId   string `json:"file_id"`
+	Deadline int64  `json:"deadline"`
+}
+
+func (m *FileMeta) expired() bool {
+	return m.Deadline > 0 && time.Now().Unix() > m.Deadline
+}
+
+// the meta of a session reclaimed by the janitor is kept here, so its
+// writers still learn why it is gone
+func reclaimedMetaPath(fileId string) string {
+	return path.Join(viper.GetString("uploader.metafile_dir"), fileId+".expired.json")
+}
+
+// sessionExpired tells whether the session of fileId, with meta when it is
+// still there, is past its deadline or reclaimed already
+func sessionExpired(fileId string, meta *FileMeta) (*SessionExpired, bool) {
+	if meta == nil {
+		content, err := os.ReadFile(reclaimedMetaPath(fileId))
+		if err != nil {
+			return nil, false
+		}
+		meta = &FileMeta{}
+		if err := decodeMeta(content, meta); err != nil {
+			return nil, false
+		}
+	}
+	if !meta.expired() {
+		return nil, false
+	}
+	return &SessionExpired{FileId: fileId, Deadline: meta.Deadline}, true
+}
+
+// StartJanitor reclaims the slice cache of the sessions past their deadline
+// every `uploader.janitor_interval` (10m by default), until ctx is done.
+func StartJanitor(ctx context.Context) {
+	go func() {
+		for {
+			interval := viper.GetDuration("uploader.janitor_interval")
+			if interval <= 0 {
+				interval = defaultJanitorInterval
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			if _, err := ReclaimExpired(); err != nil {
+				logrus.Errorf("failed to reclaim expired sessions: %v", err)
+			}
+		}
+	}()
+}
+
+// ReclaimExpired removes the slice cache of the sessions past their deadline
+// and returns their ids, their meta is kept as `<id>.expired.json` in
+// metafile_dir
+func ReclaimExpired() ([]string, error) {
+	metas, err := activeMetas()
+	if err != nil {
+		return nil, err
+	}
+	reclaimed := []string{}
+	for _, meta := range metas {
+		if !meta.expired() {
+			continue
+		}
+		if err := reclaim(meta.FileId); err != nil {
+			logrus.Errorf("failed to reclaim %s: %v", meta.FileId, err)
+			continue
+		}
+		reclaimed = append(reclaimed, meta.FileId)
+	}
+	return reclaimed, nil
+}
+
+func reclaim(fileId string) error {
+	session := lockSession(fileId)
+	defer session.Unlock()
+	defer session.forget()
+	defer rates.forget(fileId)
+
+	// a writer may have completed it meanwhile
+	meta, err := session.loadMeta()
+	if err != nil || session.isCompleted() || !meta.expired() {
+		return err
+	}
+	if err := meta.transition(StateExpired, "past its deadline"); err != nil {
+		return err
+	}
+	content, _ := json.Marshal(meta)
+	if err := permissions().WriteFile(reclaimedMetaPath(fileId), content); err != nil {
+		return err
+	}
+	targetFiles.drop(meta.partialPath())
+	session.meta = nil
+	if err := metas().remove(MetaRecordSession, fileId); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.RemoveAll(path.Join(viper.GetString("uploader.slice_cache_dir"), fileId)); err != nil {
+		return err
+	}
+	// a target file written directly into storage is outside of it
+	if meta.TargetPath != "" {
+		if err := os.Remove(meta.TargetPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	logrus.Infof("reclaimed %s, past its deadline", fileId)
+	return nil
+}
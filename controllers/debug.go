@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the counters of the uploader, next to memstats and cmdline in
+// /admin/debug/vars
+func init() {
+	expvar.Publish("uploader", expvar.Func(func() any {
+		sessionsLock.Lock()
+		open := len(sessions)
+		sessionsLock.Unlock()
+		rates.Lock()
+		measured := len(rates.sessions)
+		rates.Unlock()
+		return map[string]any{
+			"goroutines":     runtime.NumGoroutine(),
+			"open_sessions":  open,
+			"rated_sessions": measured,
+			"download_cache": downloads.snapshot(),
+		}
+	}))
+}
+
+// Pprof serves the profiles of net/http/pprof under /admin/debug/pprof/,
+// e.g. heap, goroutine?debug=2 or profile?seconds=30
+func (a *AdminController) Pprof(c *gin.Context) {
+	switch name := strings.TrimPrefix(c.Param("name"), "/"); name {
+	case "":
+		pprof.Index(c.Writer, c.Request)
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// Vars serves the variables of expvar
+func (a *AdminController) Vars(c *gin.Context) {
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+)
+
+// MetaPatch holds the fields of a file which may change after Create, the
+// ones left out are kept
+type MetaPatch struct {
+	Description *string `json:"description" binding:"omitempty,max=4096"`
+}
+
+// PatchMeta updates the description of a session or of a completed file,
+// a completed file is indexed again so searches find the new one
+func (f *FileController) PatchMeta(c *gin.Context) {
+	patch := MetaPatch{}
+	if !f.bind(c, &patch, c.ShouldBindJSON) {
+		return
+	}
+
+	fileId := c.Param("id")
+	session := lockSession(fileId)
+	defer session.Unlock()
+
+	if session.isCompleted() {
+		session.forget()
+		meta, err := readMeta(fileId)
+		if !f.checkReadMeta(c, err) {
+			return
+		}
+		meta.applyPatch(patch)
+		if err := writeCompletedMeta(&meta); err != nil {
+			logrus.Errorf("failed to update meta of %s: %v", fileId, err)
+			f.Write(c, nil, 500, 0, "")
+			return
+		}
+		if store, err := meta.storage(); err != nil {
+			logrus.Errorf("failed to reindex %s: %v", fileId, err)
+		} else if err := indexFile(&meta, store, meta.StorageKey()); err != nil {
+			logrus.Errorf("failed to reindex %s: %v", fileId, err)
+		}
+		f.Write(c, meta, 200, 0, "")
+		return
+	}
+
+	meta, err := session.loadMeta()
+	if os.IsNotExist(err) {
+		session.forget()
+	}
+	if expired, ok := sessionExpired(fileId, meta); ok {
+		f.WriteError(c, expired, uploadererrors.ErrSessionExpired)
+		return
+	}
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	if !meta.writerAllowed(writerOf(c).token) {
+		f.WriteError(c, nil, uploadererrors.ErrInvalidWriterToken)
+		return
+	}
+	meta.applyPatch(patch)
+	if err := session.saveMeta(); err != nil {
+		logrus.Errorf("failed to update meta of %s: %v", fileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	f.Write(c, meta, 200, 0, "")
+}
+
+func (m *FileMeta) applyPatch(patch MetaPatch) {
+	if patch.Description != nil {
+		m.Description = *patch.Description
+	}
+}
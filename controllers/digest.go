@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/fileio"
+)
+
+// fileDigest hashes a whole file into the digests kept in its meta
+type fileDigest struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newFileDigest() *fileDigest {
+	return &fileDigest{sha256: sha256.New(), md5: md5.New()}
+}
+
+func (d *fileDigest) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	d.md5.Write(p)
+	return len(p), nil
+}
+
+// DigestState is the state of the hashes of a file once all its bytes went
+// through them, the digests of what is appended to the file go on from it
+type DigestState struct {
+	Sha256 []byte `json:"sha256"`
+	Md5    []byte `json:"md5"`
+}
+
+func (d *fileDigest) record(meta *FileMeta) {
+	meta.Sha256 = hex.EncodeToString(d.sha256.Sum(nil))
+	meta.Md5 = hex.EncodeToString(d.md5.Sum(nil))
+	state := DigestState{}
+	state.Sha256, _ = d.sha256.(encoding.BinaryMarshaler).MarshalBinary()
+	state.Md5, _ = d.md5.(encoding.BinaryMarshaler).MarshalBinary()
+	meta.DigestState = &state
+}
+
+// resume continues the hashes from state
+func (d *fileDigest) resume(state *DigestState) error {
+	if err := d.sha256.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Sha256); err != nil {
+		return err
+	}
+	return d.md5.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Md5)
+}
+
+// digestFile records the digests of the local file name in meta
+func digestFile(ctx context.Context, meta *FileMeta, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	digest := newFileDigest()
+	if _, err := fileio.CopyContext(ctx, digest, file); err != nil {
+		return err
+	}
+	digest.record(meta)
+	return nil
+}
+
+// base64 of a hex digest, as the digest headers want it
+func hexToBase64(digest string) string {
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// digestHeaders tells the recorded digests of the whole file, so clients can
+// verify the download: `Digest` (RFC 3230), `Repr-Digest` (RFC 9530) and
+// `X-Checksum-Sha256` for any response of the file, `Content-MD5` only for
+// the full body as it is the digest of the body sent
+func digestHeaders(c *gin.Context, meta FileMeta) {
+	if sha256 := hexToBase64(meta.Sha256); sha256 != "" {
+		c.Header("Digest", "sha-256="+sha256)
+		c.Header("Repr-Digest", "sha-256=:"+sha256+":")
+		c.Header("X-Checksum-Sha256", meta.Sha256)
+	}
+	if md5 := hexToBase64(meta.Md5); md5 != "" && c.GetHeader("Range") == "" {
+		c.Header("Content-MD5", md5)
+	}
+}
@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// limits of the multipart uploads of S3
+	minPartSize = 5 * 1024 * 1024
+	maxParts    = 10000
+	// how long the part urls of a session without deadline are valid
+	defaultPartURLTTL = 24 * time.Hour
+)
+
+// DirectUpload is a session of a prefix with direct_upload, the client puts
+// its slices as the parts of a multipart upload straight into storage and the
+// uploader only keeps the state of the session. Pre and post processors
+// reading the local file don't run on such files.
+type DirectUpload struct {
+	UploadId string `json:"upload_id"`
+	// etag of the stored object, set once completed
+	ETag string `json:"etag,omitempty"`
+}
+
+// startDirectUpload starts the multipart upload of meta and returns the urls
+// to put its slices at, none when the storage can't take the slices as parts
+// so they are uploaded through the uploader as usual
+func startDirectUpload(meta *FileMeta, store storage.Storage) ([]string, error) {
+	multipart, ok := storage.AsMultipart(store)
+	if !ok || len(meta.Slices) > maxParts || len(meta.Slices) > 1 && meta.ChunkSize < minPartSize {
+		return nil, nil
+	}
+	uploadId, err := multipart.CreateMultipartUpload(meta.StorageKey())
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(defaultPartURLTTL)
+	if meta.Deadline > 0 {
+		expires = time.Unix(meta.Deadline, 0)
+	}
+	urls := make([]string, len(meta.Slices))
+	for i := range urls {
+		if urls[i], err = multipart.PresignPart(meta.StorageKey(), uploadId, i+1, expires); err != nil {
+			multipart.AbortMultipartUpload(meta.StorageKey(), uploadId)
+			return nil, err
+		}
+	}
+	meta.Direct = &DirectUpload{UploadId: uploadId}
+	return urls, nil
+}
+
+type CompleteParams struct {
+	// how the slices were uploaded, for sessions not uploaded directly
+	Mode string `form:"mode" binding:"omitempty,oneof=v1 v2"`
+}
+
+// Complete assembles the parts of a direct upload once the client put them
+// all, answers 409 with the ids of the slices missing or of the wrong size.
+// Other sessions are completed as by the upload of their last slice, e.g.
+// when that upload failed to complete the file.
+func (f *FileController) Complete(c *gin.Context) {
+	params := CompleteParams{}
+	if !f.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	fileId := c.Param("id")
+	session := lockSession(fileId)
+	defer session.Unlock()
+
+	if session.isCompleted() {
+		f.WriteError(c, nil, uploadererrors.ErrFileCompleted)
+		return
+	}
+	meta, err := session.loadMeta()
+	if os.IsNotExist(err) {
+		session.forget()
+	}
+	if expired, ok := sessionExpired(fileId, meta); ok {
+		f.WriteError(c, expired, uploadererrors.ErrSessionExpired)
+		return
+	}
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	if !meta.writerAllowed(writerOf(c).token) {
+		f.WriteError(c, nil, uploadererrors.ErrInvalidWriterToken)
+		return
+	}
+	if meta.Direct == nil {
+		f.finalize(c, session, params.Mode != "v1")
+		return
+	}
+
+	store, err := meta.storage()
+	if err != nil {
+		logrus.Errorf("failed to create storage of %s: %v", fileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	multipart, ok := storage.AsMultipart(store)
+	if !ok {
+		logrus.Errorf("storage of %s has no multipart uploads anymore", fileId)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	key := meta.StorageKey()
+	parts, err := multipart.ListParts(key, meta.Direct.UploadId)
+	if err != nil {
+		logrus.Errorf("failed to list the parts of %s: %v", fileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	byNumber := map[int]storage.Part{}
+	for _, part := range parts {
+		byNumber[part.Number] = part
+	}
+	missing := []string{}
+	completed := make([]storage.Part, 0, len(meta.Slices))
+	for i := 0; i < len(meta.Slices); i++ {
+		part, ok := byNumber[i+1]
+		if !ok || part.Size != meta.sliceSize(i) {
+			missing = append(missing, strconv.Itoa(i))
+		}
+		completed = append(completed, storage.Part{Number: part.Number, ETag: part.ETag})
+	}
+	if len(missing) > 0 {
+		f.WriteError(c, missing, uploadererrors.ErrSlicesMissing)
+		return
+	}
+
+	if storage.IsLocked(store, key) {
+		f.WriteError(c, nil, uploadererrors.ErrFileLocked)
+		return
+	}
+	unlock := lockKey(key)
+	defer unlock()
+	if err := meta.Precondition.check(store, key); errors.Is(err, uploadererrors.ErrPreconditionFailed) {
+		f.WriteError(c, nil, err)
+		return
+	} else if err != nil {
+		logrus.Errorf("failed to check the precondition of %s: %v", fileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	if err := meta.transition(StateMerging, ""); err != nil {
+		logrus.Errorf("failed to complete %s: %v", fileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	if meta.Direct.ETag, err = multipart.CompleteMultipartUpload(key, meta.Direct.UploadId, completed); err != nil {
+		logrus.Errorf("failed to complete the multipart upload of %s: %v", fileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	for id, slice := range meta.Slices {
+		slice.Status = 1
+		meta.Slices[id] = slice
+	}
+	if err := session.saveMeta(); err != nil {
+		logrus.Errorf("failed to write meta of %s: %v", fileId, err)
+	}
+	err = settle(meta, store, key)
+	session.completed = err == nil
+	session.forget()
+	if err != nil {
+		logrus.Errorf("failed to complete %s: %v", fileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	f.Write(c, meta, 200, 0, "")
+}
+
+// stored tells whether the file is complete in storage
+func (m *FileMeta) stored() bool {
+	return m.Sha256 != "" || m.Direct != nil && m.Direct.ETag != ""
+}
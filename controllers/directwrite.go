@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"path/filepath"
+
+	"github.com/louis-she/simple-uploader/storage"
+)
+
+// directWritePath is where the target file of a session under a prefix with
+// direct_write is assembled: `<file id>.part` (uploader.partial_file.suffix)
+// next to the file in its storage. The slices are written there as they
+// arrive, so the slice cache holds no copy of the file and completing it is
+// a rename on the same disk. Storages not on local disk can't be written at
+// offsets, their sessions use the slice cache.
+func directWritePath(meta *FileMeta, store storage.Storage) (string, bool) {
+	if !prefixConfig(meta.Prefix).DirectWrite {
+		return "", false
+	}
+	name, ok := storage.LocalPath(store, meta.StorageKey())
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(name), meta.FileId+partialSuffix()), true
+}
@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+)
+
+// Download serves the file, or redirects to it in a remote storage. A session
+// still being uploaded serves the contiguous part received so far with 206,
+// so large videos can be watched while they are uploaded.
+func (f *FileController) Download(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) || !f.checkReader(c, &meta) {
+		return
+	}
+
+	if meta.Manifest {
+		reader, err := openManifest(meta.FileId)
+		if err != nil {
+			logrus.Errorf("failed to open manifest of %s: %v", meta.FileId, err)
+			f.Write(c, nil, 500, 0, "")
+			return
+		}
+		defer reader.Close()
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.FileName}))
+		digestHeaders(c, meta)
+		http.ServeContent(c.Writer, c.Request, meta.FileName, time.Unix(meta.CreatedAt, 0), reader)
+		return
+	}
+
+	if meta.stored() {
+		store, err := meta.storage()
+		if err != nil {
+			logrus.Errorf("failed to create storage of %s: %v", meta.FileId, err)
+			f.Write(c, nil, 500, 0, "")
+			return
+		}
+		name, ok := storage.LocalPath(store, meta.StorageKey())
+		if !ok {
+			// hot files of remote storages are served from the download cache
+			name, ok = downloads.fetch(meta, store)
+		}
+		if presigner, presigns := storage.AsPresigner(store); !ok && presigns && c.Query("entry") == "" {
+			f.redirectToStorage(c, presigner, meta)
+			return
+		}
+		if !ok {
+			f.WriteError(c, nil, uploadererrors.ErrStorageNotLocal)
+			return
+		}
+		if entry := c.Query("entry"); entry != "" {
+			f.downloadZipEntry(c, name, entry)
+			return
+		}
+		digestHeaders(c, meta)
+		// conditional requests are answered by ServeContent
+		if info, err := store.Stat(meta.StorageKey()); err == nil {
+			c.Header("ETag", storedETag(info))
+		}
+		if f.offload(c, name, meta) {
+			return
+		}
+		c.FileAttachment(name, meta.FileName)
+		return
+	}
+
+	start, end, ok := parseRange(c.GetHeader("Range"), meta.contiguousSize())
+	if !ok {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", meta.FileSize))
+		f.Write(c, nil, 416, 0, "")
+		return
+	}
+	reader, err := openRange(meta, start, end)
+	if err != nil {
+		logrus.Errorf("failed to open %s: %v", meta.FileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	defer reader.Close()
+
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, meta.FileSize))
+	c.DataFromReader(206, end-start, meta.FileType, reader, nil)
+}
+
+// how long the urls of the files in remote storages are valid for downloads
+const storageURLTTL = 15 * time.Minute
+
+// redirectToStorage sends the client to a presigned url of the file in its
+// remote storage
+func (f *FileController) redirectToStorage(c *gin.Context, presigner storage.Presigner, meta FileMeta) {
+	url, err := presigner.PresignGet(meta.StorageKey(), time.Now().Add(storageURLTTL))
+	if err != nil {
+		logrus.Errorf("failed to presign the download of %s: %v", meta.FileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	c.Redirect(302, url)
+}
+
+// downloadZipEntry streams a single member of a stored zip, only the central
+// directory and the member itself are read
+func (f *FileController) downloadZipEntry(c *gin.Context, name string, entry string) {
+	archive, err := zip.OpenReader(name)
+	if err != nil {
+		f.WriteError(c, nil, uploadererrors.ErrNotZip)
+		return
+	}
+	defer archive.Close()
+
+	var member *zip.File
+	for _, file := range archive.File {
+		if file.Name == entry && !file.FileInfo().IsDir() {
+			member = file
+			break
+		}
+	}
+	if member == nil {
+		f.WriteError(c, nil, uploadererrors.ErrNoSuchEntry)
+		return
+	}
+	reader, err := member.Open()
+	if err != nil {
+		logrus.Errorf("failed to open zip entry %s of %s: %v", entry, name, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	defer reader.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(entry))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.DataFromReader(200, int64(member.UncompressedSize64), contentType, reader, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(entry)}),
+	})
+}
+
+// contiguousSize is the number of bytes received from the start of the file
+// without a gap
+func (m *FileMeta) contiguousSize() int64 {
+	var size int64
+	for i := 0; i < len(m.Slices); i++ {
+		if m.Slices[strconv.Itoa(i)].Status != 1 {
+			break
+		}
+		size += m.sliceSize(i)
+	}
+	return size
+}
+
+// parseRange returns the [start, end) of a single `bytes=` range within the
+// available bytes, the whole available bytes without a range
+func parseRange(header string, available int64) (int64, int64, bool) {
+	if header == "" {
+		return 0, available, available > 0
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= available {
+		return 0, 0, false
+	}
+	end := available
+	if last != "" {
+		lastByte, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || lastByte < start {
+			return 0, 0, false
+		}
+		if lastByte+1 < end {
+			end = lastByte + 1
+		}
+	}
+	return start, end, true
+}
+
+type multiReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiReadCloser) Close() error {
+	for _, closer := range m.closers {
+		closer.Close()
+	}
+	return nil
+}
+
+// openRange reads [start, end) of the slices of the session, they must all be
+// received
+func openRange(meta FileMeta, start int64, end int64) (io.ReadCloser, error) {
+	readers := []io.Reader{}
+	result := &multiReadCloser{}
+	for i := int(start / meta.ChunkSize); int64(i)*meta.ChunkSize < end; i++ {
+		reader, _, err := openSlice(meta, i)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		result.closers = append(result.closers, reader)
+		readers = append(readers, reader)
+	}
+	readers[0].(*sliceReader).Seek(start%meta.ChunkSize, io.SeekStart)
+	result.Reader = io.LimitReader(io.MultiReader(readers...), end-start)
+	return result, nil
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thanhpk/randstr"
+)
+
+const defaultDownloadCacheSize = 10 * 1024 * 1024 * 1024
+
+// DownloadCacheStats tells how the cache of remote files did since start
+type DownloadCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Files     int   `json:"files"`
+	Size      int64 `json:"size"`
+	MaxSize   int64 `json:"max_size"`
+}
+
+type cachedFile struct {
+	fileId string
+	size   int64
+}
+
+// downloadCache keeps local copies of files of remote storages in
+// `uploader.download_cache.dir`, named by file id, and drops the least
+// recently downloaded ones beyond `uploader.download_cache.max_size` bytes.
+// The modification time of a copy is its last download, so the order
+// survives restarts.
+type downloadCache struct {
+	sync.Mutex
+	// the directory indexed, the index is rebuilt when it changes
+	dir string
+	// by file id, the elements of recent
+	files map[string]*list.Element
+	// most recently downloaded first
+	recent *list.List
+	stats  DownloadCacheStats
+}
+
+var downloads = &downloadCache{}
+
+func downloadCacheMaxSize() int64 {
+	if viper.IsSet("uploader.download_cache.max_size") {
+		return viper.GetInt64("uploader.download_cache.max_size")
+	}
+	return defaultDownloadCacheSize
+}
+
+// index lists the copies in dir once, least recently used last
+func (d *downloadCache) index(dir string) {
+	if d.dir == dir {
+		return
+	}
+	d.dir = dir
+	d.files = map[string]*list.Element{}
+	d.recent = list.New()
+	d.stats = DownloadCacheStats{}
+
+	entries, _ := os.ReadDir(dir)
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() && filepath.Ext(entry.Name()) == "" {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+	for _, info := range infos {
+		d.files[info.Name()] = d.recent.PushBack(&cachedFile{fileId: info.Name(), size: info.Size()})
+		d.stats.Size += info.Size()
+	}
+}
+
+// fetch returns the local copy of the file of meta, reading it from store on
+// a miss, false when the cache is disabled or the file can't be cached
+func (d *downloadCache) fetch(meta FileMeta, store storage.Storage) (string, bool) {
+	dir := viper.GetString("uploader.download_cache.dir")
+	if dir == "" {
+		return "", false
+	}
+	name := filepath.Join(dir, meta.FileId)
+
+	d.Lock()
+	d.index(dir)
+	if element, ok := d.files[meta.FileId]; ok {
+		d.recent.MoveToFront(element)
+		d.stats.Hits++
+		now := time.Now()
+		os.Chtimes(name, now, now)
+		d.Unlock()
+		return name, true
+	}
+	d.stats.Misses++
+	d.Unlock()
+
+	maxSize := downloadCacheMaxSize()
+	if meta.FileSize > maxSize {
+		return "", false
+	}
+	size, err := copyFromStorage(store, meta.StorageKey(), name)
+	if err != nil {
+		logrus.Warningf("failed to cache %s: %v", meta.FileId, err)
+		return "", false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.dir != dir {
+		return name, true
+	}
+	if _, ok := d.files[meta.FileId]; !ok {
+		d.files[meta.FileId] = d.recent.PushFront(&cachedFile{fileId: meta.FileId, size: size})
+		d.stats.Size += size
+	}
+	// the copy just made is the most recent, it stays
+	for d.stats.Size > maxSize && d.recent.Len() > 1 {
+		oldest := d.recent.Back()
+		file := oldest.Value.(*cachedFile)
+		if err := os.Remove(filepath.Join(dir, file.fileId)); err != nil && !os.IsNotExist(err) {
+			logrus.Warningf("failed to evict %s from the download cache: %v", file.fileId, err)
+		}
+		d.recent.Remove(oldest)
+		delete(d.files, file.fileId)
+		d.stats.Size -= file.size
+		d.stats.Evictions++
+	}
+	return name, true
+}
+
+// copyFromStorage reads key into name, which appears once complete
+func copyFromStorage(store storage.Storage, key string, name string) (int64, error) {
+	reader, err := storage.Open(store, key)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	tmp := name + "." + randstr.Hex(8) + ".tmp"
+	file, err := storage.CreateFile(tmp, true)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return size, err
+}
+
+// eraseDownloadCache destroys the local copy of an erased file
+func eraseDownloadCache(meta *FileMeta, store storage.Storage, key string) ([]ErasureItem, error) {
+	dir := viper.GetString("uploader.download_cache.dir")
+	if dir == "" {
+		return nil, nil
+	}
+	downloads.Lock()
+	defer downloads.Unlock()
+	downloads.index(dir)
+	if element, ok := downloads.files[meta.FileId]; ok {
+		downloads.recent.Remove(element)
+		delete(downloads.files, meta.FileId)
+		downloads.stats.Size -= element.Value.(*cachedFile).size
+	}
+	return eraseLocalFile("download_cache", filepath.Join(dir, meta.FileId))
+}
+
+func (d *downloadCache) snapshot() DownloadCacheStats {
+	d.Lock()
+	defer d.Unlock()
+	if dir := viper.GetString("uploader.download_cache.dir"); dir != "" {
+		d.index(dir)
+	}
+	stats := d.stats
+	if d.recent != nil {
+		stats.Files = d.recent.Len()
+	}
+	stats.MaxSize = downloadCacheMaxSize()
+	return stats
+}
+
+// DownloadCache tells the hits, misses and size of the download cache
+func (a *AdminController) DownloadCache(c *gin.Context) {
+	a.Write(c, downloads.snapshot(), 200, 0, "")
+}
@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thanhpk/randstr"
+)
+
+// WatchDropFolder ingests the files appearing in dir into storage the same
+// way as uploaded ones, a file in a sub directory gets the relative path as
+// prefix. A file is only taken once it stopped changing for
+// `uploader.drop_folder_settle` (5s by default). It runs until ctx is done.
+func WatchDropFolder(ctx context.Context, dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	d := &dropFolder{dir: dir, watcher: watcher, pending: make(map[string]pendingDrop)}
+	if err := d.addTree(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go d.run(ctx)
+	return nil
+}
+
+type pendingDrop struct {
+	size      int64
+	changedAt time.Time
+}
+
+type dropFolder struct {
+	dir     string
+	watcher *fsnotify.Watcher
+	mu      sync.Mutex
+	pending map[string]pendingDrop
+}
+
+// watch dir and the directories below it, files already there are queued
+func (d *dropFolder) addTree(dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return d.watcher.Add(name)
+		}
+		d.touch(name)
+		return nil
+	})
+}
+
+func (d *dropFolder) touch(name string) {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasSuffix(base, ".tmp") || strings.HasSuffix(base, ".part") {
+		return
+	}
+	d.mu.Lock()
+	d.pending[name] = pendingDrop{size: -1, changedAt: time.Now()}
+	d.mu.Unlock()
+}
+
+func (d *dropFolder) run(ctx context.Context) {
+	defer d.watcher.Close()
+
+	settle := viper.GetDuration("uploader.drop_folder_settle")
+	if settle <= 0 {
+		settle = 5 * time.Second
+	}
+	ticker := time.NewTicker(settle / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				if err := d.addTree(event.Name); err != nil {
+					logrus.Errorf("failed to watch %s: %v", event.Name, err)
+				}
+				continue
+			}
+			d.touch(event.Name)
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("drop folder watcher error: %v", err)
+		case <-ticker.C:
+			for _, name := range d.settled(settle) {
+				if err := d.ingest(name); err != nil {
+					logrus.Errorf("failed to ingest %s: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+// files which kept the same size for the settle duration
+func (d *dropFolder) settled(settle time.Duration) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var names []string
+	for name, drop := range d.pending {
+		info, err := os.Stat(name)
+		if err != nil {
+			delete(d.pending, name)
+			continue
+		}
+		if info.Size() != drop.size {
+			d.pending[name] = pendingDrop{size: info.Size(), changedAt: time.Now()}
+			continue
+		}
+		if time.Since(drop.changedAt) >= settle && time.Since(info.ModTime()) >= settle {
+			delete(d.pending, name)
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (d *dropFolder) ingest(name string) error {
+	relative, err := filepath.Rel(d.dir, name)
+	if err != nil {
+		return err
+	}
+	prefix := filepath.ToSlash(filepath.Dir(relative))
+	if prefix == "." {
+		prefix = ""
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	fileType := mime.TypeByExtension(filepath.Ext(name))
+	if fileType == "" {
+		fileType = "application/octet-stream"
+	}
+	chunkSize := prefixConfig(prefix).ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	meta := &FileMeta{
+		MetaVersion: MetaVersion,
+		CreateParams: CreateParams{
+			FileName:  filepath.Base(name),
+			FileType:  fileType,
+			FileSize:  info.Size(),
+			ChunkSize: chunkSize,
+			Prefix:    prefix,
+		},
+		FileId:    randstr.Hex(32),
+		CreatedAt: time.Now().Unix(),
+		Slices:    make(map[string]Slice),
+	}
+	meta.Storage = sessionStorage(prefix, meta.StorageKey(), info.Size(), meta.FileId)
+	meta.transition(StateCreated, "")
+	meta.transition(StateVerifying, "")
+	if err := hashSlices(meta, name); err != nil {
+		return fmt.Errorf("failed to hash: %w", err)
+	}
+	if err := preProcess(meta, name); err != nil {
+		return err
+	}
+
+	store, err := meta.storage()
+	if err != nil {
+		return err
+	}
+	if err := place(context.Background(), meta, store, name); err != nil {
+		return err
+	}
+	logrus.Infof("ingested %s from drop folder as %s", relative, meta.FileId)
+	return nil
+}
+
+// fill the slices and the sha256 of meta from a complete local file
+func hashSlices(meta *FileMeta, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	digest := newFileDigest()
+	buf := make([]byte, meta.ChunkSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 || i == 0 {
+			sliceId := strconv.Itoa(i)
+			sha1Sum := sha1.Sum(buf[:n])
+			digest.Write(buf[:n])
+			meta.Slices[sliceId] = Slice{Id: sliceId, Status: 1, Sha1: hex.EncodeToString(sha1Sum[:])}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	digest.record(meta)
+	return nil
+}
+
+func completedMetaPath(fileId string) string {
+	return path.Join(viper.GetString("uploader.metafile_dir"), fileId+".meta.json")
+}
+
+// keep the meta of a completed file in the metadata store, readers see
+// either the old or the new meta, never a partially written one
+func writeCompletedMeta(meta *FileMeta) error {
+	content, _ := json.Marshal(meta)
+	if err := metas().write(MetaRecordFile, meta.FileId, content); err != nil {
+		return fmt.Errorf("failed to write dest meta file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package controllers_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/controllers"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchDropFolder(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.drop_folder_settle", 200*time.Millisecond)
+	defer viper.Set("uploader.drop_folder_settle", 0)
+
+	dropFolder := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(controllers.WatchDropFolder(ctx, dropFolder))
+
+	content := make([]byte, 1024*1024+7)
+	copy(content, "dropped")
+	os.MkdirAll(path.Join(dropFolder, "drop_prefix"), 0755)
+	// give the watcher a chance to pick the new directory up
+	time.Sleep(100 * time.Millisecond)
+	fileName := "dropped-" + filepath.Base(dropFolder) + ".txt"
+	os.WriteFile(path.Join(dropFolder, "drop_prefix", fileName), content, 0644)
+
+	destFilePath := path.Join(viper.GetString("uploader.upload_dir"), "drop_prefix", fileName)
+	assert.Eventually(func() bool {
+		_, err := os.Stat(destFilePath)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoFileExists(path.Join(dropFolder, "drop_prefix", fileName))
+
+	// the meta is recorded like an uploaded file
+	metaFiles, _ := filepath.Glob(path.Join(viper.GetString("uploader.metafile_dir"), "*.meta.json"))
+	var found *controllers.FileMeta
+	for _, metaFile := range metaFiles {
+		var meta controllers.FileMeta
+		metaContent, _ := os.ReadFile(metaFile)
+		json.Unmarshal(metaContent, &meta)
+		if meta.FileName == fileName {
+			found = &meta
+		}
+	}
+	assert.NotNil(found)
+	sha256Sum := sha256.Sum256(content)
+	assert.Equal(hex.EncodeToString(sha256Sum[:]), found.Sha256)
+	assert.Equal("drop_prefix", found.Prefix)
+	assert.Equal("text/plain; charset=utf-8", found.FileType)
+	assert.Len(found.Slices, 1)
+	assert.True(found.Uploaded())
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"os"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+)
+
+type DuplicateFile struct {
+	FileId   string `json:"file_id"`
+	Prefix   string `json:"prefix"`
+	FileName string `json:"file_name"`
+	// already a hardlink of the first file of the group
+	Linked bool `json:"linked"`
+	// why the file was not deduplicated
+	Error string `json:"error,omitempty"`
+}
+
+// DuplicateGroup lists the stored files sharing the same content
+type DuplicateGroup struct {
+	Sha256      string          `json:"sha256"`
+	Size        int64           `json:"size"`
+	WastedBytes int64           `json:"wasted_bytes"`
+	Files       []DuplicateFile `json:"files"`
+}
+
+type DuplicateReport struct {
+	WastedBytes int64            `json:"wasted_bytes"`
+	Groups      []DuplicateGroup `json:"groups"`
+}
+
+type duplicate struct {
+	meta FileMeta
+	name string
+	info os.FileInfo
+}
+
+// duplicates groups the completed files still in local storage by content,
+// a file overwritten by a later upload only counts once
+func duplicates() (map[string][]duplicate, error) {
+	metas, err := completedMetas()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].CreatedAt > metas[j].CreatedAt })
+
+	seen := map[string]bool{}
+	groups := map[string][]duplicate{}
+	for _, meta := range metas {
+		store, err := meta.storage()
+		if err != nil || meta.Sha256 == "" {
+			continue
+		}
+		name, ok := storage.LocalPath(store, meta.StorageKey())
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		info, err := os.Stat(name)
+		if err != nil || info.Size() != meta.FileSize {
+			continue
+		}
+		groups[meta.Sha256] = append(groups[meta.Sha256], duplicate{meta, name, info})
+	}
+	for sha256, group := range groups {
+		if len(group) < 2 {
+			delete(groups, sha256)
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].meta.CreatedAt < group[j].meta.CreatedAt })
+	}
+	return groups, nil
+}
+
+// newDuplicateReport describes the groups, bytes are wasted by every copy
+// which is not a hardlink of the first file of its group
+func newDuplicateReport(groups map[string][]duplicate, failures map[string]string) DuplicateReport {
+	report := DuplicateReport{Groups: []DuplicateGroup{}}
+	for sha256, group := range groups {
+		reportGroup := DuplicateGroup{Sha256: sha256, Size: group[0].info.Size()}
+		for i, file := range group {
+			linked := i > 0 && os.SameFile(group[0].info, file.info)
+			if i > 0 && !linked {
+				reportGroup.WastedBytes += reportGroup.Size
+			}
+			reportGroup.Files = append(reportGroup.Files, DuplicateFile{
+				FileId:   file.meta.FileId,
+				Prefix:   file.meta.Prefix,
+				FileName: file.meta.FileName,
+				Linked:   linked,
+				Error:    failures[file.meta.FileId],
+			})
+		}
+		report.WastedBytes += reportGroup.WastedBytes
+		report.Groups = append(report.Groups, reportGroup)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		return report.Groups[i].WastedBytes > report.Groups[j].WastedBytes
+	})
+	return report
+}
+
+// Duplicates reports the stored files with the same content under different
+// names or prefixes and how many bytes they waste
+func (a *AdminController) Duplicates(c *gin.Context) {
+	groups, err := duplicates()
+	if err != nil {
+		logrus.Errorf("failed to list completed files: %v", err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	a.Write(c, newDuplicateReport(groups, nil), 200, 0, "")
+}
+
+// Deduplicate replaces every duplicate by a hardlink of the first file of its
+// group, files under WORM retention or on another file system are left alone
+func (a *AdminController) Deduplicate(c *gin.Context) {
+	groups, err := duplicates()
+	if err != nil {
+		logrus.Errorf("failed to list completed files: %v", err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+
+	failures := map[string]string{}
+	for _, group := range groups {
+		first := group[0]
+		for i, file := range group[1:] {
+			if os.SameFile(first.info, file.info) {
+				continue
+			}
+			store, _ := file.meta.storage()
+			if storage.IsLocked(store, file.meta.StorageKey()) {
+				failures[file.meta.FileId] = "file is locked"
+				continue
+			}
+			if err := replaceLink(file.name, func(tmp string) error {
+				return os.Link(first.name, tmp)
+			}); err != nil {
+				logrus.Errorf("failed to hardlink %s to %s: %v", file.name, first.name, err)
+				failures[file.meta.FileId] = err.Error()
+				continue
+			}
+			group[i+1].info, _ = os.Stat(file.name)
+		}
+	}
+	a.Write(c, newDuplicateReport(groups, failures), 200, 0, "")
+}
+
+// sharesContent tells whether the stored file of meta was deduplicated with
+// another file, erasing its content would destroy the other one too
+func sharesContent(meta *FileMeta) bool {
+	groups, err := duplicates()
+	if err != nil {
+		return false
+	}
+	var self *duplicate
+	for i, file := range groups[meta.Sha256] {
+		if file.meta.FileId == meta.FileId {
+			self = &groups[meta.Sha256][i]
+		}
+	}
+	if self == nil {
+		return false
+	}
+	for _, file := range groups[meta.Sha256] {
+		if file.meta.FileId != meta.FileId && os.SameFile(self.info, file.info) {
+			return true
+		}
+	}
+	return false
+}
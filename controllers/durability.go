@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// the points of `uploader.durability` at which data is fsynced, each one
+// includes the ones before it
+var durabilityLevels = map[string]int{
+	"none":     0,
+	"complete": 1,
+	"slice":    2,
+}
+
+// syncs tells whether files written at point ("complete" or "slice") must be
+// fsynced: never with `none` (the default), the completed file and its meta
+// with `complete`, and also every slice and session meta with `slice`
+func syncs(point string) bool {
+	return durabilityLevels[viper.GetString("uploader.durability")] >= durabilityLevels[point]
+}
+
+// syncPath fsyncs the file or directory name
+func syncPath(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// syncEntry fsyncs name and the directory holding it, so a file created or
+// renamed there survives a crash
+func syncEntry(name string) error {
+	if err := syncPath(name); err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(name))
+}
@@ -1,22 +1,28 @@
 package controllers
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"mime/multipart"
 	"os"
-	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/security"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/thanhpk/randstr"
@@ -34,10 +40,33 @@ func (b *FileController) AddRoutes(r gin.IRoutes, prefix string) {
 	if prefix == "" {
 		prefix = "/"
 	}
+	r.GET(prefix+"capabilities", b.Capabilities)
+	r.GET(prefix+"search", b.Search)
+	r.GET(prefix+"prefixes/*path", b.Prefix)
+	r.GET(prefix+"files/resume", b.Resume)
+	r.GET(prefix+"files/chunk_size", b.ChunkSize)
 	r.GET(prefix+"files/:id/meta", b.Meta)
-	r.POST(prefix+"files", b.Create)
-	r.POST(prefix+"files/:id/upload", b.Upload)
-	r.POST(prefix+"files/:id/upload_v2", b.UploadV2)
+	r.PATCH(prefix+"files/:id/meta", b.PatchMeta)
+	r.GET(prefix+"files/:id/location", b.Location)
+	r.GET(prefix+"files/:id/progress", b.Progress)
+	r.GET(prefix+"files/:id/slices", b.Slices)
+	r.GET(prefix+"files/:id/slices/:slice_id", b.Slice)
+	r.GET(prefix+"files/:id/download", b.Download)
+	r.POST(prefix+"files/:id/share", b.Share)
+	r.GET(prefix+"files/:id/preview", b.Preview)
+	r.GET(prefix+"files/:id/pieces", b.Pieces)
+	r.GET(prefix+"files/:id/pieces/:slice_id", b.Piece)
+	r.POST(prefix+"files/:id/slices/:slice_id/claim", b.Claim)
+	r.DELETE(prefix+"files/:id/slices/:slice_id/claim", b.Release)
+	r.POST(prefix+"files", readOnlyGuard, b.Create)
+	r.POST(prefix+"files/resumable", readOnlyGuard, b.Resumable)
+	r.POST(prefix+"files/:id/append", readOnlyGuard, b.Append)
+	r.POST(prefix+"files/:id/complete", readOnlyGuard, b.Complete)
+	r.POST(prefix+"files/:id/upload", readOnlyGuard, slowClientGuard(true), b.Upload)
+	r.POST(prefix+"files/:id/upload_v2", readOnlyGuard, slowClientGuard(true), b.UploadV2)
+	r.POST(prefix+"files/:id/upload_batch", readOnlyGuard, slowClientGuard(true), b.UploadBatch)
+	r.POST(prefix+"files/:id/stream", readOnlyGuard, slowClientGuard(false), b.Stream)
+	r.PUT(prefix+"files/:id/content", readOnlyGuard, slowClientGuard(false), b.UploadRange)
 }
 
 type CreateParams struct {
@@ -46,102 +75,228 @@ type CreateParams struct {
 	FileSize  int64  `json:"file_size" form:"file_size" binding:"required,numeric"`
 	ChunkSize int64  `json:"chunk_size" form:"chunk_size" binding:"required,numeric,min=1024"`
 	Prefix    string `json:"prefix" form:"prefix"`
+	// computed by the client from the local file, see Resume
+	Fingerprint string `json:"fingerprint" form:"fingerprint"`
+	// several clients share the session, they need the writer token returned
+	// by Create to upload slices
+	MultiWriter bool `json:"multi_writer" form:"-"`
+	// searchable labels of the file
+	Tags []string `json:"tags,omitempty" form:"-"`
+	// free text notes, searchable and shown in listings, see PatchMeta
+	Description string `json:"description,omitempty" form:"-" binding:"max=4096"`
+	// unix time after which the session is abandoned, 0 when it never is.
+	// Create keeps the earlier of the one asked for and uploader.session_ttl
+	Deadline int64 `json:"deadline,omitempty" form:"-"`
+	// the file is named by rendering it instead of file_name, see renderName
+	NameTemplate string `json:"name_template,omitempty" form:"-"`
 }
 
 type Slice struct {
 	Id     string `json:"slice_id"`
 	Status int    `json:"status"`
 	Sha1   string `json:"sha1"`
+	// client holding the claim of the slice and when the claim expires
+	ClaimedBy      string `json:"claimed_by,omitempty"`
+	ClaimExpiresAt int64  `json:"claim_expires_at,omitempty"`
+	// uploads of the slice tried so far and why the last failed one did,
+	// cleared once it is uploaded
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// unix seconds the slice was uploaded at, with its size in bytes
+	ReceivedAt int64 `json:"received_at,omitempty"`
+	Size       int64 `json:"size,omitempty"`
+	// sent by the client with the slice, see SliceEncryption
+	Encryption *SliceEncryption `json:"encryption,omitempty"`
 }
 
 type FileMeta struct {
+	// layout of the meta, see MetaVersion
+	MetaVersion int `json:"meta_version" form:"-"`
 	CreateParams
-	FileId    string           `json:"file_id" form:"file_id"`
-	CreatedAt int64            `json:"created_at" form:"created_at"`
-	Status    int              `json:"status" form:"status"`
-	Slices    map[string]Slice `json:"slices" form:"slices"`
+	FileId    string    `json:"file_id" form:"file_id"`
+	CreatedAt int64     `json:"created_at" form:"created_at"`
+	State     FileState `json:"state" form:"-"`
+	// file_name sent at Create when a name template named the file
+	OriginalName string `json:"original_name,omitempty" form:"-"`
+	// the transitions of the session so far, oldest first
+	History []StateChange    `json:"history,omitempty" form:"-"`
+	Slices  map[string]Slice `json:"slices" form:"slices"`
+	// resolved from the prefix at Create
+	Storage storage.Config `json:"storage" form:"-"`
+	// copies of the completed file in other storages, see Replica
+	Replicas []Replica `json:"replicas,omitempty" form:"-"`
+	// hex sha256 and md5 of the whole file, set once completed
+	Sha256 string `json:"sha256,omitempty" form:"-"`
+	Md5    string `json:"md5,omitempty" form:"-"`
+	// content identifier of the file on IPFS, see uploader.ipfs
+	CID string `json:"cid,omitempty" form:"-"`
+	// lets appends go on hashing the file, see DigestState
+	DigestState *DigestState `json:"digest_state,omitempty" form:"-"`
+	// how the file was sanitized before being stored, see SanitizeConfig
+	Sanitized  string      `json:"sanitized,omitempty" form:"-"`
+	Conversion *Conversion `json:"conversion,omitempty" form:"-"`
+	// antivirus verdict of the uploaded file, see scan
+	Scan *ScanVerdict `json:"scan,omitempty" form:"-"`
+	// what the processors of uploader.processors returned, by name
+	Processors map[string]ProcessorResult `json:"processors,omitempty" form:"-"`
+	// hex sha256 of the upload token of the session, also the writer token
+	// of a multi writer session
+	WriterTokenHash string `json:"writer_token_hash,omitempty" form:"-"`
+	// the meta is only shown to holders of the token until the upload is done
+	UploadTokenRequired bool `json:"upload_token_required,omitempty" form:"-"`
+	// v1 slice files are kept in sub directories of this many slices, 0 when
+	// they are all in the slice dir
+	SliceShard int64 `json:"slice_shard,omitempty" form:"-"`
+	// the completed file is still made of the slice files of its manifest,
+	// see completeManifest
+	Manifest bool `json:"manifest,omitempty" form:"-"`
+	// the slices are put into storage by the client, see DirectUpload
+	Direct *DirectUpload `json:"direct,omitempty" form:"-"`
+	// the file is assembled there instead of the slice cache, see
+	// directWritePath
+	TargetPath string `json:"target_path,omitempty" form:"-"`
+	// the API key id the session was created with
+	UploadedBy string `json:"uploaded_by,omitempty" form:"-"`
+	// the file at the name must meet it to be replaced, see Precondition
+	Precondition *Precondition `json:"precondition,omitempty" form:"-"`
+	// the session appends to the file with this id, which had
+	// AppendOffset bytes at Create, see Append
+	AppendTo     string `json:"append_to,omitempty" form:"-"`
+	AppendOffset int64  `json:"append_offset,omitempty" form:"-"`
 }
 
 type UploadParams struct {
 	FileMeta
-	File    *multipart.FileHeader `form:"file" binding:"required"`
-	SliceId string                `form:"slice_id" binding:"required,numeric"`
+	File    *multipart.FileHeader `json:"-" form:"file" binding:"required"`
+	SliceId string                `json:"slice_id" form:"slice_id" binding:"required,numeric"`
+	// only sent in the JSON part meta, see bindUpload
+	Checksums  *SliceChecksums  `json:"checksums,omitempty" form:"-"`
+	Encryption *SliceEncryption `json:"encryption,omitempty" form:"-"`
 }
 
-func (f *FileController) Meta(c *gin.Context) {
-	// get FileId from query
+func (m *FileMeta) Uploaded() bool {
+	for _, slice := range m.Slices {
+		if slice.Status != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// readMeta reads the meta of a session, the one of its session while
+// uploading and the one of the completed file after
+func readMeta(fileId string) (FileMeta, error) {
 	var meta FileMeta
-	var metaFile string
-	fileId := c.Param("id")
-	cacheDir := path.Join(viper.GetString("uploader.slice_cache_dir"), fileId)
+	// v2 sessions leave their meta behind, it stops before the file is
+	// complete
+	store := metas()
+	content, err := store.read(MetaRecordFile, fileId)
+	if errors.Is(err, fs.ErrNotExist) {
+		content, err = store.read(MetaRecordSession, fileId)
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = decodeMeta(content, &meta)
+	return meta, err
+}
 
-	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
-		// cache not exists, find from uploader
-		metaFile = path.Join(viper.GetString("uploader.metafile_dir"), fileId+".meta.json")
-	} else {
-		// read meta in cache
-		metaFile = path.Join(cacheDir, "meta.json")
+// write the error of readMeta to response, returns false if there is none
+func (b *BaseController) checkReadMeta(c *gin.Context, err error) bool {
+	if err == nil {
+		return true
 	}
+	if os.IsNotExist(err) {
+		logrus.Warningf("meta file not found: %s", c.Param("id"))
+		b.WriteError(c, nil, uploadererrors.ErrSessionNotFound)
+		return false
+	}
+	if errors.Is(err, uploadererrors.ErrMetaVersion) {
+		// a newer server has the session, e.g. during a rolling upgrade
+		logrus.Warningf("refused meta: %v", err)
+		b.WriteError(c, nil, uploadererrors.ErrMetaVersion)
+		return false
+	}
+	logrus.Errorf("failed to read meta file: %v", err)
+	b.Write(c, nil, 500, 0, "")
+	return false
+}
 
-	if _, err := os.Stat(metaFile); os.IsNotExist(err) {
-		logrus.Warningf("meta file not found: %s", metaFile)
-		f.Write(c, nil, 404, 0, "")
+func (f *FileController) Meta(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) || !f.checkReader(c, &meta) {
+		return
+	}
+	if c.Query("format") == "bitmap" {
+		f.Write(c, newBitmapFileMeta(meta, c.Query("hashes") != ""), 200, 0, "")
 		return
 	}
+	f.Write(c, meta, 200, 0, "")
+}
 
-	content, err := ioutil.ReadFile(metaFile)
+// Resume finds the unfinished sessions created with the given fingerprint, so
+// a client which lost its local state can carry on uploading
+func (f *FileController) Resume(c *gin.Context) {
+	fingerprint := c.Query("fingerprint")
+	if fingerprint == "" {
+		f.Write(c, nil, 400, 0, "")
+		return
+	}
+
+	cached, err := metas().list(MetaRecordSession)
 	if err != nil {
-		logrus.Errorf("failed to read meta file: %v", err)
+		logrus.Errorf("failed to list sessions: %v", err)
 		f.Write(c, nil, 500, 0, "")
 		return
 	}
-	json.Unmarshal(content, &meta)
-	f.Write(c, meta, 200, 0, "")
-}
 
-var filesLock sync.Map
+	unfinished := []FileMeta{}
+	for _, content := range cached {
+		var meta FileMeta
+		if err := decodeMeta(content, &meta); err != nil {
+			continue
+		}
+		if meta.Fingerprint != fingerprint || meta.Uploaded() {
+			continue
+		}
+		unfinished = append(unfinished, meta)
+	}
 
-func init() {
-	filesLock = sync.Map{}
+	// most recent session first
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].CreatedAt > unfinished[j].CreatedAt
+	})
+	f.Write(c, unfinished, 200, 0, "")
 }
 
 // save all slice to single file
 func (f *FileController) UploadV2(c *gin.Context) {
+	f.upload(c, true)
+}
+
+func (f *FileController) Upload(c *gin.Context) {
+	f.upload(c, false)
+}
+
+func (f *FileController) upload(c *gin.Context, v2 bool) {
+	start := time.Now()
 	params := UploadParams{}
 	// print all headers with logrus.Debug
-	logrus.Debugf("headers: %v", c.Request.Header)
-	if err := c.Bind(&params); err != nil {
-		logrus.Infof("failed to bind data: %v", err)
-		f.Write(c, nil, 400, 0, "")
+	logrus.Debugf("headers: %v", security.RedactHeaders(c.Request.Header))
+	if !f.bindUpload(c, &params) {
 		return
 	}
-	sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), params.FileId)
-
-	lockAny, _ := filesLock.LoadOrStore(params.FileId, &sync.Mutex{})
-	lock := lockAny.(*sync.Mutex)
-	lock.Lock()
-	defer lock.Unlock()
 
-	// check file meta
-	var serverFileMeta FileMeta
-	content, err := ioutil.ReadFile(path.Join(sliceDir, "meta.json"))
-	if err != nil {
-		logrus.Errorf("failed to read meta file: %v", err)
-		f.Write(c, nil, 422, 0, "")
-		return
-	}
+	// update meta file, should be atomic
+	session := lockSession(params.FileId)
+	defer session.Unlock()
 
-	json.Unmarshal(content, &serverFileMeta)
-	if serverFileMeta.FileName != params.FileName || serverFileMeta.FileType != params.FileType || serverFileMeta.FileSize != params.FileSize {
-		logrus.Errorf("meta file is not matched. params %v - servers %v", params, serverFileMeta)
-		f.Write(c, nil, 422, 0, "")
+	serverFileMeta, ok := f.checkSessionMeta(c, session, params.CreateParams)
+	if !ok {
 		return
 	}
 
-	// read file bytes from form
-	form, _ := c.MultipartForm()
-	file := form.File["file"][0]
-	osfile, err := file.Open()
+	osfile, err := params.File.Open()
 	if err != nil {
 		logrus.Errorf("failed to open the uploaded file: %v", err)
 		f.Write(c, nil, 500, 0, "")
@@ -149,219 +304,727 @@ func (f *FileController) UploadV2(c *gin.Context) {
 	}
 	defer osfile.Close()
 
-	fileData, err := ioutil.ReadAll(osfile)
+	fileData, err := io.ReadAll(osfile)
 	if err != nil {
 		logrus.Errorf("failed to read file: %v", err)
 		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	if field := params.Checksums.mismatch(fileData); field != "" {
+		logrus.Infof("slice %s of %s doesn't match its %s", params.SliceId, params.FileId, field)
+		f.WriteError(c, []FieldError{{Field: field, Rule: "checksum"}}, uploadererrors.ErrChecksumMismatch)
+		return
 	}
-	sha1Sum := sha1.Sum(fileData)
-	sha1Hex := hex.EncodeToString(sha1Sum[:])
 
-	logrus.Debugf("upload file: %s", file.Filename)
+	if slice := serverFileMeta.Slices[params.SliceId]; slice.claimedByOther(writerOf(c).client) {
+		f.WriteError(c, slice, uploadererrors.ErrSliceClaimed)
+		return
+	}
 
-	// open target file
-	targetFilePath := path.Join(sliceDir, serverFileMeta.FileName)
-	if _, err = os.Stat(targetFilePath); err != nil {
-		// create a empty file but with zero bytes filled
-		emptyFile, err := os.Create(targetFilePath)
-		if err != nil {
-			logrus.Errorf("failed to create target file: %v", err)
-			f.Write(c, nil, 500, 0, "")
-			return
+	logrus.Debugf("upload file: %s", params.File.Filename)
+	ctx := c.Request.Context()
+	err = receiveSlice(ctx, session, params.SliceId, fileData, v2)
+	if err == nil && params.Encryption != nil {
+		slice := serverFileMeta.Slices[params.SliceId]
+		slice.Encryption = params.Encryption
+		serverFileMeta.Slices[params.SliceId] = slice
+		err = session.saveMeta()
+	}
+	throughput.record(c.ClientIP(), int64(len(fileData)), time.Since(start), err != nil)
+	if ctx.Err() != nil {
+		logrus.Infof("dropped slice %s of %s, the client is gone", params.SliceId, params.FileId)
+		f.WriteError(c, nil, uploadererrors.ErrClientGone)
+		return
+	}
+	if err != nil {
+		if errors.As(err, new(*sliceWriteError)) {
+			retryAfter(c, sliceRetryDelay)
 		}
-		emptyFile.WriteAt([]byte{0}, serverFileMeta.FileSize-1)
-		emptyFile.Close()
+		data, err := sliceFailure(serverFileMeta, params.SliceId, err)
+		f.WriteError(c, data, err)
+		return
 	}
 
-	// Open Target File
-	targetFile, err := os.OpenFile(targetFilePath, os.O_RDWR, 0644)
+	if !serverFileMeta.Uploaded() {
+		f.Write(c, throughput.recommend(c.ClientIP()), 206, 0, "")
+		return
+	}
+	delay, err := complete(ctx, session, v2)
+	retryAfter(c, delay)
 	if err != nil {
-		logrus.Errorf("failed to open target file: %v", err)
-		f.Write(c, nil, 500, 0, "")
+		f.WriteError(c, nil, err)
 		return
 	}
-	defer targetFile.Close()
-
-	// write the bytes to target file
-	sliceId, _ := strconv.Atoi(params.SliceId)
-	offset := params.ChunkSize * int64(sliceId)
-	targetFile.WriteAt(fileData, offset)
+	f.Write(c, nil, 200, 0, "")
+}
 
-	// update meta file
-	content, _ = os.ReadFile(path.Join(sliceDir, "meta.json"))
+type BatchUploadParams struct {
+	CreateParams
+	Mode string `form:"mode" binding:"omitempty,oneof=v1 v2"`
+}
 
-	json.Unmarshal(content, &serverFileMeta)
+type BatchSliceResult struct {
+	SliceId string `json:"slice_id"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// the name of the uploadererrors.Error failing the slice, if any
+	Error string `json:"error,omitempty"`
+}
 
-	serverFileMeta.Slices[params.SliceId] = Slice{
-		Id:     params.SliceId,
-		Status: 1,
-		Sha1:   sha1Hex,
+// UploadBatch receives several slices in one multipart request, each file
+// part is named by its slice id. Every slice is stored on its own, the result
+// of each one is listed in the response.
+func (f *FileController) UploadBatch(c *gin.Context) {
+	start := time.Now()
+	params := BatchUploadParams{}
+	if !f.bind(c, &params, c.ShouldBind) {
+		return
 	}
+	v2 := params.Mode != "v1"
 
-	content, _ = json.Marshal(serverFileMeta)
-	if err = ioutil.WriteFile(path.Join(sliceDir, "meta.json"), content, 0644); err != nil {
-		logrus.Errorf("failed to write meta file: %v", err)
-		f.Write(c, nil, 500, 0, "")
+	session := lockSession(c.Param("id"))
+	defer session.Unlock()
+
+	serverFileMeta, ok := f.checkSessionMeta(c, session, params.CreateParams)
+	if !ok {
 		return
 	}
 
-	// go over the slices in meta, and check if all slices are uploaded
-	for _, slice := range serverFileMeta.Slices {
-		if slice.Status != 1 {
-			f.Write(c, nil, 206, 0, "")
-			return
-		}
+	form, _ := c.MultipartForm()
+	sliceIds := make([]string, 0, len(form.File))
+	for sliceId := range form.File {
+		sliceIds = append(sliceIds, sliceId)
 	}
+	sort.Slice(sliceIds, func(i, j int) bool {
+		a, _ := strconv.Atoi(sliceIds[i])
+		b, _ := strconv.Atoi(sliceIds[j])
+		return a < b
+	})
 
-	// all slices are uploaded, merge them
-	filesLock.Delete(params.FileId)
-	uploadDir := viper.GetString("uploader.upload_dir")
-	if serverFileMeta.Prefix != "" {
-		uploadDir = path.Join(uploadDir, serverFileMeta.Prefix)
+	ctx := c.Request.Context()
+	results := make([]BatchSliceResult, 0, len(sliceIds))
+	failed := 0
+	var received int64
+	for _, sliceId := range sliceIds {
+		var err error
+		if slice, ok := serverFileMeta.Slices[sliceId]; !ok {
+			err = uploadererrors.ErrUnknownSlice
+		} else if slice.claimedByOther(writerOf(c).client) {
+			err = uploadererrors.ErrSliceClaimed
+		} else if err = receiveFormSlice(ctx, session, sliceId, form.File[sliceId][0], v2); ctx.Err() != nil {
+			err = uploadererrors.ErrClientGone
+		} else if err != nil {
+			_, err = sliceFailure(serverFileMeta, sliceId, err)
+		} else {
+			received += form.File[sliceId][0].Size
+		}
+		if err != nil {
+			failed++
+		}
+		results = append(results, sliceResult(c, sliceId, err))
 	}
-	os.MkdirAll(uploadDir, 0755)
 
-	// move target file to upload dir
-	err = exec.Command("mv", targetFilePath, path.Join(uploadDir, serverFileMeta.FileName)).Run()
+	throughput.record(c.ClientIP(), received, time.Since(start), failed > 0)
+	if len(results) == 0 || failed == len(results) {
+		f.Write(c, results, 400, 0, "")
+		return
+	}
+	if !serverFileMeta.Uploaded() {
+		f.Write(c, results, 206, 0, "")
+		return
+	}
+	delay, err := complete(ctx, session, v2)
+	retryAfter(c, delay)
 	if err != nil {
-		logrus.Errorf("failed to move target file: %v", err)
-		f.Write(c, nil, 500, 0, "")
+		f.WriteError(c, results, err)
 		return
 	}
-	// 这里保留 meta 文件不删除
-	// ...
-	f.Write(c, nil, 200, 0, "")
+	f.Write(c, results, 200, 0, "")
 }
 
-func (f *FileController) Upload(c *gin.Context) {
-	params := UploadParams{}
-	// print all headers with logrus.Debug
-	logrus.Debugf("headers: %v", c.Request.Header)
+func receiveFormSlice(ctx context.Context, session *session, sliceId string, file *multipart.FileHeader, v2 bool) error {
+	osfile, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open the uploaded file: %w", err)
+	}
+	defer osfile.Close()
 
-	if err := c.Bind(&params); err != nil {
-		logrus.Infof("failed to bind data: %v", err)
-		f.Write(c, nil, 400, 0, "")
-		return
+	fileData, err := io.ReadAll(osfile)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
 	}
+	return receiveSlice(ctx, session, sliceId, fileData, v2)
+}
 
-	sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), params.FileId)
+// load the meta of the session and make sure the request is talking about
+// the same file, otherwise respond with 422. Writers of a completed file get
+// 409, writers of a session past its deadline 410 and writers without the
+// token of a multi writer session 403. Slices of direct uploads go to storage,
+// 409 as well.
+func (f *FileController) checkSessionMeta(c *gin.Context, session *session, params CreateParams) (*FileMeta, bool) {
+	meta, data, err := writableSessionMeta(session, params, writerOf(c).token)
+	if err == nil {
+		return meta, true
+	}
+	if !errors.As(err, new(*uploadererrors.Error)) {
+		f.Write(c, nil, 422, 0, "")
+		return nil, false
+	}
+	f.WriteError(c, data, err)
+	return nil, false
+}
 
-	// update meta file, should be atomic
-	lockAny, _ := filesLock.LoadOrStore(params.FileId, &sync.Mutex{})
-	lock := lockAny.(*sync.Mutex)
-	lock.Lock()
-	defer lock.Unlock()
-
-	// check file meta
-	var serverFileMeta FileMeta
-	content, err := ioutil.ReadFile(path.Join(sliceDir, "meta.json"))
+// writableSessionMeta is the meta of the session when the writer with token
+// may write the file of params into it, otherwise the error refusing it with
+// its data: the expiry or the transition failing the session. An error which
+// isn't an uploadererrors.Error is a meta which can't be read.
+func writableSessionMeta(session *session, params CreateParams, token string) (*FileMeta, any, error) {
+	if session.isCompleted() {
+		return nil, nil, uploadererrors.ErrFileCompleted
+	}
+	serverFileMeta, err := session.loadMeta()
+	if expired, ok := sessionExpired(session.fileId, serverFileMeta); ok {
+		return nil, expired, uploadererrors.ErrSessionExpired
+	}
+	if errors.Is(err, uploadererrors.ErrMetaVersion) {
+		logrus.Warningf("refused meta: %v", err)
+		return nil, nil, uploadererrors.ErrMetaVersion
+	}
 	if err != nil {
 		logrus.Errorf("failed to read meta file: %v", err)
-		f.Write(c, nil, 422, 0, "")
-		return
+		return nil, nil, err
 	}
 
-	json.Unmarshal(content, &serverFileMeta)
 	if serverFileMeta.FileName != params.FileName || serverFileMeta.FileType != params.FileType || serverFileMeta.FileSize != params.FileSize {
 		logrus.Errorf("meta file is not matched. params %v - servers %v", params, serverFileMeta)
-		f.Write(c, nil, 422, 0, "")
-		return
+		return nil, nil, uploadererrors.ErrMetaMismatch
+	}
+	if !serverFileMeta.writerAllowed(token) {
+		return nil, nil, uploadererrors.ErrInvalidWriterToken
+	}
+	if serverFileMeta.state() == StateFailed {
+		return nil, serverFileMeta.History[len(serverFileMeta.History)-1], uploadererrors.ErrUploadFailed
 	}
+	if serverFileMeta.Direct != nil {
+		return nil, nil, uploadererrors.ErrDirectUpload
+	}
+	return serverFileMeta, nil, nil
+}
 
-	form, _ := c.MultipartForm()
-	file := form.File["file"][0]
-	osfile, err := file.Open()
+// partialPath is where the file is assembled in the slice cache until it is
+// complete, named `<file name>.part` or, with uploader.partial_file.name set
+// to file_id, `<file id>.part` (uploader.partial_file.suffix)
+func (m *FileMeta) partialPath() string {
+	if m.TargetPath != "" {
+		return m.TargetPath
+	}
+	name := m.FileName
+	if viper.GetString("uploader.partial_file.name") == "file_id" {
+		name = m.FileId
+	}
+	return path.Join(viper.GetString("uploader.slice_cache_dir"), m.FileId, name+partialSuffix())
+}
+
+func partialSuffix() string {
+	if viper.IsSet("uploader.partial_file.suffix") {
+		return viper.GetString("uploader.partial_file.suffix")
+	}
+	return ".part"
+}
+
+const defaultSliceShard = 1000
+
+// slicePath is the v1 slice file of a slice with the given sha1, slice n is
+// under `<n / slice shard>/` of the slice dir so no directory holds more than
+// SliceShard files
+func (m *FileMeta) slicePath(sliceId string, sha1Hex string) string {
+	dir := path.Join(viper.GetString("uploader.slice_cache_dir"), m.FileId)
+	if m.SliceShard > 0 {
+		index, _ := strconv.ParseInt(sliceId, 10, 64)
+		dir = path.Join(dir, strconv.FormatInt(index/m.SliceShard, 10))
+	}
+	return path.Join(dir, m.FileName+"."+sliceId+"."+sha1Hex+".slice")
+}
+
+func openTargetFile(meta *FileMeta) (fileio.WriterAt, error) {
+	targetFilePath := meta.partialPath()
+	if err := permissions().MkdirAll(path.Dir(targetFilePath)); err != nil {
+		return nil, fmt.Errorf("failed to create target dir: %w", err)
+	}
+	// create a empty file but with zero bytes filled, unless it is there
+	emptyFile, err := permissions().CreateFile(targetFilePath, true)
+	if err == nil {
+		emptyFile.WriteAt([]byte{0}, meta.FileSize-1)
+		emptyFile.Close()
+	} else if !errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("failed to create target file: %w", err)
+	}
+
+	targetFile, err := fileio.OpenWriterAt(targetFilePath)
 	if err != nil {
-		logrus.Errorf("failed to open the uploaded file: %v", err)
-		f.Write(c, nil, 500, 0, "")
-		return
+		return nil, fmt.Errorf("failed to open target file: %w", err)
 	}
-	defer osfile.Close()
+	return targetFile, nil
+}
+
+// sliceRejectedError is a slice refused before any of it is written, sending
+// it again as it is won't do. The response is err with data.
+type sliceRejectedError struct {
+	err  *uploadererrors.Error
+	data interface{}
+}
+
+func (e *sliceRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sliceRejectedError) Unwrap() error {
+	return e.err
+}
 
-	fileData, err := ioutil.ReadAll(osfile)
+// SliceSizeMismatch is the data of a slice refused for its size, slices are
+// chunk_size bytes but the last one, which has the rest of the file
+type SliceSizeMismatch struct {
+	SliceId      string `json:"slice_id"`
+	ExpectedSize int64  `json:"expected_size"`
+	Size         int64  `json:"size"`
+}
+
+// checkSliceSize refuses data as slice sliceId unless it has the size of the
+// slice, an empty or short slice would shift the bytes after it in the file
+// and a long one overwrite the next
+func checkSliceSize(meta *FileMeta, sliceId string, data []byte) error {
+	index, err := strconv.Atoi(sliceId)
+	if err != nil || index < 0 {
+		return nil
+	}
+	if expected := meta.sliceSize(index); int64(len(data)) != expected {
+		return &sliceRejectedError{
+			err:  uploadererrors.ErrSliceSizeMismatch,
+			data: SliceSizeMismatch{SliceId: sliceId, ExpectedSize: expected, Size: int64(len(data))},
+		}
+	}
+	return nil
+}
+
+// receiveSlice stores the data of a slice in the cache of the session, as a
+// slice file for v1 or at its offset of the target file for v2, and marks it
+// as uploaded. Every attempt is counted in the slice with the error of the
+// last one failed, so why a slice keeps failing shows in the meta.
+func receiveSlice(ctx context.Context, session *session, sliceId string, data []byte, v2 bool) error {
+	err := writeSlice(ctx, session, sliceId, data, v2)
+	slice, ok := session.meta.Slices[sliceId]
+	if !ok {
+		return err
+	}
+	slice.Attempts++
+	slice.Error = ""
+	if err == nil {
+		slice.ReceivedAt = time.Now().Unix()
+		slice.Size = int64(len(data))
+		rates.record(session.fileId, slice.Size)
+	} else {
+		slice.Error = sliceError(ctx, err)
+	}
+	session.meta.Slices[sliceId] = slice
+	event := SessionEvent{Event: "slice", SliceId: sliceId, Size: int64(len(data)), Attempt: slice.Attempts}
 	if err != nil {
-		logrus.Errorf("failed to read file: %v", err)
-		f.Write(c, nil, 500, 0, "")
+		event.Error = err.Error()
+	}
+	logSessionEvent(session.fileId, event)
+	if saveErr := session.saveMeta(); saveErr != nil && err == nil {
+		return fmt.Errorf("failed to write meta file: %w", saveErr)
+	}
+	return err
+}
+
+// sliceError tells clients why a slice failed, without the details of the
+// server, e.g. its paths
+func sliceError(ctx context.Context, err error) string {
+	var writeErr *sliceWriteError
+	switch {
+	case ctx.Err() != nil:
+		return uploadererrors.ErrClientGone.Message
+	case errors.Is(err, uploadererrors.ErrSliceConflict), errors.As(err, new(*ValidationError)), errors.As(err, new(*sliceRejectedError)):
+		return err.Error()
+	case errors.As(err, &writeErr):
+		return writeErr.named().Message
+	}
+	return "internal error"
+}
+
+// writeSlice writes the data of a slice and marks it as uploaded, the meta
+// is saved by the caller. Once ctx is done the slice is given up: a slice
+// file written is removed, bytes written into the target file stay but the
+// slice isn't marked, so it is written again by the next upload of it.
+func writeSlice(ctx context.Context, session *session, sliceId string, data []byte, v2 bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	meta := session.meta
+	if err := checkSliceSize(meta, sliceId, data); err != nil {
+		return err
 	}
-	sha1Sum := sha1.Sum(fileData)
+	sha1Sum := sha1.Sum(data)
 	sha1Hex := hex.EncodeToString(sha1Sum[:])
+	if slice := meta.Slices[sliceId]; slice.Status == 1 && slice.Sha1 != sha1Hex {
+		return uploadererrors.ErrSliceConflict
+	}
+	if err := checkCacheLimit(meta, sliceId, int64(len(data)), v2); err != nil {
+		return err
+	}
+	if sliceId == "0" {
+		if err := validateHead(meta, data); err != nil {
+			return err
+		}
+	}
 
-	logrus.Debugf("upload file: %s", file.Filename)
-	fileSlicePath := path.Join(sliceDir, serverFileMeta.FileName+"."+params.SliceId+"."+sha1Hex+".slice")
-	if err = c.SaveUploadedFile(file, fileSlicePath); err != nil {
-		logrus.Errorf("failed to save file: %v", err)
-		f.Write(c, nil, 500, 0, "")
-		return
+	if v2 {
+		// open target file, it is usually still open from the last slice
+		handle, err := targetFiles.acquire(meta.partialPath(), func() (fileio.WriterAt, error) {
+			return openTargetFile(meta)
+		})
+		if err != nil {
+			return err
+		}
+		defer targetFiles.release(handle)
+		targetFile := handle.file
+
+		// write the bytes to target file, a failed write leaves zeros
+		sliceIndex, _ := strconv.Atoi(sliceId)
+		offset := meta.ChunkSize * int64(sliceIndex)
+		undo := func() error {
+			// the handle may be broken, the next slice opens the file again
+			targetFiles.drop(meta.partialPath())
+			_, err := targetFile.WriteAt(make([]byte, len(data)), offset)
+			return err
+		}
+		if err := fileio.WriteFullAt(targetFile, data, offset); err != nil {
+			return failSlice(session, sliceId, fmt.Errorf("failed to write target file: %w", err), undo)
+		}
+		if syncs("slice") {
+			if err := targetFile.Sync(); err != nil {
+				return failSlice(session, sliceId, fmt.Errorf("failed to sync target file: %w", err), undo)
+			}
+		}
+	} else {
+		fileSlicePath := meta.slicePath(sliceId, sha1Hex)
+		if err := permissions().MkdirAll(path.Dir(fileSlicePath)); err != nil {
+			return fmt.Errorf("failed to create slice dir: %w", err)
+		}
+		undo := func() error {
+			if err := os.Remove(fileSlicePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		if err := permissions().WriteFile(fileSlicePath, data); err != nil {
+			return failSlice(session, sliceId, fmt.Errorf("failed to save slice file: %w", err), undo)
+		}
+		if syncs("slice") {
+			if err := syncEntry(fileSlicePath); err != nil {
+				return failSlice(session, sliceId, fmt.Errorf("failed to sync slice file: %w", err), undo)
+			}
+		}
+		// the file of a slice uploaded before has the same content, it stays
+		if err := ctx.Err(); err != nil && meta.Slices[sliceId].Status != 1 {
+			os.Remove(fileSlicePath)
+		}
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the claim is done with
+	meta.Slices[sliceId] = Slice{
+		Id:       sliceId,
+		Status:   1,
+		Sha1:     sha1Hex,
+		Attempts: meta.Slices[sliceId].Attempts,
+	}
+	return meta.transition(StateUploading, "")
+}
+
+// sliceWriteError is a slice which couldn't be written to disk, what was
+// written of it is undone and it is marked as not uploaded, so the client can
+// send it again later
+type sliceWriteError struct {
+	err error
+}
 
-	content, _ = os.ReadFile(path.Join(sliceDir, "meta.json"))
+func (e *sliceWriteError) Error() string {
+	return e.err.Error()
+}
 
-	json.Unmarshal(content, &serverFileMeta)
+func (e *sliceWriteError) Unwrap() error {
+	return e.err
+}
 
-	serverFileMeta.Slices[params.SliceId] = Slice{
-		Id:     params.SliceId,
-		Status: 1,
-		Sha1:   sha1Hex,
+// sliceRetryDelay is when clients are asked to send a slice not written again
+const sliceRetryDelay = 5 * time.Second
+
+// named is insufficient storage when the disk is full, slice not written for
+// other failures
+func (e *sliceWriteError) named() *uploadererrors.Error {
+	if errors.Is(e.err, syscall.ENOSPC) || errors.Is(e.err, syscall.EDQUOT) {
+		return uploadererrors.ErrInsufficientStorage
 	}
+	return uploadererrors.ErrSliceNotWritten
+}
 
-	content, _ = json.Marshal(serverFileMeta)
-	if err = ioutil.WriteFile(path.Join(sliceDir, "meta.json"), content, 0644); err != nil {
-		logrus.Errorf("failed to write meta file: %v", err)
-		f.Write(c, nil, 500, 0, "")
-		return
+// sliceFailure is the error answering err, the failure to store slice sliceId
+// of meta, and the data answered with it. Writes which failed are logged and
+// can be retried after sliceRetryDelay, errors not named are answered 500.
+func sliceFailure(meta *FileMeta, sliceId string, err error) (interface{}, error) {
+	var rejected *sliceRejectedError
+	var invalid *ValidationError
+	var writeErr *sliceWriteError
+	switch {
+	case errors.Is(err, uploadererrors.ErrSliceConflict):
+		return meta.Slices[sliceId], err
+	case errors.As(err, &rejected):
+		return rejected.data, rejected
+	case errors.As(err, &invalid):
+		return invalid, invalid
+	case errors.As(err, &writeErr):
+		logrus.Errorf("failed to save slice %s of %s: %v", sliceId, meta.FileId, err)
+		return nil, writeErr.named()
 	}
+	logrus.Errorf("failed to save slice %s of %s: %v", sliceId, meta.FileId, err)
+	return nil, err
+}
 
-	// go over the slices in meta, and check if all slices are uploaded
-	for _, slice := range serverFileMeta.Slices {
-		if slice.Status != 1 {
-			f.Write(c, nil, 206, 0, "")
-			return
-		}
+// sliceResult is the result of slice sliceId in the language of c, failed by
+// err unless it is nil
+func sliceResult(c *gin.Context, sliceId string, err error) BatchSliceResult {
+	if err == nil {
+		return BatchSliceResult{SliceId: sliceId, Code: 200}
 	}
+	status, code, known := answer(err)
+	result := BatchSliceResult{SliceId: sliceId, Code: code, Message: localize(c, status, known)}
+	if known != nil {
+		result.Error = known.Name
+	}
+	return result
+}
 
-	// all slices are uploaded, merge them
-	filesLock.Delete(params.FileId)
-	uploadDir := viper.GetString("uploader.upload_dir")
-	if serverFileMeta.Prefix != "" {
-		uploadDir = path.Join(uploadDir, serverFileMeta.Prefix)
+// failSlice undoes the write of a slice which failed with err and marks the
+// slice as not uploaded, an earlier upload of it may have been overwritten
+func failSlice(session *session, sliceId string, err error, undo func() error) error {
+	if undoErr := undo(); undoErr != nil {
+		logrus.Errorf("failed to undo the write of slice %s of %s: %v", sliceId, session.fileId, undoErr)
+	}
+	if slice := session.meta.Slices[sliceId]; slice.Status == 1 {
+		slice.Status = 0
+		slice.Sha1 = ""
+		session.meta.Slices[sliceId] = slice
+	}
+	return &sliceWriteError{err: err}
+}
+
+// complete places the file of a fully uploaded session into storage, it
+// returns the error to answer the request with unless it succeeds and, when
+// storage is unavailable, when to try again
+func complete(ctx context.Context, session *session, v2 bool) (time.Duration, error) {
+	meta := session.meta
+
+	var err error
+	if v2 {
+		err = completeV2(ctx, session)
+	} else {
+		err = completeV1(ctx, session)
+	}
+	if err != nil && meta.state() != StateComplete {
+		// rejected files are done with, for other failures the file is
+		// completed again once the client sends a slice again
+		state, reason := StateUploading, ""
+		if errors.As(err, new(*ValidationError)) || errors.Is(err, uploadererrors.ErrPreconditionFailed) {
+			state, reason = StateFailed, err.Error()
+		}
+		if err := session.advance(state, reason); err != nil {
+			logrus.Errorf("failed to record the state of %s: %v", meta.FileId, err)
+		}
+	}
+	// drop the session only now, so other writers can't get in while the file
+	// is being completed
+	session.completed = err == nil
+	session.forget()
+	if err == nil {
+		rates.forget(meta.FileId)
+	} else {
+		logSessionEvent(meta.FileId, SessionEvent{Event: "error", Error: err.Error()})
+	}
+	if err != nil && ctx.Err() != nil {
+		// all slices are there, the next upload of one completes the file
+		logrus.Infof("gave up completing %s, the client is gone: %v", meta.FileId, err)
+		return 0, uploadererrors.ErrClientGone
+	}
+	if errors.Is(err, storage.ErrObjectLocked) {
+		logrus.Warningf("refused to overwrite locked file: %s", meta.StorageKey())
+		return 0, uploadererrors.ErrFileLocked
+	}
+	if errors.As(err, new(*ValidationError)) {
+		logrus.Infof("rejected %s: %v", meta.FileId, err)
+		return 0, err
+	}
+	if errors.Is(err, uploadererrors.ErrPreconditionFailed) {
+		logrus.Infof("did not replace %s by %s: %v", meta.StorageKey(), meta.FileId, err)
+		return 0, err
+	}
+	var open *storage.CircuitOpenError
+	if errors.As(err, &open) {
+		logrus.Warningf("failed to complete %s: %v", meta.FileId, err)
+		return open.RetryAfter, uploadererrors.ErrStorageUnavailable
 	}
-	os.MkdirAll(uploadDir, 0755)
-	destFile, err := os.OpenFile(path.Join(uploadDir, serverFileMeta.FileName), os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		logrus.Errorf("failed to create dest file: %v", err)
-		f.Write(c, nil, 500, 0, "")
+		logrus.Errorf("failed to complete %s: %v", meta.FileId, err)
+		return 0, err
+	}
+	return 0, nil
+}
+
+// finalize completes the file of a session whose slices are all uploaded,
+// answers 409 with the ids of the slices missing otherwise
+func (f *FileController) finalize(c *gin.Context, session *session, v2 bool) {
+	meta := session.meta
+	if meta.state() == StateFailed {
+		f.WriteError(c, meta.History[len(meta.History)-1], uploadererrors.ErrUploadFailed)
 		return
 	}
-	defer destFile.Close()
-	metaFilePath := path.Join(viper.GetString("uploader.metafile_dir"), params.FileId+".meta.json")
-	destMetaFile, err := os.Create(metaFilePath)
+	missing := []string{}
+	for i := 0; i < len(meta.Slices); i++ {
+		if meta.Slices[strconv.Itoa(i)].Status != 1 {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+	if len(missing) > 0 {
+		f.WriteError(c, missing, uploadererrors.ErrSlicesMissing)
+		return
+	}
+	delay, err := complete(c.Request.Context(), session, v2)
+	retryAfter(c, delay)
 	if err != nil {
-		logrus.Errorf("failed to create dest meta file: %v", err)
-		f.Write(c, nil, 500, 0, "")
+		f.WriteError(c, nil, err)
 		return
 	}
-	defer destMetaFile.Close()
+	f.Write(c, meta, 200, 0, "")
+}
+
+// retryAfter asks the client to come back after delay, rounded up to seconds
+func retryAfter(c *gin.Context, delay time.Duration) {
+	if delay > 0 {
+		c.Header("Retry-After", strconv.Itoa(int((delay+time.Second-1)/time.Second)))
+	}
+}
+
+func completeV2(ctx context.Context, session *session) error {
+	meta := session.meta
+	targetFilePath := meta.partialPath()
+	targetFiles.drop(targetFilePath)
+
+	store, err := meta.storage()
+	if err != nil {
+		return err
+	}
+	// the slices were written in place, there is nothing to merge
+	if err := session.advance(StateVerifying, ""); err != nil {
+		return err
+	}
+	if err := checkFileSize(meta, targetFilePath, meta.receivedSliceSize); err != nil {
+		return err
+	}
+	if err := finalizeV2(meta, targetFilePath); err != nil {
+		return err
+	}
+
+	if err := preProcess(meta, targetFilePath); err != nil {
+		return err
+	}
+	if meta.Sha256 == "" || meta.Md5 == "" {
+		if err := digestFile(ctx, meta, targetFilePath); err != nil {
+			return fmt.Errorf("failed to hash target file: %w", err)
+		}
+	}
+
+	// 这里保留 meta 文件不删除
+	// ...
+	content, _ := json.Marshal(meta)
+	if err := metas().write(MetaRecordSession, meta.FileId, content); err != nil {
+		return fmt.Errorf("failed to write meta file: %w", err)
+	}
+	// move target file to upload dir
+	return place(ctx, meta, store, targetFilePath)
+}
 
-	io.Copy(destMetaFile, bytes.NewReader(content))
+// merge the slice files in order and move the result into storage
+func completeV1(ctx context.Context, session *session) error {
+	meta := session.meta
+	if err := session.advance(StateMerging, ""); err != nil {
+		return err
+	}
+	if manifestCompletion(meta) {
+		return completeManifest(meta)
+	}
+	sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId)
+	store, err := meta.storage()
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < len(serverFileMeta.Slices); i++ {
-		slice := serverFileMeta.Slices[strconv.Itoa(i)]
-		sliceFilePath := path.Join(sliceDir, serverFileMeta.FileName+"."+slice.Id+"."+slice.Sha1+".slice")
+	mergedFilePath := meta.partialPath()
+	destFile, err := permissions().CreateFile(mergedFilePath, false)
+	if err != nil {
+		return fmt.Errorf("failed to create dest file: %w", err)
+	}
+	defer destFile.Close()
+
+	digest := newFileDigest()
+	writer := io.MultiWriter(destFile, digest)
+	for i := 0; i < len(meta.Slices); i++ {
+		slice := meta.Slices[strconv.Itoa(i)]
+		sliceFilePath := meta.slicePath(slice.Id, slice.Sha1)
 		sliceFile, err := os.Open(sliceFilePath)
 		if err != nil {
-			logrus.Errorf("failed to open slice file: %v", err)
-			f.Write(c, nil, 500, 0, "")
-			return
+			return fmt.Errorf("failed to open slice file: %w", err)
 		}
-		io.Copy(destFile, sliceFile)
+		n, err := fileio.CopyContext(ctx, writer, sliceFile)
 		sliceFile.Close()
+		if err != nil {
+			return fmt.Errorf("failed to merge slice files: %w", err)
+		}
+		if n != meta.sliceSize(i) {
+			if strictSize() {
+				var merged int64
+				for j := 0; j < len(meta.Slices); j++ {
+					merged += max(meta.sliceFileSize(j), 0)
+				}
+				return sizeMismatch(meta, merged, meta.sliceFileSize)
+			}
+			return fmt.Errorf("failed to merge slice files: slice %d has %d bytes instead of %d", i, n, meta.sliceSize(i))
+		}
+	}
+	destFile.Close()
+	if err := checkFileSize(meta, mergedFilePath, meta.sliceFileSize); err != nil {
+		return err
+	}
+	digest.record(meta)
+	if err := session.advance(StateVerifying, ""); err != nil {
+		return err
+	}
+	if err := preProcess(meta, mergedFilePath); err != nil {
+		return err
 	}
 
-	// remove slice dir
-	os.RemoveAll(sliceDir)
+	if err = place(ctx, meta, store, mergedFilePath); err != nil {
+		return err
+	}
 
-	// return 200
-	f.Write(c, nil, 200, 0, "")
+	// remove slice dir, with the meta of the session
+	if err := metas().remove(MetaRecordSession, meta.FileId); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logrus.Errorf("failed to remove the session meta of %s: %v", meta.FileId, err)
+	}
+	os.RemoveAll(sliceDir)
+	return nil
 }
 
 func (f *FileController) Create(c *gin.Context) {
@@ -374,45 +1037,151 @@ func (f *FileController) Create(c *gin.Context) {
 	//
 	// server will create a temp dir somewhere to receive the file slices
 	params := CreateParams{}
-	if err := c.BindJSON(&params); err != nil {
-		logrus.Infof("failed to bind json: %v", err)
-		f.Write(c, nil, 400, 0, "")
+	if !f.bind(c, &params, c.ShouldBindJSON) {
+		return
+	}
+	result, ok := f.create(c, params, nil)
+	if !ok {
 		return
 	}
+	f.Write(c, result, 200, 0, "")
+}
 
+// create starts the session of the file described by params, appending to
+// base unless it is nil. It writes the response to c unless it succeeds.
+func (f *FileController) create(c *gin.Context, params CreateParams, base *FileMeta) (*CreateResult, bool) {
 	if strings.Contains(params.Prefix, "..") {
 		f.Write(c, nil, 400, 0, "")
-		return
+		return nil, false
+	}
+	if params.Deadline != 0 && params.Deadline <= time.Now().Unix() {
+		f.WriteError(c, nil, uploadererrors.ErrDeadlinePassed)
+		return nil, false
+	}
+
+	if chunkSize := prefixConfig(params.Prefix).ChunkSize; chunkSize > 0 {
+		params.ChunkSize = chunkSize
+	}
+	fileId := randstr.Hex(32)
+	var originalName string
+	if base == nil {
+		var err error
+		if originalName, err = applyNameTemplate(&params, fileId); err != nil {
+			f.WriteError(c, gin.H{"detail": err.Error()}, uploadererrors.ErrInvalidNameTemplate)
+			return nil, false
+		}
+		if err := checkName(params.Prefix, params.FileName); err != nil {
+			f.WriteError(c, err, err)
+			return nil, false
+		}
+	}
+	storageConfig := sessionStorage(params.Prefix, path.Join(params.Prefix, params.FileName), params.FileSize, fileId)
+	if base != nil && base.Storage.Driver != "" {
+		storageConfig = base.Storage
+	}
+	store, err := newStorage(storageConfig)
+	if err != nil {
+		logrus.Errorf("failed to create storage of prefix %s: %v", params.Prefix, err)
+		f.Write(c, nil, 500, 0, "")
+		return nil, false
+	}
+
+	// fail fast instead of refusing the file after all slices are uploaded
+	if storage.IsLocked(store, path.Join(params.Prefix, params.FileName)) {
+		f.WriteError(c, nil, uploadererrors.ErrFileLocked)
+		return nil, false
+	}
+	precondition, err := newPrecondition(c)
+	if err != nil {
+		f.WriteError(c, nil, err)
+		return nil, false
+	}
+	var appendOffset int64
+	if base != nil {
+		var ok bool
+		if appendOffset, ok = f.appendOffset(c, store, base, &precondition); !ok {
+			return nil, false
+		}
+	}
+	if err := precondition.check(store, path.Join(params.Prefix, params.FileName)); errors.Is(err, uploadererrors.ErrPreconditionFailed) {
+		f.WriteError(c, nil, err)
+		return nil, false
+	} else if err != nil {
+		logrus.Errorf("failed to check the precondition of %s: %v", params.FileName, err)
+		f.Write(c, nil, 500, 0, "")
+		return nil, false
+	}
+
+	var sliceNum int64
+	if params.FileSize%params.ChunkSize != 0 {
+		sliceNum = params.FileSize/params.ChunkSize + 1
+	} else {
+		sliceNum = params.FileSize / params.ChunkSize
+	}
+
+	preflight, err := newPreflight(params.Prefix, params.FileSize, c.ClientIP())
+	if err != nil {
+		logrus.Errorf("failed to compute quota: %v", err)
+		f.Write(c, nil, 500, 0, "")
+		return nil, false
+	}
+	if preflight.QuotaRemaining >= 0 && params.FileSize > preflight.QuotaRemaining {
+		f.WriteError(c, preflight, uploadererrors.ErrQuotaExceeded)
+		return nil, false
+	}
+	if preflight.MaxChunkCount > 0 && sliceNum > preflight.MaxChunkCount {
+		f.WriteError(c, preflight, uploadererrors.ErrTooManyChunks)
+		return nil, false
 	}
 
-	var fileId string
 	var cacheDirPath string
 	for i := 0; i < 10; i++ {
-		fileId = randstr.Hex(32)
+		if i > 0 {
+			fileId = randstr.Hex(32)
+		}
 		// join config and fileId as dir
 		cacheDirPath = path.Join(viper.GetString("uploader.slice_cache_dir"), fileId)
 		if _, err := os.Stat(cacheDirPath); err != nil {
 			if err == nil {
 				continue
 			}
-			os.MkdirAll(cacheDirPath, os.ModePerm)
+			permissions().MkdirAll(cacheDirPath)
 			break
 		}
 	}
 
 	meta := FileMeta{
+		MetaVersion:  MetaVersion,
 		CreateParams: params,
+		OriginalName: originalName,
 		FileId:       fileId,
 		CreatedAt:    time.Now().Unix(),
-		Status:       0,
 		Slices:       make(map[string]Slice),
+		Storage:      storageConfig,
+		UploadedBy:   c.GetString("api_key_id"),
+		Precondition: precondition,
 	}
-
-	var sliceNum int64
-	if params.FileSize%params.ChunkSize != 0 {
-		sliceNum = params.FileSize/params.ChunkSize + 1
+	if base != nil {
+		meta.AppendTo, meta.AppendOffset = base.FileId, appendOffset
 	} else {
-		sliceNum = params.FileSize / params.ChunkSize
+		meta.Replicas = newReplicas(params.Prefix)
+	}
+	logSessionEvent(meta.FileId, SessionEvent{Event: "create", Client: c.ClientIP(), Size: meta.FileSize, ChunkSize: meta.ChunkSize})
+	meta.transition(StateCreated, "")
+	var uploadToken string
+	if params.MultiWriter || viper.GetBool("uploader.upload_token") {
+		uploadToken = randstr.Hex(32)
+		meta.WriterTokenHash = hashToken(uploadToken)
+		meta.UploadTokenRequired = viper.GetBool("uploader.upload_token")
+	}
+	meta.SliceShard = defaultSliceShard
+	if viper.IsSet("uploader.slice_shard_size") {
+		meta.SliceShard = viper.GetInt64("uploader.slice_shard_size")
+	}
+	if ttl := viper.GetDuration("uploader.session_ttl"); ttl > 0 {
+		if deadline := meta.CreatedAt + int64(ttl.Seconds()); meta.Deadline == 0 || meta.Deadline > deadline {
+			meta.Deadline = deadline
+		}
 	}
 
 	for i := int64(0); i < sliceNum; i++ {
@@ -425,19 +1194,35 @@ func (f *FileController) Create(c *gin.Context) {
 		meta.Slices[sliceId] = slice
 	}
 
+	var partURLs []string
+	if prefixConfig(params.Prefix).DirectUpload {
+		if partURLs, err = startDirectUpload(&meta, store); err != nil {
+			logrus.Errorf("failed to start the direct upload of %s: %v", fileId, err)
+			f.Write(c, nil, 500, 0, "")
+			return nil, false
+		}
+	}
+	if meta.Direct == nil {
+		meta.TargetPath, _ = directWritePath(&meta, store)
+	}
+
 	metaData, err := json.Marshal(meta)
 	if err != nil {
 		logrus.Errorf("failed to marshal meta data: %v", err)
 		f.Write(c, nil, 500, 0, "")
-		return
+		return nil, false
 	}
 
-	metaFilePath := path.Join(cacheDirPath, "meta.json")
-	if err := ioutil.WriteFile(metaFilePath, metaData, 0644); err != nil {
+	if err := metas().write(MetaRecordSession, fileId, metaData); err != nil {
 		logrus.Errorf("failed to write meta data to file: %v", err)
 		f.Write(c, nil, 500, 0, "")
-		return
+		return nil, false
 	}
 
-	f.Write(c, meta, 200, 0, "")
+	result := CreateResult{FileMeta: meta, Preflight: preflight, UploadToken: uploadToken, PartURLs: partURLs}
+	if params.MultiWriter {
+		result.WriterToken = uploadToken
+	}
+	setAffinity(c, &meta)
+	return &result, true
 }
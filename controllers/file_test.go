@@ -1,29 +1,51 @@
 package controllers_test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/processor"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/storage/s3test"
 	"github.com/louis-she/simple-uploader/utils"
+	"github.com/louis-she/simple-uploader/wasm/wasmtest"
 
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/thanhpk/randstr"
 )
 
 var r *gin.Engine
@@ -42,11 +64,11 @@ func TestMain(m *testing.M) {
 	r = gin.New()
 	controllers.Attach(r, "/")
 
-	m.Run()
+	code := m.Run()
 	// remove all temp files
 	logrus.Debug("remove all test directory")
 	os.RemoveAll("/tmp/golang_test_dev")
-	os.Exit(0)
+	os.Exit(code)
 }
 
 func prepareContext(req *http.Request) (*gin.Context, *httptest.ResponseRecorder) {
@@ -109,6 +131,26 @@ func createRandomFile(fileSize int64, chunkSize int64) (*os.File, controllers.Fi
 }
 
 func uploadSlice(slice int64, meta controllers.FileMeta, file *os.File, assert *assert.Assertions, v string) *httptest.ResponseRecorder {
+	c, w := prepareContext(newSliceRequest(slice, meta, file, v))
+	r.HandleContext(c)
+	assert.True(w.Code == http.StatusOK || w.Code == http.StatusPartialContent)
+
+	return w
+}
+
+func newSliceRequest(slice int64, meta controllers.FileMeta, file *os.File, v string) *http.Request {
+	sliceChunkSize := utils.Min(meta.FileSize-int64(slice)*meta.ChunkSize, meta.ChunkSize)
+
+	buf := make([]byte, sliceChunkSize)
+	fileReader, _ := os.Open(file.Name())
+	defer fileReader.Close()
+	offset := slice * meta.ChunkSize
+	fileReader.Seek(offset, 0)
+	io.ReadFull(fileReader, buf)
+	return newSliceDataRequest(slice, meta, file.Name(), buf, v)
+}
+
+func newSliceDataRequest(slice int64, meta controllers.FileMeta, name string, data []byte, v string) *http.Request {
 	multipartBody := &bytes.Buffer{}
 	writer := multipart.NewWriter(multipartBody)
 	writer.WriteField("file_id", meta.FileId)
@@ -118,17 +160,9 @@ func uploadSlice(slice int64, meta controllers.FileMeta, file *os.File, assert *
 	writer.WriteField("file_size", strconv.FormatInt(meta.FileSize, 10))
 	writer.WriteField("slice_id", strconv.FormatInt(slice, 10))
 	writer.WriteField("created_at", strconv.FormatInt(meta.CreatedAt, 10))
-	writer.WriteField("status", strconv.Itoa(meta.Status))
-
-	fileWriter, _ := writer.CreateFormFile("file", file.Name())
-	sliceChunkSize := utils.Min(meta.FileSize-int64(slice)*meta.ChunkSize, meta.ChunkSize)
 
-	buf := make([]byte, sliceChunkSize)
-	fileReader, _ := os.Open(file.Name())
-	offset := slice * meta.ChunkSize
-	fileReader.Seek(offset, 0)
-	io.ReadFull(fileReader, buf)
-	io.Copy(fileWriter, bytes.NewReader(buf))
+	fileWriter, _ := writer.CreateFormFile("file", name)
+	fileWriter.Write(data)
 	writer.Close()
 	var path string
 	if v == "v2" {
@@ -138,12 +172,7 @@ func uploadSlice(slice int64, meta controllers.FileMeta, file *os.File, assert *
 	}
 	req, _ := http.NewRequest("POST", path, multipartBody)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	c, w := prepareContext(req)
-	r.HandleContext(c)
-	assert.True(w.Code == http.StatusOK || w.Code == http.StatusPartialContent)
-
-	return w
+	return req
 }
 
 func TestCreateFileNoArgs(t *testing.T) {
@@ -253,7 +282,7 @@ func TestCreateFileValid(t *testing.T) {
 	assert.Equal(params.FileType, responseFileMeta.FileType)
 	assert.Equal(params.FileSize, responseFileMeta.FileSize)
 	assert.Equal(params.ChunkSize, responseFileMeta.ChunkSize)
-	assert.Equal(responseFileMeta.Status, 0)
+	assert.Equal(controllers.StateCreated, responseFileMeta.State)
 	assert.Less(time.Now().Unix()-responseFileMeta.CreatedAt, int64(4))
 	assert.GreaterOrEqual(time.Now().Unix()-responseFileMeta.CreatedAt, int64(0))
 	assert.NotEmpty(responseFileMeta.FileId)
@@ -268,7 +297,7 @@ func TestCreateFileValid(t *testing.T) {
 	assert.Equal(params.FileSize, fileMeta.FileSize)
 	assert.Equal(params.ChunkSize, fileMeta.ChunkSize)
 	assert.Equal(responseFileMeta.FileId, fileMeta.FileId)
-	assert.Equal(responseFileMeta.Status, fileMeta.Status)
+	assert.Equal(responseFileMeta.State, fileMeta.State)
 	assert.Equal(responseFileMeta.CreatedAt, fileMeta.CreatedAt)
 	assert.Equal(len(fileMeta.Slices), 1024)
 }
@@ -300,7 +329,7 @@ func TestCreateFileValidV2(t *testing.T) {
 	assert.Equal(params.FileType, responseFileMeta.FileType)
 	assert.Equal(params.FileSize, responseFileMeta.FileSize)
 	assert.Equal(params.ChunkSize, responseFileMeta.ChunkSize)
-	assert.Equal(responseFileMeta.Status, 0)
+	assert.Equal(controllers.StateCreated, responseFileMeta.State)
 	assert.Less(time.Now().Unix()-responseFileMeta.CreatedAt, int64(4))
 	assert.GreaterOrEqual(time.Now().Unix()-responseFileMeta.CreatedAt, int64(0))
 	assert.NotEmpty(responseFileMeta.FileId)
@@ -315,7 +344,7 @@ func TestCreateFileValidV2(t *testing.T) {
 	assert.Equal(params.FileSize, fileMeta.FileSize)
 	assert.Equal(params.ChunkSize, fileMeta.ChunkSize)
 	assert.Equal(responseFileMeta.FileId, fileMeta.FileId)
-	assert.Equal(responseFileMeta.Status, fileMeta.Status)
+	assert.Equal(responseFileMeta.State, fileMeta.State)
 	assert.Equal(responseFileMeta.CreatedAt, fileMeta.CreatedAt)
 	assert.Equal(len(fileMeta.Slices), 1024)
 }
@@ -463,7 +492,7 @@ func TestFildUploadMultipleSlices(t *testing.T) {
 			file.Read(fileContent)
 			sha1Sum := sha1.Sum(fileContent)
 			sha1Hex := hex.EncodeToString(sha1Sum[:])
-			cacheSlicePath := path.Join(slicesDir, responseMeta.FileName+"."+strconv.Itoa(i)+"."+sha1Hex+".slice")
+			cacheSlicePath := path.Join(slicesDir, strconv.Itoa(i/1000), responseMeta.FileName+"."+strconv.Itoa(i)+"."+sha1Hex+".slice")
 			assert.FileExists(cacheSlicePath)
 		} else {
 			destFilePath := path.Join(viper.GetString("uploader.upload_dir"), responseMeta.FileName)
@@ -531,6 +560,30 @@ func TestFildUploadMultipleSlicesV2(t *testing.T) {
 	logrus.Debug("OK")
 }
 
+func TestSliceSharding(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.slice_shard_size", 2)
+	defer viper.Set("uploader.slice_shard_size", nil)
+
+	file, meta := createRandomFile(5*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	assert.Equal(int64(2), meta.SliceShard)
+
+	slicesDir := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId)
+	for _, i := range []int{4, 0, 3, 1} {
+		uploadSlice(int64(i), meta, file, assert, "v1")
+		matches, _ := filepath.Glob(path.Join(slicesDir, strconv.Itoa(i/2), meta.FileName+"."+strconv.Itoa(i)+".*.slice"))
+		assert.Len(matches, 1)
+	}
+	w := uploadSlice(2, meta, file, assert, "v1")
+	assert.Equal(http.StatusOK, w.Code)
+
+	original, _ := os.ReadFile(file.Name())
+	stored, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.True(bytes.Equal(original, stored))
+	assert.NoDirExists(slicesDir)
+}
+
 func TestFileUploadInteruptResume(t *testing.T) {
 	assert := assert.New(t)
 	file, responseMeta := createRandomFile(0, 0)
@@ -586,6 +639,144 @@ func TestFileUploadInteruptResume(t *testing.T) {
 	assert.Equal(localSha1Hex, serverSha1Hex)
 }
 
+func TestFileUploadClientGone(t *testing.T) {
+	assert := assert.New(t)
+	file, responseMeta := createRandomFile(0, 0)
+	defer os.Remove(file.Name())
+
+	last := int64(len(responseMeta.Slices) - 1)
+	for i := int64(0); i < last; i++ {
+		uploadSlice(i, responseMeta, file, assert, "v1")
+	}
+
+	// the client hangs up while sending the last slice
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, w := prepareContext(newSliceRequest(last, responseMeta, file, "v1").WithContext(ctx))
+	r.HandleContext(c)
+	assert.Equal(499, w.Code)
+
+	req, _ := http.NewRequest("GET", "/files/"+responseMeta.FileId+"/meta", nil)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	var meta controllers.FileMeta
+	var response controllers.Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	assert.Equal(0, meta.Slices[strconv.FormatInt(last, 10)].Status)
+	destFilePath := path.Join(viper.GetString("uploader.upload_dir"), responseMeta.FileName)
+	assert.NoFileExists(destFilePath)
+
+	// sent again, it completes the file
+	w = uploadSlice(last, responseMeta, file, assert, "v1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.FileExists(destFilePath)
+}
+
+func TestFileUploadDiskFull(t *testing.T) {
+	assert := assert.New(t)
+	file, responseMeta := createRandomFile(0, 0)
+	defer os.Remove(file.Name())
+	sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), responseMeta.FileId)
+	// every slice opens the target file again
+	viper.Set("uploader.open_target_files", 0)
+	defer viper.Set("uploader.open_target_files", nil)
+
+	slice := func() controllers.Slice {
+		req, _ := http.NewRequest("GET", "/files/"+responseMeta.FileId+"/meta", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var meta controllers.FileMeta
+		var response controllers.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return meta.Slices["0"]
+	}
+
+	// writes to the target file fail as on a full disk
+	uploadSlice(0, responseMeta, file, assert, "v2")
+	assert.Equal(1, slice().Status)
+	partial := path.Join(sliceDir, responseMeta.FileName+".part")
+	os.Remove(partial)
+	os.Symlink("/dev/full", partial)
+	c, w := prepareContext(newSliceRequest(0, responseMeta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusInsufficientStorage, w.Code)
+	assert.NotEmpty(w.Header().Get("Retry-After"))
+	failed := slice()
+	assert.Equal(0, failed.Status)
+	assert.Equal("insufficient storage", failed.Error)
+	assert.Equal(2, failed.Attempts)
+
+	// once there is room again the slice is taken
+	os.Remove(partial)
+	uploadSlice(0, responseMeta, file, assert, "v2")
+	uploaded := slice()
+	assert.Equal(1, uploaded.Status)
+	assert.Empty(uploaded.Error)
+	assert.Equal(3, uploaded.Attempts)
+	assert.Equal(responseMeta.ChunkSize, uploaded.Size)
+	assert.NotZero(uploaded.ReceivedAt)
+}
+
+func TestFileUploadShortSlice(t *testing.T) {
+	assert := assert.New(t)
+	file, responseMeta := createRandomFile(0, 0)
+	defer os.Remove(file.Name())
+
+	last := int64(len(responseMeta.Slices) - 1)
+	for i := int64(0); i < last; i++ {
+		uploadSlice(i, responseMeta, file, assert, "v1")
+	}
+	// a slice file lost its tail on disk
+	sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), responseMeta.FileId)
+	names, _ := filepath.Glob(path.Join(sliceDir, "0", responseMeta.FileName+".0.*.slice"))
+	if !assert.Len(names, 1) {
+		return
+	}
+	os.Truncate(names[0], responseMeta.ChunkSize-1)
+
+	c, w := prepareContext(newSliceRequest(last, responseMeta, file, "v1"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.NoFileExists(path.Join(viper.GetString("uploader.upload_dir"), responseMeta.FileName))
+}
+
+func TestFileStates(t *testing.T) {
+	assert := assert.New(t)
+	file, responseMeta := createRandomFile(0, 0)
+	defer os.Remove(file.Name())
+	assert.Equal(controllers.StateCreated, responseMeta.State)
+
+	meta := func() controllers.FileMeta {
+		req, _ := http.NewRequest("GET", "/files/"+responseMeta.FileId+"/meta", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var meta controllers.FileMeta
+		var response controllers.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return meta
+	}
+	uploadSlice(0, responseMeta, file, assert, "v1")
+	assert.Equal(controllers.StateUploading, meta().State)
+	for i := 1; i < len(responseMeta.Slices); i++ {
+		uploadSlice(int64(i), responseMeta, file, assert, "v1")
+	}
+
+	completed := meta()
+	assert.Equal(controllers.StateComplete, completed.State)
+	var states []controllers.FileState
+	for _, change := range completed.History {
+		states = append(states, change.State)
+		assert.GreaterOrEqual(change.At, completed.CreatedAt)
+	}
+	assert.Equal([]controllers.FileState{
+		controllers.StateCreated, controllers.StateUploading, controllers.StateMerging,
+		controllers.StateVerifying, controllers.StateComplete,
+	}, states)
+}
+
 func TestFileUploadInteruptResumeV2(t *testing.T) {
 	assert := assert.New(t)
 	file, responseMeta := createRandomFile(0, 0)
@@ -640,3 +831,3225 @@ func TestFileUploadInteruptResumeV2(t *testing.T) {
 	serverSha1Hex := hex.EncodeToString(serverSha1Sum[:])
 	assert.Equal(localSha1Hex, serverSha1Hex)
 }
+
+func TestMetadataMigrationResume(t *testing.T) {
+	assert := assert.New(t)
+	// the migration moves every meta, keep it to the ones of this test
+	cacheDir, metaDir := viper.GetString("uploader.slice_cache_dir"), viper.GetString("uploader.metafile_dir")
+	viper.Set("uploader.slice_cache_dir", t.TempDir())
+	viper.Set("uploader.metafile_dir", t.TempDir())
+	defer viper.Set("uploader.slice_cache_dir", cacheDir)
+	defer viper.Set("uploader.metafile_dir", metaDir)
+	// the session is read from the store again, not from memory
+	viper.Set("uploader.session_cache.idle", time.Nanosecond)
+	defer viper.Set("uploader.session_cache.idle", 0)
+
+	file, responseMeta := createRandomFile(0, 0)
+	defer os.Remove(file.Name())
+	uploadSlice(0, responseMeta, file, assert, "v1")
+
+	viper.Set("uploader.metadata", map[string]interface{}{"driver": "bolt", "path": path.Join(t.TempDir(), "metadata.db")})
+	defer viper.Set("uploader.metadata", map[string]interface{}{})
+	defer controllers.CloseMetadata()
+	migrated, err := controllers.MigrateMetadata()
+	assert.Nil(err)
+	assert.Equal(1, migrated.Sessions)
+
+	metaFile := path.Join(viper.GetString("uploader.slice_cache_dir"), responseMeta.FileId, "meta.json")
+	assert.NoFileExists(metaFile)
+	var tombstone map[string]interface{}
+	content, _ := os.ReadFile(metaFile + ".migrated")
+	assert.Nil(json.Unmarshal(content, &tombstone))
+	assert.Equal("bolt", tombstone["driver"])
+
+	// migrating again finds nothing to move
+	migrated, err = controllers.MigrateMetadata()
+	assert.Nil(err)
+	assert.Equal(0, migrated.Sessions)
+
+	for slice := int64(1); slice < 4; slice++ {
+		uploadSlice(slice, responseMeta, file, assert, "v1")
+	}
+	destFilePath := path.Join(viper.GetString("uploader.upload_dir"), responseMeta.FileName)
+	serverBytes, _ := os.ReadFile(destFilePath)
+	localBytes, _ := os.ReadFile(file.Name())
+	assert.Equal(sha1.Sum(localBytes), sha1.Sum(serverBytes))
+
+	req, _ := http.NewRequest("GET", "/files/"+responseMeta.FileId+"/meta", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NoFileExists(path.Join(viper.GetString("uploader.metafile_dir"), responseMeta.FileId+".meta.json"))
+}
+
+func TestFileUploadWormPrefix(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "worm_prefix", "worm_retention": "1h"},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	file := generateRandomLargeFile(1024 * 1024)
+	defer os.Remove(file.Name())
+	fileStat, _ := os.Stat(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  fileStat.Size(),
+		ChunkSize: 1024 * 1024,
+		Prefix:    "worm_prefix/sub",
+	}
+
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+
+	var response controllers.Response
+	var responseMeta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &responseMeta)
+	w = uploadSlice(0, responseMeta, file, assert, "v2")
+	assert.Equal(http.StatusOK, w.Code)
+
+	// the same name can not be uploaded again within the retention
+	req, _ = http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusConflict, w.Code)
+}
+
+func TestResumeByFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	file := generateRandomLargeFile(2 * 1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:    filepath.Base(file.Name()),
+		FileType:    "text/plain",
+		FileSize:    2 * 1024 * 1024,
+		ChunkSize:   1024 * 1024,
+		Fingerprint: "fingerprint-" + filepath.Base(file.Name()),
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+
+	resume := func() []controllers.FileMeta {
+		req, _ := http.NewRequest("GET", "/files/resume?fingerprint="+params.Fingerprint, nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var sessions []controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &sessions)
+		return sessions
+	}
+
+	uploadSlice(0, meta, file, assert, "v2")
+	sessions := resume()
+	assert.Len(sessions, 1)
+	assert.Equal(meta.FileId, sessions[0].FileId)
+	assert.Equal(1, sessions[0].Slices["0"].Status)
+
+	uploadSlice(1, meta, file, assert, "v2")
+	assert.Len(resume(), 0)
+}
+
+func TestProbeSlice(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+
+	probe := func(sliceId string) (*httptest.ResponseRecorder, controllers.Slice) {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/slices/"+sliceId, nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var slice controllers.Slice
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &slice)
+		return w, slice
+	}
+
+	w, slice := probe("0")
+	assert.Equal(http.StatusOK, w.Code)
+	sliceContent := make([]byte, 1024*1024)
+	file.ReadAt(sliceContent, 0)
+	sha1Sum := sha1.Sum(sliceContent)
+	assert.Equal(hex.EncodeToString(sha1Sum[:]), slice.Sha1)
+
+	w, _ = probe("1")
+	assert.Equal(http.StatusNotFound, w.Code)
+	w, _ = probe("2")
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestMetaBitmapFormat(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(4*1024*1024-100, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	uploadSlice(2, meta, file, assert, "v2")
+
+	req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/meta?format=bitmap&hashes=1", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+
+	var response controllers.Response
+	var bitmapMeta controllers.BitmapFileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &bitmapMeta)
+	assert.Equal(meta.FileId, bitmapMeta.FileId)
+	assert.Equal(4, bitmapMeta.SliceCount)
+	assert.Equal("oA==", bitmapMeta.SlicesBitmap)
+	assert.Len(bitmapMeta.SliceHashes, 4)
+	assert.NotEmpty(bitmapMeta.SliceHashes[0])
+	assert.Empty(bitmapMeta.SliceHashes[1])
+	assert.NotEmpty(bitmapMeta.SliceHashes[2])
+	assert.NotContains(string(response.Data), `"slices"`)
+}
+
+func TestSlicesPagination(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(5*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(1, meta, file, assert, "v2")
+	uploadSlice(3, meta, file, assert, "v2")
+
+	list := func(query string) (*httptest.ResponseRecorder, controllers.SlicesPage) {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/slices?"+query, nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var page controllers.SlicesPage
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &page)
+		return w, page
+	}
+
+	w, page := list("")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(5, page.Total)
+	assert.Len(page.Slices, 5)
+
+	_, page = list("status=pending&offset=1&limit=1")
+	assert.Equal(3, page.Total)
+	assert.Len(page.Slices, 1)
+	assert.Equal("2", page.Slices[0].Id)
+
+	_, page = list("status=uploaded")
+	assert.Equal(2, page.Total)
+	assert.Equal("1", page.Slices[0].Id)
+	assert.Equal("3", page.Slices[1].Id)
+
+	w, _ = list("status=unknown")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	w, _ = list("limit=100000")
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func uploadBatch(sliceIds []int64, meta controllers.FileMeta, file *os.File) *httptest.ResponseRecorder {
+	multipartBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(multipartBody)
+	writer.WriteField("chunk_size", strconv.FormatInt(meta.ChunkSize, 10))
+	writer.WriteField("file_type", meta.FileType)
+	writer.WriteField("file_name", meta.FileName)
+	writer.WriteField("file_size", strconv.FormatInt(meta.FileSize, 10))
+	for _, slice := range sliceIds {
+		fileWriter, _ := writer.CreateFormFile(strconv.FormatInt(slice, 10), file.Name())
+		buf := make([]byte, utils.Max(0, utils.Min(meta.FileSize-slice*meta.ChunkSize, meta.ChunkSize)))
+		file.ReadAt(buf, slice*meta.ChunkSize)
+		fileWriter.Write(buf)
+	}
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", "/files/"+meta.FileId+"/upload_batch", multipartBody)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	return w
+}
+
+func TestFileUploadBatch(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(3*1024*1024-10, 1024*1024)
+	defer os.Remove(file.Name())
+
+	w := uploadBatch([]int64{1, 0, 9}, meta, file)
+	assert.Equal(http.StatusPartialContent, w.Code)
+	var response controllers.Response
+	var results []controllers.BatchSliceResult
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &results)
+	assert.Equal([]controllers.BatchSliceResult{
+		{SliceId: "0", Code: 200},
+		{SliceId: "1", Code: 200},
+		{SliceId: "9", Code: 400, Message: "unknown slice", Error: "unknown_slice"},
+	}, results)
+
+	w = uploadBatch([]int64{2}, meta, file)
+	assert.Equal(http.StatusOK, w.Code)
+
+	localBytes, _ := os.ReadFile(file.Name())
+	serverBytes, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.Equal(sha1.Sum(localBytes), sha1.Sum(serverBytes))
+}
+
+func TestChunkSizeRecommendation(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.adaptive_chunk.max", 2*1024*1024)
+	defer viper.Set("uploader.adaptive_chunk.max", 0)
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	w := uploadSlice(0, meta, file, assert, "v2")
+	assert.Equal(http.StatusPartialContent, w.Code)
+
+	var response controllers.Response
+	var recommendation controllers.ChunkSizeRecommendation
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &recommendation)
+	assert.GreaterOrEqual(recommendation.Samples, 1)
+	assert.Greater(recommendation.Throughput, float64(0))
+
+	req, _ := http.NewRequest("GET", "/files/chunk_size", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &recommendation)
+	assert.GreaterOrEqual(recommendation.RecommendedChunkSize, int64(1024*1024))
+	assert.LessOrEqual(recommendation.RecommendedChunkSize, int64(2*1024*1024))
+}
+
+func TestPrefixStorageOverride(t *testing.T) {
+	assert := assert.New(t)
+	root := "/tmp/golang_test_dev/override_root"
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "override", "chunk_size": 2 * 1024 * 1024, "storage": map[string]interface{}{"driver": "local", "root": root}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	file := generateRandomLargeFile(3 * 1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  3 * 1024 * 1024,
+		ChunkSize: 1024 * 1024,
+		Prefix:    "override/videos",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	assert.Equal(http.StatusOK, w.Code)
+
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	assert.Equal(int64(2*1024*1024), meta.ChunkSize)
+	assert.Len(meta.Slices, 2)
+	assert.Equal("local", meta.Storage.Driver)
+	assert.Equal(root, meta.Storage.Root)
+
+	// later config changes do not affect the recorded session
+	viper.Set("uploader.prefixes", nil)
+	uploadSlice(0, meta, file, assert, "v1")
+	uploadSlice(1, meta, file, assert, "v1")
+	assert.FileExists(path.Join(root, "override/videos", meta.FileName))
+	assert.NoFileExists(path.Join(viper.GetString("uploader.upload_dir"), "override/videos", meta.FileName))
+}
+
+func TestDirectUpload(t *testing.T) {
+	assert := assert.New(t)
+	server := s3test.NewServer()
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "direct", "direct_upload": true, "storage": map[string]interface{}{
+			"driver": "s3", "root": "bucket", "options": map[string]interface{}{"endpoint": server.URL},
+		}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	file := generateRandomLargeFile(6 * 1024 * 1024)
+	defer os.Remove(file.Name())
+	content, _ := os.ReadFile(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  6 * 1024 * 1024,
+		ChunkSize: 5 * 1024 * 1024,
+		Prefix:    "direct",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var result controllers.CreateResult
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &result)
+	if !assert.Len(result.PartURLs, 2) {
+		return
+	}
+	meta := result.FileMeta
+
+	putPart := func(i int) {
+		end := (i + 1) * 5 * 1024 * 1024
+		if end > len(content) {
+			end = len(content)
+		}
+		req, _ := http.NewRequest("PUT", result.PartURLs[i], bytes.NewReader(content[i*5*1024*1024:end]))
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(err) {
+			resp.Body.Close()
+			assert.Equal(http.StatusOK, resp.StatusCode)
+		}
+	}
+	complete := func() (*httptest.ResponseRecorder, controllers.Response) {
+		req, _ := http.NewRequest("POST", "/files/"+meta.FileId+"/complete", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	putPart(0)
+	w, response = complete()
+	assert.Equal(http.StatusConflict, w.Code)
+	assert.Equal("slices_missing", response.Error)
+	assert.JSONEq(`["1"]`, string(response.Data))
+	// the slices don't go through the uploader
+	c, w := prepareContext(newSliceRequest(1, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusConflict, w.Code)
+
+	putPart(1)
+	w, _ = complete()
+	assert.Equal(http.StatusOK, w.Code)
+	stored, _ := server.Object("bucket/direct/" + meta.FileName)
+	assert.True(bytes.Equal(content, stored))
+	w, response = complete()
+	assert.Equal(http.StatusConflict, w.Code)
+	assert.Equal("file_completed", response.Error)
+
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusFound, w.Code)
+	assert.True(strings.HasPrefix(w.Header().Get("Location"), server.URL+"/bucket/direct/"+meta.FileName+"?"))
+}
+
+func TestStoragePlacement(t *testing.T) {
+	assert := assert.New(t)
+	server := s3test.NewServer()
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	prefix := "hybrid-" + randstr.Hex(8)
+	root := t.TempDir()
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": prefix, "placement": []map[string]interface{}{
+			{"max_size": 1024 * 1024, "storage": map[string]interface{}{"driver": "local", "root": root}},
+			{"storage": map[string]interface{}{"driver": "s3", "root": "bucket", "options": map[string]interface{}{"endpoint": server.URL}}},
+		}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	contents := map[string][]byte{}
+	metas := map[string]controllers.FileMeta{}
+	for _, size := range []int64{512 * 1024, 2 * 1024 * 1024} {
+		file := generateRandomLargeFile(size)
+		defer os.Remove(file.Name())
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  size,
+			ChunkSize: 1024 * 1024,
+			Prefix:    prefix,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		for i := range meta.Slices {
+			index, _ := strconv.ParseInt(i, 10, 64)
+			uploadSlice(index, meta, file, assert, "v2")
+		}
+		contents[meta.FileName], _ = os.ReadFile(file.Name())
+		metas[meta.Storage.Driver] = meta
+	}
+
+	small, large := metas["local"], metas["s3"]
+	assert.FileExists(path.Join(root, prefix, small.FileName))
+	stored, _ := server.Object("bucket/" + prefix + "/" + large.FileName)
+	assert.True(bytes.Equal(contents[large.FileName], stored))
+
+	download := func(meta controllers.FileMeta) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	assert.Equal(http.StatusOK, download(small).Code)
+	assert.Equal(http.StatusFound, download(large).Code)
+
+	// archives read both storages
+	req, _ := http.NewRequest("GET", "/prefixes/"+prefix+"/archive.tar.gz", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	gzipReader, err := gzip.NewReader(w.Body)
+	if !assert.NoError(err) {
+		return
+	}
+	tarReader := tar.NewReader(gzipReader)
+	archived := map[string][]byte{}
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			break
+		}
+		archived[header.Name], _ = io.ReadAll(tarReader)
+	}
+	assert.Equal(contents, archived)
+}
+
+func TestStorageRetry(t *testing.T) {
+	assert := assert.New(t)
+	server := s3test.NewServer()
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "retried", "storage": map[string]interface{}{"driver": "s3", "root": "bucket", "options": map[string]interface{}{"endpoint": server.URL}}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+	viper.Set("uploader.storage_retry.base_delay", "1ms")
+	defer viper.Set("uploader.storage_retry.base_delay", nil)
+
+	file := generateRandomLargeFile(1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  1024 * 1024,
+		ChunkSize: 1024 * 1024,
+		Prefix:    "retried",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+
+	// the first two puts of the file are throttled
+	server.Fail(2, http.StatusServiceUnavailable)
+	w = uploadSlice(0, meta, file, assert, "v2")
+	assert.Equal(http.StatusOK, w.Code)
+	_, ok := server.Object("bucket/retried/" + meta.FileName)
+	assert.True(ok)
+}
+
+func TestReplication(t *testing.T) {
+	assert := assert.New(t)
+	server := s3test.NewServer()
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	// the local replica can't be written while a file is at its root
+	lagging := filepath.Join(t.TempDir(), "replica")
+	os.WriteFile(lagging, nil, 0644)
+	prefix := "replicated-" + randstr.Hex(8)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": prefix, "replicas": []map[string]interface{}{
+			{"driver": "s3", "root": "bucket", "options": map[string]interface{}{"endpoint": server.URL}},
+			{"driver": "local", "root": lagging},
+		}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controllers.StartReplication(ctx)
+
+	file := generateRandomLargeFile(1024 * 1024)
+	defer os.Remove(file.Name())
+	content, _ := os.ReadFile(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  1024 * 1024,
+		ChunkSize: 1024 * 1024,
+		Prefix:    prefix,
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	assert.Len(meta.Replicas, 2)
+
+	w = uploadSlice(0, meta, file, assert, "v2")
+	assert.Equal(http.StatusOK, w.Code)
+	readMeta := func() controllers.FileMeta {
+		var completed controllers.FileMeta
+		data, _ := os.ReadFile(path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".meta.json"))
+		json.Unmarshal(data, &completed)
+		return completed
+	}
+	completed := readMeta()
+	if !assert.Len(completed.Replicas, 2) {
+		return
+	}
+	// the completion leaves the copies to the replication worker
+	assert.Equal(controllers.ReplicaPending, completed.Replicas[0].State)
+	assert.Eventually(func() bool {
+		completed = readMeta()
+		return len(completed.Replicas) == 2 && completed.Replicas[1].Attempts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(controllers.ReplicaDone, completed.Replicas[0].State)
+	object, _ := server.Object("bucket/" + prefix + "/" + meta.FileName)
+	assert.Equal(content, object)
+	assert.Equal(controllers.ReplicaPending, completed.Replicas[1].State)
+	assert.Equal(1, completed.Replicas[1].Attempts)
+	assert.NotEmpty(completed.Replicas[1].Error)
+	assert.FileExists(filepath.Join(viper.GetString("uploader.metafile_dir"), "replication", meta.FileId))
+
+	// the lagging replica catches up once it can be written
+	os.Remove(lagging)
+	c, w := prepareContext(adminRequest("POST", "/admin/replicate"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), meta.FileId)
+	completed = readMeta()
+	assert.Equal(controllers.ReplicaDone, completed.Replicas[1].State)
+	assert.Empty(completed.Replicas[1].Error)
+	// the worker only reads the metas of the files queued
+	assert.NoFileExists(filepath.Join(viper.GetString("uploader.metafile_dir"), "replication", meta.FileId))
+	replicated, _ := os.ReadFile(filepath.Join(lagging, prefix, meta.FileName))
+	assert.Equal(content, replicated)
+
+	// erasing the file erases its replicas
+	c, w = prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(2, strings.Count(w.Body.String(), `"kind":"replica"`))
+	_, ok := server.Object("bucket/" + prefix + "/" + meta.FileName)
+	assert.False(ok)
+	assert.NoFileExists(filepath.Join(lagging, prefix, meta.FileName))
+}
+
+func TestStorageBreaker(t *testing.T) {
+	assert := assert.New(t)
+	server := s3test.NewServer()
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "guarded", "storage": map[string]interface{}{"driver": "s3", "root": "bucket", "options": map[string]interface{}{"endpoint": server.URL}}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+	viper.Set("uploader.storage_retry.attempts", 1)
+	defer viper.Set("uploader.storage_retry.attempts", nil)
+	viper.Set("uploader.storage_breaker.threshold", 1)
+	viper.Set("uploader.storage_breaker.cooldown", "1m")
+	defer viper.Set("uploader.storage_breaker.threshold", nil)
+	defer viper.Set("uploader.storage_breaker.cooldown", nil)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	file := generateRandomLargeFile(1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  1024 * 1024,
+		ChunkSize: 1024 * 1024,
+		Prefix:    "guarded",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+
+	// the failing put opens the circuit, the next try doesn't reach s3
+	server.Fail(1, http.StatusServiceUnavailable)
+	c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	requests := len(server.Requests())
+	c, w = prepareContext(newSliceRequest(0, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal("60", w.Header().Get("Retry-After"))
+	assert.Len(server.Requests(), requests)
+
+	c, w = prepareContext(adminRequest("GET", "/admin/storage_breakers"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	var breakers []storage.BreakerStatus
+	json.Unmarshal(response.Data, &breakers)
+	states := map[string]string{}
+	for _, breaker := range breakers {
+		states[breaker.Backend] = breaker.State
+	}
+	assert.Equal(storage.BreakerOpen, states["s3:"+server.URL+"/bucket"])
+}
+
+func TestDownloadCache(t *testing.T) {
+	assert := assert.New(t)
+	server := s3test.NewServer()
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "cached", "storage": map[string]interface{}{"driver": "s3", "root": "bucket", "options": map[string]interface{}{"endpoint": server.URL}}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+	viper.Set("uploader.download_cache.dir", t.TempDir())
+	viper.Set("uploader.download_cache.max_size", 3*1024*1024/2)
+	defer viper.Set("uploader.download_cache.dir", nil)
+	defer viper.Set("uploader.download_cache.max_size", nil)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", "")
+
+	upload := func() (controllers.FileMeta, []byte) {
+		file := generateRandomLargeFile(1024 * 1024)
+		defer os.Remove(file.Name())
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  1024 * 1024,
+			ChunkSize: 1024 * 1024,
+			Prefix:    "cached",
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		uploadSlice(0, meta, file, assert, "v2")
+		content, _ := os.ReadFile(file.Name())
+		return meta, content
+	}
+	download := func(meta controllers.FileMeta) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	stats := func() controllers.DownloadCacheStats {
+		c, w := prepareContext(adminRequest("GET", "/admin/download_cache"))
+		r.HandleContext(c)
+		var response controllers.Response
+		var stats controllers.DownloadCacheStats
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &stats)
+		return stats
+	}
+	gets := func(meta controllers.FileMeta) int {
+		count := 0
+		for _, request := range server.Requests() {
+			if request == "GET bucket/cached/"+meta.FileName {
+				count++
+			}
+		}
+		return count
+	}
+
+	first, firstContent := upload()
+	for i := 0; i < 2; i++ {
+		w := download(first)
+		assert.Equal(http.StatusOK, w.Code)
+		assert.True(bytes.Equal(firstContent, w.Body.Bytes()))
+	}
+	assert.Equal(1, gets(first))
+	assert.Equal(controllers.DownloadCacheStats{Hits: 1, Misses: 1, Files: 1, Size: 1024 * 1024, MaxSize: 3 * 1024 * 1024 / 2}, stats())
+
+	// the least recently downloaded file makes room
+	second, _ := upload()
+	assert.Equal(http.StatusOK, download(second).Code)
+	assert.Equal(http.StatusOK, download(first).Code)
+	assert.Equal(2, gets(first))
+	current := stats()
+	assert.Equal(int64(2), current.Evictions)
+	assert.Equal(1, current.Files)
+}
+
+func TestPrefixUnknownStorageDriver(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "unknown_driver", "storage": map[string]interface{}{"driver": "floppy"}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	params := controllers.CreateParams{
+		FileName:  "test.txt",
+		FileType:  "text/plain",
+		FileSize:  1024 * 1024,
+		ChunkSize: 1024 * 1024,
+		Prefix:    "unknown_driver",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+}
+
+func TestFileUploadPublish(t *testing.T) {
+	assert := assert.New(t)
+	hardlinkDir := "/tmp/golang_test_dev/published"
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "publish", "publish": map[string]interface{}{"symlink": "latest", "hardlink_dir": hardlinkDir}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	for i := 0; i < 2; i++ {
+		file := generateRandomLargeFile(1024 * 1024)
+		defer os.Remove(file.Name())
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  1024 * 1024,
+			ChunkSize: 1024 * 1024,
+			Prefix:    "publish",
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		w = uploadSlice(0, meta, file, assert, "v2")
+		assert.Equal(http.StatusOK, w.Code)
+
+		filePath := path.Join(viper.GetString("uploader.upload_dir"), "publish", meta.FileName)
+		target, err := os.Readlink(path.Join(viper.GetString("uploader.upload_dir"), "publish", "latest"))
+		assert.NoError(err)
+		assert.Equal(meta.FileName, target)
+
+		fileInfo, _ := os.Stat(filePath)
+		linkInfo, err := os.Stat(path.Join(hardlinkDir, "publish", meta.FileName))
+		assert.NoError(err)
+		assert.True(os.SameFile(fileInfo, linkInfo))
+	}
+}
+
+func TestFileUploadDoneMarker(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.done_marker", true)
+	defer viper.Set("uploader.done_marker", false)
+
+	for _, v := range []string{"v1", "v2"} {
+		file, meta := createRandomFile(2*1024*1024+1, 1024*1024)
+		defer os.Remove(file.Name())
+		for slice := int64(0); slice < 3; slice++ {
+			uploadSlice(slice, meta, file, assert, v)
+		}
+
+		localBytes, _ := os.ReadFile(file.Name())
+		sha256Sum := sha256.Sum256(localBytes)
+		markerPath := path.Join(viper.GetString("uploader.upload_dir"), meta.FileName+".done")
+		content, err := os.ReadFile(markerPath)
+		assert.NoError(err)
+		var marker controllers.DoneMarker
+		json.Unmarshal(content, &marker)
+		assert.Equal(meta.FileId, marker.FileId)
+		assert.Equal(meta.FileSize, marker.Size)
+		assert.Equal(hex.EncodeToString(sha256Sum[:]), marker.Sha256)
+
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var serverMeta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &serverMeta)
+		assert.Equal(marker.Sha256, serverMeta.Sha256)
+	}
+}
+
+func TestFileUploadProvenance(t *testing.T) {
+	assert := assert.New(t)
+	xattr := runtime.GOOS == "linux"
+	viper.Set("uploader.provenance.xattr", xattr)
+	viper.Set("uploader.provenance.sidecar", true)
+	defer viper.Set("uploader.provenance", nil)
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	uploadSlice(1, meta, file, assert, "v2")
+
+	localBytes, _ := os.ReadFile(file.Name())
+	sha256Sum := sha256.Sum256(localBytes)
+	filePath := path.Join(viper.GetString("uploader.upload_dir"), meta.FileName)
+	content, err := os.ReadFile(filePath + ".meta.json")
+	assert.NoError(err)
+	var provenance controllers.Provenance
+	json.Unmarshal(content, &provenance)
+	assert.Equal(controllers.ProvenanceSchema, provenance.Schema)
+	assert.Equal(meta.FileId, provenance.FileId)
+	assert.Equal(meta.FileSize, provenance.Size)
+	assert.Equal(hex.EncodeToString(sha256Sum[:]), provenance.Sha256)
+	assert.NotZero(provenance.CompletedAt)
+
+	if xattr {
+		value, err := fileio.GetXattr(filePath, "user.simple_uploader.sha256")
+		assert.NoError(err)
+		assert.Equal(provenance.Sha256, string(value))
+		value, _ = fileio.GetXattr(filePath, "user.simple_uploader.file_id")
+		assert.Equal(meta.FileId, string(value))
+	}
+}
+
+func TestFileDownloadDigests(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []string{"v1", "v2"} {
+		file, meta := createRandomFile(2*1024*1024+1, 1024*1024)
+		defer os.Remove(file.Name())
+		for slice := int64(0); slice < 3; slice++ {
+			uploadSlice(slice, meta, file, assert, v)
+		}
+		localBytes, _ := os.ReadFile(file.Name())
+		sha256Sum := sha256.Sum256(localBytes)
+		md5Sum := md5.Sum(localBytes)
+
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal("sha-256="+base64.StdEncoding.EncodeToString(sha256Sum[:]), w.Header().Get("Digest"))
+		assert.Equal("sha-256=:"+base64.StdEncoding.EncodeToString(sha256Sum[:])+":", w.Header().Get("Repr-Digest"))
+		assert.Equal(hex.EncodeToString(sha256Sum[:]), w.Header().Get("X-Checksum-Sha256"))
+		assert.Equal(base64.StdEncoding.EncodeToString(md5Sum[:]), w.Header().Get("Content-MD5"))
+
+		// a range is not the whole body
+		req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		req.Header.Set("Range", "bytes=0-99")
+		c, w = prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusPartialContent, w.Code)
+		assert.NotEmpty(w.Header().Get("Digest"))
+		assert.Empty(w.Header().Get("Content-MD5"))
+	}
+}
+
+func TestFileUploadPrecondition(t *testing.T) {
+	assert := assert.New(t)
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v1")
+	uploadSlice(1, meta, file, assert, "v1")
+
+	req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(etag)
+
+	create := func(header string, value string) (*httptest.ResponseRecorder, controllers.FileMeta) {
+		body, _ := json.Marshal(meta.CreateParams)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		req.Header.Set(header, value)
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var created controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &created)
+		return w, created
+	}
+	w, first := create("If-Match", etag)
+	assert.Equal(http.StatusOK, w.Code)
+	w, second := create("If-Match", etag)
+	assert.Equal(http.StatusOK, w.Code)
+	w, _ = create("If-None-Match", "*")
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+	// the first replaces the file, the second doesn't find the version it
+	// expected anymore
+	uploadSlice(0, first, file, assert, "v1")
+	uploadSlice(1, first, file, assert, "v1")
+	uploadSlice(0, second, file, assert, "v1")
+	c, w = prepareContext(newSliceRequest(1, second, file, "v1"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+	req, _ = http.NewRequest("GET", "/files/"+second.FileId+"/meta", nil)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	var response controllers.Response
+	var secondMeta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &secondMeta)
+	assert.Equal(controllers.StateFailed, secondMeta.State)
+
+	w, _ = create("If-Match", etag)
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+	w, _ = create("If-Unmodified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+	req, _ = http.NewRequest("GET", "/files/"+first.FileId+"/download", nil)
+	req.Header.Set("If-None-Match", etag)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusNotModified, w.Code)
+}
+
+func TestCreatePreflight(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "quota_prefix", "quota": 3 * 1024 * 1024},
+	})
+	viper.Set("uploader.max_chunks", 4)
+	viper.Set("uploader.session_ttl", time.Hour)
+	defer viper.Set("uploader.prefixes", nil)
+	defer viper.Set("uploader.max_chunks", 0)
+	defer viper.Set("uploader.session_ttl", 0)
+
+	create := func(prefix string, fileSize int64, chunkSize int64) (*httptest.ResponseRecorder, controllers.CreateResult) {
+		params := controllers.CreateParams{
+			FileName:  "preflight.txt",
+			FileType:  "text/plain",
+			FileSize:  fileSize,
+			ChunkSize: chunkSize,
+			Prefix:    prefix,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var result controllers.CreateResult
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &result)
+		return w, result
+	}
+
+	w, result := create("quota_prefix/a", 2*1024*1024, 1024*1024)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(int64(3*1024*1024), result.QuotaRemaining)
+	assert.Equal(int64(4), result.MaxChunkCount)
+	assert.InDelta(time.Now().Add(time.Hour).Unix(), result.Deadline, 5)
+	assert.NotEmpty(result.FileId)
+
+	// the in-flight session counts
+	w, result = create("quota_prefix/b", 2*1024*1024, 1024*1024)
+	assert.Equal(http.StatusInsufficientStorage, w.Code)
+	assert.Equal(int64(1024*1024), result.QuotaRemaining)
+
+	w, result = create("", 5*1024*1024, 1024*1024)
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(int64(-1), result.QuotaRemaining)
+}
+
+func TestClaimSlice(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+
+	claim := func(method string, sliceId string, client string) int {
+		req, _ := http.NewRequest(method, "/files/"+meta.FileId+"/slices/"+sliceId+"/claim", nil)
+		req.Header.Set("X-Client-Id", client)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w.Code
+	}
+	claimable := func() int {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/slices?status=claimable", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var page controllers.SlicesPage
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &page)
+		return page.Total
+	}
+
+	assert.Equal(http.StatusBadRequest, claim("POST", "0", ""))
+	assert.Equal(http.StatusNotFound, claim("POST", "5", "a"))
+	assert.Equal(http.StatusOK, claim("POST", "0", "a"))
+	assert.Equal(http.StatusOK, claim("POST", "0", "a"))
+	assert.Equal(http.StatusConflict, claim("POST", "0", "b"))
+	assert.Equal(1, claimable())
+
+	assert.Equal(http.StatusConflict, claim("DELETE", "0", "b"))
+	assert.Equal(http.StatusOK, claim("DELETE", "0", "a"))
+	assert.Equal(2, claimable())
+
+	// an expired claim does not block others
+	viper.Set("uploader.slice_claim_timeout", "1ns")
+	assert.Equal(http.StatusOK, claim("POST", "1", "a"))
+	viper.Set("uploader.slice_claim_timeout", nil)
+	assert.Equal(http.StatusOK, claim("POST", "1", "b"))
+
+	uploadSlice(0, meta, file, assert, "v2")
+	assert.Equal(http.StatusConflict, claim("POST", "0", "a"))
+}
+
+func TestMultiWriterSession(t *testing.T) {
+	assert := assert.New(t)
+	file := generateRandomLargeFile(8 * 1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:    filepath.Base(file.Name()),
+		FileType:    "text/plain",
+		FileSize:    8 * 1024 * 1024,
+		ChunkSize:   1024 * 1024,
+		MultiWriter: true,
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var result controllers.CreateResult
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &result)
+	assert.NotEmpty(result.WriterToken)
+	meta := result.FileMeta
+
+	// without the token
+	c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	// every slice from its own writer, exactly one of them completes the file
+	codes := make(chan int, 8)
+	var wg sync.WaitGroup
+	for i := int64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(slice int64) {
+			defer wg.Done()
+			req := newSliceRequest(slice, meta, file, "v2")
+			req.Header.Set("X-Writer-Token", result.WriterToken)
+			c, w := prepareContext(req)
+			r.HandleContext(c)
+			codes <- w.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	completed := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			completed++
+		} else {
+			assert.Equal(http.StatusPartialContent, code)
+		}
+	}
+	assert.Equal(1, completed)
+
+	content, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	original, _ := os.ReadFile(file.Name())
+	assert.Equal(original, content)
+
+	// late writers can't touch the completed file
+	req = newSliceRequest(3, meta, file, "v2")
+	req.Header.Set("X-Writer-Token", result.WriterToken)
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusConflict, w.Code)
+}
+
+func TestPieces(t *testing.T) {
+	assert := assert.New(t)
+	for _, v := range []string{"v1", "v2"} {
+		file, meta := createRandomFile(3*1024*1024-100, 1024*1024)
+		defer os.Remove(file.Name())
+		original, _ := os.ReadFile(file.Name())
+		uploadSlice(1, meta, file, assert, v)
+
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/pieces", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var info controllers.PieceInfo
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &info)
+		assert.Equal(3, info.PieceCount)
+		assert.Equal("QA==", info.Bitfield)
+		assert.Equal("", info.PieceHashes[0])
+		assert.NotEmpty(info.PieceHashes[1])
+		assert.False(info.Complete)
+
+		piece := func(sliceId string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/pieces/"+sliceId, nil)
+			c, w := prepareContext(req)
+			r.HandleContext(c)
+			return w
+		}
+		assert.Equal(http.StatusNotFound, piece("0").Code)
+		w = piece("1")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal(original[1024*1024:2*1024*1024], w.Body.Bytes())
+		assert.Equal(info.PieceHashes[1], w.Header().Get("X-Piece-Sha1"))
+
+		uploadSlice(0, meta, file, assert, v)
+		uploadSlice(2, meta, file, assert, v)
+		w = piece("2")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal(original[2*1024*1024:], w.Body.Bytes())
+	}
+}
+
+func TestPartialFileName(t *testing.T) {
+	assert := assert.New(t)
+	for _, convention := range []string{"file_name", "file_id"} {
+		viper.Set("uploader.partial_file.name", convention)
+		file, meta := createRandomFile(2*1024*1024, 1024*1024)
+		defer os.Remove(file.Name())
+
+		partial := meta.FileName + ".part"
+		if convention == "file_id" {
+			partial = meta.FileId + ".part"
+		}
+		sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId)
+		destFilePath := path.Join(viper.GetString("uploader.upload_dir"), meta.FileName)
+
+		uploadSlice(0, meta, file, assert, "v2")
+		assert.FileExists(path.Join(sliceDir, partial))
+		assert.NoFileExists(path.Join(sliceDir, meta.FileName))
+		assert.NoFileExists(destFilePath)
+
+		w := uploadSlice(1, meta, file, assert, "v2")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.NoFileExists(path.Join(sliceDir, partial))
+		assert.FileExists(destFilePath)
+	}
+	viper.Set("uploader.partial_file.name", "")
+}
+
+func TestStaging(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.staging", true)
+	defer viper.Set("uploader.staging", false)
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	location := func() controllers.Location {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/location", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var location controllers.Location
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &location)
+		return location
+	}
+
+	uploadSlice(0, meta, file, assert, "v1")
+	assert.Equal(meta.FileName, location().StorageKey)
+	assert.Equal(".staging/"+meta.FileId, location().StagingKey)
+	assert.False(location().Staged)
+
+	w := uploadSlice(1, meta, file, assert, "v1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.FileExists(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.NoFileExists(path.Join(viper.GetString("uploader.upload_dir"), ".staging", meta.FileId))
+	assert.False(location().Staged)
+}
+
+func TestProgressiveDownload(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(3*1024*1024-100, 1024*1024)
+	defer os.Remove(file.Name())
+	original, _ := os.ReadFile(file.Name())
+
+	download := func(rangeHeader string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+
+	// nothing contiguous yet
+	uploadSlice(2, meta, file, assert, "v2")
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, download("").Code)
+
+	uploadSlice(0, meta, file, assert, "v2")
+	w := download("")
+	assert.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal(original[:1024*1024], w.Body.Bytes())
+	assert.Equal(fmt.Sprintf("bytes 0-%d/%d", 1024*1024-1, meta.FileSize), w.Header().Get("Content-Range"))
+
+	w = download("bytes=100-199")
+	assert.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal(original[100:200], w.Body.Bytes())
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, download("bytes=1048576-").Code)
+
+	uploadSlice(1, meta, file, assert, "v2")
+	w = download("")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(original, w.Body.Bytes())
+}
+
+func TestPreview(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.preview.text_bytes", 100)
+	defer viper.Set("uploader.preview.text_bytes", nil)
+
+	preview := func(meta controllers.FileMeta) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/preview", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	original, _ := os.ReadFile(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	assert.Equal(http.StatusNotFound, preview(meta).Code)
+	uploadSlice(1, meta, file, assert, "v2")
+	w := preview(meta)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.GreaterOrEqual(w.Body.Len(), 96)
+	assert.Equal(original[:w.Body.Len()], w.Body.Bytes())
+
+	// configured commands take precedence
+	viper.Set("uploader.preview.commands", []map[string]string{{"type": "text/*", "command": "cp {input} {output}"}})
+	defer viper.Set("uploader.preview.commands", nil)
+	file, meta = createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	original, _ = os.ReadFile(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	w = preview(meta)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(original, w.Body.Bytes())
+	assert.Equal("image/png", w.Header().Get("Content-Type"))
+}
+
+func TestFileUploadSanitize(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "photos", "sanitize": map[string]interface{}{"strip_metadata": true}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, img, nil)
+	exif := append([]byte{0xFF, 0xE1, 0x00, 0x10}, []byte("Exif\x00\x00GPSDATA\x00")...)
+	content := append(append(append([]byte{0xFF, 0xD8}, exif...), encoded.Bytes()[2:]...), []byte("PAYLOAD")...)
+
+	file, _ := os.CreateTemp("", "test")
+	defer os.Remove(file.Name())
+	file.Write(content)
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "image/jpeg",
+		FileSize:  int64(len(content)),
+		ChunkSize: 1024,
+		Prefix:    "photos",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	for i := 0; i < len(meta.Slices); i++ {
+		w = uploadSlice(int64(i), meta, file, assert, "v1")
+	}
+	assert.Equal(http.StatusOK, w.Code)
+
+	stored, err := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), "photos", meta.FileName))
+	assert.NoError(err)
+	assert.False(bytes.Contains(stored, []byte("GPSDATA")))
+	assert.False(bytes.HasSuffix(stored, []byte("PAYLOAD")))
+	_, err = jpeg.Decode(bytes.NewReader(stored))
+	assert.NoError(err)
+
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	assert.Equal("metadata_stripped", meta.Sanitized)
+	assert.Equal(int64(len(stored)), meta.FileSize)
+	sha256Sum := sha256.Sum256(stored)
+	assert.Equal(hex.EncodeToString(sha256Sum[:]), meta.Sha256)
+}
+
+func TestFileUploadConvert(t *testing.T) {
+	assert := assert.New(t)
+	for _, keepOriginal := range []bool{false, true} {
+		viper.Set("uploader.prefixes", []map[string]interface{}{
+			{"prefix": "convert", "convert": []map[string]interface{}{
+				{"type": "text/*", "command": "sort -o {output} {input}", "extension": ".sorted", "file_type": "application/x-sorted", "keep_original": keepOriginal},
+			}},
+		})
+		file := generateRandomLargeFile(1024 * 1024)
+		defer os.Remove(file.Name())
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()) + ".txt",
+			FileType:  "text/plain",
+			FileSize:  1024 * 1024,
+			ChunkSize: 1024 * 1024,
+			Prefix:    "convert",
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		w = uploadSlice(0, meta, file, assert, "v2")
+		assert.Equal(http.StatusOK, w.Code)
+
+		dir := path.Join(viper.GetString("uploader.upload_dir"), "convert")
+		convertedName := filepath.Base(file.Name()) + ".sorted"
+		_, err := os.Stat(path.Join(dir, convertedName))
+		assert.NoError(err)
+		_, err = os.Stat(path.Join(dir, params.FileName))
+		assert.Equal(keepOriginal, err == nil)
+
+		req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		assert.Equal(convertedName, meta.Conversion.ConvertedName)
+		assert.Equal(keepOriginal, meta.Conversion.KeptOriginal)
+		if keepOriginal {
+			assert.Equal(params.FileName, meta.FileName)
+		} else {
+			assert.Equal(convertedName, meta.FileName)
+			assert.Equal("application/x-sorted", meta.FileType)
+		}
+	}
+	viper.Set("uploader.prefixes", nil)
+}
+
+func TestSearch(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.search.index_dir", "/tmp/golang_test_dev/search_index")
+	defer viper.Set("uploader.search.index_dir", nil)
+
+	search := func(query string) controllers.SearchResult {
+		req, _ := http.NewRequest("GET", "/search?q="+url.QueryEscape(query), nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var result controllers.SearchResult
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &result)
+		return result
+	}
+
+	word := "zebra" + randstr.Hex(8)
+	content := []byte("the quick brown fox jumps over the " + word)
+	file, _ := os.CreateTemp("", "test")
+	defer os.Remove(file.Name())
+	file.Write(content)
+	params := controllers.CreateParams{
+		FileName:  "notes-" + randstr.Hex(8) + ".txt",
+		FileType:  "text/plain",
+		FileSize:  int64(len(content)),
+		ChunkSize: 1024,
+		Tags:      []string{"tag" + word},
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	uploadSlice(0, meta, file, assert, "v2")
+
+	for _, query := range []string{word, "tags:tag" + word} {
+		result := search(query)
+		if assert.Equal(uint64(1), result.Total, query) {
+			assert.Equal(meta.FileId, result.Hits[0].FileId)
+			assert.Equal(params.FileName, result.Hits[0].FileName)
+		}
+	}
+
+	// erased files are gone from the index
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.admin_token", nil)
+	c, w := prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(uint64(0), search(word).Total)
+}
+
+func TestDownloadZipEntry(t *testing.T) {
+	assert := assert.New(t)
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	entry, _ := writer.Create("data/train.csv")
+	entry.Write([]byte("a,b\n1,2\n"))
+	writer.Close()
+
+	file, _ := os.CreateTemp("", "test")
+	defer os.Remove(file.Name())
+	file.Write(archive.Bytes())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()) + ".zip",
+		FileType:  "application/zip",
+		FileSize:  int64(archive.Len()),
+		ChunkSize: 1024 * 1024,
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	uploadSlice(0, meta, file, assert, "v2")
+
+	download := func(entry string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download?entry="+url.QueryEscape(entry), nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	w = download("data/train.csv")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("a,b\n1,2\n", w.Body.String())
+	assert.Equal(http.StatusNotFound, download("data/test.csv").Code)
+}
+
+func TestDownloadOffload(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.offload.location", "/protected/")
+	defer viper.Set("uploader.offload.location", nil)
+	defer viper.Set("uploader.offload.header", nil)
+	defer viper.Set("uploader.offload.root", nil)
+
+	file, meta := createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+
+	download := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	viper.Set("uploader.offload.header", "X-Accel-Redirect")
+	w := download()
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("/protected/"+meta.FileName, w.Header().Get("X-Accel-Redirect"))
+	assert.Contains(w.Header().Get("Content-Disposition"), meta.FileName)
+	assert.Zero(w.Body.Len())
+
+	viper.Set("uploader.offload.header", "X-Sendfile")
+	w = download()
+	name, _ := filepath.Abs(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.Equal(name, w.Header().Get("X-Sendfile"))
+	assert.Zero(w.Body.Len())
+
+	// out of root, the file is streamed
+	viper.Set("uploader.offload.header", "X-Accel-Redirect")
+	viper.Set("uploader.offload.root", "/elsewhere")
+	w = download()
+	assert.Empty(w.Header().Get("X-Accel-Redirect"))
+	assert.Equal(int(meta.FileSize), w.Body.Len())
+}
+
+func TestShare(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+
+	share := func(body string) (*httptest.ResponseRecorder, controllers.ShareResult) {
+		req, _ := http.NewRequest("POST", "/files/"+meta.FileId+"/share", strings.NewReader(body))
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var result controllers.ShareResult
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &result)
+		return w, result
+	}
+	w, _ := share("")
+	assert.Equal(http.StatusNotImplemented, w.Code)
+
+	viper.Set("uploader.cdn", map[string]interface{}{"provider": "cloudflare", "base_url": "https://cdn.example.com", "secret": "s3cret", "lifetime": "2h", "ttl": "1h"})
+	defer viper.Set("uploader.cdn", nil)
+	w, _ = share("")
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	uploadSlice(0, meta, file, assert, "v2")
+	w, result := share("")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(strings.HasPrefix(result.URL, "https://cdn.example.com/"+meta.FileName+"?verify="))
+	assert.InDelta(time.Now().Add(time.Hour).Unix(), result.Expires, 5)
+
+	// shorter than the configured ttl only
+	_, result = share(`{"ttl": 60}`)
+	assert.InDelta(time.Now().Add(time.Minute).Unix(), result.Expires, 5)
+	_, result = share(`{"ttl": 86400}`)
+	assert.InDelta(time.Now().Add(time.Hour).Unix(), result.Expires, 5)
+}
+
+func TestPrefixArchive(t *testing.T) {
+	assert := assert.New(t)
+	prefix := "archive-" + randstr.Hex(8)
+	contents := map[string][]byte{}
+	for _, sub := range []string{"", "/sub"} {
+		file := generateRandomLargeFile(1024 * 1024)
+		defer os.Remove(file.Name())
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  1024 * 1024,
+			ChunkSize: 1024 * 1024,
+			Prefix:    prefix + sub,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		uploadSlice(0, meta, file, assert, "v1")
+		contents[strings.TrimPrefix(sub+"/", "/")+params.FileName], _ = os.ReadFile(file.Name())
+	}
+
+	req, _ := http.NewRequest("GET", "/prefixes/"+prefix+"/archive.tar.gz", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+
+	gzipReader, err := gzip.NewReader(w.Body)
+	assert.NoError(err)
+	tarReader := tar.NewReader(gzipReader)
+	archived := map[string][]byte{}
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			break
+		}
+		archived[header.Name], _ = io.ReadAll(tarReader)
+	}
+	assert.Equal(contents, archived)
+}
+
+func TestPrefixChecksums(t *testing.T) {
+	assert := assert.New(t)
+	prefix := "checksums-" + randstr.Hex(8)
+	file := generateRandomLargeFile(1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  1024 * 1024,
+		ChunkSize: 1024 * 1024,
+		Prefix:    prefix + "/sub",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	uploadSlice(0, meta, file, assert, "v2")
+
+	req, _ = http.NewRequest("GET", "/prefixes/"+prefix+"/checksums", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	content, _ := os.ReadFile(file.Name())
+	sum := sha256.Sum256(content)
+	assert.Equal(hex.EncodeToString(sum[:])+"  sub/"+params.FileName+"\n", w.Body.String())
+}
+
+func TestManifestCompletion(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.manifest_completion", true)
+	defer viper.Set("uploader.manifest_completion", false)
+
+	file, meta := createRandomFile(3*1024*1024+100, 1024*1024)
+	defer os.Remove(file.Name())
+	original, _ := os.ReadFile(file.Name())
+	for _, i := range []int64{2, 0, 3} {
+		uploadSlice(i, meta, file, assert, "v1")
+	}
+	w := uploadSlice(1, meta, file, assert, "v1")
+	assert.Equal(http.StatusOK, w.Code)
+
+	sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId)
+	assert.FileExists(path.Join(sliceDir, "manifest"))
+	assert.NoFileExists(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+
+	req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(bytes.Equal(original, w.Body.Bytes()))
+
+	// a range across two slice files
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+	req.Header.Set("Range", "bytes=1048570-1048580")
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal(original[1048570:1048581], w.Body.Bytes())
+
+	c, w = prepareContext(newSliceRequest(1, meta, file, "v1"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusConflict, w.Code)
+}
+
+func TestDurability(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Set("uploader.durability", "")
+	for _, durability := range []string{"none", "complete", "slice"} {
+		viper.Set("uploader.durability", durability)
+		for _, v := range []string{"v1", "v2"} {
+			file, meta := createRandomFile(2*1024*1024, 1024*1024)
+			defer os.Remove(file.Name())
+			uploadSlice(1, meta, file, assert, v)
+			w := uploadSlice(0, meta, file, assert, v)
+			assert.Equal(http.StatusOK, w.Code, durability+" "+v)
+
+			original, _ := os.ReadFile(file.Name())
+			stored, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+			assert.True(bytes.Equal(original, stored), durability+" "+v)
+		}
+	}
+}
+
+func TestOpenTargetFiles(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Set("uploader.open_target_files", nil)
+	for _, limit := range []int{0, 1, 256} {
+		viper.Set("uploader.open_target_files", limit)
+		// interleave two sessions, with a limit of one they keep evicting
+		// each other
+		first, firstMeta := createRandomFile(3*1024*1024, 1024*1024)
+		defer os.Remove(first.Name())
+		second, secondMeta := createRandomFile(3*1024*1024, 1024*1024)
+		defer os.Remove(second.Name())
+		for i := int64(0); i < 3; i++ {
+			uploadSlice(i, firstMeta, first, assert, "v2")
+			uploadSlice(2-i, secondMeta, second, assert, "v2")
+		}
+
+		for _, file := range []*os.File{first, second} {
+			original, _ := os.ReadFile(file.Name())
+			stored, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), filepath.Base(file.Name())))
+			assert.True(bytes.Equal(original, stored))
+		}
+	}
+}
+
+func TestSessionDeadline(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.session_ttl", time.Hour)
+	defer viper.Set("uploader.session_ttl", 0)
+
+	file := generateRandomLargeFile(2 * 1024 * 1024)
+	defer os.Remove(file.Name())
+	create := func(deadline int64) (*httptest.ResponseRecorder, controllers.FileMeta) {
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  2 * 1024 * 1024,
+			ChunkSize: 1024 * 1024,
+			Deadline:  deadline,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return w, meta
+	}
+
+	w, _ := create(time.Now().Unix() - 1)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	// the ttl caps the deadline asked for
+	_, meta := create(time.Now().Add(48 * time.Hour).Unix())
+	assert.InDelta(time.Now().Add(time.Hour).Unix(), meta.Deadline, 5)
+
+	deadline := time.Now().Unix() + 1
+	w, meta = create(deadline)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(deadline, meta.Deadline)
+	uploadSlice(0, meta, file, assert, "v2")
+	time.Sleep(time.Until(time.Unix(deadline+1, 0)))
+
+	expired := func() {
+		c, w := prepareContext(newSliceRequest(1, meta, file, "v2"))
+		r.HandleContext(c)
+		assert.Equal(http.StatusGone, w.Code)
+		var response controllers.Response
+		var data controllers.SessionExpired
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &data)
+		assert.Equal(controllers.SessionExpired{FileId: meta.FileId, Deadline: deadline}, data)
+	}
+	expired()
+
+	reclaimed, err := controllers.ReclaimExpired()
+	assert.NoError(err)
+	assert.Contains(reclaimed, meta.FileId)
+	assert.NoDirExists(path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId))
+	expired()
+}
+
+func TestCapabilities(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.max_chunks", 500)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.max_chunks", 0)
+	defer viper.Set("uploader.admin_token", "")
+
+	req, _ := http.NewRequest("GET", "/capabilities", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+
+	var response controllers.Response
+	var capabilities controllers.Capabilities
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &capabilities)
+	assert.Equal(1, capabilities.Version)
+	assert.Contains(capabilities.Protocols, controllers.Protocol{Name: "slices", Version: 2, Path: "files/:id/upload_v2"})
+	assert.Equal(int64(500), capabilities.Limits.MaxChunks)
+	assert.Contains(capabilities.Checksums, "sha1")
+	assert.Contains(capabilities.Auth, controllers.AuthMode{Name: "admin_token", Header: "Authorization", Required: true})
+	assert.NotContains(capabilities.Features, "manifest_completion")
+}
+
+func TestLocalizedMessages(t *testing.T) {
+	assert := assert.New(t)
+	body, _ := json.Marshal(controllers.CreateParams{
+		FileName:  "test.txt",
+		FileType:  "text/plain",
+		FileSize:  1024,
+		ChunkSize: 1024,
+		Deadline:  1,
+	})
+	for language, expected := range map[string]string{
+		"":                        "deadline already passed",
+		"fr-FR, en;q=0.5":         "deadline already passed",
+		"zh-CN,zh;q=0.9,en;q=0.8": "截止时间已过",
+		"en;q=0.5, zh;q=0.8":      "截止时间已过",
+	} {
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		req.Header.Set("Accept-Language", language)
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(http.StatusBadRequest, response.Code)
+		assert.Equal(expected, response.Message, language)
+		assert.Equal("deadline_passed", response.Error, language)
+	}
+
+	// messages left empty are the status text of the code
+	req, _ := http.NewRequest("GET", "/files/unknown/meta", nil)
+	req.Header.Set("Accept-Language", "zh")
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	var response controllers.Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal("zh", w.Header().Get("Content-Language"))
+	assert.Equal(w.Code, response.Code)
+	assert.NotEqual(http.StatusText(w.Code), response.Message)
+}
+
+func TestDescription(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.search.index_dir", "/tmp/golang_test_dev/search_index")
+	defer viper.Set("uploader.search.index_dir", nil)
+
+	prefix := "described-" + randstr.Hex(8)
+	file := generateRandomLargeFile(2 * 1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:    filepath.Base(file.Name()),
+		FileType:    "application/octet-stream",
+		FileSize:    2 * 1024 * 1024,
+		ChunkSize:   1024 * 1024,
+		Prefix:      prefix,
+		Description: "first draft",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	assert.Equal("first draft", meta.Description)
+
+	patch := func(description string) controllers.FileMeta {
+		body, _ := json.Marshal(map[string]string{"description": description})
+		req, _ := http.NewRequest("PATCH", "/files/"+meta.FileId+"/meta", bytes.NewBuffer(body))
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var response controllers.Response
+		var patched controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &patched)
+		return patched
+	}
+	assert.Equal("second draft", patch("second draft").Description)
+	uploadSlice(0, meta, file, assert, "v2")
+	uploadSlice(1, meta, file, assert, "v2")
+
+	list := func() []controllers.FileListing {
+		req, _ := http.NewRequest("GET", "/prefixes/"+prefix+"/files", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		var listing []controllers.FileListing
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &listing)
+		return listing
+	}
+	listing := list()
+	if assert.Len(listing, 1) {
+		assert.Equal(meta.FileId, listing[0].FileId)
+		assert.Equal("second draft", listing[0].Description)
+	}
+
+	word := "okapi" + randstr.Hex(8)
+	patch("final version, " + word)
+	assert.Equal("final version, "+word, list()[0].Description)
+
+	req, _ = http.NewRequest("GET", "/search?q="+word, nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	var result controllers.SearchResult
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &result)
+	if assert.Len(result.Hits, 1) {
+		assert.Equal(meta.FileId, result.Hits[0].FileId)
+		assert.Equal("final version, "+word, result.Hits[0].Description)
+	}
+
+	req, _ = http.NewRequest("PATCH", "/files/unknown/meta", bytes.NewBufferString(`{"description": ""}`))
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestValidationRules(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "validated", "validate": map[string]interface{}{
+			"max_image_width":  32,
+			"max_image_height": 32,
+			"magic":            []map[string]interface{}{{"type": "application/pdf", "hex": []string{"255044462d"}}},
+			"svg_no_scripts":   true,
+		}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	upload := func(name string, fileType string, content []byte) (controllers.FileMeta, *httptest.ResponseRecorder) {
+		params := controllers.CreateParams{
+			FileName:  name,
+			FileType:  fileType,
+			FileSize:  int64(len(content)),
+			ChunkSize: 1024,
+			Prefix:    "validated",
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		for i := int64(0); i*1024 < int64(len(content)); i++ {
+			data := content[i*1024 : utils.Min((i+1)*1024, int64(len(content)))]
+			var c *gin.Context
+			c, w = prepareContext(newSliceDataRequest(i, meta, name, data, "v2"))
+			r.HandleContext(c)
+			if w.Code != http.StatusPartialContent {
+				break
+			}
+		}
+		return meta, w
+	}
+	rejectedBy := func(w *httptest.ResponseRecorder) string {
+		var response controllers.Response
+		var invalid controllers.ValidationError
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &invalid)
+		return invalid.Rule
+	}
+
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 64, 16)), nil)
+	_, w := upload("wide.jpg", "image/jpeg", encoded.Bytes())
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Equal("max_image_size", rejectedBy(w))
+
+	_, w = upload("fake.pdf", "application/pdf", []byte("<html>not a pdf</html>"))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Equal("magic", rejectedBy(w))
+	_, w = upload("real.pdf", "application/pdf", []byte("%PDF-1.7\n%%EOF\n"))
+	assert.Equal(http.StatusOK, w.Code)
+
+	// the script is past the first slice, the complete file is rejected
+	svg := `<svg xmlns="http://www.w3.org/2000/svg">` + strings.Repeat(" ", 2000) + `<script>alert(1)</script></svg>`
+	meta, w := upload("logo-"+randstr.Hex(8)+".svg", "image/svg+xml", []byte(svg))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.NoFileExists(path.Join(viper.GetString("uploader.upload_dir"), "validated", meta.FileName))
+	// the session failed, it takes no more slices
+	c, w := prepareContext(newSliceDataRequest(0, meta, meta.FileName, []byte(svg[:1024]), "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusConflict, w.Code)
+	_, w = upload("icon.svg", "image/svg+xml", []byte(`<svg onload="alert(1)"></svg>`))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Equal("svg_no_scripts", rejectedBy(w))
+	_, w = upload("clean.svg", "image/svg+xml", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`))
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestAntivirusVerdictCache(t *testing.T) {
+	assert := assert.New(t)
+	// a fake scanner in the manner of clamscan, counting its runs
+	dir := t.TempDir()
+	scanner := filepath.Join(dir, "scan")
+	os.WriteFile(scanner, []byte(`#!/bin/sh
+echo run >> `+filepath.Join(dir, "runs")+`
+if grep -q EICAR "$1"; then echo "$1: Eicar-Test-Signature FOUND"; exit 1; fi
+echo "$1: OK"
+`), 0755)
+	viper.Set("uploader.antivirus.command", scanner+" {input}")
+	viper.Set("uploader.antivirus.version_command", "echo engine-1")
+	defer viper.Set("uploader.antivirus", nil)
+
+	upload := func(content []byte) (controllers.FileMeta, *httptest.ResponseRecorder) {
+		file, _ := os.CreateTemp("", "test")
+		defer os.Remove(file.Name())
+		file.Write(content)
+		params := controllers.CreateParams{
+			FileName:  filepath.Base(file.Name()),
+			FileType:  "text/plain",
+			FileSize:  int64(len(content)),
+			ChunkSize: 1024,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+		r.HandleContext(c)
+		return meta, w
+	}
+	readMeta := func(fileId string) controllers.FileMeta {
+		req, _ := http.NewRequest("GET", "/files/"+fileId+"/meta", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return meta
+	}
+	runs := func() int {
+		content, _ := os.ReadFile(filepath.Join(dir, "runs"))
+		return strings.Count(string(content), "run")
+	}
+
+	content := []byte("clean " + randstr.Hex(8))
+	meta, w := upload(content)
+	assert.Equal(http.StatusOK, w.Code)
+	meta = readMeta(meta.FileId)
+	if assert.NotNil(meta.Scan) {
+		assert.Equal("clean", meta.Scan.Verdict)
+		assert.Equal("engine-1", meta.Scan.Engine)
+		assert.False(meta.Scan.Cached)
+	}
+	assert.Equal(1, runs())
+
+	meta, w = upload(content)
+	assert.Equal(http.StatusOK, w.Code)
+	meta = readMeta(meta.FileId)
+	if assert.NotNil(meta.Scan) {
+		assert.True(meta.Scan.Cached)
+	}
+	assert.Equal(1, runs())
+
+	infected := []byte("EICAR " + randstr.Hex(8))
+	for i := 0; i < 2; i++ {
+		_, w = upload(infected)
+		assert.Equal(http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(w.Body.String(), "Eicar-Test-Signature")
+	}
+	assert.Equal(2, runs())
+}
+
+func TestResponseCompression(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.compression.algorithms", []string{"zstd", "gzip"})
+	defer viper.Set("uploader.compression", nil)
+
+	file, meta := createRandomFile(1024*1024, 1024)
+	defer os.Remove(file.Name())
+	get := func(url string, acceptEncoding string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	decodedMeta := func(body io.Reader) controllers.FileMeta {
+		var response controllers.Response
+		var decoded controllers.FileMeta
+		json.NewDecoder(body).Decode(&response)
+		json.Unmarshal(response.Data, &decoded)
+		return decoded
+	}
+
+	w := get("/files/"+meta.FileId+"/meta", "gzip, deflate, br")
+	assert.Equal("gzip", w.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(w.Body)
+	if assert.NoError(err) {
+		assert.Len(decodedMeta(reader).Slices, 1024)
+	}
+
+	w = get("/files/"+meta.FileId+"/meta", "gzip;q=0.5, zstd")
+	assert.Equal("zstd", w.Header().Get("Content-Encoding"))
+	decoder, err := zstd.NewReader(w.Body)
+	if assert.NoError(err) {
+		assert.Len(decodedMeta(decoder).Slices, 1024)
+		decoder.Close()
+	}
+
+	w = get("/files/"+meta.FileId+"/meta", "")
+	assert.Empty(w.Header().Get("Content-Encoding"))
+	assert.Len(decodedMeta(w.Body).Slices, 1024)
+	w = get("/files/"+meta.FileId+"/meta", "zstd;q=0, gzip;q=0")
+	assert.Empty(w.Header().Get("Content-Encoding"))
+
+	// too small to be worth it
+	w = get("/files/unknown/meta", "gzip")
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Empty(w.Header().Get("Content-Encoding"))
+}
+
+func TestUploadToken(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.upload_token", true)
+	defer viper.Set("uploader.upload_token", false)
+
+	file := generateRandomLargeFile(2 * 1024 * 1024)
+	defer os.Remove(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  2 * 1024 * 1024,
+		ChunkSize: 1024 * 1024,
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var result controllers.CreateResult
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &result)
+	assert.NotEmpty(result.UploadToken)
+	assert.Empty(result.WriterToken)
+	meta := result.FileMeta
+
+	send := func(req *http.Request, token string) int {
+		if token != "" {
+			req.Header.Set("X-Upload-Token", token)
+		}
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w.Code
+	}
+	metaRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+		return req
+	}
+	slicesRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/slices", nil)
+		return req
+	}
+
+	// knowing the file id isn't enough
+	assert.Equal(http.StatusForbidden, send(newSliceRequest(0, meta, file, "v2"), ""))
+	assert.Equal(http.StatusForbidden, send(newSliceRequest(0, meta, file, "v2"), "guessed"))
+	assert.Equal(http.StatusForbidden, send(metaRequest(), ""))
+	assert.Equal(http.StatusForbidden, send(slicesRequest(), ""))
+
+	assert.Equal(http.StatusPartialContent, send(newSliceRequest(0, meta, file, "v2"), result.UploadToken))
+	assert.Equal(http.StatusOK, send(metaRequest(), result.UploadToken))
+	assert.Equal(http.StatusOK, send(slicesRequest(), result.UploadToken))
+
+	// nor is it to read the bytes received so far
+	for _, endpoint := range []string{"pieces", "pieces/0", "download"} {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/"+endpoint, nil)
+		assert.Equal(http.StatusForbidden, send(req, ""), endpoint)
+	}
+	req, _ = http.NewRequest("GET", "/files/"+meta.FileId+"/pieces/0", nil)
+	assert.Equal(http.StatusOK, send(req, result.UploadToken))
+	assert.Equal(http.StatusOK, send(newSliceRequest(1, meta, file, "v2"), result.UploadToken))
+
+	// the meta of the completed file is public like any other
+	assert.Equal(http.StatusOK, send(metaRequest(), ""))
+}
+
+func TestUploadPermissions(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.permissions", map[string]interface{}{"file_mode": "0640", "dir_mode": "0750"})
+	defer viper.Set("uploader.permissions", nil)
+	mode := func(name string) os.FileMode {
+		info, err := os.Stat(name)
+		assert.NoError(err)
+		return info.Mode().Perm()
+	}
+
+	file, meta := createRandomFile(2048, 1024)
+	defer os.Remove(file.Name())
+	cacheDir := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId)
+	assert.Equal(os.FileMode(0750), mode(cacheDir))
+	assert.Equal(os.FileMode(0640), mode(path.Join(cacheDir, "meta.json")))
+
+	uploadSlice(0, meta, file, assert, "v1")
+	slices, _ := filepath.Glob(path.Join(cacheDir, "*", "*.slice"))
+	assert.NotEmpty(slices)
+	for _, slice := range slices {
+		assert.Equal(os.FileMode(0750), mode(filepath.Dir(slice)))
+		assert.Equal(os.FileMode(0640), mode(slice))
+	}
+	uploadSlice(1, meta, file, assert, "v1")
+	assert.Equal(os.FileMode(0640), mode(path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".meta.json")))
+}
+
+func TestBindingErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	create := func(body string) []map[string]interface{} {
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBufferString(body))
+		w := createFileWithRequest(req)
+		assert.Equal(http.StatusBadRequest, w.Code)
+		var response controllers.Response
+		var fields []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal("invalid request", response.Message)
+		json.Unmarshal(response.Data, &fields)
+		return fields
+	}
+
+	fields := create(`{"file_name": "a.txt", "file_size": 4096, "chunk_size": 10}`)
+	assert.Equal([]map[string]interface{}{
+		{"field": "file_type", "rule": "required"},
+		{"field": "chunk_size", "rule": "min", "min": float64(1024)},
+	}, fields)
+
+	fields = create(`{"file_name": "a.txt", "file_type": "text/plain", "file_size": 4096, "chunk_size": "big"}`)
+	assert.Equal([]map[string]interface{}{{"field": "chunk_size", "rule": "type", "type": "int64"}}, fields)
+
+	fields = create(`{"file_name": `)
+	assert.Empty(fields)
+}
+
+func TestFileUploadMetaPart(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(2048, 1024)
+	defer os.Remove(file.Name())
+	content, _ := os.ReadFile(file.Name())
+
+	upload := func(part map[string]interface{}, data []byte) (*httptest.ResponseRecorder, controllers.Response) {
+		metaJson, _ := json.Marshal(part)
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("meta", string(metaJson))
+		fileWriter, _ := writer.CreateFormFile("file", meta.FileName)
+		fileWriter.Write(data)
+		writer.Close()
+		req, _ := http.NewRequest("POST", "/files/"+meta.FileId+"/upload_v2", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+	slicePart := func(sliceId string, checksums map[string]string) map[string]interface{} {
+		return map[string]interface{}{
+			"file_id":    meta.FileId,
+			"file_name":  meta.FileName,
+			"file_type":  meta.FileType,
+			"file_size":  meta.FileSize,
+			"chunk_size": meta.ChunkSize,
+			"created_at": meta.CreatedAt,
+			"slice_id":   sliceId,
+			"checksums":  checksums,
+		}
+	}
+	sha256Of := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	// the fields are checked as the form ones are
+	part := slicePart("0", nil)
+	delete(part, "slice_id")
+	w, response := upload(part, content[:1024])
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.JSONEq(`[{"field": "slice_id", "rule": "required"}]`, string(response.Data))
+
+	w, response = upload(slicePart("0", map[string]string{"sha256": sha256Of(content[1024:])}), content[:1024])
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal("checksum mismatch", response.Message)
+	assert.JSONEq(`[{"field": "checksums.sha256", "rule": "checksum"}]`, string(response.Data))
+
+	part = slicePart("0", map[string]string{"sha256": sha256Of(content[:1024])})
+	part["encryption"] = map[string]string{"algorithm": "AES-256-GCM", "key_id": "k1", "iv": "00ff"}
+	w, _ = upload(part, content[:1024])
+	assert.Equal(http.StatusPartialContent, w.Code)
+	metaJson, _ := os.ReadFile(path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId, "meta.json"))
+	var stored controllers.FileMeta
+	json.Unmarshal(metaJson, &stored)
+	assert.Equal(&controllers.SliceEncryption{Algorithm: "AES-256-GCM", KeyId: "k1", IV: "00ff"}, stored.Slices["0"].Encryption)
+
+	w, _ = upload(slicePart("1", map[string]string{"sha256": sha256Of(content[1024:])}), content[1024:])
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestFileAppend(t *testing.T) {
+	assert := assert.New(t)
+
+	file, meta := createRandomFile(1024*1024+1, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v1")
+	uploadSlice(1, meta, file, assert, "v1")
+	content, _ := os.ReadFile(file.Name())
+
+	openAppend := func(id string, size int64) (*httptest.ResponseRecorder, controllers.FileMeta) {
+		body, _ := json.Marshal(controllers.AppendParams{FileSize: size, ChunkSize: 1024})
+		req, _ := http.NewRequest("POST", "/files/"+id+"/append", bytes.NewBuffer(body))
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var created controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &created)
+		return w, created
+	}
+	download := func() []byte {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		sum := sha256.Sum256(w.Body.Bytes())
+		assert.Equal(hex.EncodeToString(sum[:]), w.Header().Get("X-Checksum-Sha256"))
+		md5Sum := md5.Sum(w.Body.Bytes())
+		assert.Equal(base64.StdEncoding.EncodeToString(md5Sum[:]), w.Header().Get("Content-MD5"))
+		return w.Body.Bytes()
+	}
+
+	for i, v := range []string{"v1", "v2"} {
+		data := make([]byte, 1500)
+		rand.Read(data)
+		w, session := openAppend(meta.FileId, int64(len(data)))
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal(meta.FileId, session.AppendTo)
+		assert.Equal(int64(len(content)), session.AppendOffset)
+		// the file grows before this one completes
+		w, stale := openAppend(meta.FileId, int64(len(data)))
+		assert.Equal(http.StatusOK, w.Code)
+
+		c, w := prepareContext(newSliceDataRequest(0, session, fmt.Sprint(i), data[:1024], v))
+		r.HandleContext(c)
+		c, w = prepareContext(newSliceDataRequest(1, session, fmt.Sprint(i), data[1024:], v))
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		content = append(content, data...)
+		assert.Equal(content, download())
+
+		c, w = prepareContext(newSliceDataRequest(0, stale, fmt.Sprint(i), data[:1024], v))
+		r.HandleContext(c)
+		c, w = prepareContext(newSliceDataRequest(1, stale, fmt.Sprint(i), data[1024:], v))
+		r.HandleContext(c)
+		assert.Equal(http.StatusPreconditionFailed, w.Code)
+		assert.Equal(content, download())
+	}
+
+	req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	var response controllers.Response
+	var grown controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &grown)
+	assert.Equal(int64(len(content)), grown.FileSize)
+	sum := sha256.Sum256(content)
+	assert.Equal(hex.EncodeToString(sum[:]), grown.Sha256)
+	// the last slice took the appended bytes
+	assert.Len(grown.Slices, 2)
+	tail := sha1.Sum(content[1024*1024:])
+	assert.Equal(controllers.Slice{Id: "1", Status: 1, Sha1: hex.EncodeToString(tail[:]), ReceivedAt: grown.Slices["1"].ReceivedAt, Size: int64(len(content) - 1024*1024)}, grown.Slices["1"])
+
+	w, _ = openAppend("missing", 10)
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestSessionCacheLimit(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.session_cache.max_ratio", 0.75)
+	defer viper.Set("uploader.session_cache.max_ratio", nil)
+
+	// slices of the right size only add up to more than the file with a
+	// ratio below 1, v2 target files then never fit
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v1")
+
+	req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/progress", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	var response controllers.Response
+	var progress controllers.Progress
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &progress)
+	assert.GreaterOrEqual(progress.CacheBytes, int64(1024*1024))
+
+	c, w = prepareContext(newSliceRequest(1, meta, file, "v1"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+
+	viper.Set("uploader.session_cache.max_ratio", 0)
+	uploadSlice(1, meta, file, assert, "v1")
+}
+
+func TestUploadSliceSizeMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []string{"v1", "v2"} {
+		file, meta := createRandomFile(2*1024*1024+100, 1024*1024)
+		defer os.Remove(file.Name())
+		for _, size := range []int{0, 1024*1024 - 1, 1024*1024 + 1} {
+			c, w := prepareContext(newSliceDataRequest(0, meta, file.Name(), make([]byte, size), v))
+			r.HandleContext(c)
+			assert.Equal(http.StatusBadRequest, w.Code)
+			var response controllers.Response
+			var mismatch controllers.SliceSizeMismatch
+			json.Unmarshal(w.Body.Bytes(), &response)
+			json.Unmarshal(response.Data, &mismatch)
+			assert.Equal(4001, response.Code)
+			assert.Equal(int64(1024*1024), mismatch.ExpectedSize)
+			assert.Equal(int64(size), mismatch.Size)
+		}
+		// the last slice has the rest of the file
+		c, w := prepareContext(newSliceDataRequest(2, meta, file.Name(), make([]byte, 1024*1024), v))
+		r.HandleContext(c)
+		assert.Equal(http.StatusBadRequest, w.Code)
+
+		for slice := int64(0); slice < 3; slice++ {
+			uploadSlice(slice, meta, file, assert, v)
+		}
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		c, w = prepareContext(req)
+		r.HandleContext(c)
+		content, _ := os.ReadFile(file.Name())
+		assert.Equal(content, w.Body.Bytes())
+	}
+}
+
+func TestUploadStrictSize(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.strict_size", true)
+	defer viper.Set("uploader.strict_size", false)
+
+	for _, v := range []string{"v1", "v2"} {
+		file, meta := createRandomFile(2*1024*1024, 1024*1024)
+		defer os.Remove(file.Name())
+		uploadSlice(0, meta, file, assert, v)
+
+		// the cache is damaged behind the back of the session
+		cacheDir := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId)
+		if v == "v1" {
+			filepath.WalkDir(cacheDir, func(name string, entry os.DirEntry, err error) error {
+				if strings.HasSuffix(name, ".slice") {
+					os.Truncate(name, 100)
+				}
+				return nil
+			})
+		} else {
+			partial, _ := os.OpenFile(path.Join(cacheDir, meta.FileName+".part"), os.O_WRONLY|os.O_APPEND, 0)
+			partial.Write([]byte("padding"))
+			partial.Close()
+		}
+
+		c, w := prepareContext(newSliceRequest(1, meta, file, v))
+		r.HandleContext(c)
+		assert.Equal(http.StatusUnprocessableEntity, w.Code)
+		var response controllers.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if v == "v1" {
+			assert.Equal("file rejected by file_size: 1048676 bytes instead of 2097152: slice 0 has 100 bytes instead of 1048576", response.Message)
+		} else {
+			assert.Equal("file rejected by file_size: 2097159 bytes instead of 2097152", response.Message)
+		}
+
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/meta", nil)
+		c, w = prepareContext(req)
+		r.HandleContext(c)
+		var failed controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &failed)
+		assert.Equal(controllers.StateFailed, failed.State)
+	}
+}
+
+func TestUploadV2Finalize(t *testing.T) {
+	assert := assert.New(t)
+	const chunkSize = 1024 * 1024
+
+	for _, fileSize := range []int64{2*chunkSize - 1, 2 * chunkSize, 2*chunkSize + 1} {
+		file, meta := createRandomFile(fileSize, chunkSize)
+		defer os.Remove(file.Name())
+		content, _ := os.ReadFile(file.Name())
+		complete := func() (*httptest.ResponseRecorder, controllers.Response) {
+			req, _ := http.NewRequest("POST", "/files/"+meta.FileId+"/complete", nil)
+			c, w := prepareContext(req)
+			r.HandleContext(c)
+			var response controllers.Response
+			json.Unmarshal(w.Body.Bytes(), &response)
+			return w, response
+		}
+
+		uploadSlice(0, meta, file, assert, "v2")
+		// bytes past the file size in the target file, e.g. left by an
+		// earlier one, aren't part of the file
+		partial, _ := os.OpenFile(path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId, meta.FileName+".part"), os.O_WRONLY|os.O_APPEND, 0)
+		partial.Write([]byte("padding"))
+		partial.Close()
+
+		w, response := complete()
+		assert.Equal(http.StatusConflict, w.Code)
+		if fileSize > 2*chunkSize {
+			assert.JSONEq(`["1", "2"]`, string(response.Data))
+		} else {
+			assert.JSONEq(`["1"]`, string(response.Data))
+		}
+
+		// the upload of the last slice fails to complete the file
+		viper.Set("uploader.antivirus.command", "/nonexistent/scanner {input}")
+		last := int64(len(meta.Slices) - 1)
+		for slice := int64(1); slice < last; slice++ {
+			uploadSlice(slice, meta, file, assert, "v2")
+		}
+		c, w := prepareContext(newSliceRequest(last, meta, file, "v2"))
+		r.HandleContext(c)
+		assert.Equal(http.StatusInternalServerError, w.Code)
+		viper.Set("uploader.antivirus", nil)
+
+		w, _ = complete()
+		assert.Equal(http.StatusOK, w.Code)
+		stored, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+		assert.Equal(fileSize, int64(len(stored)))
+		assert.True(bytes.Equal(content, stored))
+		w, _ = complete()
+		assert.Equal(http.StatusConflict, w.Code)
+	}
+}
+
+func TestUploadV2DirectWrite(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": "direct_write", "direct_write": true},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	file := generateRandomLargeFile(2*1024*1024 + 1)
+	defer os.Remove(file.Name())
+	content, _ := os.ReadFile(file.Name())
+	params := controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  int64(len(content)),
+		ChunkSize: 1024 * 1024,
+		Prefix:    "direct_write",
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	w := createFileWithRequest(req)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	dir := path.Join(viper.GetString("uploader.upload_dir"), "direct_write")
+	assert.Equal(path.Join(dir, meta.FileId+".part"), meta.TargetPath)
+
+	// the slices go into the storage, not the slice cache
+	uploadSlice(0, meta, file, assert, "v2")
+	assert.FileExists(meta.TargetPath)
+	assert.NoFileExists(path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId, meta.FileName+".part"))
+
+	uploadSlice(2, meta, file, assert, "v2")
+	w = uploadSlice(1, meta, file, assert, "v2")
+	assert.Equal(http.StatusOK, w.Code)
+	stored, _ := os.ReadFile(path.Join(dir, meta.FileName))
+	assert.True(bytes.Equal(content, stored))
+	assert.NoFileExists(meta.TargetPath)
+}
+
+func TestSessionAffinity(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.affinity.instance", "uploader-a")
+	viper.Set("uploader.affinity.secret", "secret")
+	defer viper.Set("uploader.affinity", nil)
+
+	file := generateRandomLargeFile(1024)
+	defer os.Remove(file.Name())
+	body, _ := json.Marshal(controllers.CreateParams{
+		FileName:  filepath.Base(file.Name()),
+		FileType:  "text/plain",
+		FileSize:  1024,
+		ChunkSize: 1024,
+	})
+	req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	cookies := w.Result().Cookies()
+	if !assert.Len(cookies, 1) {
+		return
+	}
+	cookie := cookies[0]
+	assert.Equal("uploader_affinity", cookie.Name)
+	assert.Equal("/files/"+meta.FileId, cookie.Path)
+	assert.True(cookie.HttpOnly)
+	assert.True(strings.HasPrefix(cookie.Value, "uploader-a."))
+
+	progress := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/progress", nil)
+		req.AddCookie(cookie)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	assert.Equal(http.StatusOK, progress(cookie).Code)
+
+	// another replica sends the client back where the session is
+	viper.Set("uploader.affinity.instance", "uploader-b")
+	w = progress(cookie)
+	assert.Equal(http.StatusMisdirectedRequest, w.Code)
+	viper.Set("uploader.affinity.instances", map[string]string{"uploader-a": "https://a.example.com/"})
+	w = progress(cookie)
+	assert.Equal(http.StatusTemporaryRedirect, w.Code)
+	assert.Equal("https://a.example.com/files/"+meta.FileId+"/progress", w.Header().Get("Location"))
+
+	// a cookie not signed for the session is ignored
+	forged := &http.Cookie{Name: cookie.Name, Value: "uploader-a." + strings.Repeat("0", 64)}
+	assert.Equal(http.StatusOK, progress(forged).Code)
+}
+
+func TestMetaVersion(t *testing.T) {
+	assert := assert.New(t)
+	readMeta := func(fileId string) (*httptest.ResponseRecorder, controllers.FileMeta) {
+		req, _ := http.NewRequest("GET", "/files/"+fileId+"/meta", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return w, meta
+	}
+
+	// sessions of a server from before meta_version carry on
+	legacyMeta := func(meta controllers.FileMeta, uploaded int) {
+		slices := map[string]interface{}{}
+		for id := range meta.Slices {
+			status := 0
+			if id == strconv.Itoa(uploaded) {
+				status = 1
+			}
+			slices[id] = map[string]interface{}{"slice_id": id, "status": status}
+		}
+		legacy, _ := json.Marshal(map[string]interface{}{
+			"file_id": meta.FileId, "file_name": meta.FileName, "file_type": meta.FileType,
+			"file_size": meta.FileSize, "chunk_size": meta.ChunkSize, "created_at": meta.CreatedAt,
+			"slices": slices,
+		})
+		os.WriteFile(path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId, "meta.json"), legacy, 0644)
+	}
+	file, meta := createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	assert.Equal(controllers.MetaVersion, meta.MetaVersion)
+	legacyMeta(meta, -1)
+	_, migrated := readMeta(meta.FileId)
+	assert.Equal(controllers.MetaVersion, migrated.MetaVersion)
+	assert.Equal(controllers.StateCreated, migrated.State)
+	uploadSlice(0, meta, file, assert, "v2")
+	w := uploadSlice(1, meta, file, assert, "v2")
+	assert.Equal(http.StatusOK, w.Code)
+	_, completed := readMeta(meta.FileId)
+	assert.Equal(controllers.StateComplete, completed.State)
+	assert.Equal(controllers.MetaVersion, completed.MetaVersion)
+
+	file, meta = createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	legacyMeta(meta, 0)
+	_, migrated = readMeta(meta.FileId)
+	assert.Equal(controllers.StateUploading, migrated.State)
+
+	// the meta of a newer server is left alone
+	file, meta = createRandomFile(2*1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	metaFile := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId, "meta.json")
+	content, _ := os.ReadFile(metaFile)
+	newer := map[string]interface{}{}
+	json.Unmarshal(content, &newer)
+	newer["meta_version"] = controllers.MetaVersion + 1
+	content, _ = json.Marshal(newer)
+	os.WriteFile(metaFile, content, 0644)
+	w, _ = readMeta(meta.FileId)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	written, _ := os.ReadFile(metaFile)
+	assert.Equal(content, written)
+}
+
+func TestUploadDirs(t *testing.T) {
+	assert := assert.New(t)
+	uploadDir := viper.GetString("uploader.upload_dir")
+	disks := []string{path.Join(uploadDir, "disk0"), path.Join(uploadDir, "disk1")}
+	viper.Set("uploader.upload_dir", disks)
+	defer viper.Set("uploader.upload_dir", uploadDir)
+	defer os.RemoveAll(disks[0])
+	defer os.RemoveAll(disks[1])
+
+	upload := func(name string, content []byte) controllers.FileMeta {
+		body, _ := json.Marshal(controllers.CreateParams{
+			FileName:  name,
+			FileType:  "text/plain",
+			FileSize:  int64(len(content)),
+			ChunkSize: 1024,
+			Prefix:    "disks",
+		})
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		file, _ := os.CreateTemp("", "disks")
+		defer os.Remove(file.Name())
+		file.Write(content)
+		w = uploadSlice(0, meta, file, assert, "v2")
+		assert.Equal(http.StatusOK, w.Code)
+		return meta
+	}
+
+	// files are spread across the disks by file id
+	seen := map[string]bool{}
+	for i := 0; len(seen) < 2 && i < 32; i++ {
+		meta := upload(fmt.Sprintf("file%d.txt", i), []byte(strconv.Itoa(i)))
+		assert.Contains(disks, meta.Storage.Root)
+		seen[meta.Storage.Root] = true
+		stored, _ := os.ReadFile(path.Join(meta.Storage.Root, "disks", meta.FileName))
+		assert.Equal(strconv.Itoa(i), string(stored))
+
+		req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/download", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal(strconv.Itoa(i), w.Body.String())
+	}
+	assert.Len(seen, 2)
+
+	// a file replacing another stays on the disk of the one it replaces
+	first := upload("replaced.txt", []byte("first"))
+	for i := 0; i < 8; i++ {
+		second := upload("replaced.txt", []byte("second"))
+		assert.Equal(first.Storage.Root, second.Storage.Root)
+	}
+	for _, disk := range disks {
+		if disk != first.Storage.Root {
+			assert.NoFileExists(path.Join(disk, "disks", "replaced.txt"))
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	assert := assert.New(t)
+	var order []string
+	controllers.RegisterMiddleware("tenant", func(config controllers.MiddlewareConfig) (gin.HandlerFunc, error) {
+		return func(c *gin.Context) {
+			order = append(order, config.Options["name"])
+			if c.GetHeader("X-Tenant") != config.Options["tenant"] {
+				c.AbortWithStatus(http.StatusForbidden)
+			}
+		}, nil
+	})
+	viper.Set("uploader.admin_token", "secret")
+	viper.Set("uploader.middlewares", []map[string]interface{}{
+		{"name": "headers", "options": map[string]string{"X-Site": "example"}},
+		{"name": "tenant", "group": "files", "options": map[string]string{"name": "first", "tenant": "a"}},
+		{"name": "tenant", "group": "files", "options": map[string]string{"name": "second", "tenant": "a"}},
+	})
+	defer viper.Set("uploader.admin_token", nil)
+	defer viper.Set("uploader.middlewares", nil)
+	engine := gin.New()
+	controllers.Attach(engine, "/")
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	req, _ := http.NewRequest("GET", "/files/chunk_size?file_size=1024", nil)
+	w := serve(req)
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Equal("example", w.Header().Get("X-Site"))
+	assert.Equal([]string{"first"}, order)
+
+	order = nil
+	req.Header.Set("X-Tenant", "a")
+	assert.Equal(http.StatusOK, serve(req).Code)
+	assert.Equal([]string{"first", "second"}, order)
+
+	// the files middlewares don't run on the admin routes
+	order = nil
+	req, _ = http.NewRequest("GET", "/admin/maintenance", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = serve(req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("example", w.Header().Get("X-Site"))
+	assert.Empty(order)
+
+	// an unknown middleware fails its routes closed
+	viper.Set("uploader.middlewares", []map[string]interface{}{{"name": "missing", "group": "admin"}})
+	engine = gin.New()
+	controllers.Attach(engine, "/")
+	assert.Equal(http.StatusInternalServerError, serve(req).Code)
+	assert.Contains(failedChecks(), "config uploader.middlewares")
+}
+
+// upperProcessor rejects files containing VIRUS and rewrites markdown files
+// into upper case text
+type upperProcessor struct{}
+
+func (upperProcessor) Describe(ctx context.Context) (*processor.DescribeResponse, error) {
+	return &processor.DescribeResponse{Name: "upper", Version: "1.0"}, nil
+}
+
+func (upperProcessor) Process(ctx context.Context, request *processor.ProcessRequest) (*processor.ProcessResponse, error) {
+	content, err := os.ReadFile(request.Path)
+	if err != nil {
+		return nil, err
+	}
+	response := &processor.ProcessResponse{Version: "1.0", Metadata: map[string]string{"size": strconv.Itoa(len(content))}}
+	if bytes.Contains(content, []byte("VIRUS")) {
+		response.RejectReason = "found a virus"
+		return response, nil
+	}
+	if request.FileType == "text/markdown" {
+		response.Rewritten = true
+		response.FileName = strings.TrimSuffix(request.FileName, ".md") + ".txt"
+		response.FileType = "text/plain"
+		return response, os.WriteFile(request.OutputPath, bytes.ToUpper(content), 0644)
+	}
+	return response, nil
+}
+
+func TestNameTemplate(t *testing.T) {
+	assert := assert.New(t)
+	prefix := "camera-" + randstr.Hex(4)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": prefix + "/roll", "name_template": "{file_id}{ext}"},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	create := func(params controllers.CreateParams) (controllers.FileMeta, *httptest.ResponseRecorder) {
+		params.FileType, params.FileSize, params.ChunkSize = "image/jpeg", 1024, 1024
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return meta, w
+	}
+	params := controllers.CreateParams{FileName: "IMG_0001.JPG", Prefix: prefix, NameTemplate: "{date}/{uuid}_{orig_name}"}
+	meta, w := create(params)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(prefix+"/"+time.Now().UTC().Format("2006-01-02"), meta.Prefix)
+	assert.Regexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}_IMG_0001\.JPG$`, meta.FileName)
+	assert.Equal("IMG_0001.JPG", meta.OriginalName)
+	other, _ := create(params)
+	assert.NotEqual(meta.FileName, other.FileName)
+
+	file, _ := os.CreateTemp("", "test")
+	defer os.Remove(file.Name())
+	file.Write(make([]byte, 1024))
+	c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.FileExists(path.Join(viper.GetString("uploader.upload_dir"), meta.Prefix, meta.FileName))
+
+	// the template of the prefix applies when the client sends none
+	meta, _ = create(controllers.CreateParams{FileName: `C:\DCIM\IMG_0002.jpg`, Prefix: prefix + "/roll"})
+	assert.Equal(meta.FileId+".jpg", meta.FileName)
+	assert.Equal(prefix+"/roll", meta.Prefix)
+
+	for _, template := range []string{"{orig_name}", "{uuid}_{size}", "../{uuid}", "a//{rand}"} {
+		_, w := create(controllers.CreateParams{FileName: "a.jpg", Prefix: prefix, NameTemplate: template})
+		assert.Equal(http.StatusBadRequest, w.Code, template)
+		assert.Contains(w.Body.String(), "invalid name template")
+	}
+}
+
+func TestNamePolicy(t *testing.T) {
+	assert := assert.New(t)
+	prefix := "served-" + randstr.Hex(4)
+	viper.Set("uploader.prefixes", []map[string]interface{}{
+		{"prefix": prefix, "names": map[string]interface{}{
+			"deny":             []string{".htaccess", "*.php", "*.PHTML"},
+			"append_extension": true,
+		}},
+	})
+	defer viper.Set("uploader.prefixes", nil)
+
+	upload := func(name string, content []byte) (controllers.FileMeta, *httptest.ResponseRecorder) {
+		file, _ := os.CreateTemp("", "test")
+		defer os.Remove(file.Name())
+		file.Write(content)
+		params := controllers.CreateParams{
+			FileName:  name,
+			FileType:  "application/octet-stream",
+			FileSize:  int64(len(content)),
+			ChunkSize: 1024 * 1024,
+			Prefix:    prefix,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		if w.Code != http.StatusOK {
+			return meta, w
+		}
+		c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+		r.HandleContext(c)
+		return meta, w
+	}
+
+	for _, name := range []string{".htaccess", "Shell.PHP", "x.phtml. ", "sub/x.php", "a/.htaccess"} {
+		_, w := upload(name, []byte("<?php system($_GET['c']);"))
+		assert.Equal(http.StatusUnprocessableEntity, w.Code, name)
+		assert.Contains(w.Body.String(), `"rule":"names"`)
+		assert.Contains(w.Body.String(), `"error":"file_rejected"`)
+		assert.Contains(w.Body.String(), `"message":"file rejected by names: file name matches`)
+	}
+
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	name := "photo-" + randstr.Hex(4)
+	meta, w := upload(name, encoded.Bytes())
+	assert.Equal(http.StatusOK, w.Code)
+	assert.FileExists(path.Join(viper.GetString("uploader.upload_dir"), prefix, name+".jpg"))
+	completed, _ := os.ReadFile(path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".meta.json"))
+	json.Unmarshal(completed, &meta)
+	assert.Equal(name+".jpg", meta.FileName)
+
+	// html is stored as text, so the web server doesn't serve it as a page
+	name = "page-" + randstr.Hex(4)
+	_, w = upload(name, []byte("<html><script>alert(1)</script></html>"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.FileExists(path.Join(viper.GetString("uploader.upload_dir"), prefix, name+".txt"))
+	name = "notes-" + randstr.Hex(4) + ".md"
+	_, w = upload(name, []byte("# notes"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.FileExists(path.Join(viper.GetString("uploader.upload_dir"), prefix, name))
+}
+
+func TestProcessors(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := os.MkdirTemp("", "processor")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "upper.sock")
+	listener, err := net.Listen("unix", socket)
+	if !assert.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	go processor.Serve(listener, upperProcessor{})
+	viper.Set("uploader.processors", []map[string]interface{}{
+		{"name": "upper", "endpoint": "unix://" + socket, "types": []string{"text/*"}, "timeout": "10s"},
+	})
+	defer viper.Set("uploader.processors", nil)
+
+	upload := func(name string, fileType string, content []byte) (controllers.FileMeta, *httptest.ResponseRecorder) {
+		file, _ := os.CreateTemp("", "test")
+		defer os.Remove(file.Name())
+		file.Write(content)
+		params := controllers.CreateParams{
+			FileName:  name,
+			FileType:  fileType,
+			FileSize:  int64(len(content)),
+			ChunkSize: 1024,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+		r.HandleContext(c)
+		return meta, w
+	}
+	readMeta := func(fileId string) controllers.FileMeta {
+		req, _ := http.NewRequest("GET", "/files/"+fileId+"/meta", nil)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		return meta
+	}
+	assert.NotContains(failedChecks(), "processor upper")
+
+	name := "notes-" + randstr.Hex(8)
+	meta, w := upload(name+".md", "text/markdown", []byte("# notes"))
+	assert.Equal(http.StatusOK, w.Code)
+	meta = readMeta(meta.FileId)
+	assert.Equal(name+".txt", meta.FileName)
+	assert.Equal("text/plain", meta.FileType)
+	if assert.Contains(meta.Processors, "upper") {
+		assert.Equal("1.0", meta.Processors["upper"].Version)
+		assert.Equal("7", meta.Processors["upper"].Metadata["size"])
+	}
+	stored, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), name+".txt"))
+	assert.Equal("# NOTES", string(stored))
+
+	_, w = upload("virus-"+randstr.Hex(8)+".txt", "text/plain", []byte("a VIRUS"))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(w.Body.String(), "found a virus")
+
+	// other types don't go to the processor
+	meta, w = upload("virus-"+randstr.Hex(8)+".bin", "application/octet-stream", []byte("a VIRUS"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(readMeta(meta.FileId).Processors)
+
+	viper.Set("uploader.processors", []map[string]interface{}{
+		{"name": "upper", "endpoint": "unix://" + filepath.Join(dir, "down.sock")},
+	})
+	_, w = upload("down-"+randstr.Hex(8)+".txt", "text/plain", []byte("text"))
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.Contains(failedChecks(), "processor upper")
+}
+
+func TestWasmProcessors(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := os.MkdirTemp("", "wasm")
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "upper.wasm"), wasmtest.Upper(), 0644)
+	os.WriteFile(filepath.Join(dir, "spin.wasm"), wasmtest.Spin(), 0644)
+	viper.Set("uploader.wasm_processors", []map[string]interface{}{
+		{"name": "upper", "module": filepath.Join(dir, "upper.wasm"), "types": []string{"text/*"}},
+		{"name": "spin", "module": filepath.Join(dir, "spin.wasm"), "types": []string{"application/x-spin"}, "timeout": "100ms"},
+	})
+	defer viper.Set("uploader.wasm_processors", nil)
+
+	upload := func(name string, fileType string, content []byte) (controllers.FileMeta, *httptest.ResponseRecorder) {
+		file, _ := os.CreateTemp("", "test")
+		defer os.Remove(file.Name())
+		file.Write(content)
+		params := controllers.CreateParams{
+			FileName:  name,
+			FileType:  fileType,
+			FileSize:  int64(len(content)),
+			ChunkSize: 1024,
+		}
+		body, _ := json.Marshal(params)
+		req, _ := http.NewRequest("POST", "/files", bytes.NewBuffer(body))
+		w := createFileWithRequest(req)
+		var response controllers.Response
+		var meta controllers.FileMeta
+		json.Unmarshal(w.Body.Bytes(), &response)
+		json.Unmarshal(response.Data, &meta)
+		c, w := prepareContext(newSliceRequest(0, meta, file, "v2"))
+		r.HandleContext(c)
+		return meta, w
+	}
+	assert.NotContains(failedChecks(), "wasm processor upper")
+
+	name := "notes-" + randstr.Hex(8) + ".txt"
+	meta, w := upload(name, "text/plain", []byte("hello, wasm"))
+	assert.Equal(http.StatusOK, w.Code)
+	completed, _ := os.ReadFile(path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".meta.json"))
+	json.Unmarshal(completed, &meta)
+	if assert.Contains(meta.Processors, "upper") {
+		assert.True(strings.HasPrefix(meta.Processors["upper"].Version, "sha256:"))
+		assert.Equal("upper", meta.Processors["upper"].Metadata["case"])
+	}
+	stored, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), name))
+	assert.Equal("HELLO, WASM", string(stored))
+
+	_, w = upload("bang-"+randstr.Hex(8)+".txt", "text/plain", []byte("!hello"))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(w.Body.String(), "starts with !")
+
+	// a module never returning runs out of time
+	_, w = upload("spin-"+randstr.Hex(8)+".bin", "application/x-spin", []byte("spin"))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(w.Body.String(), "call timed out")
+
+	os.WriteFile(filepath.Join(dir, "upper.wasm"), []byte("not wasm"), 0644)
+	assert.Contains(failedChecks(), "wasm processor upper")
+	_, w = upload("broken-"+randstr.Hex(8)+".txt", "text/plain", []byte("text"))
+	assert.Equal(http.StatusInternalServerError, w.Code)
+}
+
+func TestIPFS(t *testing.T) {
+	assert := assert.New(t)
+	var mu sync.Mutex
+	pins := map[string][]byte{}
+	var queries []url.Values
+	// a node answering the RPC API calls of the uploader, cids are made up
+	// from the sha256 of the content
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/api/v0/add":
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			content, _ := io.ReadAll(file)
+			sum := sha256.Sum256(content)
+			cid := "bafk" + hex.EncodeToString(sum[:8])
+			queries = append(queries, r.URL.Query())
+			if r.URL.Query().Get("pin") == "true" {
+				pins[cid] = content
+			}
+			fmt.Fprintf(w, `{"Name":"file","Hash":%q,"Size":"%d"}`+"\n", cid, len(content))
+		case "/api/v0/pin/rm":
+			if _, ok := pins[r.URL.Query().Get("arg")]; !ok {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `{"Message":"not pinned or pinned indirectly","Code":0,"Type":"error"}`)
+				return
+			}
+			delete(pins, r.URL.Query().Get("arg"))
+			fmt.Fprint(w, `{"Pins":[]}`)
+		case "/api/v0/version":
+			fmt.Fprint(w, `{"Version":"0.20.0"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer node.Close()
+	viper.Set("uploader.ipfs.api", node.URL)
+	viper.Set("uploader.admin_token", "secret")
+	defer viper.Set("uploader.ipfs", nil)
+	defer viper.Set("uploader.admin_token", "")
+	assert.NotContains(failedChecks(), "ipfs "+node.URL)
+
+	file, meta := createRandomFile(4096, 1024)
+	defer os.Remove(file.Name())
+	for i := int64(0); i < 4; i++ {
+		uploadSlice(i, meta, file, assert, "v2")
+	}
+	content, _ := os.ReadFile(file.Name())
+	completed, _ := os.ReadFile(path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".meta.json"))
+	json.Unmarshal(completed, &meta)
+	if assert.NotEmpty(meta.CID) {
+		assert.Equal(content, pins[meta.CID])
+	}
+	if assert.Len(queries, 1) {
+		assert.Equal("1", queries[0].Get("cid-version"))
+	}
+
+	c, w := prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "ipfs_pin")
+	_, pinned := pins[meta.CID]
+	assert.False(pinned)
+
+	// without a pin the node may drop the file, there is nothing to unpin
+	viper.Set("uploader.ipfs.pin", false)
+	file, meta = createRandomFile(1024, 1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	completed, _ = os.ReadFile(path.Join(viper.GetString("uploader.metafile_dir"), meta.FileId+".meta.json"))
+	json.Unmarshal(completed, &meta)
+	assert.NotEmpty(meta.CID)
+	_, pinned = pins[meta.CID]
+	assert.False(pinned)
+	c, w = prepareContext(adminRequest("POST", "/admin/files/"+meta.FileId+"/erase"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+
+	node.Close()
+	file, meta = createRandomFile(1024, 1024)
+	defer os.Remove(file.Name())
+	c, w = prepareContext(newSliceRequest(0, meta, file, "v2"))
+	r.HandleContext(c)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.Contains(failedChecks(), "ipfs "+node.URL)
+}
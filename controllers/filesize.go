@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// strictSize is `uploader.strict_size`: a complete file of another size than
+// declared at Create fails its session instead of being stored
+func strictSize() bool {
+	return viper.GetBool("uploader.strict_size")
+}
+
+// sizeMismatch is the diagnostic of a file of size bytes instead of its file
+// size, naming the slices stored with another size than theirs. sizeOf is the
+// size slice i was stored with, -1 when it is missing.
+func sizeMismatch(meta *FileMeta, size int64, sizeOf func(i int) int64) *ValidationError {
+	detail := fmt.Sprintf("%d bytes instead of %d", size, meta.FileSize)
+	var wrong []string
+	for i := 0; i < len(meta.Slices); i++ {
+		expected := meta.sliceSize(i)
+		switch stored := sizeOf(i); {
+		case stored < 0:
+			wrong = append(wrong, fmt.Sprintf("slice %d is missing", i))
+		case stored != expected:
+			wrong = append(wrong, fmt.Sprintf("slice %d has %d bytes instead of %d", i, stored, expected))
+		}
+	}
+	if len(wrong) > 0 {
+		detail += ": " + strings.Join(wrong, ", ")
+	}
+	return &ValidationError{Rule: "file_size", Detail: detail}
+}
+
+// checkFileSize fails the session, with strict size, unless the complete
+// local file name has the file size
+func checkFileSize(meta *FileMeta, name string, sizeOf func(i int) int64) error {
+	if !strictSize() {
+		return nil
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.Size() == meta.FileSize {
+		return nil
+	}
+	return sizeMismatch(meta, info.Size(), sizeOf)
+}
+
+// sliceFileSize is the size of the v1 slice file of slice i
+func (m *FileMeta) sliceFileSize(i int) int64 {
+	slice := m.Slices[strconv.Itoa(i)]
+	info, err := os.Stat(m.slicePath(slice.Id, slice.Sha1))
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// receivedSliceSize is the size slice i was received with, as recorded in
+// the meta, for the slices written into the v2 target file. Slices received
+// before their size was recorded are taken as right.
+func (m *FileMeta) receivedSliceSize(i int) int64 {
+	slice := m.Slices[strconv.Itoa(i)]
+	switch {
+	case slice.Status != 1:
+		return -1
+	case slice.Size == 0:
+		return m.sliceSize(i)
+	}
+	return slice.Size
+}
+
+// finalizeV2 cuts the v2 target file name to the file size once its tail
+// slice is checked. The target file may be longer than the file when it was
+// there before the session, e.g. with a chunk size the file size isn't a
+// multiple of; the bytes past the file size aren't part of it.
+func finalizeV2(meta *FileMeta, name string) error {
+	tail := len(meta.Slices) - 1
+	if received, expected := meta.receivedSliceSize(tail), meta.sliceSize(tail); received != expected {
+		return &ValidationError{Rule: "file_size", Detail: fmt.Sprintf("slice %d has %d bytes instead of %d", tail, received, expected)}
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.Size() > meta.FileSize {
+		logrus.Warningf("cut %d bytes past the file size of %s", info.Size()-meta.FileSize, meta.FileId)
+	}
+	return os.Truncate(name, meta.FileSize)
+}
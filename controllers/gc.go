@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ballast is never read, the heap it adds delays the collections triggered
+// by bursts of short lived slice buffers. Its pages are never touched so it
+// costs no resident memory.
+var ballast []byte
+
+// TuneGC applies `uploader.gc` to the runtime: percent is GOGC (-1 turns the
+// collector off until memory_limit is reached), memory_limit is GOMEMLIMIT
+// and ballast the bytes of heap allocated once. Settings left out keep the
+// GOGC and GOMEMLIMIT of the environment. Call it once at startup.
+func TuneGC() {
+	if viper.IsSet("uploader.gc.percent") {
+		percent := viper.GetInt("uploader.gc.percent")
+		debug.SetGCPercent(percent)
+		logrus.Infof("gc percent set to %d", percent)
+	}
+	if limit := viper.GetSizeInBytes("uploader.gc.memory_limit"); limit > 0 {
+		debug.SetMemoryLimit(int64(limit))
+		logrus.Infof("gc memory limit set to %d bytes", limit)
+	}
+	if size := viper.GetSizeInBytes("uploader.gc.ballast"); size > 0 {
+		ballast = make([]byte, size)
+		logrus.Infof("allocated a gc ballast of %d bytes", size)
+	}
+}
@@ -0,0 +1,31 @@
+package controllers_test
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTuneGC(t *testing.T) {
+	assert := assert.New(t)
+	percent := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(percent)
+	limit := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(limit)
+
+	viper.Set("uploader.gc", map[string]interface{}{"percent": 400, "memory_limit": "6GB"})
+	defer viper.Set("uploader.gc", nil)
+	controllers.TuneGC()
+	assert.Equal(400, debug.SetGCPercent(100))
+	assert.Equal(int64(6*1024*1024*1024), debug.SetMemoryLimit(-1))
+
+	// the settings left out keep the ones of the environment
+	debug.SetMemoryLimit(limit)
+	viper.Set("uploader.gc", map[string]interface{}{"percent": -1})
+	controllers.TuneGC()
+	assert.Equal(-1, debug.SetGCPercent(100))
+	assert.Equal(limit, debug.SetMemoryLimit(-1))
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultOpenTargetFiles = 256
+
+// targetFiles keeps the v2 target files of active sessions open, so slices
+// are written without opening the file every time. At most
+// `uploader.open_target_files` (256 by default, 0 disables it) stay open,
+// the least recently used is closed first.
+var targetFiles = &fileHandles{order: list.New(), entries: make(map[string]*list.Element)}
+
+type fileHandle struct {
+	name string
+	file fileio.WriterAt
+	// writers using the file, it is only closed when there are none
+	refs    int
+	evicted bool
+}
+
+type fileHandles struct {
+	mu sync.Mutex
+	// most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func openTargetFilesLimit() int {
+	if !viper.IsSet("uploader.open_target_files") {
+		return defaultOpenTargetFiles
+	}
+	return viper.GetInt("uploader.open_target_files")
+}
+
+// acquire returns the open file name, open calls it when it is not cached.
+// The handle must be given back with release.
+func (h *fileHandles) acquire(name string, open func() (fileio.WriterAt, error)) (*fileHandle, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if element, ok := h.entries[name]; ok {
+		h.order.MoveToFront(element)
+		handle := element.Value.(*fileHandle)
+		handle.refs++
+		return handle, nil
+	}
+
+	file, err := open()
+	if err != nil {
+		return nil, err
+	}
+	handle := &fileHandle{name: name, file: file, refs: 1}
+	limit := openTargetFilesLimit()
+	if limit <= 0 {
+		handle.evicted = true
+		return handle, nil
+	}
+	h.entries[name] = h.order.PushFront(handle)
+	h.evict(limit)
+	return handle, nil
+}
+
+func (h *fileHandles) release(handle *fileHandle) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	handle.refs--
+	if handle.evicted && handle.refs == 0 {
+		handle.close()
+	}
+}
+
+// drop closes name once nobody uses it anymore, the next acquire opens it
+// again. It must be called before the file is moved or removed.
+func (h *fileHandles) drop(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if element, ok := h.entries[name]; ok {
+		h.remove(element)
+	}
+}
+
+// close the least recently used files beyond limit
+func (h *fileHandles) evict(limit int) {
+	for h.order.Len() > limit {
+		h.remove(h.order.Back())
+	}
+}
+
+func (h *fileHandles) remove(element *list.Element) {
+	handle := h.order.Remove(element).(*fileHandle)
+	delete(h.entries, handle.name)
+	handle.evicted = true
+	if handle.refs == 0 {
+		handle.close()
+	}
+}
+
+func (handle *fileHandle) close() {
+	if err := handle.file.Close(); err != nil {
+		logrus.Warningf("failed to close %s: %v", handle.name, err)
+	}
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+)
+
+const defaultLanguage = "en"
+
+// translations of the messages of the uploadererrors, keyed on their name so
+// a message can change or carry details without losing its translation.
+// Errors missing here are answered in english.
+var translations = map[string]map[string]string{
+	"zh": {
+		uploadererrors.ErrDeadlinePassed.Name:         "截止时间已过",
+		uploadererrors.ErrInvalidNameTemplate.Name:    "文件名模板无效",
+		uploadererrors.ErrRangeTooLong.Name:           "请求范围过长",
+		uploadererrors.ErrUnknownAPIKey.Name:          "未知的 API key",
+		uploadererrors.ErrInvalidUploadToken.Name:     "无效的 upload token",
+		uploadererrors.ErrInvalidWriterToken.Name:     "无效的 writer token",
+		uploadererrors.ErrNotCompleted.Name:           "文件尚未上传完成",
+		uploadererrors.ErrNoSuchEntry.Name:            "压缩包中没有该文件",
+		uploadererrors.ErrSearchDisabled.Name:         "搜索未开启",
+		uploadererrors.ErrFileCompleted.Name:          "文件已上传完成",
+		uploadererrors.ErrFileLocked.Name:             "文件已锁定",
+		uploadererrors.ErrStorageUnavailable.Name:     "存储暂不可用",
+		uploadererrors.ErrInsufficientStorage.Name:    "存储空间不足",
+		uploadererrors.ErrSliceNotWritten.Name:        "分片写入失败，请重试",
+		uploadererrors.ErrUploadFailed.Name:           "上传失败",
+		uploadererrors.ErrInvalidRequest.Name:         "请求参数无效",
+		uploadererrors.ErrChecksumMismatch.Name:       "校验和不匹配",
+		uploadererrors.ErrInvalidContentRange.Name:    "Content-Range 无效",
+		uploadererrors.ErrResumeIncomplete.Name:       "上传未完成，请从已接收的位置继续",
+		uploadererrors.ErrContentLengthRequired.Name:  "缺少文件大小（X-Upload-Content-Length）",
+		uploadererrors.ErrPreconditionFailed.Name:     "目标文件不满足前置条件",
+		uploadererrors.ErrInvalidUnmodifiedSince.Name: "If-Unmodified-Since 无效",
+		uploadererrors.ErrNotAppendable.Name:          "文件无法追加",
+		uploadererrors.ErrSliceSizeMismatch.Name:      "分片大小不符",
+		uploadererrors.ErrCacheLimit.Name:             "会话缓存超出限制",
+		uploadererrors.ErrNotPatchable.Name:           "文件无法修改",
+		uploadererrors.ErrPatchTooLarge.Name:          "修改的范围过大",
+		uploadererrors.ErrBodyTooShort.Name:           "请求体短于 Content-Range",
+		uploadererrors.ErrSliceUploaded.Name:          "分片已上传",
+		uploadererrors.ErrSliceConflict.Name:          "分片已上传且内容不同",
+		uploadererrors.ErrSliceClaimed.Name:           "分片已被其他客户端认领",
+		uploadererrors.ErrUnknownSlice.Name:           "未知的分片",
+		uploadererrors.ErrSessionExpired.Name:         "上传会话已过期",
+		uploadererrors.ErrTooManyChunks.Name:          "分片过多",
+		uploadererrors.ErrNotZip.Name:                 "文件不是 zip 压缩包",
+		uploadererrors.ErrPreviewFailed.Name:          "生成预览失败",
+		uploadererrors.ErrStorageNotLocal.Name:        "存储不是本地存储",
+		uploadererrors.ErrQuotaExceeded.Name:          "超出配额",
+		uploadererrors.ErrCDNNotConfigured.Name:       "未配置 CDN",
+		uploadererrors.ErrDirectUpload.Name:           "文件直接上传到存储",
+		uploadererrors.ErrSlicesMissing.Name:          "缺少分片",
+		uploadererrors.ErrMisdirected.Name:            "会话由其他实例处理",
+		uploadererrors.ErrMaintenance.Name:            "只读维护中",
+		uploadererrors.ErrMetaVersion.Name:            "元数据版本较新",
+		uploadererrors.ErrSessionNotFound.Name:        "上传会话不存在",
+		uploadererrors.ErrMetaMismatch.Name:           "元数据与上传会话不符",
+		uploadererrors.ErrSlowClient.Name:             "客户端发送过慢",
+		uploadererrors.ErrFileRejected.Name:           "文件被拒绝",
+		uploadererrors.ErrMissingClientId.Name:        "缺少 X-Client-Id",
+		uploadererrors.ErrInvalidQuery.Name:           "查询无效",
+		uploadererrors.ErrInvalidDump.Name:            "元数据导出文件无效",
+		uploadererrors.ErrNoPreview.Name:              "该类型没有预览",
+		uploadererrors.ErrClientGone.Name:             "客户端已断开",
+	},
+}
+
+// statusTranslations are the messages of the responses without an error, the
+// status text of their code, so `code` stays the same in every language
+var statusTranslations = map[string]map[int]string{
+	"zh": {
+		200: "成功",
+		206: "部分完成",
+		400: "请求无效",
+		401: "未授权",
+		403: "禁止访问",
+		404: "未找到",
+		409: "冲突",
+		410: "已失效",
+		413: "请求过大",
+		415: "不支持的类型",
+		416: "请求范围无效",
+		422: "无法处理",
+		500: "服务器内部错误",
+		501: "未实现",
+		507: "存储空间不足",
+	},
+}
+
+// language picks the language of the responses to c from its
+// Accept-Language, english unless another one with translations is preferred
+func language(c *gin.Context) string {
+	best, bestQuality := defaultLanguage, 0.0
+	for _, part := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		// zh-CN, zh-Hans... all get the zh messages
+		tag, _, _ = strings.Cut(strings.ToLower(tag), "-")
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if _, ok := translations[tag]; (ok || tag == defaultLanguage) && quality > bestQuality {
+			best, bestQuality = tag, quality
+		}
+	}
+	return best
+}
+
+// localize is the message of err in the language of c, the status text of
+// status when err is nil
+func localize(c *gin.Context, status int, err *uploadererrors.Error) string {
+	if err == nil {
+		if translated, ok := statusTranslations[language(c)][status]; ok {
+			return translated
+		}
+		return http.StatusText(status)
+	}
+	if translated, ok := translations[language(c)][err.Name]; ok && err.Name != "" {
+		return translated
+	}
+	return err.Message
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/spf13/viper"
+)
+
+const defaultIPFSTimeout = 10 * time.Minute
+
+// ipfsAPI is the url of the RPC API of the IPFS node of `uploader.ipfs.api`,
+// empty when files aren't added to IPFS
+func ipfsAPI() string {
+	return strings.TrimSuffix(viper.GetString("uploader.ipfs.api"), "/")
+}
+
+// ipfsCall posts body to an endpoint of the RPC API, the node answers errors
+// as {"Message": ...}
+func ipfsCall(ctx context.Context, endpoint string, query url.Values, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", ipfsAPI()+"/api/v0/"+endpoint+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ipfs %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ipfs %s: %w", endpoint, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct{ Message string }
+		json.Unmarshal(content, &failure)
+		return nil, fmt.Errorf("ipfs %s: %s: %s", endpoint, resp.Status, failure.Message)
+	}
+	return content, nil
+}
+
+// addToIPFS is the post processor adding the stored file to the IPFS node,
+// pinned unless `uploader.ipfs.pin` is false, and recording its CID in meta
+func addToIPFS(meta *FileMeta, store storage.Storage, key string) error {
+	if ipfsAPI() == "" {
+		return nil
+	}
+	timeout := viper.GetDuration("uploader.ipfs.timeout")
+	if timeout <= 0 {
+		timeout = defaultIPFSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	file, err := storage.Open(store, key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// the file is streamed to the node as the only part of a multipart form
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", meta.FileName)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	pin := !viper.IsSet("uploader.ipfs.pin") || viper.GetBool("uploader.ipfs.pin")
+	cidVersion := 1
+	if viper.IsSet("uploader.ipfs.cid_version") {
+		cidVersion = viper.GetInt("uploader.ipfs.cid_version")
+	}
+	query := url.Values{
+		"pin":         {strconv.FormatBool(pin)},
+		"cid-version": {strconv.Itoa(cidVersion)},
+		"quieter":     {"true"},
+	}
+	content, err := ipfsCall(ctx, "add", query, form.FormDataContentType(), reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to add %s to ipfs: %w", meta.FileId, err)
+	}
+	// one json object per line, the last is the file
+	var added struct{ Hash string }
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for decoder.Decode(&added) == nil {
+	}
+	if added.Hash == "" {
+		return fmt.Errorf("failed to add %s to ipfs: no hash in %q", meta.FileId, content)
+	}
+	meta.CID = added.Hash
+	return nil
+}
+
+// unpinFromIPFS removes the pin of cid, the node may then collect the blocks;
+// copies fetched by other nodes are out of reach
+func unpinFromIPFS(cid string) error {
+	if ipfsAPI() == "" || cid == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := ipfsCall(ctx, "pin/rm", url.Values{"arg": {cid}}, "", nil)
+	if err != nil && strings.Contains(err.Error(), "not pinned") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Maintenance is the read-only mode of the server, set through the admin
+// API. New sessions and slices are refused while it is enabled, downloads
+// and meta reads keep working.
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	// unix seconds it was enabled at
+	Since int64 `json:"since,omitempty"`
+	// seconds clients are asked to wait before trying again, 0 when unknown
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// maintenancePath is `maintenance.json` in metafile_dir, replicas sharing it
+// go into maintenance together and it outlives restarts
+func maintenancePath() string {
+	return path.Join(viper.GetString("uploader.metafile_dir"), "maintenance.json")
+}
+
+func readMaintenance() (Maintenance, error) {
+	var maintenance Maintenance
+	content, err := os.ReadFile(maintenancePath())
+	if os.IsNotExist(err) {
+		return maintenance, nil
+	}
+	if err != nil {
+		return maintenance, err
+	}
+	return maintenance, json.Unmarshal(content, &maintenance)
+}
+
+// maintenanceRecheck is how often the guard looks at maintenance.json for
+// the changes of other replicas
+const maintenanceRecheck = time.Second
+
+type cachedMaintenance struct {
+	path        string
+	modTime     time.Time
+	size        int64
+	checkedAt   time.Time
+	maintenance Maintenance
+}
+
+var (
+	maintenanceCache     cachedMaintenance
+	maintenanceCacheLock sync.Mutex
+)
+
+// currentMaintenance is the maintenance of readMaintenance, maintenance.json
+// is looked at once every maintenanceRecheck and only read again when its
+// mtime or size changed
+func currentMaintenance() (Maintenance, error) {
+	name := maintenancePath()
+	now := time.Now()
+	maintenanceCacheLock.Lock()
+	defer maintenanceCacheLock.Unlock()
+	if maintenanceCache.path == name && now.Sub(maintenanceCache.checkedAt) < maintenanceRecheck {
+		return maintenanceCache.maintenance, nil
+	}
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		maintenanceCache = cachedMaintenance{path: name, checkedAt: now}
+		return Maintenance{}, nil
+	}
+	if err != nil {
+		return Maintenance{}, err
+	}
+	if maintenanceCache.path == name && info.ModTime().Equal(maintenanceCache.modTime) && info.Size() == maintenanceCache.size {
+		maintenanceCache.checkedAt = now
+		return maintenanceCache.maintenance, nil
+	}
+	maintenance, err := readMaintenance()
+	if err != nil {
+		return maintenance, err
+	}
+	maintenanceCache = cachedMaintenance{path: name, modTime: info.ModTime(), size: info.Size(), checkedAt: now, maintenance: maintenance}
+	return maintenance, nil
+}
+
+// forgetMaintenance makes the guard read maintenance.json on the next request
+func forgetMaintenance() {
+	maintenanceCacheLock.Lock()
+	defer maintenanceCacheLock.Unlock()
+	maintenanceCache = cachedMaintenance{}
+}
+
+// readOnlyGuard refuses the request with 503 and code 5031 while in
+// maintenance, with the Maintenance as data
+func readOnlyGuard(c *gin.Context) {
+	maintenance, err := currentMaintenance()
+	if err != nil {
+		// the server can't tell, uploads go on
+		logrus.Errorf("failed to read the maintenance mode: %v", err)
+	}
+	if !maintenance.Enabled {
+		c.Next()
+		return
+	}
+	retryAfter(c, time.Duration(maintenance.RetryAfter)*time.Second)
+	(&BaseController{}).WriteError(c, maintenance, uploadererrors.ErrMaintenance)
+	c.Abort()
+}
+
+// Maintenance tells whether the server is in maintenance
+func (a *AdminController) Maintenance(c *gin.Context) {
+	maintenance, err := readMaintenance()
+	if err != nil {
+		logrus.Errorf("failed to read the maintenance mode: %v", err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	a.Write(c, maintenance, 200, 0, "")
+}
+
+type MaintenanceParams struct {
+	Enabled    bool   `json:"enabled"`
+	Reason     string `json:"reason" binding:"max=1024"`
+	RetryAfter int64  `json:"retry_after" binding:"min=0"`
+}
+
+// SetMaintenance enables or disables the maintenance mode. Requests already
+// past the guard finish, e.g. a slice being received completes its file.
+func (a *AdminController) SetMaintenance(c *gin.Context) {
+	params := MaintenanceParams{}
+	if !a.bind(c, &params, c.ShouldBindJSON) {
+		return
+	}
+	maintenance := Maintenance{}
+	if params.Enabled {
+		maintenance = Maintenance{Enabled: true, Reason: params.Reason, Since: time.Now().Unix(), RetryAfter: params.RetryAfter}
+		// it is enabled already, since when stays
+		if current, err := readMaintenance(); err == nil && current.Enabled {
+			maintenance.Since = current.Since
+		}
+	}
+	content, _ := json.Marshal(maintenance)
+	if err := storage.WriteFile(maintenancePath(), content); err != nil {
+		logrus.Errorf("failed to write the maintenance mode: %v", err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	// this server goes into maintenance at once, the others within
+	// maintenanceRecheck
+	forgetMaintenance()
+	if maintenance.Enabled {
+		logrus.Warningf("maintenance enabled by %s: %s", c.GetString("admin_key_id"), maintenance.Reason)
+	} else {
+		logrus.Warningf("maintenance disabled by %s", c.GetString("admin_key_id"))
+	}
+	a.Write(c, maintenance, 200, 0, "")
+}
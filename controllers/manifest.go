@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/spf13/viper"
+)
+
+// manifestCompletion tells whether a v1 session completes by writing the
+// manifest of its slice files instead of merging them, which takes no time
+// whatever the size of the file. Files of prefixes rewriting them before
+// storage are always merged.
+func manifestCompletion(meta *FileMeta) bool {
+	if !viper.GetBool("uploader.manifest_completion") || meta.AppendTo != "" {
+		return false
+	}
+	config := prefixConfig(meta.Prefix)
+	return len(config.Convert) == 0 && !config.Sanitize.StripMetadata && !config.Sanitize.Reencode
+}
+
+// the manifest lists the slice files of the session in order, one
+// `<size> <path relative to the slice dir>` per line
+func manifestPath(fileId string) string {
+	return path.Join(viper.GetString("uploader.slice_cache_dir"), fileId, "manifest")
+}
+
+// completeManifest completes a v1 session by writing its manifest, the file
+// stays in the slice cache and is served from its slice files until it is
+// compacted, it is not put into storage nor post processed before.
+func completeManifest(meta *FileMeta) error {
+	if meta.Precondition != nil {
+		store, err := meta.storage()
+		if err != nil {
+			return err
+		}
+		if err := meta.Precondition.check(store, meta.StorageKey()); err != nil {
+			return err
+		}
+	}
+	sliceDir := path.Join(viper.GetString("uploader.slice_cache_dir"), meta.FileId)
+	var manifest strings.Builder
+	for i := 0; i < len(meta.Slices); i++ {
+		slice := meta.Slices[strconv.Itoa(i)]
+		name := meta.slicePath(slice.Id, slice.Sha1)
+		info, err := os.Stat(name)
+		if err != nil {
+			return fmt.Errorf("failed to stat slice file: %w", err)
+		}
+		relative, _ := filepath.Rel(sliceDir, name)
+		fmt.Fprintf(&manifest, "%d %s\n", info.Size(), filepath.ToSlash(relative))
+	}
+	if err := storage.WriteFile(manifestPath(meta.FileId), []byte(manifest.String())); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	meta.Manifest = true
+	if err := meta.transition(StateComplete, ""); err != nil {
+		return err
+	}
+	content, _ := json.Marshal(meta)
+	if err := metas().write(MetaRecordSession, meta.FileId, content); err != nil {
+		return fmt.Errorf("failed to write meta file: %w", err)
+	}
+	return writeCompletedMeta(meta)
+}
+
+type manifestPart struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// manifestReader reads the slice files listed in a manifest as one file,
+// only the slice file being read is open
+type manifestReader struct {
+	parts  []manifestPart
+	size   int64
+	offset int64
+	// the open slice file and its index in parts
+	file *os.File
+	part int
+}
+
+func openManifest(fileId string) (*manifestReader, error) {
+	manifest, err := os.Open(manifestPath(fileId))
+	if err != nil {
+		return nil, err
+	}
+	defer manifest.Close()
+
+	sliceDir := path.Dir(manifestPath(fileId))
+	reader := &manifestReader{part: -1}
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		sizeField, name, ok := strings.Cut(scanner.Text(), " ")
+		size, err := strconv.ParseInt(sizeField, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("malformed manifest line %q", scanner.Text())
+		}
+		reader.parts = append(reader.parts, manifestPart{path.Join(sliceDir, name), reader.size, size})
+		reader.size += size
+	}
+	return reader, scanner.Err()
+}
+
+func (r *manifestReader) Size() int64 {
+	return r.size
+}
+
+func (r *manifestReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.parts), func(i int) bool {
+		return r.parts[i].offset+r.parts[i].size > r.offset
+	})
+	part := r.parts[i]
+	if r.part != i {
+		r.Close()
+		file, err := os.Open(part.name)
+		if err != nil {
+			return 0, err
+		}
+		r.file, r.part = file, i
+	}
+
+	if left := part.offset + part.size - r.offset; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := r.file.ReadAt(p, r.offset-part.offset)
+	r.offset += int64(n)
+	if n == len(p) {
+		return n, nil
+	}
+	if errors.Is(err, io.EOF) {
+		// the slice file is shorter than the manifest says
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *manifestReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *manifestReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file, r.part = nil, -1
+	return err
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+)
+
+// the kinds of MetaRecord
+const (
+	// the meta of a completed file, in metafile_dir
+	MetaRecordFile = "file"
+	// the meta of a session not completed, in the slice cache
+	MetaRecordSession = "session"
+)
+
+var errInvalidDump = errors.New("invalid metadata dump")
+
+// MetaRecord is a line of a metadata dump, see ExportMetadata
+type MetaRecord struct {
+	Kind string   `json:"kind"`
+	Meta FileMeta `json:"meta"`
+}
+
+// MetadataImport tells how many records an import wrote and how many it left
+// out as they were already there
+type MetadataImport struct {
+	Files    int `json:"files"`
+	Sessions int `json:"sessions"`
+	Skipped  int `json:"skipped"`
+}
+
+// metaRecords are the records of every file and session, sorted by kind and
+// file id
+func metaRecords() ([]MetaRecord, error) {
+	files, err := completedMetas()
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := cachedMetas()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]MetaRecord, 0, len(files)+len(sessions))
+	for _, meta := range files {
+		records = append(records, MetaRecord{Kind: MetaRecordFile, Meta: meta})
+	}
+	for _, meta := range sessions {
+		records = append(records, MetaRecord{Kind: MetaRecordSession, Meta: meta})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Kind != records[j].Kind {
+			return records[i].Kind < records[j].Kind
+		}
+		return records[i].Meta.FileId < records[j].Meta.FileId
+	})
+	return records, nil
+}
+
+// ExportMetadata writes the meta of every file and session to w as json
+// lines of MetaRecord, returns how many. Only the metadata is exported, the
+// stored files and slices stay where they are.
+func ExportMetadata(w io.Writer) (int, error) {
+	records, err := metaRecords()
+	if err != nil {
+		return 0, err
+	}
+	encoder := json.NewEncoder(w)
+	for i, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// ImportMetadata writes the records of the json lines of r, as written by
+// ExportMetadata, into the metadata store. Records of files or sessions
+// already there are skipped unless overwrite is set. It stops at the first
+// invalid line, the records before it are imported.
+func ImportMetadata(r io.Reader, overwrite bool) (MetadataImport, error) {
+	result := MetadataImport{}
+	lines := bufio.NewScanner(r)
+	// a meta with many slices makes a long line
+	lines.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; lines.Scan(); n++ {
+		if len(strings.TrimSpace(lines.Text())) == 0 {
+			continue
+		}
+		var record MetaRecord
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			return result, fmt.Errorf("%w: line %d: %v", errInvalidDump, n, err)
+		}
+		if err := importMeta(record, overwrite, &result); err != nil {
+			return result, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return result, lines.Err()
+}
+
+// importMeta writes record into the metadata store and counts it in result,
+// it is skipped when its meta is there already unless overwrite is set
+func importMeta(record MetaRecord, overwrite bool, result *MetadataImport) error {
+	if err := migrateMeta(&record.Meta); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidDump, err)
+	}
+	if fileId := record.Meta.FileId; fileId == "" || strings.ContainsAny(fileId, "/.") {
+		return fmt.Errorf("%w: invalid file id %q", errInvalidDump, fileId)
+	}
+	written, err := importRecord(record, overwrite)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !written:
+		result.Skipped++
+	case record.Kind == MetaRecordFile:
+		result.Files++
+	default:
+		result.Sessions++
+	}
+	return nil
+}
+
+func importRecord(record MetaRecord, overwrite bool) (bool, error) {
+	if record.Kind != MetaRecordFile && record.Kind != MetaRecordSession {
+		return false, fmt.Errorf("%w: unknown record kind %q", errInvalidDump, record.Kind)
+	}
+	session := lockSession(record.Meta.FileId)
+	defer session.Unlock()
+	// the next request reads the imported meta
+	defer session.forget()
+
+	store := metas()
+	if _, err := store.read(record.Kind, record.Meta.FileId); err == nil && !overwrite {
+		return false, nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	content, _ := json.Marshal(record.Meta)
+	return true, store.write(record.Kind, record.Meta.FileId, content)
+}
+
+// ExportMetadata streams the metadata dump as json lines
+func (a *AdminController) ExportMetadata(c *gin.Context) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="metadata.jsonl"`)
+	c.Status(200)
+	if _, err := ExportMetadata(c.Writer); err != nil {
+		// the status is sent already, the dump is cut short
+		logrus.Errorf("failed to export metadata: %v", err)
+	}
+}
+
+type ImportMetadataParams struct {
+	Overwrite bool `form:"overwrite"`
+}
+
+// ImportMetadata imports the metadata dump of the body
+func (a *AdminController) ImportMetadata(c *gin.Context) {
+	params := ImportMetadataParams{}
+	if !a.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	result, err := ImportMetadata(c.Request.Body, params.Overwrite)
+	if errors.Is(err, errInvalidDump) {
+		a.WriteError(c, result, uploadererrors.ErrInvalidDump.WithMessage(err.Error()))
+		return
+	}
+	if err != nil {
+		logrus.Errorf("failed to import metadata: %v", err)
+		a.Write(c, result, 500, 0, "")
+		return
+	}
+	logrus.Infof("imported metadata of %d files and %d sessions", result.Files, result.Sessions)
+	a.Write(c, result, 200, 0, "")
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// SliceChecksums are hex digests of a slice computed by the client, the
+// slice is rejected unless those given match what arrived
+type SliceChecksums struct {
+	Sha1   string `json:"sha1,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// SliceEncryption tells how the client encrypted a slice, it is kept with
+// the slice for the clients decrypting the file and never checked
+type SliceEncryption struct {
+	Algorithm string `json:"algorithm" binding:"required"`
+	KeyId     string `json:"key_id,omitempty"`
+	// hex
+	IV string `json:"iv,omitempty"`
+}
+
+// mismatch is the field of the first checksum data doesn't match, "" when
+// they all do
+func (s *SliceChecksums) mismatch(data []byte) string {
+	if s == nil {
+		return ""
+	}
+	if s.Sha1 != "" {
+		sum := sha1.Sum(data)
+		if !strings.EqualFold(s.Sha1, hex.EncodeToString(sum[:])) {
+			return "checksums.sha1"
+		}
+	}
+	if s.Sha256 != "" {
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(s.Sha256, hex.EncodeToString(sum[:])) {
+			return "checksums.sha256"
+		}
+	}
+	return ""
+}
+
+// metaPart is the JSON part meta of a multipart upload, as a field or a
+// file part, nil when the upload has none
+func metaPart(c *gin.Context) ([]byte, error) {
+	if c.ContentType() != binding.MIMEMultipartPOSTForm {
+		return nil, nil
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	if values := form.Value["meta"]; len(values) > 0 {
+		return []byte(values[0]), nil
+	}
+	if files := form.File["meta"]; len(files) > 0 {
+		file, err := files[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(io.LimitReader(file, maxMetaPart))
+	}
+	return nil, nil
+}
+
+// the meta part is a few fields, not a slice
+const maxMetaPart = 1 << 20
+
+// bindUpload binds the params of an upload from its JSON part meta and its
+// binary part file, or from its form fields when it has no meta part
+func (f *FileController) bindUpload(c *gin.Context, params *UploadParams) bool {
+	return f.bind(c, params, func(any) error {
+		meta, err := metaPart(c)
+		if err != nil {
+			return err
+		}
+		if meta == nil {
+			return c.ShouldBind(params)
+		}
+		if err := json.Unmarshal(meta, params); err != nil {
+			return err
+		}
+		if params.File, err = c.FormFile("file"); err != nil && err != http.ErrMissingFile {
+			return err
+		}
+		return binding.Validator.ValidateStruct(params)
+	})
+}
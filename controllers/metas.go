@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// readMetas are the metas of kind in the metadata store, but for the ones
+// which can't be read
+func readMetas(kind string) ([]FileMeta, error) {
+	stored, err := metas().list(kind)
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]FileMeta, 0, len(stored))
+	for _, content := range stored {
+		var meta FileMeta
+		if err := decodeMeta(content, &meta); err != nil {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// metas of the completed files
+func completedMetas() ([]FileMeta, error) {
+	return readMetas(MetaRecordFile)
+}
+
+// metas of the sessions still waiting for slices
+func activeMetas() ([]FileMeta, error) {
+	metas, err := readMetas(MetaRecordSession)
+	if err != nil {
+		return nil, err
+	}
+	active := metas[:0]
+	for _, meta := range metas {
+		if !meta.Uploaded() {
+			active = append(active, meta)
+		}
+	}
+	return active, nil
+}
+
+// metas of the sessions in the slice cache whatever their state, but for the
+// meta a completed v2 session leaves there
+func cachedMetas() ([]FileMeta, error) {
+	metas, err := readMetas(MetaRecordSession)
+	if err != nil {
+		return nil, err
+	}
+	completed, err := completedMetas()
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool, len(completed))
+	for _, meta := range completed {
+		done[meta.FileId] = true
+	}
+	cached := metas[:0]
+	for _, meta := range metas {
+		if !done[meta.FileId] {
+			cached = append(cached, meta)
+		}
+	}
+	return cached, nil
+}
+
+// whether prefix is parent or the same as the parent prefix, every prefix is
+// under the empty one
+func underPrefix(prefix string, parent string) bool {
+	prefix = strings.Trim(path.Clean("/"+prefix), "/")
+	parent = strings.Trim(path.Clean("/"+parent), "/")
+	return parent == "" || prefix == parent || strings.HasPrefix(prefix, parent+"/")
+}
+
+// completedUnder lists the completed files under prefix sorted by storage
+// key, a key overwritten by a later upload only has its latest meta
+func completedUnder(prefix string) ([]FileMeta, error) {
+	metas, err := completedMetas()
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]FileMeta{}
+	for _, meta := range metas {
+		if !underPrefix(meta.Prefix, prefix) {
+			continue
+		}
+		if previous, ok := latest[meta.StorageKey()]; !ok || meta.CreatedAt >= previous.CreatedAt {
+			latest[meta.StorageKey()] = meta
+		}
+	}
+	files := make([]FileMeta, 0, len(latest))
+	for _, meta := range latest {
+		files = append(files, meta)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].StorageKey() < files[j].StorageKey() })
+	return files, nil
+}
@@ -0,0 +1,309 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// metaStore keeps the metas of the completed files (MetaRecordFile) and of
+// the sessions (MetaRecordSession), the records of a metadata dump
+type metaStore interface {
+	// read is the meta of kind of fileId, an error wrapping fs.ErrNotExist
+	// when there is none
+	read(kind string, fileId string) ([]byte, error)
+	write(kind string, fileId string, content []byte) error
+	// remove destroys the meta as erasure tells, an error wrapping
+	// fs.ErrNotExist when there is none
+	remove(kind string, fileId string) error
+	// list is every meta of kind by file id
+	list(kind string) (map[string][]byte, error)
+	// erasure is how remove destroys a meta, for erasure reports
+	erasure() string
+}
+
+const defaultMetadataDriver = "files"
+
+var (
+	boltStores     = map[string]*bolt.DB{}
+	boltStoresLock sync.Mutex
+)
+
+// metas is the metadata store of `uploader.metadata.driver`: files (the
+// default) keeps every meta in its meta.json file, in metafile_dir or the
+// slice cache, bolt keeps them in the database `uploader.metadata.path`
+// (metadata.db in metafile_dir by default)
+func metas() metaStore {
+	driver := viper.GetString("uploader.metadata.driver")
+	if driver == "" || driver == defaultMetadataDriver {
+		return fileMetaStore{}
+	}
+	if driver != "bolt" {
+		return failedMetaStore{fmt.Errorf("unknown metadata driver %q", driver)}
+	}
+	db, err := openBolt(metadataPath())
+	if err != nil {
+		return failedMetaStore{err}
+	}
+	return boltMetaStore{db}
+}
+
+func metadataPath() string {
+	if name := viper.GetString("uploader.metadata.path"); name != "" {
+		return name
+	}
+	return path.Join(viper.GetString("uploader.metafile_dir"), "metadata.db")
+}
+
+// openBolt opens the database name once, every store of it shares it
+func openBolt(name string) (*bolt.DB, error) {
+	boltStoresLock.Lock()
+	defer boltStoresLock.Unlock()
+	if db, ok := boltStores[name]; ok {
+		return db, nil
+	}
+	if err := permissions().MkdirAll(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+	// another server holding the database makes this one wait, then fail
+	db, err := bolt.Open(name, storage.DefaultFileMode, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata store %s: %w", name, err)
+	}
+	if err := permissions().ApplyFile(name); err != nil {
+		db.Close()
+		return nil, err
+	}
+	boltStores[name] = db
+	return db, nil
+}
+
+// CloseMetadata closes the metadata store, at shutdown
+func CloseMetadata() {
+	boltStoresLock.Lock()
+	defer boltStoresLock.Unlock()
+	for name, db := range boltStores {
+		if err := db.Close(); err != nil {
+			logrus.Errorf("failed to close metadata store %s: %v", name, err)
+		}
+		delete(boltStores, name)
+	}
+}
+
+// fileMetaStore keeps the meta of a completed file in
+// `<metafile_dir>/<file id>.meta.json` and the one of a session in
+// `<slice_cache_dir>/<file id>/meta.json`
+type fileMetaStore struct{}
+
+func (fileMetaStore) path(kind string, fileId string) string {
+	if kind == MetaRecordFile {
+		return completedMetaPath(fileId)
+	}
+	return path.Join(viper.GetString("uploader.slice_cache_dir"), fileId, "meta.json")
+}
+
+func (s fileMetaStore) read(kind string, fileId string) ([]byte, error) {
+	return os.ReadFile(s.path(kind, fileId))
+}
+
+// write replaces the meta at once, readers see either the old or the new
+// one. Sessions are synced with their slices, files once complete.
+func (s fileMetaStore) write(kind string, fileId string, content []byte) error {
+	name := s.path(kind, fileId)
+	sync := syncs("slice")
+	if kind == MetaRecordFile {
+		sync = syncs("complete")
+	}
+	tmp := name + ".tmp"
+	file, err := permissions().CreateFile(tmp, false)
+	if err == nil {
+		_, err = file.Write(content)
+		if err == nil && sync {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if sync {
+		return syncPath(path.Dir(name))
+	}
+	return nil
+}
+
+func (s fileMetaStore) remove(kind string, fileId string) error {
+	name := s.path(kind, fileId)
+	if err := storage.OverwriteFile(name); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (s fileMetaStore) list(kind string) (map[string][]byte, error) {
+	pattern := path.Join(viper.GetString("uploader.slice_cache_dir"), "*", "meta.json")
+	if kind == MetaRecordFile {
+		pattern = path.Join(viper.GetString("uploader.metafile_dir"), "*.meta.json")
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	metas := make(map[string][]byte, len(names))
+	for _, name := range names {
+		fileId := path.Base(path.Dir(name))
+		if kind == MetaRecordFile {
+			fileId = strings.TrimSuffix(path.Base(name), ".meta.json")
+		}
+		// removed since it was listed
+		if content, err := os.ReadFile(name); err == nil {
+			metas[fileId] = content
+		}
+	}
+	return metas, nil
+}
+
+func (fileMetaStore) erasure() string {
+	return "overwrite+unlink"
+}
+
+// boltMetaStore keeps the metas in a bucket per kind of a bolt database,
+// every write is synced
+type boltMetaStore struct {
+	db *bolt.DB
+}
+
+func (s boltMetaStore) read(kind string, fileId string) ([]byte, error) {
+	var content []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(kind)); bucket != nil {
+			content = bytes.Clone(bucket.Get([]byte(fileId)))
+		}
+		return nil
+	})
+	if err == nil && content == nil {
+		err = &fs.PathError{Op: "read", Path: kind + "/" + fileId, Err: fs.ErrNotExist}
+	}
+	return content, err
+}
+
+func (s boltMetaStore) write(kind string, fileId string, content []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fileId), content)
+	})
+}
+
+func (s boltMetaStore) remove(kind string, fileId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil || bucket.Get([]byte(fileId)) == nil {
+			return &fs.PathError{Op: "remove", Path: kind + "/" + fileId, Err: fs.ErrNotExist}
+		}
+		return bucket.Delete([]byte(fileId))
+	})
+}
+
+func (s boltMetaStore) list(kind string) (map[string][]byte, error) {
+	metas := map[string][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(fileId []byte, content []byte) error {
+			metas[string(fileId)] = bytes.Clone(content)
+			return nil
+		})
+	})
+	return metas, err
+}
+
+// erasure of bolt: the pages freed keep the bytes until they are reused
+func (boltMetaStore) erasure() string {
+	return "delete"
+}
+
+// failedMetaStore is a metadata store which can't be opened, every request
+// needing it fails
+type failedMetaStore struct {
+	err error
+}
+
+func (s failedMetaStore) read(string, string) ([]byte, error)    { return nil, s.err }
+func (s failedMetaStore) write(string, string, []byte) error     { return s.err }
+func (s failedMetaStore) remove(string, string) error            { return s.err }
+func (s failedMetaStore) list(string) (map[string][]byte, error) { return nil, s.err }
+func (s failedMetaStore) erasure() string                        { return "" }
+
+// metaTombstone is left in place of a meta.json file moved into another
+// metadata store, see MigrateMetadata
+type metaTombstone struct {
+	Kind       string `json:"kind"`
+	FileId     string `json:"file_id"`
+	Driver     string `json:"driver"`
+	MigratedAt int64  `json:"migrated_at"`
+}
+
+// MigrateMetadata moves the meta.json files of metafile_dir and the slice
+// cache into the metadata store when it is not the files one, e.g. on the
+// first start with bolt, through the import of metadata dumps. Metas already
+// in the store are left as they are. Each meta.json moved is replaced by its
+// tombstone, `meta.json.migrated`, so the next start doesn't import it again
+// and sessions being uploaded carry on from the store.
+func MigrateMetadata() (MetadataImport, error) {
+	result := MetadataImport{}
+	store := metas()
+	if _, ok := store.(fileMetaStore); ok {
+		return result, nil
+	}
+	legacy := fileMetaStore{}
+	for _, kind := range []string{MetaRecordFile, MetaRecordSession} {
+		metas, err := legacy.list(kind)
+		if err != nil {
+			return result, err
+		}
+		for fileId, content := range metas {
+			var record MetaRecord
+			record.Kind = kind
+			if err := json.Unmarshal(content, &record.Meta); err != nil || record.Meta.FileId != fileId {
+				logrus.Errorf("left out meta of %s which can't be read: %v", fileId, err)
+				continue
+			}
+			if err := importMeta(record, false, &result); err != nil {
+				return result, fmt.Errorf("failed to import meta of %s: %w", fileId, err)
+			}
+			tombstone, _ := json.Marshal(metaTombstone{Kind: kind, FileId: fileId, Driver: viper.GetString("uploader.metadata.driver"), MigratedAt: time.Now().Unix()})
+			name := legacy.path(kind, fileId)
+			if err := permissions().WriteFile(name+".migrated", tombstone); err != nil {
+				return result, err
+			}
+			if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
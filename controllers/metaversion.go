@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/louis-she/simple-uploader/uploadererrors"
+)
+
+// MetaVersion is the layout of the FileMeta this server writes, recorded in
+// every meta as `meta_version`. Fields are added as optional ones, which
+// older servers ignore, without changing it; a change older servers would
+// misread, e.g. a field changing meaning, bumps it with a migration from the
+// previous layout in metaMigrations.
+const MetaVersion = 1
+
+// metaMigrations[v] brings a meta of version v to version v+1, version 0 is
+// the metas written before meta_version was recorded
+var metaMigrations = []func(meta *FileMeta){
+	migrateUnversionedMeta,
+}
+
+// migrateUnversionedMeta records what metas written before meta_version
+// only tell by their shape: the state of sessions from before the state
+// machine, uploading once one of their slices arrived
+func migrateUnversionedMeta(meta *FileMeta) {
+	if meta.Slices == nil {
+		meta.Slices = make(map[string]Slice)
+	}
+	if meta.State != "" {
+		return
+	}
+	meta.State = meta.state()
+	for _, slice := range meta.Slices {
+		if meta.State == StateCreated && slice.Status == 1 {
+			meta.State = StateUploading
+		}
+	}
+}
+
+// migrateMeta brings meta to MetaVersion. Metas of a newer version, written
+// by a newer server during a rolling upgrade, are refused rather than
+// misread or written back without the fields this server doesn't know.
+func migrateMeta(meta *FileMeta) error {
+	if meta.MetaVersion > MetaVersion {
+		return fmt.Errorf("%w: %s has version %d, this server reads up to %d", uploadererrors.ErrMetaVersion, meta.FileId, meta.MetaVersion, MetaVersion)
+	}
+	for meta.MetaVersion < MetaVersion {
+		metaMigrations[meta.MetaVersion](meta)
+		meta.MetaVersion++
+	}
+	return nil
+}
+
+// decodeMeta reads the json of a meta and migrates it
+func decodeMeta(content []byte, meta *FileMeta) error {
+	if err := json.Unmarshal(content, meta); err != nil {
+		return err
+	}
+	return migrateMeta(meta)
+}
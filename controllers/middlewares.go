@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// route groups of the middlewares, the middlewares without one run on both
+const (
+	GroupFiles = "files"
+	GroupAdmin = "admin"
+)
+
+// MiddlewareConfig is one of `uploader.middlewares`, which run in their order
+// on the routes of Group after the middlewares of the uploader itself and
+// before the guards and handlers of the routes
+type MiddlewareConfig struct {
+	Name    string            `mapstructure:"name"`
+	Group   string            `mapstructure:"group"`
+	Options map[string]string `mapstructure:"options"`
+}
+
+type MiddlewareFactory func(config MiddlewareConfig) (gin.HandlerFunc, error)
+
+var middlewareFactories = map[string]MiddlewareFactory{
+	"headers": func(config MiddlewareConfig) (gin.HandlerFunc, error) {
+		return func(c *gin.Context) {
+			for name, value := range config.Options {
+				c.Header(name, value)
+			}
+			c.Next()
+		}, nil
+	},
+}
+
+// RegisterMiddleware makes a middleware available to `uploader.middlewares`,
+// e.g. the authentication or logging of a site embedding the uploader
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareFactories[name] = factory
+}
+
+func newMiddleware(config MiddlewareConfig) (gin.HandlerFunc, error) {
+	switch config.Group {
+	case "", GroupFiles, GroupAdmin:
+	default:
+		return nil, fmt.Errorf("unknown group %q", config.Group)
+	}
+	factory, ok := middlewareFactories[config.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware %q", config.Name)
+	}
+	return factory(config)
+}
+
+func middlewareConfigs() ([]MiddlewareConfig, error) {
+	var configs []MiddlewareConfig
+	err := viper.UnmarshalKey("uploader.middlewares", &configs)
+	return configs, err
+}
+
+// middlewares of group, a middleware which can't be built answers 500 in
+// its place rather than letting requests through without it
+func middlewares(group string) []gin.HandlerFunc {
+	configs, err := middlewareConfigs()
+	if err != nil {
+		logrus.Errorf("invalid uploader.middlewares: %v", err)
+		return []gin.HandlerFunc{brokenMiddleware}
+	}
+	var handlers []gin.HandlerFunc
+	for _, config := range configs {
+		if config.Group != "" && config.Group != group {
+			continue
+		}
+		handler, err := newMiddleware(config)
+		if err != nil {
+			logrus.Errorf("failed to create middleware %s: %v", config.Name, err)
+			handler = brokenMiddleware
+		}
+		handlers = append(handlers, handler)
+	}
+	return handlers
+}
+
+func brokenMiddleware(c *gin.Context) {
+	(&BaseController{}).Write(c, nil, 500, 0, "")
+	c.Abort()
+}
+
+// groupRoutes adds the middlewares of a group in front of the handlers of
+// the routes registered through it
+type groupRoutes struct {
+	gin.IRoutes
+	middlewares []gin.HandlerFunc
+}
+
+func withMiddlewares(r gin.IRoutes, group string) gin.IRoutes {
+	handlers := middlewares(group)
+	if len(handlers) == 0 {
+		return r
+	}
+	return &groupRoutes{IRoutes: r, middlewares: handlers}
+}
+
+func (r *groupRoutes) chain(handlers []gin.HandlerFunc) []gin.HandlerFunc {
+	return append(append([]gin.HandlerFunc{}, r.middlewares...), handlers...)
+}
+
+func (r *groupRoutes) Handle(method string, path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.IRoutes.Handle(method, path, r.chain(handlers)...)
+}
+
+func (r *groupRoutes) GET(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.IRoutes.GET(path, r.chain(handlers)...)
+}
+
+func (r *groupRoutes) POST(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.IRoutes.POST(path, r.chain(handlers)...)
+}
+
+func (r *groupRoutes) PUT(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.IRoutes.PUT(path, r.chain(handlers)...)
+}
+
+func (r *groupRoutes) PATCH(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.IRoutes.PATCH(path, r.chain(handlers)...)
+}
+
+func (r *groupRoutes) DELETE(path string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	return r.IRoutes.DELETE(path, r.chain(handlers)...)
+}
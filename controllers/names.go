@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// NamePolicy keeps names out of the stored tree which the web server serving
+// it would treat specially, such as `.htaccess` or scripts it runs
+type NamePolicy struct {
+	// path.Match patterns of the file names refused, whatever their case,
+	// e.g. `.htaccess`, `*.php` or `*.php.*`
+	Deny []string `mapstructure:"deny"`
+	// a file named without an extension gets the one of the type sniffed
+	// from its content before it is stored, see safeExtensions
+	AppendExtension bool `mapstructure:"append_extension"`
+}
+
+// safeExtensions of the sniffed types, types a browser would run scripts of
+// are stored as text and unknown ones as binary
+var safeExtensions = map[string]string{
+	"image/jpeg":                   ".jpg",
+	"image/png":                    ".png",
+	"image/gif":                    ".gif",
+	"image/webp":                   ".webp",
+	"image/bmp":                    ".bmp",
+	"image/x-icon":                 ".ico",
+	"application/pdf":              ".pdf",
+	"application/zip":              ".zip",
+	"application/x-gzip":           ".gz",
+	"application/x-rar-compressed": ".rar",
+	"application/ogg":              ".ogg",
+	"application/wasm":             ".wasm",
+	"audio/mpeg":                   ".mp3",
+	"audio/wave":                   ".wav",
+	"audio/aiff":                   ".aiff",
+	"audio/midi":                   ".mid",
+	"video/mp4":                    ".mp4",
+	"video/webm":                   ".webm",
+	"video/avi":                    ".avi",
+	"font/woff":                    ".woff",
+	"font/woff2":                   ".woff2",
+	"font/ttf":                     ".ttf",
+	"font/otf":                     ".otf",
+	"text/plain":                   ".txt",
+	"text/html":                    ".txt",
+	"text/xml":                     ".txt",
+	"application/octet-stream":     ".bin",
+}
+
+// checkName refuses name when it matches a deny rule of prefix. Trailing
+// dots and spaces are ignored, some servers drop them.
+func checkName(prefix string, name string) error {
+	// every element of the name, "sub/shell.php" is a script in sub
+	elements := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool { return r == '/' || r == '\\' })
+	for _, pattern := range prefixConfig(prefix).Names.Deny {
+		for _, element := range elements {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.TrimRight(element, ". ")); ok {
+				return &ValidationError{Rule: "names", Detail: fmt.Sprintf("file name matches %s", pattern)}
+			}
+		}
+	}
+	return nil
+}
+
+// enforceNames is the pre processor appending the extension of the sniffed
+// type to a file named without one, and checking the deny rules again once
+// the processors may have renamed it
+func enforceNames(meta *FileMeta, name string) (bool, error) {
+	policy := prefixConfig(meta.Prefix).Names
+	if policy.AppendExtension && path.Ext(meta.FileName) == "" {
+		file, err := os.Open(name)
+		if err != nil {
+			return false, err
+		}
+		head := make([]byte, 512)
+		n, err := io.ReadFull(file, head)
+		file.Close()
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return false, err
+		}
+		sniffed, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+		ext, ok := safeExtensions[sniffed]
+		if !ok {
+			ext = ".bin"
+		}
+		meta.FileName += ext
+	}
+	return false, checkName(meta.Prefix, meta.FileName)
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var namePlaceholder = regexp.MustCompile(`\{([a-z_]*)\}`)
+
+// components a name template must have one of, so two files never get the
+// same name
+var uniqueComponents = []string{"uuid", "rand", "file_id"}
+
+// renderName renders the name template of a session, e.g.
+// `{date}/{uuid}_{orig_name}`: {date}, {year}, {month}, {day} and {time}
+// (hhmmss) of now in UTC, {uuid} (random v4), {rand} (16 hex), {file_id},
+// and {orig_name}, {orig_base} and {ext} of the name the client sent. The
+// result is relative and without `..`, a slash separates directories.
+func renderName(template string, origName string, fileId string, now time.Time) (string, error) {
+	now = now.UTC()
+	origName = safeOrigName(origName)
+	ext := path.Ext(origName)
+	unique := false
+	var unknown string
+	rendered := namePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		component := strings.Trim(placeholder, "{}")
+		for _, name := range uniqueComponents {
+			unique = unique || component == name
+		}
+		switch component {
+		case "date":
+			return now.Format("2006-01-02")
+		case "year":
+			return now.Format("2006")
+		case "month":
+			return now.Format("01")
+		case "day":
+			return now.Format("02")
+		case "time":
+			return now.Format("150405")
+		case "uuid":
+			return newUUID()
+		case "rand":
+			b := make([]byte, 8)
+			rand.Read(b)
+			return hex.EncodeToString(b)
+		case "file_id":
+			return fileId
+		case "orig_name":
+			return origName
+		case "orig_base":
+			return strings.TrimSuffix(origName, ext)
+		case "ext":
+			return ext
+		}
+		if unknown == "" {
+			unknown = placeholder
+		}
+		return placeholder
+	})
+	if unknown != "" {
+		return "", fmt.Errorf("unknown component %s", unknown)
+	}
+	if !unique {
+		return "", fmt.Errorf("needs one of {uuid}, {rand} or {file_id}")
+	}
+	rendered = strings.Trim(rendered, "/")
+	for _, segment := range strings.Split(rendered, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("renders %q, an invalid path", rendered)
+		}
+	}
+	return rendered, nil
+}
+
+// safeOrigName is the base of the name sent by the client without control
+// characters, it may come from any file system
+func safeOrigName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// applyNameTemplate names the file of a new session with the template it was
+// created with, or the one of its prefix. The directories of the rendered
+// name go to the prefix, the original name is kept in the meta.
+func applyNameTemplate(params *CreateParams, fileId string) (string, error) {
+	template := params.NameTemplate
+	if template == "" {
+		template = prefixConfig(params.Prefix).NameTemplate
+	}
+	if template == "" {
+		return "", nil
+	}
+	rendered, err := renderName(template, params.FileName, fileId, time.Now())
+	if err != nil {
+		return "", err
+	}
+	origName := params.FileName
+	params.NameTemplate = template
+	if dir := path.Dir(rendered); dir != "." {
+		params.Prefix = path.Join(params.Prefix, dir)
+	}
+	params.FileName = path.Base(rendered)
+	return origName, nil
+}
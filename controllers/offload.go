@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// offload answers the download of the completed file at name with the header
+// of `uploader.offload.header`, the front proxy then sends the file itself:
+// X-Accel-Redirect (nginx) gets `uploader.offload.location` followed by the
+// path of the file under `uploader.offload.root` (the directory holding the
+// upload dirs by default), X-Sendfile (Apache, lighttpd) the absolute path.
+// Files out of root are not offloaded.
+func (f *FileController) offload(c *gin.Context, name string, meta FileMeta) bool {
+	header := http.CanonicalHeaderKey(viper.GetString("uploader.offload.header"))
+	var target string
+	switch header {
+	case "X-Accel-Redirect":
+		root := viper.GetString("uploader.offload.root")
+		if root == "" {
+			root = commonDir(UploadDirs())
+		}
+		relative, err := filepath.Rel(root, name)
+		if err != nil || !filepath.IsLocal(relative) {
+			return false
+		}
+		location := path.Join("/", viper.GetString("uploader.offload.location"), filepath.ToSlash(relative))
+		target = (&url.URL{Path: location}).EscapedPath()
+	case "X-Sendfile":
+		absolute, err := filepath.Abs(name)
+		if err != nil {
+			return false
+		}
+		target = absolute
+	default:
+		return false
+	}
+
+	contentType := meta.FileType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	// metered as sent, see Accounting
+	if start, end, ok := parseRange(c.GetHeader("Range"), meta.FileSize); ok {
+		c.Set("offloaded_bytes", end-start)
+	} else {
+		c.Set("offloaded_bytes", meta.FileSize)
+	}
+	c.Header(header, target)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.FileName}))
+	c.Status(200)
+	c.Writer.WriteHeaderNow()
+	return true
+}
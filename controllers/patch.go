@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultPatchMaxSize = 64 * 1024 * 1024
+
+// patchJournal heads the journal of a patch, followed by the bytes the patch
+// overwrites
+type patchJournal struct {
+	FileId string `json:"file_id"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// patchJournalPath is the journal of the patch of a file in progress,
+// `<file id>.patch.journal` in metafile_dir
+func patchJournalPath(fileId string) string {
+	return path.Join(viper.GetString("uploader.metafile_dir"), fileId+".patch.journal")
+}
+
+// erasePatchJournal destroys the journal of a patch a crash left behind, it
+// holds the bytes the patch overwrote
+func erasePatchJournal(meta *FileMeta, store storage.Storage, key string) ([]ErasureItem, error) {
+	return eraseLocalFile("patch_journal", patchJournalPath(meta.FileId))
+}
+
+func patchMaxSize() int64 {
+	if viper.IsSet("uploader.patch.max_size") {
+		return int64(viper.GetSizeInBytes("uploader.patch.max_size"))
+	}
+	return defaultPatchMaxSize
+}
+
+// Patch overwrites the bytes of the Content-Range of a completed file with
+// the raw body, e.g. the few blocks which changed in a disk image, instead
+// of uploading it whole again. The range can't go past the end of the file.
+// The bytes overwritten are journaled first, so a patch interrupted by a
+// crash is rolled back at start (see RecoverPatches), then the digests of
+// the file are computed again. Takes If-Match and If-Unmodified-Since as
+// Create does.
+func (a *AdminController) Patch(c *gin.Context) {
+	if fileId := c.Param("id"); fileId == "" || strings.ContainsAny(fileId, "/.") {
+		a.Write(c, nil, 400, 0, "")
+		return
+	}
+	session := lockSession(c.Param("id"))
+	defer session.Unlock()
+	defer session.forget()
+	meta, err := readMeta(c.Param("id"))
+	if !a.checkReadMeta(c, err) {
+		return
+	}
+	if !meta.stored() || meta.Manifest {
+		a.WriteError(c, nil, uploadererrors.ErrNotPatchable)
+		return
+	}
+	store, err := meta.storage()
+	if err != nil {
+		logrus.Errorf("failed to create storage of %s: %v", meta.FileId, err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	key := meta.StorageKey()
+	name, ok := storage.LocalPath(store, key)
+	if !ok {
+		a.WriteError(c, nil, uploadererrors.ErrNotPatchable)
+		return
+	}
+	if storage.IsLocked(store, key) {
+		a.WriteError(c, nil, uploadererrors.ErrFileLocked)
+		return
+	}
+
+	bytesRange, err := parseContentRange(c.GetHeader("Content-Range"), meta.FileSize)
+	if err != nil || bytesRange.empty {
+		a.WriteError(c, nil, uploadererrors.ErrInvalidContentRange)
+		return
+	}
+	if bytesRange.end-bytesRange.start+1 > patchMaxSize() {
+		a.WriteError(c, nil, uploadererrors.ErrPatchTooLarge)
+		return
+	}
+	precondition, err := newPrecondition(c)
+	if err != nil {
+		a.WriteError(c, nil, err)
+		return
+	}
+
+	unlock := lockKey(key)
+	defer unlock()
+	if err := precondition.check(store, key); errors.Is(err, uploadererrors.ErrPreconditionFailed) {
+		a.WriteError(c, nil, err)
+		return
+	} else if err != nil {
+		logrus.Errorf("failed to check the precondition of %s: %v", meta.FileId, err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+
+	journal := patchJournal{FileId: meta.FileId, Offset: bytesRange.start, Size: bytesRange.end - bytesRange.start + 1}
+	if err := patchFile(c.Request.Context(), &meta, name, journal, c.Request.Body); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			a.WriteError(c, nil, uploadererrors.ErrBodyTooShort)
+			return
+		}
+		logrus.Errorf("failed to patch %s: %v", meta.FileId, err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	logSessionEvent(meta.FileId, SessionEvent{Event: "patch", Client: c.ClientIP(), Size: journal.Size})
+	for _, finisher := range finishers {
+		if err := finisher(&meta, store, key); err != nil {
+			logrus.Errorf("failed to finish the patch of %s: %v", meta.FileId, err)
+		}
+	}
+	a.Write(c, meta, 200, 0, "")
+}
+
+// patchFile overwrites the bytes of journal in the file name with body and
+// records the new digests of the file and of the slices it overlaps in meta,
+// the file is left as it was on failure
+func patchFile(ctx context.Context, meta *FileMeta, name string, journal patchJournal, body io.Reader) error {
+	// a patch a crash left behind before RecoverPatches ran
+	if err := rollbackPatch(meta.FileId, name); err != nil {
+		return err
+	}
+	if err := writePatchJournal(name, journal); err != nil {
+		return fmt.Errorf("failed to journal: %w", err)
+	}
+
+	err := writeAt(name, journal.Offset, journal.Size, body)
+	if err == nil {
+		err = rehashSlices(ctx, meta, name, journal.Offset, journal.Offset+journal.Size)
+	}
+	if err == nil {
+		err = digestFile(ctx, meta, name)
+	}
+	if err == nil {
+		err = writeCompletedMeta(meta)
+	}
+	if err != nil {
+		if rollbackErr := rollbackPatch(meta.FileId, name); rollbackErr != nil {
+			logrus.Errorf("failed to roll back the patch of %s: %v", meta.FileId, rollbackErr)
+		}
+		return err
+	}
+	return os.Remove(patchJournalPath(meta.FileId))
+}
+
+// writePatchJournal saves the bytes journal is about to overwrite. Journals
+// are synced whatever uploader.durability is, they are only worth anything
+// once on disk.
+func writePatchJournal(name string, journal patchJournal) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	journalPath := patchJournalPath(journal.FileId)
+	tmp := journalPath + ".tmp"
+	out, err := storage.CreateFile(tmp, false)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(journal)
+	_, err = out.Write(append(header, '\n'))
+	if err == nil {
+		var n int64
+		n, err = io.Copy(out, io.NewSectionReader(file, journal.Offset, journal.Size))
+		if err == nil && n != journal.Size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, journalPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncEntry(journalPath)
+}
+
+// writeAt writes size bytes of r at offset of the file name and syncs it
+func writeAt(name string, offset int64, size int64, r io.Reader) error {
+	out, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.NewOffsetWriter(out, offset), io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rollbackPatch puts back the bytes journaled for the file name, if any
+func rollbackPatch(fileId string, name string) error {
+	journalPath := patchJournalPath(fileId)
+	file, err := os.Open(journalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("invalid patch journal %s: %w", journalPath, err)
+	}
+	var journal patchJournal
+	if err := json.Unmarshal(header, &journal); err != nil {
+		return fmt.Errorf("invalid patch journal %s: %w", journalPath, err)
+	}
+	if err := writeAt(name, journal.Offset, journal.Size, reader); err != nil {
+		return err
+	}
+	logrus.Warningf("rolled back an unfinished patch of %s", fileId)
+	return os.Remove(journalPath)
+}
+
+// RecoverPatches rolls back the patches a crash interrupted, before the
+// server takes requests
+func RecoverPatches() error {
+	journals, err := filepath.Glob(patchJournalPath("*"))
+	if err != nil {
+		return err
+	}
+	for _, journalPath := range journals {
+		fileId := strings.TrimSuffix(filepath.Base(journalPath), ".patch.journal")
+		meta, err := readMeta(fileId)
+		if err != nil {
+			return err
+		}
+		store, err := meta.storage()
+		if err != nil {
+			return err
+		}
+		name, ok := storage.LocalPath(store, meta.StorageKey())
+		if !ok {
+			return fmt.Errorf("patch journal of %s without local storage", fileId)
+		}
+		if err := rollbackPatch(fileId, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
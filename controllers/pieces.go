@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// PieceInfo describes a file the way BitTorrent does, the slices are the
+// pieces: the bitfield has the highest bit of the first byte for piece 0 and
+// the spare bits cleared, hashes are the sha1 of the pieces
+type PieceInfo struct {
+	Name        string `json:"name"`
+	Length      int64  `json:"length"`
+	PieceLength int64  `json:"piece_length"`
+	PieceCount  int    `json:"piece_count"`
+	// base64 of the bitfield of the available pieces
+	Bitfield string `json:"bitfield"`
+	// hex sha1 of every piece, empty for the ones not available yet
+	PieceHashes []string `json:"piece_hashes"`
+	Complete    bool     `json:"complete"`
+}
+
+func newPieceInfo(meta FileMeta) PieceInfo {
+	info := PieceInfo{
+		Name:        meta.FileName,
+		Length:      meta.FileSize,
+		PieceLength: meta.ChunkSize,
+		PieceCount:  len(meta.Slices),
+		Bitfield:    base64.StdEncoding.EncodeToString(slicesBitmap(meta)),
+		PieceHashes: make([]string, len(meta.Slices)),
+		Complete:    meta.Uploaded(),
+	}
+	for i := range info.PieceHashes {
+		if slice := meta.Slices[strconv.Itoa(i)]; slice.Status == 1 {
+			info.PieceHashes[i] = slice.Sha1
+		}
+	}
+	return info
+}
+
+// Pieces tells mirrors which pieces of the file they can fetch already, also
+// while it is being uploaded
+func (f *FileController) Pieces(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) || !f.checkReader(c, &meta) {
+		return
+	}
+	f.Write(c, newPieceInfo(meta), 200, 0, "")
+}
+
+// Piece serves the data of an available piece
+func (f *FileController) Piece(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) || !f.checkReader(c, &meta) {
+		return
+	}
+	index, err := strconv.Atoi(c.Param("slice_id"))
+	if err != nil || meta.Slices[c.Param("slice_id")].Status != 1 {
+		f.Write(c, nil, 404, 0, "")
+		return
+	}
+
+	reader, size, err := openSlice(meta, index)
+	if err != nil {
+		if os.IsNotExist(err) {
+			f.Write(c, nil, 404, 0, "")
+			return
+		}
+		logrus.Errorf("failed to open slice %d of %s: %v", index, meta.FileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	defer reader.Close()
+	c.Header("X-Piece-Sha1", meta.Slices[c.Param("slice_id")].Sha1)
+	c.DataFromReader(200, size, "application/octet-stream", reader, nil)
+}
+
+func (m *FileMeta) sliceSize(index int) int64 {
+	offset := int64(index) * m.ChunkSize
+	if m.FileSize-offset < m.ChunkSize {
+		return m.FileSize - offset
+	}
+	return m.ChunkSize
+}
+
+type sliceReader struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// openSlice reads slice index of the file wherever it is: in the stored file
+// once completed, otherwise in the slice file (v1) or the target file (v2) of
+// the cache
+func openSlice(meta FileMeta, index int) (*sliceReader, int64, error) {
+	size := meta.sliceSize(index)
+	offset := int64(index) * meta.ChunkSize
+
+	var name string
+	if meta.stored() {
+		store, err := meta.storage()
+		if err != nil {
+			return nil, 0, err
+		}
+		var ok bool
+		if name, ok = storage.LocalPath(store, meta.StorageKey()); !ok {
+			return nil, 0, errors.New("storage is not local")
+		}
+	} else {
+		slice := meta.Slices[strconv.Itoa(index)]
+		name = meta.slicePath(slice.Id, slice.Sha1)
+		if _, err := os.Stat(name); err == nil {
+			offset = 0
+		} else {
+			name = meta.partialPath()
+		}
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &sliceReader{io.NewSectionReader(file, offset, size), file}, size, nil
+}
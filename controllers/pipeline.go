@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/spf13/viper"
+)
+
+// a preProcessor may rewrite the local file of a session before it goes into
+// storage, it tells whether it did
+type preProcessor func(meta *FileMeta, name string) (bool, error)
+
+var preProcessors = []preProcessor{
+	// the policy applies to what was uploaded
+	validate,
+	scan,
+	convert,
+	sanitize,
+	sandbox,
+	external,
+	// the name the file is stored under, once the processors renamed it
+	enforceNames,
+}
+
+// preProcess runs the pre processors on the complete local file, when it is
+// rewritten the size and the hashes in meta are updated to match
+func preProcess(meta *FileMeta, name string) error {
+	rewritten := false
+	for _, processor := range preProcessors {
+		changed, err := processor(meta, name)
+		if err != nil {
+			return err
+		}
+		rewritten = rewritten || changed
+	}
+	if !rewritten {
+		return nil
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	meta.FileSize = info.Size()
+	meta.Slices = make(map[string]Slice)
+	return hashSlices(meta, name)
+}
+
+// a postProcessor runs once the file of a session is in storage at key, its
+// staging key while uploader.staging is enabled
+type postProcessor func(meta *FileMeta, store storage.Storage, key string) error
+
+var postProcessors = []postProcessor{
+	indexFile,
+	addToIPFS,
+}
+
+// finishers run once the file has its final key and its meta is written
+var finishers = []postProcessor{
+	publish,
+	writeProvenance,
+	replicate,
+	// keep it last, consumers take the marker as the file being ready
+	writeDoneMarker,
+}
+
+// place moves the complete local file src into storage, runs the post
+// processors and writes the meta of the completed file. With
+// uploader.staging the file waits as `.staging/<file id>` until the post
+// processors passed, so nothing half processed shows up under its name.
+// Putting the file is given up once ctx is done, what follows isn't.
+func place(ctx context.Context, meta *FileMeta, store storage.Storage, src string) error {
+	if meta.AppendTo != "" {
+		return appendFile(ctx, meta, store, src)
+	}
+	unlock := lockKey(meta.StorageKey())
+	defer unlock()
+	// compacted files met it when they were completed
+	if meta.state() != StateComplete {
+		if err := meta.Precondition.check(store, meta.StorageKey()); err != nil {
+			return err
+		}
+	}
+	key := meta.StorageKey()
+	if viper.GetBool("uploader.staging") {
+		key = stagingKey(meta.FileId)
+	}
+	if err := storage.PutContext(ctx, store, key, src); err != nil {
+		return fmt.Errorf("failed to move into storage: %w", err)
+	}
+	return settle(meta, store, key)
+}
+
+// settle runs the post processors on the file put into storage at key, moves
+// it out of staging and writes the meta of the completed file
+func settle(meta *FileMeta, store storage.Storage, key string) error {
+	for _, processor := range postProcessors {
+		if err := processor(meta, store, key); err != nil {
+			return err
+		}
+	}
+	if key != meta.StorageKey() {
+		if err := store.Rename(key, meta.StorageKey()); err != nil {
+			return fmt.Errorf("failed to move %s out of staging: %w", meta.FileId, err)
+		}
+	}
+	if name, ok := storage.LocalPath(store, meta.StorageKey()); ok && syncs("complete") {
+		if err := syncEntry(name); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", meta.FileId, err)
+		}
+	}
+	if err := meta.transition(StateComplete, ""); err != nil {
+		return err
+	}
+	if err := writeCompletedMeta(meta); err != nil {
+		return err
+	}
+	for _, finisher := range finishers {
+		if err := finisher(meta, store, meta.StorageKey()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish links the file as configured in the publish settings of its prefix
+func publish(meta *FileMeta, store storage.Storage, key string) error {
+	config := prefixConfig(meta.Prefix).Publish
+	if config.Symlink == "" && config.HardlinkDir == "" {
+		return nil
+	}
+	filePath, ok := storage.LocalPath(store, key)
+	if !ok {
+		return fmt.Errorf("publish needs local storage, got %s", meta.Storage.Driver)
+	}
+
+	if config.Symlink != "" {
+		link := filepath.Join(filepath.Dir(filePath), config.Symlink)
+		if err := replaceLink(link, func(tmp string) error {
+			return os.Symlink(filepath.Base(filePath), tmp)
+		}); err != nil {
+			return fmt.Errorf("failed to symlink %s: %w", link, err)
+		}
+	}
+
+	if config.HardlinkDir != "" {
+		link := filepath.Join(config.HardlinkDir, filepath.FromSlash(key))
+		if err := permissions().MkdirAll(filepath.Dir(link)); err != nil {
+			return err
+		}
+		if err := replaceLink(link, func(tmp string) error {
+			return os.Link(filePath, tmp)
+		}); err != nil {
+			return fmt.Errorf("failed to hardlink %s: %w", link, err)
+		}
+	}
+	return nil
+}
+
+// erasePublished unlinks the links publish made to an erased file, the
+// symlink only while it still points at it
+func erasePublished(meta *FileMeta, store storage.Storage, key string) ([]ErasureItem, error) {
+	config := prefixConfig(meta.Prefix).Publish
+	filePath, ok := storage.LocalPath(store, key)
+	if !ok {
+		return nil, nil
+	}
+	var items []ErasureItem
+	if config.Symlink != "" {
+		link := filepath.Join(filepath.Dir(filePath), config.Symlink)
+		if target, err := os.Readlink(link); err == nil && target == filepath.Base(filePath) {
+			if err := os.Remove(link); err != nil {
+				return nil, err
+			}
+			items = append(items, ErasureItem{Kind: "published_link", Method: "unlink"})
+		}
+	}
+	if config.HardlinkDir != "" {
+		link := filepath.Join(config.HardlinkDir, filepath.FromSlash(key))
+		if info, err := os.Lstat(link); err == nil {
+			if err := os.Remove(link); err != nil {
+				return nil, err
+			}
+			items = append(items, ErasureItem{Kind: "published_link", Bytes: info.Size(), Method: "unlink"})
+		}
+	}
+	return items, nil
+}
+
+// create the link at a temporary name and rename it over the old one, so
+// consumers never see the link missing
+func replaceLink(link string, create func(tmp string) error) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+type DoneMarker struct {
+	FileId string `json:"file_id"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// writeDoneMarker puts `<file name>.done` next to the completed file when
+// `uploader.done_marker` is enabled, for consumers watching the directory
+func writeDoneMarker(meta *FileMeta, store storage.Storage, key string) error {
+	if !viper.GetBool("uploader.done_marker") {
+		return nil
+	}
+	filePath, ok := storage.LocalPath(store, key)
+	if !ok {
+		return fmt.Errorf("done marker needs local storage, got %s", meta.Storage.Driver)
+	}
+
+	content, _ := json.Marshal(DoneMarker{FileId: meta.FileId, Size: meta.FileSize, Sha256: meta.Sha256})
+	if err := permissions().WriteFile(filePath+".done", content); err != nil {
+		return fmt.Errorf("failed to write done marker: %w", err)
+	}
+	return nil
+}
+
+// eraseDoneMarker destroys the done marker of an erased file, it holds its
+// sha256
+func eraseDoneMarker(meta *FileMeta, store storage.Storage, key string) ([]ErasureItem, error) {
+	filePath, ok := storage.LocalPath(store, key)
+	if !ok {
+		return nil, nil
+	}
+	return eraseLocalFile("done_marker", filePath+".done")
+}
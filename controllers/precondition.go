@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+)
+
+var errInvalidUnmodifiedSince = uploadererrors.ErrInvalidUnmodifiedSince
+
+// Precondition is what the file at the name of a session must be for the
+// session to replace it, taken from the If-Match, If-None-Match and
+// If-Unmodified-Since headers of Create. It is checked at Create and again
+// when the file is completed.
+type Precondition struct {
+	// etags the file must have, * for any file
+	IfMatch []string `json:"if_match,omitempty"`
+	// etags the file must not have, * for no file at all
+	IfNoneMatch []string `json:"if_none_match,omitempty"`
+	// unix seconds
+	IfUnmodifiedSince int64 `json:"if_unmodified_since,omitempty"`
+}
+
+// storedETag is the etag of the version of a stored file, its modification
+// time and size as nginx does it
+func storedETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// etagList splits an If-Match or If-None-Match header
+func etagList(header string) []string {
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimSpace(etag); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// newPrecondition is the precondition of the request, nil without one
+func newPrecondition(c *gin.Context) (*Precondition, error) {
+	precondition := Precondition{
+		IfMatch:     etagList(c.GetHeader("If-Match")),
+		IfNoneMatch: etagList(c.GetHeader("If-None-Match")),
+	}
+	if header := c.GetHeader("If-Unmodified-Since"); header != "" {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return nil, errInvalidUnmodifiedSince
+		}
+		precondition.IfUnmodifiedSince = since.Unix()
+	}
+	if precondition.IfMatch == nil && precondition.IfNoneMatch == nil && precondition.IfUnmodifiedSince == 0 {
+		return nil, nil
+	}
+	return &precondition, nil
+}
+
+func matchesETag(etags []string, etag string) bool {
+	for _, candidate := range etags {
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// check tells whether the file at key meets p, a nil p always passes
+func (p *Precondition) check(store storage.Storage, key string) error {
+	if p == nil {
+		return nil
+	}
+	info, err := store.Stat(key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	exists := err == nil
+	var etag string
+	if exists {
+		etag = storedETag(info)
+	}
+	switch {
+	case p.IfMatch != nil && !(exists && matchesETag(p.IfMatch, etag)):
+		return uploadererrors.ErrPreconditionFailed
+	case p.IfNoneMatch != nil && exists && matchesETag(p.IfNoneMatch, etag):
+		return uploadererrors.ErrPreconditionFailed
+	// If-Match supersedes it
+	case p.IfMatch == nil && p.IfUnmodifiedSince != 0 && exists && info.ModTime().Unix() > p.IfUnmodifiedSince:
+		return uploadererrors.ErrPreconditionFailed
+	}
+	return nil
+}
+
+// keyLock serializes the completions putting files at the same storage key,
+// so the precondition checked still holds when the file is put
+type keyLock struct {
+	sync.Mutex
+	users int
+}
+
+var keyLocks = struct {
+	sync.Mutex
+	keys map[string]*keyLock
+}{keys: make(map[string]*keyLock)}
+
+// lockKey locks key until the returned func is called
+func lockKey(key string) func() {
+	keyLocks.Lock()
+	lock, ok := keyLocks.keys[key]
+	if !ok {
+		lock = &keyLock{}
+		keyLocks.keys[key] = lock
+	}
+	lock.users++
+	keyLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		keyLocks.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(keyLocks.keys, key)
+		}
+		keyLocks.Unlock()
+	}
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PrefixConfig holds the settings of one entry of `uploader.prefixes`, it
+// applies to the prefix itself and everything below it.
+type PrefixConfig struct {
+	Prefix        string        `mapstructure:"prefix"`
+	WORMRetention time.Duration `mapstructure:"worm_retention"`
+	// chunk size forced on the sessions created under the prefix
+	ChunkSize int64 `mapstructure:"chunk_size"`
+	// names the files of the sessions created without a name_template, see
+	// renderName
+	NameTemplate string `mapstructure:"name_template"`
+	// bytes of completed and in-flight files allowed under the prefix
+	Quota    int64          `mapstructure:"quota"`
+	Storage  storage.Config `mapstructure:"storage"`
+	Publish  PublishConfig  `mapstructure:"publish"`
+	Sanitize SanitizeConfig `mapstructure:"sanitize"`
+	// the first rule matching the type of a file converts it
+	Convert []ConvertRule `mapstructure:"convert"`
+	// checked before the file is converted or sanitized
+	Validate ValidateConfig `mapstructure:"validate"`
+	// names refused and extensions appended, checked at Create and again
+	// before the file is stored
+	Names NamePolicy `mapstructure:"names"`
+	// clients put the slices into the storage themselves when it supports
+	// multipart uploads, see DirectUpload
+	DirectUpload bool `mapstructure:"direct_upload"`
+	// the v2 target file of the sessions is written next to the file in its
+	// storage instead of the slice cache, local storage only, see
+	// directWritePath
+	DirectWrite bool `mapstructure:"direct_write"`
+	// the first rule the size of a file fits picks its storage instead of
+	// Storage, e.g. small files on local disk and large ones in a bucket
+	Placement []PlacementRule `mapstructure:"placement"`
+	// completed files are copied to these storages as well, see Replica
+	Replicas []storage.Config `mapstructure:"replicas"`
+}
+
+// PlacementRule sends the files of at most MaxSize bytes, of any size when 0,
+// to Storage
+type PlacementRule struct {
+	MaxSize int64          `mapstructure:"max_size"`
+	Storage storage.Config `mapstructure:"storage"`
+}
+
+// PublishConfig links completed files for other systems, local storage only
+type PublishConfig struct {
+	// name of a symlink next to the file, pointing at the latest one
+	Symlink string `mapstructure:"symlink"`
+	// the file is hardlinked to the same key under this directory
+	HardlinkDir string `mapstructure:"hardlink_dir"`
+}
+
+func prefixConfigs() []PrefixConfig {
+	var configs []PrefixConfig
+	if err := viper.UnmarshalKey("uploader.prefixes", &configs); err != nil {
+		logrus.Errorf("failed to parse uploader.prefixes: %v", err)
+	}
+	return configs
+}
+
+// find the config of the longest configured prefix containing the given one
+func prefixConfig(prefix string) PrefixConfig {
+	matched := PrefixConfig{}
+	matchedLen := -1
+	for _, config := range prefixConfigs() {
+		configPrefix := strings.Trim(config.Prefix, "/")
+		if !underPrefix(prefix, configPrefix) {
+			continue
+		}
+		if len(configPrefix) > matchedLen {
+			matched = config
+			matchedLen = len(configPrefix)
+		}
+	}
+	return matched
+}
+
+// the storage config of a file of size bytes under prefix, local storage in
+// upload_dir unless the prefix is configured otherwise
+func storageConfig(prefix string, size int64) storage.Config {
+	prefixConfig := prefixConfig(prefix)
+	config := prefixConfig.Storage
+	for _, rule := range prefixConfig.Placement {
+		if rule.MaxSize == 0 || size <= rule.MaxSize {
+			config = rule.Storage
+			break
+		}
+	}
+	if config.Driver == "" {
+		config.Driver = "local"
+	}
+	if config.Driver == "local" && config.Root == "" {
+		config.Root = UploadDirs()[0]
+	}
+	return config
+}
+
+// retryPolicy is `uploader.storage_retry`, storage.DefaultRetryPolicy for
+// the settings left out
+func retryPolicy() storage.RetryPolicy {
+	policy := storage.DefaultRetryPolicy
+	if viper.IsSet("uploader.storage_retry.attempts") {
+		policy.Attempts = viper.GetInt("uploader.storage_retry.attempts")
+	}
+	if viper.IsSet("uploader.storage_retry.base_delay") {
+		policy.BaseDelay = viper.GetDuration("uploader.storage_retry.base_delay")
+	}
+	if viper.IsSet("uploader.storage_retry.max_delay") {
+		policy.MaxDelay = viper.GetDuration("uploader.storage_retry.max_delay")
+	}
+	return policy
+}
+
+// breakerPolicy is `uploader.storage_breaker`, storage.DefaultBreakerPolicy
+// for the settings left out
+func breakerPolicy() storage.BreakerPolicy {
+	policy := storage.DefaultBreakerPolicy
+	if viper.IsSet("uploader.storage_breaker.threshold") {
+		policy.Threshold = viper.GetInt("uploader.storage_breaker.threshold")
+	}
+	if viper.IsSet("uploader.storage_breaker.cooldown") {
+		policy.Cooldown = viper.GetDuration("uploader.storage_breaker.cooldown")
+	}
+	return policy
+}
+
+func newStorage(config storage.Config) (storage.Storage, error) {
+	s, err := storage.New(config)
+	if err != nil {
+		return nil, err
+	}
+	if local, ok := s.(*storage.Local); ok {
+		local.Permissions = permissions()
+	}
+	s = storage.NewRetry(s, retryPolicy())
+	// the breaker counts an operation failed only once its retries are spent
+	s = storage.NewGuarded(s, storage.BreakerFor(config.Backend(), breakerPolicy()))
+	return storage.NewWORM(s, func(key string) time.Duration {
+		return prefixConfig(path.Dir(key)).WORMRetention
+	}), nil
+}
+
+// the storage recorded in the session, sessions created before storages were
+// configurable use the default one, on the upload dir holding their file
+func (m *FileMeta) storage() (storage.Storage, error) {
+	if m.Storage.Driver == "" {
+		config := storageConfig("", m.FileSize)
+		config.Root = uploadDirOf(m.StorageKey())
+		return newStorage(config)
+	}
+	return newStorage(m.Storage)
+}
+
+func (m *FileMeta) StorageKey() string {
+	return path.Join(m.Prefix, m.FileName)
+}
+
+// permissions is `uploader.permissions`, nil when none is set. Modes are
+// octal strings, e.g. "0640".
+func permissions() *storage.Permissions {
+	if !viper.IsSet("uploader.permissions") {
+		return nil
+	}
+	p := &storage.Permissions{
+		FileMode: permissionMode("file_mode"),
+		DirMode:  permissionMode("dir_mode"),
+		Uid:      -1,
+		Gid:      -1,
+	}
+	if viper.IsSet("uploader.permissions.uid") {
+		p.Uid = viper.GetInt("uploader.permissions.uid")
+	}
+	if viper.IsSet("uploader.permissions.gid") {
+		p.Gid = viper.GetInt("uploader.permissions.gid")
+	}
+	return p
+}
+
+// permissionMode is the octal mode `uploader.permissions.<key>`, 0 when
+// missing or invalid
+func permissionMode(key string) fs.FileMode {
+	value := viper.GetString("uploader.permissions." + key)
+	if value == "" {
+		return 0
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > uint64(fs.ModePerm) {
+		logrus.Errorf("ignored invalid uploader.permissions.%s %q", key, value)
+		return 0
+	}
+	return fs.FileMode(mode)
+}
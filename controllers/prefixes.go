@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Prefix serves the resources of a whole prefix, `/prefixes/<prefix>/<name>`
+func (f *FileController) Prefix(c *gin.Context) {
+	prefix, name := path.Split(c.Param("path"))
+	prefix = strings.Trim(prefix, "/")
+	if strings.Contains(prefix, "..") {
+		f.Write(c, nil, 400, 0, "")
+		return
+	}
+	switch name {
+	case "archive.tar.gz":
+		f.archive(c, prefix)
+	case "checksums":
+		f.checksums(c, prefix)
+	case "files":
+		f.files(c, prefix)
+	default:
+		f.Write(c, nil, 404, 0, "")
+	}
+}
+
+// FileListing is what the listing of a prefix tells about a completed file
+type FileListing struct {
+	FileId      string   `json:"file_id"`
+	FileName    string   `json:"file_name"`
+	Prefix      string   `json:"prefix"`
+	FileType    string   `json:"file_type"`
+	FileSize    int64    `json:"file_size"`
+	Tags        []string `json:"tags,omitempty"`
+	Description string   `json:"description,omitempty"`
+	CreatedAt   int64    `json:"created_at"`
+	// driver of the storage holding the file
+	Storage string `json:"storage"`
+}
+
+// files lists the completed files under prefix sorted by storage key
+func (f *FileController) files(c *gin.Context, prefix string) {
+	files, err := completedUnder(prefix)
+	if err != nil {
+		logrus.Errorf("failed to list files of %s: %v", prefix, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	listing := make([]FileListing, 0, len(files))
+	for _, meta := range files {
+		driver := meta.Storage.Driver
+		if driver == "" {
+			driver = "local"
+		}
+		listing = append(listing, FileListing{
+			FileId:      meta.FileId,
+			FileName:    meta.FileName,
+			Prefix:      meta.Prefix,
+			FileType:    meta.FileType,
+			FileSize:    meta.FileSize,
+			Tags:        meta.Tags,
+			Description: meta.Description,
+			CreatedAt:   meta.CreatedAt,
+			Storage:     driver,
+		})
+	}
+	f.Write(c, listing, 200, 0, "")
+}
+
+// archive streams a tar.gz of the completed files under prefix, built while
+// sending so memory stays bounded whatever the size of the prefix
+func (f *FileController) archive(c *gin.Context, prefix string) {
+	files, err := completedUnder(prefix)
+	if err != nil {
+		logrus.Errorf("failed to list files of %s: %v", prefix, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+
+	archiveName := path.Base("/"+prefix) + ".tar.gz"
+	if prefix == "" {
+		archiveName = "archive.tar.gz"
+	}
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName}))
+	c.Status(200)
+
+	gzipWriter := gzip.NewWriter(c.Writer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, meta := range files {
+		if err := addToArchive(tarWriter, meta, prefix); err != nil {
+			// the status is sent already, a truncated archive tells the
+			// client something went wrong
+			logrus.Errorf("failed to archive %s: %v", meta.FileId, err)
+			return
+		}
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+}
+
+func addToArchive(tarWriter *tar.Writer, meta FileMeta, prefix string) error {
+	if meta.Manifest {
+		reader, err := openManifest(meta.FileId)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return writeArchiveEntry(tarWriter, relativeKey(meta, prefix), reader, reader.Size(), time.Unix(meta.CreatedAt, 0))
+	}
+
+	store, err := meta.storage()
+	if err != nil {
+		return err
+	}
+	info, err := store.Stat(meta.StorageKey())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	reader, err := storage.Open(store, meta.StorageKey())
+	if errors.Is(err, storage.ErrNotReadable) {
+		logrus.Warningf("skipped %s from archive, %v", meta.FileId, err)
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return writeArchiveEntry(tarWriter, relativeKey(meta, prefix), reader, info.Size(), info.ModTime())
+}
+
+func writeArchiveEntry(tarWriter *tar.Writer, name string, reader io.Reader, size int64, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime.Truncate(time.Second),
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tarWriter, reader, size)
+	return err
+}
+
+// the storage key of a file relative to a prefix containing it
+func relativeKey(meta FileMeta, prefix string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(strings.TrimLeft(meta.StorageKey(), "/"), prefix), "/")
+}
+
+// checksums writes a SHA256SUMS manifest of the completed files under prefix
+// from their meta, names are the same as in the archive so `sha256sum -c`
+// verifies an extracted one
+func (f *FileController) checksums(c *gin.Context, prefix string) {
+	files, err := completedUnder(prefix)
+	if err != nil {
+		logrus.Errorf("failed to list files of %s: %v", prefix, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+
+	var manifest strings.Builder
+	for _, meta := range files {
+		if meta.Sha256 == "" {
+			continue
+		}
+		// escaped the way coreutils does for names with newlines or backslashes
+		name := relativeKey(meta, prefix)
+		if strings.ContainsAny(name, "\\\n") {
+			name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+			manifest.WriteString("\\")
+		}
+		manifest.WriteString(meta.Sha256 + "  " + name + "\n")
+	}
+	c.Data(200, "text/plain; charset=utf-8", []byte(manifest.String()))
+}
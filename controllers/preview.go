@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultPreviewSize      = 256
+	defaultPreviewTextBytes = 4096
+	defaultToolTimeout      = 30 * time.Second
+)
+
+// PreviewCommand renders the preview of the file types matching Type (a
+// path.Match pattern such as `application/vnd.ms-*`) as a png, {input} and
+// {output} in Command are replaced by the file and the png to write
+type PreviewCommand struct {
+	Type    string `mapstructure:"type"`
+	Command string `mapstructure:"command"`
+}
+
+// Preview serves a small preview of a completed file: the head of a text,
+// a thumbnail of an image or what the configured command renders for other
+// types. Previews are generated once and kept in `uploader.preview.cache_dir`.
+func (f *FileController) Preview(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	if !meta.stored() {
+		f.WriteError(c, nil, uploadererrors.ErrNotCompleted)
+		return
+	}
+
+	cacheDir := previewCacheDir()
+	for _, ext := range []string{".png", ".txt"} {
+		if cached := path.Join(cacheDir, meta.FileId+ext); fileExists(cached) {
+			c.File(cached)
+			return
+		}
+	}
+
+	store, err := meta.storage()
+	if err != nil {
+		logrus.Errorf("failed to create storage of %s: %v", meta.FileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	input, ok := storage.LocalPath(store, meta.StorageKey())
+	if !ok {
+		f.WriteError(c, nil, uploadererrors.ErrStorageNotLocal)
+		return
+	}
+
+	generate, ext := previewGenerator(meta.FileType)
+	if generate == nil {
+		f.WriteError(c, nil, uploadererrors.ErrNoPreview.WithMessage("no preview for "+meta.FileType))
+		return
+	}
+	if err := permissions().MkdirAll(cacheDir); err != nil {
+		logrus.Errorf("failed to create preview cache: %v", err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	output := path.Join(cacheDir, meta.FileId+ext)
+	tmp := output + ".tmp"
+	defer os.Remove(tmp)
+	if err := generate(input, tmp); err != nil {
+		logrus.Errorf("failed to generate preview of %s: %v", meta.FileId, err)
+		f.WriteError(c, nil, uploadererrors.ErrPreviewFailed)
+		return
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		logrus.Errorf("failed to cache preview of %s: %v", meta.FileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	c.File(output)
+}
+
+func previewCacheDir() string {
+	if dir := viper.GetString("uploader.preview.cache_dir"); dir != "" {
+		return dir
+	}
+	return path.Join(viper.GetString("uploader.metafile_dir"), "previews")
+}
+
+// erasePreview destroys the cached preview of an erased file
+func erasePreview(meta *FileMeta, store storage.Storage, key string) ([]ErasureItem, error) {
+	var items []ErasureItem
+	for _, ext := range []string{".png", ".txt"} {
+		erased, err := eraseLocalFile("preview", path.Join(previewCacheDir(), meta.FileId+ext))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, erased...)
+	}
+	return items, nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// previewGenerator picks how to preview a file type, nil when it can't be
+func previewGenerator(fileType string) (func(input string, output string) error, string) {
+	var commands []PreviewCommand
+	viper.UnmarshalKey("uploader.preview.commands", &commands)
+	for _, command := range commands {
+		if ok, _ := path.Match(command.Type, fileType); ok {
+			return func(input string, output string) error {
+				return runTool(command.Command, map[string]string{"{input}": input, "{output}": output})
+			}, ".png"
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(fileType, "text/"):
+		return textHead, ".txt"
+	case fileType == "image/jpeg" || fileType == "image/png" || fileType == "image/gif":
+		return thumbnail, ".png"
+	}
+	return nil, ""
+}
+
+func textHead(input string, output string) error {
+	size := viper.GetInt64("uploader.preview.text_bytes")
+	if size <= 0 {
+		size = defaultPreviewTextBytes
+	}
+	file, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	head, err := io.ReadAll(io.LimitReader(file, size))
+	if err != nil {
+		return err
+	}
+	// don't cut a multi byte character in half
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	return permissions().WriteFile(output, head)
+}
+
+// thumbnail scales the image down to fit `uploader.preview.size`
+func thumbnail(input string, output string) error {
+	maxSize := viper.GetInt("uploader.preview.size")
+	if maxSize <= 0 {
+		maxSize = defaultPreviewSize
+	}
+	file, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxSize || height > maxSize {
+		if width > height {
+			width, height = maxSize, height*maxSize/width
+		} else {
+			width, height = width*maxSize/height, maxSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/dst.Rect.Dx(), bounds.Min.Y+y*bounds.Dy()/dst.Rect.Dy()))
+		}
+	}
+
+	out, err := permissions().CreateFile(output, false)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return png.Encode(out, dst)
+}
+
+// runTool runs an external command configured as a single line, placeholders
+// are replaced in each argument so paths with spaces stay one argument
+func runTool(command string, replacements map[string]string) error {
+	_, err := toolOutput(command, replacements)
+	return err
+}
+
+// toolOutput runs the command like runTool and returns what it printed, the
+// error wraps an *exec.ExitError when the command failed
+func toolOutput(command string, replacements map[string]string) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	for i, arg := range args {
+		for placeholder, value := range replacements {
+			arg = strings.ReplaceAll(arg, placeholder, value)
+		}
+		args[i] = arg
+	}
+
+	timeout := viper.GetDuration("uploader.tool_timeout")
+	if timeout <= 0 {
+		timeout = defaultToolTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), fmt.Errorf("%s: %w: %s", filepath.Base(args[0]), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
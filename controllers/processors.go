@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/louis-she/simple-uploader/processor"
+	"github.com/spf13/viper"
+)
+
+const defaultProcessorTimeout = 5 * time.Minute
+
+// ProcessorConfig is one of `uploader.processors`, processors running out of
+// process behind the gRPC contract of processor/processor.proto, called in
+// their order after the built in ones
+type ProcessorConfig struct {
+	Name string `mapstructure:"name"`
+	// host:port or unix:///path/of/the/socket
+	Endpoint string `mapstructure:"endpoint"`
+	// path.Match patterns of the file types sent to the processor, all when
+	// empty
+	Types   []string      `mapstructure:"types"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// ProcessorResult records in the meta of a file what a processor returned
+type ProcessorResult struct {
+	Version     string            `json:"version,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ProcessedAt int64             `json:"processed_at"`
+}
+
+func processorConfigs() ([]ProcessorConfig, error) {
+	var configs []ProcessorConfig
+	if err := viper.UnmarshalKey("uploader.processors", &configs); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" || names[config.Name] {
+			return nil, fmt.Errorf("processors need distinct names, got %q", config.Name)
+		}
+		names[config.Name] = true
+	}
+	return configs, nil
+}
+
+func (config ProcessorConfig) matches(fileType string) bool {
+	for _, pattern := range config.Types {
+		if ok, _ := path.Match(pattern, fileType); ok {
+			return true
+		}
+	}
+	return len(config.Types) == 0
+}
+
+var processorClients = struct {
+	sync.Mutex
+	clients map[string]*processor.Client
+}{clients: map[string]*processor.Client{}}
+
+// processorClient is shared by the calls to endpoint, so they reuse its
+// connections
+func processorClient(endpoint string) (*processor.Client, error) {
+	processorClients.Lock()
+	defer processorClients.Unlock()
+	if client, ok := processorClients.clients[endpoint]; ok {
+		return client, nil
+	}
+	client, err := processor.NewClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	processorClients.clients[endpoint] = client
+	return client, nil
+}
+
+// external is the pre processor calling the processors of
+// `uploader.processors` matching the type of the file. A processor which
+// can't be reached fails the completion like storage being down, the file is
+// completed again later.
+func external(meta *FileMeta, name string) (bool, error) {
+	configs, err := processorConfigs()
+	if err != nil {
+		return false, fmt.Errorf("invalid uploader.processors: %w", err)
+	}
+	rewritten := false
+	for _, config := range configs {
+		if !config.matches(meta.FileType) {
+			continue
+		}
+		changed, err := runProcessor(config, meta, name)
+		if err != nil {
+			return false, err
+		}
+		rewritten = rewritten || changed
+	}
+	return rewritten, nil
+}
+
+func runProcessor(config ProcessorConfig, meta *FileMeta, name string) (bool, error) {
+	client, err := processorClient(config.Endpoint)
+	if err != nil {
+		return false, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultProcessorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the processor runs in another working directory
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return false, err
+	}
+	output := name + ".processed"
+	defer os.Remove(output)
+	response, err := client.Process(ctx, &processor.ProcessRequest{
+		FileId:     meta.FileId,
+		FileName:   meta.FileName,
+		FileType:   meta.FileType,
+		Prefix:     meta.Prefix,
+		FileSize:   meta.FileSize,
+		Path:       name,
+		OutputPath: output,
+	})
+	if err != nil {
+		return false, fmt.Errorf("processor %s failed: %w", config.Name, err)
+	}
+	if meta.Processors == nil {
+		meta.Processors = map[string]ProcessorResult{}
+	}
+	meta.Processors[config.Name] = ProcessorResult{
+		Version:     response.Version,
+		Metadata:    response.Metadata,
+		ProcessedAt: time.Now().Unix(),
+	}
+	if response.RejectReason != "" {
+		return false, &ValidationError{Rule: config.Name, Detail: response.RejectReason}
+	}
+	if !response.Rewritten {
+		return false, nil
+	}
+	if response.FileName != "" && (response.FileName != path.Base(response.FileName) || response.FileName == "..") {
+		return false, fmt.Errorf("processor %s renamed %s to %q", config.Name, meta.FileId, response.FileName)
+	}
+	if err := os.Rename(output, name); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("processor %s rewrote %s without writing it", config.Name, meta.FileId)
+		}
+		return false, err
+	}
+	if response.FileName != "" {
+		meta.FileName = response.FileName
+	}
+	if response.FileType != "" {
+		meta.FileType = response.FileType
+	}
+	return true, nil
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultRateWindow       = 8
+	defaultProgressInterval = time.Second
+	maxTrackedSessions      = 10000
+)
+
+// rateSample is a slice received by a session
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// sessionRates keeps the last slices received by every session, measured by
+// the server so the rate covers all the writers of a session whatever their
+// clocks
+type sessionRates struct {
+	sync.Mutex
+	sessions map[string][]rateSample
+}
+
+var rates = &sessionRates{sessions: make(map[string][]rateSample)}
+
+// rateWindow is how many slices the rate of a session is measured over,
+// uploader.progress.window
+func rateWindow() int {
+	if window := viper.GetInt("uploader.progress.window"); window > 1 {
+		return window
+	}
+	return defaultRateWindow
+}
+
+func (r *sessionRates) record(fileId string, bytes int64) {
+	r.Lock()
+	defer r.Unlock()
+	samples, ok := r.sessions[fileId]
+	if !ok {
+		r.evict()
+	}
+	samples = append(samples, rateSample{at: time.Now(), bytes: bytes})
+	if window := rateWindow(); len(samples) > window {
+		samples = samples[len(samples)-window:]
+	}
+	r.sessions[fileId] = samples
+}
+
+// rate is the bytes per second received by the session between its first and
+// last samples, 0 until it received two slices
+func (r *sessionRates) rate(fileId string) float64 {
+	r.Lock()
+	defer r.Unlock()
+	samples := r.sessions[fileId]
+	if len(samples) < 2 {
+		return 0
+	}
+	elapsed := samples[len(samples)-1].at.Sub(samples[0].at)
+	if elapsed <= 0 {
+		return 0
+	}
+	// the bytes of the first sample arrived before the window started
+	var bytes int64
+	for _, sample := range samples[1:] {
+		bytes += sample.bytes
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+func (r *sessionRates) forget(fileId string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.sessions, fileId)
+}
+
+// make room for a new session by dropping the ones idle for an hour, or an
+// arbitrary one when all of them are active
+func (r *sessionRates) evict() {
+	if len(r.sessions) < maxTrackedSessions {
+		return
+	}
+	for fileId, samples := range r.sessions {
+		if time.Since(samples[len(samples)-1].at) > time.Hour {
+			delete(r.sessions, fileId)
+		}
+	}
+	for fileId := range r.sessions {
+		if len(r.sessions) < maxTrackedSessions {
+			break
+		}
+		delete(r.sessions, fileId)
+	}
+}
+
+type Progress struct {
+	FileId         string    `json:"file_id"`
+	State          FileState `json:"state"`
+	UploadedBytes  int64     `json:"uploaded_bytes"`
+	TotalBytes     int64     `json:"total_bytes"`
+	UploadedSlices int       `json:"uploaded_slices"`
+	SliceCount     int       `json:"slice_count"`
+	// bytes per second over the last slices received, 0 until known
+	Throughput float64 `json:"throughput"`
+	// seconds until the remaining bytes are uploaded at that rate, missing
+	// while it isn't known
+	ETA *int64 `json:"eta,omitempty"`
+	// space the slice cache of the session takes on disk
+	CacheBytes int64 `json:"cache_bytes"`
+}
+
+func newProgress(meta FileMeta) Progress {
+	progress := Progress{
+		FileId:     meta.FileId,
+		State:      meta.state(),
+		TotalBytes: meta.FileSize,
+		SliceCount: len(meta.Slices),
+		Throughput: rates.rate(meta.FileId),
+		CacheBytes: cacheUsage(meta.FileId),
+	}
+	for i := 0; i < len(meta.Slices); i++ {
+		if meta.Slices[strconv.Itoa(i)].Status == 1 {
+			progress.UploadedSlices++
+			progress.UploadedBytes += meta.sliceSize(i)
+		}
+	}
+	remaining := progress.TotalBytes - progress.UploadedBytes
+	if remaining == 0 || progress.Throughput > 0 {
+		eta := int64(math.Ceil(float64(remaining) / math.Max(progress.Throughput, 1)))
+		progress.ETA = &eta
+	}
+	return progress
+}
+
+// changed tells whether p tells more than from, the ETA follows the rest
+func (p Progress) changed(from Progress) bool {
+	p.ETA, from.ETA = nil, nil
+	return p != from
+}
+
+// done tells whether the session moves no more
+func (p Progress) done() bool {
+	return p.State == StateComplete || p.State == StateFailed || p.State == StateExpired
+}
+
+// Progress tells how much of the file is uploaded, the rate the server
+// receives it at and the time left. Asked with `Accept: text/event-stream`
+// it is sent as a `progress` event whenever it changes, checked every
+// uploader.progress.interval, until the session is done.
+func (f *FileController) Progress(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) || !f.checkReader(c, &meta) {
+		return
+	}
+	progress := newProgress(meta)
+	if c.GetHeader("Accept") != "text/event-stream" {
+		f.Write(c, progress, 200, 0, "")
+		return
+	}
+
+	interval := viper.GetDuration("uploader.progress.interval")
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	c.SSEvent("progress", progress)
+	c.Stream(func(w io.Writer) bool {
+		if progress.done() {
+			return false
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-ticker.C:
+		}
+		meta, err := readMeta(progress.FileId)
+		if err != nil {
+			logrus.Errorf("failed to read the meta of %s: %v", progress.FileId, err)
+			return false
+		}
+		if next := newProgress(meta); next.changed(progress) {
+			progress = next
+			c.SSEvent("progress", progress)
+		}
+		return true
+	})
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/spf13/viper"
+)
+
+// ProvenanceSchema names the layout of Provenance, it changes whenever a
+// field changes meaning or goes away
+const ProvenanceSchema = "simple-uploader/provenance/v1"
+
+// the extended attributes of stored files are named user.simple_uploader.<field>
+const xattrPrefix = "user.simple_uploader."
+
+// Provenance tells where a stored file comes from, for consumers reading the
+// storage directly: the sidecar `<file name>.meta.json` holds it as JSON and
+// the extended attributes of the file hold its fields as text
+type Provenance struct {
+	Schema   string `json:"schema"`
+	FileId   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileType string `json:"file_type"`
+	Size     int64  `json:"size"`
+	// hex
+	Sha256 string   `json:"sha256"`
+	Prefix string   `json:"prefix,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	// the API key the session was created with, anonymous without one
+	UploadedBy string `json:"uploaded_by,omitempty"`
+	// unix seconds
+	CreatedAt   int64 `json:"created_at"`
+	CompletedAt int64 `json:"completed_at"`
+}
+
+func newProvenance(meta *FileMeta) Provenance {
+	provenance := Provenance{
+		Schema:     ProvenanceSchema,
+		FileId:     meta.FileId,
+		FileName:   meta.FileName,
+		FileType:   meta.FileType,
+		Size:       meta.FileSize,
+		Sha256:     meta.Sha256,
+		Prefix:     meta.Prefix,
+		Tags:       meta.Tags,
+		UploadedBy: meta.UploadedBy,
+		CreatedAt:  meta.CreatedAt,
+	}
+	for _, change := range meta.History {
+		if change.State == StateComplete {
+			provenance.CompletedAt = change.At
+		}
+	}
+	if provenance.CompletedAt == 0 {
+		provenance.CompletedAt = time.Now().Unix()
+	}
+	return provenance
+}
+
+// xattrs are the fields of p as extended attributes, tags comma separated
+func (p Provenance) xattrs() map[string]string {
+	attrs := map[string]string{
+		"schema":       p.Schema,
+		"file_id":      p.FileId,
+		"file_type":    p.FileType,
+		"size":         strconv.FormatInt(p.Size, 10),
+		"sha256":       p.Sha256,
+		"created_at":   strconv.FormatInt(p.CreatedAt, 10),
+		"completed_at": strconv.FormatInt(p.CompletedAt, 10),
+	}
+	if len(p.Tags) > 0 {
+		attrs["tags"] = strings.Join(p.Tags, ",")
+	}
+	if p.UploadedBy != "" {
+		attrs["uploaded_by"] = p.UploadedBy
+	}
+	return attrs
+}
+
+// sidecarPath is the sidecar of the file stored at name
+func sidecarPath(name string) string {
+	return name + ".meta.json"
+}
+
+// writeProvenance records the provenance of the completed file as extended
+// attributes with `uploader.provenance.xattr` and as a sidecar with
+// `uploader.provenance.sidecar`
+func writeProvenance(meta *FileMeta, store storage.Storage, key string) error {
+	xattr, sidecar := viper.GetBool("uploader.provenance.xattr"), viper.GetBool("uploader.provenance.sidecar")
+	if !xattr && !sidecar {
+		return nil
+	}
+	filePath, ok := storage.LocalPath(store, key)
+	if !ok {
+		return fmt.Errorf("provenance needs local storage, got %s", meta.Storage.Driver)
+	}
+
+	provenance := newProvenance(meta)
+	if xattr {
+		for field, value := range provenance.xattrs() {
+			if err := fileio.SetXattr(filePath, xattrPrefix+field, []byte(value)); err != nil {
+				return fmt.Errorf("failed to set xattr %s: %w", field, err)
+			}
+		}
+	}
+	if sidecar {
+		content, _ := json.MarshalIndent(provenance, "", "  ")
+		if err := permissions().WriteFile(sidecarPath(filePath), content); err != nil {
+			return fmt.Errorf("failed to write sidecar: %w", err)
+		}
+	}
+	return nil
+}
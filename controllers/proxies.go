@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"net"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/viper"
+)
+
+// TrustProxies makes the client ip of the requests to engine (throughput,
+// chunk size recommendations, logs) the one given by the proxies of
+// `uploader.trusted_proxies` (addresses or CIDRs) in
+// `uploader.remote_ip_headers`, X-Forwarded-For and X-Real-IP by default.
+// Unlike gin's default, the headers are ignored while no proxy is trusted.
+func TrustProxies(engine *gin.Engine) error {
+	if headers := viper.GetStringSlice("uploader.remote_ip_headers"); len(headers) > 0 {
+		engine.RemoteIPHeaders = headers
+	}
+	return engine.SetTrustedProxies(viper.GetStringSlice("uploader.trusted_proxies"))
+}
+
+// Listen listens on addr. With `uploader.proxy_protocol` the trusted proxies
+// may send a PROXY protocol (v1 or v2) header giving the address of the
+// client, such as an ELB or nginx streaming TCP, the header of other peers
+// is ignored.
+func Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || !viper.GetBool("uploader.proxy_protocol") {
+		return listener, err
+	}
+	policy, err := proxyproto.LaxWhiteListPolicy(viper.GetStringSlice("uploader.trusted_proxies"))
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &proxyproto.Listener{
+		Listener:          listener,
+		Policy:            policy,
+		ReadHeaderTimeout: timeout("read_header", defaultReadHeaderTimeout),
+	}, nil
+}
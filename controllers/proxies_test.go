@@ -0,0 +1,70 @@
+package controllers_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.trusted_proxies", []string{"10.0.0.0/8"})
+	defer viper.Set("uploader.trusted_proxies", nil)
+
+	engine := gin.New()
+	if !assert.NoError(controllers.TrustProxies(engine)) {
+		return
+	}
+	engine.GET("/ip", func(c *gin.Context) { c.String(200, c.ClientIP()) })
+
+	for remote, expected := range map[string]string{"10.1.2.3:4000": "203.0.113.7", "198.51.100.1:4000": "198.51.100.1"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ip", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		engine.ServeHTTP(w, req)
+		assert.Equal(expected, w.Body.String(), remote)
+	}
+
+	viper.Set("uploader.trusted_proxies", []string{"not an ip"})
+	assert.Error(controllers.TrustProxies(gin.New()))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.proxy_protocol", true)
+	viper.Set("uploader.trusted_proxies", []string{"127.0.0.1"})
+	defer viper.Set("uploader.proxy_protocol", nil)
+	defer viper.Set("uploader.trusted_proxies", nil)
+
+	listener, err := controllers.Listen("127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 51000 80\r\n")
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: uploader\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.NoError(err) {
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal("203.0.113.7:51000", string(body))
+	}
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Preflight tells clients at Create what they are allowed to upload, so they
+// can adjust or give up before sending any data
+type Preflight struct {
+	// bytes left for the prefix, -1 when there is no quota
+	QuotaRemaining int64 `json:"quota_remaining"`
+	// max slices of a session, 0 when there is no limit
+	MaxChunkCount int64 `json:"max_chunk_count"`
+	// when the upload would complete at the client's past throughput
+	EstimatedCompletionAt int64 `json:"estimated_completion_at,omitempty"`
+}
+
+type CreateResult struct {
+	FileMeta
+	Preflight
+	// only returned here, to be shared with the other writers of the session
+	WriterToken string `json:"writer_token,omitempty"`
+	// only returned here, required by the requests of the session with
+	// uploader.upload_token
+	UploadToken string `json:"upload_token,omitempty"`
+	// only returned here for direct uploads, slice n is PUT at part_urls[n]
+	// and the file completed with POST files/:id/complete
+	PartURLs []string `json:"part_urls,omitempty"`
+}
+
+func newPreflight(prefix string, fileSize int64, client string) (Preflight, error) {
+	remaining, err := remainingQuota(prefix)
+	if err != nil {
+		return Preflight{}, err
+	}
+	preflight := Preflight{
+		QuotaRemaining: remaining,
+		MaxChunkCount:  viper.GetInt64("uploader.max_chunks"),
+	}
+	if bytesPerSecond := throughput.recommend(client).Throughput; bytesPerSecond > 0 {
+		eta := time.Duration(float64(fileSize) / bytesPerSecond * float64(time.Second))
+		preflight.EstimatedCompletionAt = time.Now().Add(eta).Unix()
+	}
+	return preflight, nil
+}
+
+// the quota left for files under prefix, the smallest one of
+// `uploader.quota` and the quotas of the configured prefixes containing it.
+// Both completed files and in-flight sessions count.
+func remainingQuota(prefix string) (int64, error) {
+	type quota struct {
+		prefix string
+		bytes  int64
+	}
+	var quotas []quota
+	if bytes := viper.GetInt64("uploader.quota"); bytes > 0 {
+		quotas = append(quotas, quota{"", bytes})
+	}
+	for _, config := range prefixConfigs() {
+		if config.Quota > 0 && underPrefix(prefix, config.Prefix) {
+			quotas = append(quotas, quota{config.Prefix, config.Quota})
+		}
+	}
+	if len(quotas) == 0 {
+		return -1, nil
+	}
+
+	completed, err := completedMetas()
+	if err != nil {
+		return 0, err
+	}
+	active, err := activeMetas()
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := int64(-1)
+	for _, q := range quotas {
+		left := q.bytes
+		for _, meta := range append(completed, active...) {
+			if underPrefix(meta.Prefix, q.prefix) {
+				left -= meta.FileSize
+			}
+		}
+		if remaining == -1 || left < remaining {
+			remaining = left
+		}
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
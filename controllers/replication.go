@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultReplicationInterval = time.Minute
+	maxReplicationBackoff      = time.Hour
+)
+
+const (
+	ReplicaPending = "pending"
+	ReplicaDone    = "done"
+)
+
+// Replica is a copy of the file in one of the replicas of its prefix,
+// recorded in the session at Create like its storage
+type Replica struct {
+	Storage storage.Config `json:"storage"`
+	// pending until the file in storage is copied, done after, and pending
+	// again once it changes
+	State    string `json:"state"`
+	Attempts int    `json:"attempts,omitempty"`
+	// why the last attempt failed
+	Error string `json:"error,omitempty"`
+	// unix seconds of the last attempt and of the last copy
+	AttemptedAt  int64 `json:"attempted_at,omitempty"`
+	ReplicatedAt int64 `json:"replicated_at,omitempty"`
+}
+
+func newReplicas(prefix string) []Replica {
+	var replicas []Replica
+	for _, config := range prefixConfig(prefix).Replicas {
+		replicas = append(replicas, Replica{Storage: config, State: ReplicaPending})
+	}
+	return replicas
+}
+
+// replicationKick wakes the replication worker up before its interval
+var replicationKick = make(chan struct{}, 1)
+
+// replicationQueue holds an empty `<file id>` file for every completed file
+// with replicas pending, the replication worker only reads their metas
+func replicationQueue() string {
+	return path.Join(viper.GetString("uploader.metafile_dir"), "replication")
+}
+
+// replicate is the finisher marking the replicas of the session pending and
+// queueing the file, the replication worker copies it to them without
+// holding the completion
+func replicate(meta *FileMeta, store storage.Storage, key string) error {
+	if len(meta.Replicas) == 0 {
+		return nil
+	}
+	for i := range meta.Replicas {
+		meta.Replicas[i].State, meta.Replicas[i].Attempts, meta.Replicas[i].AttemptedAt = ReplicaPending, 0, 0
+	}
+	if err := writeCompletedMeta(meta); err != nil {
+		return err
+	}
+	queued, err := permissions().CreateFile(path.Join(replicationQueue(), meta.FileId), false)
+	if err != nil {
+		return err
+	}
+	queued.Close()
+	select {
+	case replicationKick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// copyToReplica copies the file at key into the storage of replica through a
+// temporary file, recording the outcome in replica
+func copyToReplica(meta *FileMeta, replica *Replica, store storage.Storage, key string) {
+	replica.Attempts++
+	replica.AttemptedAt = time.Now().Unix()
+	if err := copyFileTo(meta, replica.Storage, store, key); err != nil {
+		logrus.Errorf("failed to replicate %s to %s: %v", meta.FileId, replica.Storage.Backend(), err)
+		replica.Error = err.Error()
+		return
+	}
+	replica.State, replica.Error, replica.ReplicatedAt = ReplicaDone, "", time.Now().Unix()
+}
+
+func copyFileTo(meta *FileMeta, config storage.Config, store storage.Storage, key string) error {
+	replica, err := newStorage(config)
+	if err != nil {
+		return err
+	}
+	reader, err := storage.Open(store, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tmp, err := os.CreateTemp(viper.GetString("uploader.slice_cache_dir"), ".replica-"+meta.FileId+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := fileio.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != meta.FileSize {
+		return fmt.Errorf("read %d bytes instead of %d", n, meta.FileSize)
+	}
+	return replica.Put(key, tmp.Name())
+}
+
+// StartReplication copies the files to the replicas they lag behind in the
+// background, as soon as they are completed and then every
+// `uploader.replication.interval` (1m by default). A replica failing again
+// waits twice as long as the last time, up to an hour. It runs until ctx is
+// done.
+func StartReplication(ctx context.Context) {
+	interval := replicationInterval()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-replicationKick:
+			case <-time.After(interval):
+			}
+			if _, err := replicatePending(false); err != nil {
+				logrus.Errorf("failed to replicate: %v", err)
+			}
+		}
+	}()
+}
+
+func replicationInterval() time.Duration {
+	if interval := viper.GetDuration("uploader.replication.interval"); interval > 0 {
+		return interval
+	}
+	return defaultReplicationInterval
+}
+
+// due tells whether the replica is pending and waited long enough since its
+// last attempt
+func (r Replica) due(now time.Time) bool {
+	if r.State != ReplicaPending {
+		return false
+	}
+	backoff := replicationInterval()
+	for i := 1; i < r.Attempts && backoff < maxReplicationBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxReplicationBackoff)
+	return !now.Before(time.Unix(r.AttemptedAt, 0).Add(backoff))
+}
+
+// Replicate copies the completed files to their pending replicas right away,
+// whenever they were last tried, and returns the ids of the files whose
+// replicas are all done now
+func Replicate() ([]string, error) {
+	return replicatePending(true)
+}
+
+func replicatePending(force bool) ([]string, error) {
+	queued, err := os.ReadDir(replicationQueue())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	replicated := []string{}
+	for _, entry := range queued {
+		meta, err := readMeta(entry.Name())
+		if errors.Is(err, fs.ErrNotExist) {
+			// erased since
+			os.Remove(path.Join(replicationQueue(), entry.Name()))
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("failed to read meta of %s: %v", entry.Name(), err)
+			continue
+		}
+		// manifests are replicated once compacted into storage
+		if meta.Manifest || !meta.stored() {
+			continue
+		}
+		pending, due := false, false
+		for _, replica := range meta.Replicas {
+			pending = pending || replica.State == ReplicaPending
+			due = due || replica.State == ReplicaPending && (force || replica.due(time.Now()))
+		}
+		if !pending {
+			os.Remove(path.Join(replicationQueue(), entry.Name()))
+			continue
+		}
+		if !due {
+			continue
+		}
+		done, err := replicateFile(meta.FileId, meta.StorageKey(), force)
+		if err != nil {
+			logrus.Errorf("failed to replicate %s: %v", meta.FileId, err)
+			continue
+		}
+		if done {
+			replicated = append(replicated, meta.FileId)
+		}
+	}
+	return replicated, nil
+}
+
+// replicateFile retries the pending replicas of a completed file, tells
+// whether they are all done and takes it out of the queue then
+func replicateFile(fileId string, key string, force bool) (bool, error) {
+	// in the order appends take them
+	unlock := lockKey(key)
+	defer unlock()
+	session := lockSession(fileId)
+	defer session.Unlock()
+	defer session.forget()
+
+	meta, err := readMeta(fileId)
+	if err != nil {
+		return false, err
+	}
+	store, err := meta.storage()
+	if err != nil {
+		return false, err
+	}
+	done := true
+	for i := range meta.Replicas {
+		replica := &meta.Replicas[i]
+		if replica.State == ReplicaPending && (force || replica.due(time.Now())) {
+			copyToReplica(&meta, replica, store, meta.StorageKey())
+		}
+		done = done && replica.State == ReplicaDone
+	}
+	if err := writeCompletedMeta(&meta); err != nil {
+		return false, err
+	}
+	if done {
+		if err := os.Remove(path.Join(replicationQueue(), fileId)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return true, err
+		}
+	}
+	return done, nil
+}
+
+// Replicate retries the pending replicas right away and returns the ids of
+// the files fully replicated
+func (a *AdminController) Replicate(c *gin.Context) {
+	replicated, err := Replicate()
+	if err != nil {
+		logrus.Errorf("failed to replicate: %v", err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	a.Write(c, replicated, 200, 0, "")
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/louis-she/simple-uploader/utils"
+)
+
+// Google resumable uploads send the size and type of the file in these
+// headers when starting the session
+const (
+	uploadContentLengthHeader = "X-Upload-Content-Length"
+	uploadContentTypeHeader   = "X-Upload-Content-Type"
+)
+
+// the chunks of Google resumable clients are multiples of 256 KiB, slices of
+// such a size are never split between two chunks
+const resumableChunkUnit = 256 * 1024
+
+// ResumableMetadata is the body starting a Google resumable upload
+type ResumableMetadata struct {
+	Name     string `json:"name" binding:"required"`
+	MimeType string `json:"mimeType"`
+}
+
+type ResumableParams struct {
+	UploadType string `form:"uploadType" binding:"omitempty,oneof=resumable"`
+	Prefix     string `form:"prefix"`
+}
+
+// resumableChunkSize is the chunk size recommended to the client, in whole
+// resumable chunk units
+func resumableChunkSize(client string) int64 {
+	size := throughput.recommend(client).RecommendedChunkSize
+	return utils.Max(size-size%resumableChunkUnit, resumableChunkUnit)
+}
+
+// Resumable starts a session the way Google resumable uploads do: the
+// metadata of the file is the body, its size and type are headers, and the
+// session URI is answered in Location. The client then PUTs the bytes of the
+// file to it with Content-Range, see UploadRange. The upload token of the
+// session is the upload_id of the URI.
+func (f *FileController) Resumable(c *gin.Context) {
+	params := ResumableParams{}
+	if !f.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	metadata := ResumableMetadata{}
+	if !f.bind(c, &metadata, c.ShouldBindJSON) {
+		return
+	}
+	fileSize, err := strconv.ParseInt(c.GetHeader(uploadContentLengthHeader), 10, 64)
+	if err != nil || fileSize <= 0 {
+		f.WriteError(c, []FieldError{{Field: uploadContentLengthHeader, Rule: "required"}}, uploadererrors.ErrContentLengthRequired)
+		return
+	}
+	if prefixConfig(params.Prefix).DirectUpload {
+		f.WriteError(c, nil, uploadererrors.ErrDirectUpload)
+		return
+	}
+
+	fileType := c.GetHeader(uploadContentTypeHeader)
+	if fileType == "" {
+		fileType = metadata.MimeType
+	}
+	if fileType == "" {
+		fileType = "application/octet-stream"
+	}
+	result, ok := f.create(c, CreateParams{
+		FileName:  metadata.Name,
+		FileType:  fileType,
+		FileSize:  fileSize,
+		ChunkSize: resumableChunkSize(c.ClientIP()),
+		Prefix:    params.Prefix,
+	}, nil)
+	if !ok {
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	uri := scheme + "://" + c.Request.Host + strings.TrimSuffix(c.FullPath(), "resumable") + result.FileId + "/content"
+	if result.UploadToken != "" {
+		uri += "?upload_id=" + result.UploadToken
+	}
+	c.Header("Location", uri)
+	f.Write(c, result, 200, 0, "")
+}
@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/louis-she/simple-uploader/wasm"
+	"github.com/spf13/viper"
+)
+
+const defaultSandboxFileSize = 16 << 20
+
+// WasmProcessorConfig is one of `uploader.wasm_processors`, modules run by
+// the wasm package on completed files. A module can only reach the file
+// through the imports of the uploader, and a call is limited in time and
+// memory, so modules of unknown authors can't harm the server.
+type WasmProcessorConfig struct {
+	Name string `mapstructure:"name"`
+	// path of the .wasm file
+	Module string `mapstructure:"module"`
+	// path.Match patterns of the file types given to the module, all when
+	// empty
+	Types []string `mapstructure:"types"`
+	// how long each call of the module on a file may run, 10s when 0
+	Timeout time.Duration `mapstructure:"timeout"`
+	// 64KiB pages of memory the module may grow to, 512 when 0
+	MaxMemoryPages uint32 `mapstructure:"max_memory_pages"`
+	// larger files are rejected, as is a larger output, 16MiB when 0
+	MaxFileSize int64 `mapstructure:"max_file_size"`
+}
+
+func wasmProcessorConfigs() ([]WasmProcessorConfig, error) {
+	var configs []WasmProcessorConfig
+	if err := viper.UnmarshalKey("uploader.wasm_processors", &configs); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" || names[config.Name] {
+			return nil, fmt.Errorf("wasm processors need distinct names, got %q", config.Name)
+		}
+		if config.Module == "" {
+			return nil, fmt.Errorf("wasm processor %s has no module", config.Name)
+		}
+		names[config.Name] = true
+	}
+	return configs, nil
+}
+
+func (config WasmProcessorConfig) matches(fileType string) bool {
+	return ProcessorConfig{Types: config.Types}.matches(fileType)
+}
+
+func (config WasmProcessorConfig) limits() wasm.Limits {
+	limits := wasm.Limits{Timeout: config.Timeout, MaxMemoryPages: config.MaxMemoryPages}
+	if limits.MaxMemoryPages == 0 {
+		limits.MaxMemoryPages = 512
+	}
+	return limits
+}
+
+func (config WasmProcessorConfig) maxFileSize() int64 {
+	if config.MaxFileSize <= 0 {
+		return defaultSandboxFileSize
+	}
+	return config.MaxFileSize
+}
+
+type compiledModule struct {
+	modTime time.Time
+	size    int64
+	module  *wasm.Module
+	version string
+}
+
+var wasmModules = struct {
+	sync.Mutex
+	modules map[string]compiledModule
+}{modules: map[string]compiledModule{}}
+
+// loadWasmModule compiles the module at name once, and again when the file
+// changes. The version is the sha256 of the module.
+func loadWasmModule(name string) (*wasm.Module, string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, "", err
+	}
+	wasmModules.Lock()
+	defer wasmModules.Unlock()
+	if compiled, ok := wasmModules.modules[name]; ok && compiled.modTime.Equal(info.ModTime()) && compiled.size == info.Size() {
+		return compiled.module, compiled.version, nil
+	}
+	binary, err := os.ReadFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+	module, err := wasm.Compile(binary)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to compile %s: %w", name, err)
+	}
+	sum := sha256.Sum256(binary)
+	version := "sha256:" + hex.EncodeToString(sum[:])[:16]
+	wasmModules.modules[name] = compiledModule{modTime: info.ModTime(), size: info.Size(), module: module, version: version}
+	return module, version, nil
+}
+
+// sandbox is the pre processor running the modules of
+// `uploader.wasm_processors` matching the type of the file. A module which
+// traps or runs out of time or memory rejects the file, one which can't be
+// loaded fails the completion.
+func sandbox(meta *FileMeta, name string) (bool, error) {
+	configs, err := wasmProcessorConfigs()
+	if err != nil {
+		return false, fmt.Errorf("invalid uploader.wasm_processors: %w", err)
+	}
+	rewritten := false
+	for _, config := range configs {
+		if !config.matches(meta.FileType) {
+			continue
+		}
+		changed, err := runWasmProcessor(config, meta, name)
+		if err != nil {
+			return false, err
+		}
+		rewritten = rewritten || changed
+	}
+	return rewritten, nil
+}
+
+// runWasmProcessor calls `process(ptr, len)` of a fresh instance of the
+// module with the content of the file at ptr, which the module allocated with
+// `alloc(len)`. The module answers through the imports of the "uploader"
+// module: `set_output(ptr, len)`, `reject(ptr, len)` and
+// `set_metadata(key_ptr, key_len, value_ptr, value_len)`.
+func runWasmProcessor(config WasmProcessorConfig, meta *FileMeta, name string) (bool, error) {
+	module, version, err := loadWasmModule(config.Module)
+	if err != nil {
+		return false, fmt.Errorf("wasm processor %s: %w", config.Name, err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() > config.maxFileSize() {
+		return false, &ValidationError{Rule: config.Name, Detail: fmt.Sprintf("larger than the %d bytes of the sandbox", config.maxFileSize())}
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+
+	var output []byte
+	var rejected string
+	metadata := map[string]string{}
+	read := func(instance *wasm.Instance, args []uint64) (string, error) {
+		data, err := instance.Read(uint32(args[0]), uint32(args[1]))
+		return string(data), err
+	}
+	pair := wasm.FuncType{Params: []wasm.ValueType{wasm.I32, wasm.I32}}
+	imports := wasm.Imports{"uploader": {
+		"set_output": {Type: pair, Call: func(instance *wasm.Instance, args []uint64) ([]uint64, error) {
+			if int64(uint32(args[1])) > config.maxFileSize() {
+				return nil, &ValidationError{Rule: config.Name, Detail: "output larger than the sandbox allows"}
+			}
+			data, err := instance.Read(uint32(args[0]), uint32(args[1]))
+			output = append([]byte{}, data...)
+			return nil, err
+		}},
+		"reject": {Type: pair, Call: func(instance *wasm.Instance, args []uint64) ([]uint64, error) {
+			reason, err := read(instance, args)
+			rejected = reason
+			return nil, err
+		}},
+		"set_metadata": {
+			Type: wasm.FuncType{Params: []wasm.ValueType{wasm.I32, wasm.I32, wasm.I32, wasm.I32}},
+			Call: func(instance *wasm.Instance, args []uint64) ([]uint64, error) {
+				key, err := read(instance, args[:2])
+				if err != nil {
+					return nil, err
+				}
+				value, err := read(instance, args[2:])
+				metadata[key] = value
+				return nil, err
+			},
+		},
+	}}
+
+	err = func() error {
+		instance, err := module.Instantiate(imports, config.limits())
+		if err != nil {
+			return err
+		}
+		defer instance.Close()
+		results, err := instance.Call("alloc", uint64(len(content)))
+		if err != nil {
+			return err
+		}
+		if err := instance.Write(uint32(results[0]), content); err != nil {
+			return err
+		}
+		_, err = instance.Call("process", results[0], uint64(len(content)))
+		return err
+	}()
+	var trap *wasm.Trap
+	var validationError *ValidationError
+	switch {
+	case errors.As(err, &validationError):
+		return false, err
+	case errors.As(err, &trap) || errors.Is(err, wasm.ErrTimeout) || errors.Is(err, wasm.ErrMemoryLimit):
+		return false, &ValidationError{Rule: config.Name, Detail: err.Error()}
+	case err != nil:
+		return false, fmt.Errorf("wasm processor %s: %w", config.Name, err)
+	}
+
+	if meta.Processors == nil {
+		meta.Processors = map[string]ProcessorResult{}
+	}
+	result := ProcessorResult{Version: version, ProcessedAt: time.Now().Unix()}
+	if len(metadata) > 0 {
+		result.Metadata = metadata
+	}
+	meta.Processors[config.Name] = result
+	if rejected != "" {
+		return false, &ValidationError{Rule: config.Name, Detail: rejected}
+	}
+	if output == nil {
+		return false, nil
+	}
+	return true, permissions().WriteFile(name, output)
+}
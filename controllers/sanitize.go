@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+)
+
+// SanitizeConfig cleans the images uploaded under a prefix before they are
+// stored
+type SanitizeConfig struct {
+	// drop EXIF, XMP, comments and text chunks, the image data is untouched
+	StripMetadata bool `mapstructure:"strip_metadata"`
+	// decode and encode the image again, dropping anything but the pixels
+	Reencode bool `mapstructure:"reencode"`
+}
+
+// sanitize rewrites jpeg and png files as configured for their prefix, the
+// type is sniffed from the content as the client may lie about it
+func sanitize(meta *FileMeta, name string) (bool, error) {
+	config := prefixConfig(meta.Prefix).Sanitize
+	if !config.StripMetadata && !config.Reencode {
+		return false, nil
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+
+	var sanitized []byte
+	fileType := http.DetectContentType(content)
+	switch {
+	case fileType != "image/jpeg" && fileType != "image/png":
+		return false, nil
+	case config.Reencode:
+		sanitized, err = reencodeImage(content, fileType)
+		meta.Sanitized = "reencoded"
+	case fileType == "image/jpeg":
+		sanitized, err = stripJPEG(content)
+		meta.Sanitized = "metadata_stripped"
+	default:
+		sanitized, err = stripPNG(content)
+		meta.Sanitized = "metadata_stripped"
+	}
+	if err != nil {
+		meta.Sanitized = ""
+		return false, fmt.Errorf("failed to sanitize %s: %w", meta.FileName, err)
+	}
+	return true, permissions().WriteFile(name, sanitized)
+}
+
+func reencodeImage(content []byte, fileType string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if fileType == "image/jpeg" {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&out, img)
+	}
+	return out.Bytes(), err
+}
+
+var errMalformedImage = errors.New("malformed image")
+
+// stripJPEG drops the APPn (but the JFIF/Adobe ones needed to decode) and COM
+// segments, and whatever follows the end of the image
+func stripJPEG(content []byte) ([]byte, error) {
+	if len(content) < 4 || content[0] != 0xFF || content[1] != 0xD8 {
+		return nil, errMalformedImage
+	}
+	out := bytes.NewBuffer([]byte{0xFF, 0xD8})
+	pos := 2
+	for {
+		if pos+2 > len(content) || content[pos] != 0xFF {
+			return nil, errMalformedImage
+		}
+		marker := content[pos+1]
+		if marker == 0xFF {
+			// fill byte
+			pos++
+			continue
+		}
+		if marker == 0xD9 {
+			out.Write(content[pos : pos+2])
+			return out.Bytes(), nil
+		}
+		if pos+4 > len(content) {
+			return nil, errMalformedImage
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(content[pos+2:]))
+		if end > len(content) {
+			return nil, errMalformedImage
+		}
+		segment := content[pos:end]
+		if marker == 0xDA {
+			// the entropy coded data runs until the next marker which is not
+			// a stuffed byte or a restart
+			for end < len(content)-1 && !(content[end] == 0xFF && content[end+1] != 0 && (content[end+1] < 0xD0 || content[end+1] > 0xD7)) {
+				end++
+			}
+			segment = content[pos:end]
+		}
+		if keepJPEGSegment(marker, segment) {
+			out.Write(segment)
+		}
+		pos = end
+	}
+}
+
+func keepJPEGSegment(marker byte, segment []byte) bool {
+	switch {
+	case marker == 0xFE:
+		return false
+	case marker == 0xE0:
+		return bytes.HasPrefix(segment[4:], []byte("JFIF\x00"))
+	case marker == 0xEE:
+		return bytes.HasPrefix(segment[4:], []byte("Adobe"))
+	case marker >= 0xE1 && marker <= 0xEF:
+		return false
+	}
+	return true
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNG drops the ancillary chunks carrying metadata, and whatever follows
+// the IEND chunk
+func stripPNG(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, pngSignature) {
+		return nil, errMalformedImage
+	}
+	out := bytes.NewBuffer(pngSignature)
+	reader := bytes.NewReader(content[len(pngSignature):])
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return nil, errMalformedImage
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+		// data and crc
+		chunk := make([]byte, length+4)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, errMalformedImage
+		}
+		switch chunkType {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			continue
+		}
+		out.Write(header[:])
+		out.Write(chunk)
+		if chunkType == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultMaxIndexedBytes = 1024 * 1024
+
+// Extractor writes the text of the files of a type (a path.Match pattern) to
+// {output}, e.g. with tika or an ocr tool
+type Extractor struct {
+	Type    string `mapstructure:"type"`
+	Command string `mapstructure:"command"`
+}
+
+// searchDocument is what is indexed of a completed file
+type searchDocument struct {
+	FileName    string   `json:"file_name"`
+	Prefix      string   `json:"prefix"`
+	FileType    string   `json:"file_type"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+	Content     string   `json:"content"`
+}
+
+var searchIndex struct {
+	sync.Mutex
+	dir   string
+	index bleve.Index
+}
+
+// openSearchIndex opens (or creates) the index in `uploader.search.index_dir`,
+// nil when searching is disabled
+func openSearchIndex() (bleve.Index, error) {
+	dir := viper.GetString("uploader.search.index_dir")
+	searchIndex.Lock()
+	defer searchIndex.Unlock()
+	if searchIndex.index != nil && searchIndex.dir == dir {
+		return searchIndex.index, nil
+	}
+	if searchIndex.index != nil {
+		searchIndex.index.Close()
+		searchIndex.index = nil
+	}
+	if dir == "" {
+		return nil, nil
+	}
+
+	index, err := bleve.Open(dir)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		index, err = bleve.New(dir, bleve.NewIndexMapping())
+	}
+	if err != nil {
+		return nil, err
+	}
+	searchIndex.dir = dir
+	searchIndex.index = index
+	return index, nil
+}
+
+// indexFile adds the name, tags, description and text of a completed file to the search
+// index
+func indexFile(meta *FileMeta, store storage.Storage, key string) error {
+	index, err := openSearchIndex()
+	if index == nil {
+		return err
+	}
+	document := searchDocument{
+		FileName:    meta.FileName,
+		Prefix:      meta.Prefix,
+		FileType:    meta.FileType,
+		Tags:        meta.Tags,
+		Description: meta.Description,
+	}
+	if name, ok := storage.LocalPath(store, key); ok {
+		// a file which can't be extracted is still found by its name
+		if document.Content, err = extractText(meta.FileType, name); err != nil {
+			logrus.Warningf("failed to extract text of %s: %v", meta.FileId, err)
+		}
+	}
+	return index.Index(meta.FileId, document)
+}
+
+func unindexFile(fileId string) error {
+	index, err := openSearchIndex()
+	if index == nil {
+		return err
+	}
+	return index.Delete(fileId)
+}
+
+// extractText reads the head of text files, other types go through the first
+// matching extractor
+func extractText(fileType string, name string) (string, error) {
+	maxBytes := viper.GetInt64("uploader.search.max_content_bytes")
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxIndexedBytes
+	}
+
+	textFile := ""
+	if strings.HasPrefix(fileType, "text/") {
+		textFile = name
+	}
+	var extractors []Extractor
+	viper.UnmarshalKey("uploader.search.extractors", &extractors)
+	for _, extractor := range extractors {
+		if ok, _ := path.Match(extractor.Type, fileType); !ok {
+			continue
+		}
+		output, err := os.CreateTemp("", "extract")
+		if err != nil {
+			return "", err
+		}
+		output.Close()
+		defer os.Remove(output.Name())
+		if err := runTool(extractor.Command, map[string]string{"{input}": name, "{output}": output.Name()}); err != nil {
+			return "", err
+		}
+		textFile = output.Name()
+		break
+	}
+	if textFile == "" {
+		return "", nil
+	}
+
+	file, err := os.Open(textFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, maxBytes))
+	return strings.ToValidUTF8(string(content), ""), err
+}
+
+type SearchParams struct {
+	Query  string `form:"q" binding:"required"`
+	Offset int    `form:"offset" binding:"min=0"`
+	Limit  int    `form:"limit" binding:"min=0,max=100"`
+}
+
+type SearchHit struct {
+	FileId      string  `json:"file_id"`
+	FileName    string  `json:"file_name"`
+	Prefix      string  `json:"prefix"`
+	FileType    string  `json:"file_type"`
+	Description string  `json:"description,omitempty"`
+	Score       float64 `json:"score"`
+}
+
+type SearchResult struct {
+	Total uint64      `json:"total"`
+	Hits  []SearchHit `json:"hits"`
+}
+
+// Search finds completed files by name, tags, description and content, q is a bleve query
+// string such as `report +prefix:contracts`
+func (f *FileController) Search(c *gin.Context) {
+	params := SearchParams{}
+	if !f.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	if params.Limit == 0 {
+		params.Limit = 20
+	}
+
+	index, err := openSearchIndex()
+	if err != nil {
+		logrus.Errorf("failed to open search index: %v", err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	if index == nil {
+		f.WriteError(c, nil, uploadererrors.ErrSearchDisabled)
+		return
+	}
+
+	request := bleve.NewSearchRequestOptions(bleve.NewQueryStringQuery(params.Query), params.Limit, params.Offset, false)
+	request.Fields = []string{"file_name", "prefix", "file_type", "description"}
+	found, err := index.Search(request)
+	if err != nil {
+		f.WriteError(c, gin.H{"detail": err.Error()}, uploadererrors.ErrInvalidQuery)
+		return
+	}
+
+	result := SearchResult{Total: found.Total, Hits: []SearchHit{}}
+	for _, hit := range found.Hits {
+		searchHit := SearchHit{FileId: hit.ID, Score: hit.Score}
+		searchHit.FileName, _ = hit.Fields["file_name"].(string)
+		searchHit.Prefix, _ = hit.Fields["prefix"].(string)
+		searchHit.FileType, _ = hit.Fields["file_type"].(string)
+		searchHit.Description, _ = hit.Fields["description"].(string)
+		result.Hits = append(result.Hits, searchHit)
+	}
+	f.Write(c, result, 200, 0, "")
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const defaultSessionIdle = time.Minute
+
+// session is the in-memory state of an active upload, it serializes the
+// requests of the file and caches its meta, which is written through to the
+// meta file on every change
+type session struct {
+	sync.Mutex
+	fileId string
+	meta   *FileMeta
+	// set once the file is completed, requests still waiting for the lock
+	// must not write into it anymore
+	completed bool
+	// the requests holding or waiting for the lock, and since when there are
+	// none, guarded by sessionsLock
+	users     int
+	idleSince time.Time
+}
+
+var (
+	sessionsLock sync.Mutex
+	sessions     = map[string]*session{}
+	// when the idle sessions were last dropped
+	sessionsSwept time.Time
+)
+
+// sessionIdle is how long a session nobody uses stays in memory,
+// `uploader.session_cache.idle` (1m by default)
+func sessionIdle() time.Duration {
+	if idle := viper.GetDuration("uploader.session_cache.idle"); idle > 0 {
+		return idle
+	}
+	return defaultSessionIdle
+}
+
+// lockSession locks the session of the file, several writers of the same file
+// are served one at a time
+func lockSession(fileId string) *session {
+	for {
+		sessionsLock.Lock()
+		sweepSessions(time.Now())
+		s, ok := sessions[fileId]
+		if !ok {
+			s = &session{fileId: fileId}
+			sessions[fileId] = s
+		}
+		s.users++
+		sessionsLock.Unlock()
+
+		s.Lock()
+		// the session may have been forgotten while waiting, start over with
+		// the current one unless it's done with
+		sessionsLock.Lock()
+		current := sessions[fileId] == s
+		sessionsLock.Unlock()
+		if s.completed || current {
+			return s
+		}
+		s.Unlock()
+	}
+}
+
+// Unlock releases the session, it stays in memory for sessionIdle once no
+// request holds or waits for it
+func (s *session) Unlock() {
+	sessionsLock.Lock()
+	s.users--
+	if s.users == 0 {
+		s.idleSince = time.Now()
+	}
+	sessionsLock.Unlock()
+	s.Mutex.Unlock()
+}
+
+// sweepSessions drops the sessions idle for longer than sessionIdle, at most
+// once every sessionIdle, with sessionsLock held
+func sweepSessions(now time.Time) {
+	idle := sessionIdle()
+	if now.Sub(sessionsSwept) < idle {
+		return
+	}
+	sessionsSwept = now
+	for fileId, s := range sessions {
+		if s.users == 0 && now.Sub(s.idleSince) >= idle {
+			delete(sessions, fileId)
+		}
+	}
+}
+
+// isCompleted tells whether the file is completed already, by this session
+// or by one before it
+func (s *session) isCompleted() bool {
+	if s.completed {
+		return true
+	}
+	_, err := metas().read(MetaRecordFile, s.fileId)
+	return err == nil
+}
+
+func (s *session) loadMeta() (*FileMeta, error) {
+	if s.meta != nil {
+		return s.meta, nil
+	}
+	content, err := metas().read(MetaRecordSession, s.fileId)
+	if err != nil {
+		return nil, err
+	}
+	meta := &FileMeta{}
+	if err := decodeMeta(content, meta); err != nil {
+		return nil, err
+	}
+	s.meta = meta
+	return meta, nil
+}
+
+func (s *session) saveMeta() error {
+	content, err := json.Marshal(s.meta)
+	if err == nil {
+		err = metas().write(MetaRecordSession, s.fileId, content)
+	}
+	if err != nil {
+		// the cached meta is ahead of the file, read it again next time
+		s.meta = nil
+	}
+	return err
+}
+
+// forget drops the session from memory, the meta file is left untouched
+func (s *session) forget() {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if sessions[s.fileId] == s {
+		delete(sessions, s.fileId)
+	}
+}
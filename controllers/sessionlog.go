@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SessionEvent is a line of the log of a session
+type SessionEvent struct {
+	// unix milliseconds
+	At int64 `json:"at"`
+	// create, slice, state, error or patch
+	Event   string `json:"event"`
+	Client  string `json:"client,omitempty"`
+	SliceId string `json:"slice_id,omitempty"`
+	// of the file for create, of the slice for slice
+	Size      int64     `json:"size,omitempty"`
+	ChunkSize int64     `json:"chunk_size,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	State     FileState `json:"state,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	// the error as logged by the server, with its details
+	Error string `json:"error,omitempty"`
+}
+
+// sessionLogPath is the log of the session, `<file id>.log.jsonl` in
+// uploader.session_log.dir, or in metafile_dir with only
+// uploader.session_log.enabled. Logs are off without either.
+func sessionLogPath(fileId string) (string, bool) {
+	dir := viper.GetString("uploader.session_log.dir")
+	if dir == "" && viper.GetBool("uploader.session_log.enabled") {
+		dir = viper.GetString("uploader.metafile_dir")
+	}
+	if dir == "" {
+		return "", false
+	}
+	return path.Join(dir, fileId+".log.jsonl"), true
+}
+
+// logSessionEvent appends event to the log of the session, failing to only
+// costs the line
+func logSessionEvent(fileId string, event SessionEvent) {
+	name, ok := sessionLogPath(fileId)
+	if !ok {
+		return
+	}
+	event.At = time.Now().UnixMilli()
+	line, _ := json.Marshal(event)
+	file, err := permissions().AppendFile(name)
+	if err != nil {
+		logrus.Errorf("failed to open the log of %s: %v", fileId, err)
+		return
+	}
+	defer file.Close()
+	// one write per line, appends of concurrent requests don't interleave
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		logrus.Errorf("failed to write the log of %s: %v", fileId, err)
+	}
+}
+
+// SessionLog serves the log of a session as json lines, oldest first
+func (a *AdminController) SessionLog(c *gin.Context) {
+	fileId := c.Param("id")
+	if fileId == "" || strings.ContainsAny(fileId, "/.") {
+		a.Write(c, nil, 400, 0, "")
+		return
+	}
+	name, ok := sessionLogPath(fileId)
+	if !ok || !fileExists(name) {
+		a.Write(c, nil, 404, 0, "")
+		return
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.File(name)
+}
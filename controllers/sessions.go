@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// SessionSummary is a session holding slice cache, as listed by Sessions
+type SessionSummary struct {
+	Progress
+	FileName   string `json:"file_name"`
+	Prefix     string `json:"prefix,omitempty"`
+	UploadedBy string `json:"uploaded_by,omitempty"`
+	// unix seconds
+	CreatedAt int64 `json:"created_at"`
+	Deadline  int64 `json:"deadline,omitempty"`
+	// unix seconds of the last slice received or state change
+	LastActivity int64 `json:"last_activity"`
+	// bytes of slices the session may hold in the cache, 0 without limit
+	CacheLimit int64 `json:"cache_limit,omitempty"`
+}
+
+func newSessionSummary(meta FileMeta) SessionSummary {
+	summary := SessionSummary{
+		Progress:     newProgress(meta),
+		FileName:     meta.FileName,
+		Prefix:       meta.Prefix,
+		UploadedBy:   meta.UploadedBy,
+		CreatedAt:    meta.CreatedAt,
+		Deadline:     meta.Deadline,
+		LastActivity: meta.CreatedAt,
+		CacheLimit:   meta.cacheLimit(),
+	}
+	for _, change := range meta.History {
+		summary.LastActivity = max(summary.LastActivity, change.At)
+	}
+	for _, slice := range meta.Slices {
+		summary.LastActivity = max(summary.LastActivity, slice.ReceivedAt)
+	}
+	return summary
+}
+
+type SessionsParams struct {
+	State  FileState `form:"state" binding:"omitempty,oneof=created uploading merging verifying failed"`
+	Prefix string    `form:"prefix"`
+	// the API key the sessions were created with
+	KeyId string `form:"key_id"`
+}
+
+// Sessions lists the sessions not completed yet, whose slices take space in
+// the slice cache, most recently active first. They can be filtered by
+// state, prefix (and the prefixes under it) and API key.
+func (a *AdminController) Sessions(c *gin.Context) {
+	params := SessionsParams{}
+	if !a.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	metas, err := cachedMetas()
+	if err != nil {
+		logrus.Errorf("failed to list sessions: %v", err)
+		a.Write(c, nil, 500, 0, "")
+		return
+	}
+	sessions := []SessionSummary{}
+	for _, meta := range metas {
+		if params.State != "" && meta.state() != params.State {
+			continue
+		}
+		if !underPrefix(meta.Prefix, params.Prefix) {
+			continue
+		}
+		if params.KeyId != "" && meta.UploadedBy != params.KeyId {
+			continue
+		}
+		sessions = append(sessions, newSessionSummary(meta))
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].LastActivity != sessions[j].LastActivity {
+			return sessions[i].LastActivity > sessions[j].LastActivity
+		}
+		return sessions[i].FileId < sessions[j].FileId
+	})
+	a.Write(c, sessions, 200, 0, "")
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/cdn"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const defaultShareTTL = time.Hour
+
+// ShareParams asks for a url valid for TTL seconds, at most and by default
+// `uploader.cdn.ttl`
+type ShareParams struct {
+	TTL int64 `json:"ttl" binding:"min=0"`
+}
+
+type ShareResult struct {
+	URL string `json:"url"`
+	// unix seconds
+	Expires int64 `json:"expires"`
+}
+
+// Share mints a signed url of the completed file on the CDN of `uploader.cdn`,
+// downloads with it don't go through the uploader
+func (f *FileController) Share(c *gin.Context) {
+	params := ShareParams{}
+	if c.Request.ContentLength != 0 {
+		if !f.bind(c, &params, c.ShouldBindJSON) {
+			return
+		}
+	}
+
+	config := cdn.Config{}
+	if err := viper.UnmarshalKey("uploader.cdn", &config); err != nil || config.Provider == "" {
+		f.WriteError(c, nil, uploadererrors.ErrCDNNotConfigured)
+		return
+	}
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	if !meta.stored() {
+		f.WriteError(c, nil, uploadererrors.ErrNotCompleted)
+		return
+	}
+
+	signer, err := cdn.New(config)
+	if err != nil {
+		logrus.Errorf("failed to create cdn signer: %v", err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	ttl := defaultShareTTL
+	if viper.IsSet("uploader.cdn.ttl") {
+		ttl = viper.GetDuration("uploader.cdn.ttl")
+	}
+	if requested := time.Duration(params.TTL) * time.Second; requested > 0 && requested < ttl {
+		ttl = requested
+	}
+	expires := time.Now().Add(ttl)
+	url, err := signer.Sign(meta.StorageKey(), expires)
+	if err != nil {
+		logrus.Errorf("failed to sign the url of %s: %v", meta.FileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+	f.Write(c, ShareResult{URL: url, Expires: expires.Unix()}, 200, 0, "")
+}
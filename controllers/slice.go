@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Slice tells whether a slice is already stored, so clients can probe it
+// before sending the data again
+func (f *FileController) Slice(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) || !f.checkReader(c, &meta) {
+		return
+	}
+
+	slice, ok := meta.Slices[c.Param("slice_id")]
+	if !ok || slice.Status != 1 {
+		f.Write(c, nil, 404, 0, "")
+		return
+	}
+	f.Write(c, slice, 200, 0, "")
+}
+
+type SlicesParams struct {
+	Offset int    `form:"offset" binding:"min=0"`
+	Limit  int    `form:"limit" binding:"min=0,max=1000"`
+	Status string `form:"status" binding:"omitempty,oneof=pending uploaded claimable"`
+}
+
+type SlicesPage struct {
+	Total  int     `json:"total"`
+	Offset int     `json:"offset"`
+	Limit  int     `json:"limit"`
+	Slices []Slice `json:"slices"`
+}
+
+// Slices lists the slices in order a page at a time, optionally only the
+// pending, uploaded or claimable ones
+func (f *FileController) Slices(c *gin.Context) {
+	params := SlicesParams{}
+	if !f.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	if params.Limit == 0 {
+		params.Limit = 100
+	}
+
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) || !f.checkReader(c, &meta) {
+		return
+	}
+
+	page := SlicesPage{Offset: params.Offset, Limit: params.Limit, Slices: []Slice{}}
+	for i := 0; i < len(meta.Slices); i++ {
+		slice := meta.Slices[strconv.Itoa(i)]
+		if params.Status == "pending" && slice.Status == 1 || params.Status == "uploaded" && slice.Status != 1 {
+			continue
+		}
+		// pending and free to be claimed by anybody
+		if params.Status == "claimable" && (slice.Status == 1 || slice.claimedByOther("")) {
+			continue
+		}
+		if page.Total >= params.Offset && len(page.Slices) < params.Limit {
+			page.Slices = append(page.Slices, slice)
+		}
+		page.Total++
+	}
+	f.Write(c, page, 200, 0, "")
+}
+
+// BitmapFileMeta is the compact form of FileMeta, the slices map is replaced
+// by a bitmap of the uploaded slices and optionally their hashes
+type BitmapFileMeta struct {
+	CreateParams
+	FileId       string    `json:"file_id"`
+	CreatedAt    int64     `json:"created_at"`
+	State        FileState `json:"state"`
+	SliceCount   int       `json:"slice_count"`
+	SlicesBitmap string    `json:"slices_bitmap"`
+	SliceHashes  []string  `json:"slice_hashes,omitempty"`
+}
+
+func newBitmapFileMeta(meta FileMeta, withHashes bool) BitmapFileMeta {
+	bitmapMeta := BitmapFileMeta{
+		CreateParams: meta.CreateParams,
+		FileId:       meta.FileId,
+		CreatedAt:    meta.CreatedAt,
+		State:        meta.state(),
+		SliceCount:   len(meta.Slices),
+		SlicesBitmap: base64.StdEncoding.EncodeToString(slicesBitmap(meta)),
+	}
+	if withHashes {
+		bitmapMeta.SliceHashes = make([]string, len(meta.Slices))
+		for i := range bitmapMeta.SliceHashes {
+			bitmapMeta.SliceHashes[i] = meta.Slices[strconv.Itoa(i)].Sha1
+		}
+	}
+	return bitmapMeta
+}
+
+// bit i is set when slice i is uploaded, the first slice is the highest bit
+// of the first byte
+func slicesBitmap(meta FileMeta) []byte {
+	bitmap := make([]byte, (len(meta.Slices)+7)/8)
+	for i := 0; i < len(meta.Slices); i++ {
+		if meta.Slices[strconv.Itoa(i)].Status == 1 {
+			bitmap[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return bitmap
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// completed files wait here, relative to the root of their storage, until
+// their post processing is done, see place
+const stagingDir = ".staging"
+
+func stagingKey(fileId string) string {
+	return stagingDir + "/" + fileId
+}
+
+// Location maps a file id to where its file is in storage
+type Location struct {
+	FileId     string `json:"file_id"`
+	StorageKey string `json:"storage_key"`
+	StagingKey string `json:"staging_key"`
+	// the file is still in staging, at StagingKey
+	Staged bool `json:"staged"`
+}
+
+// Location tells where the file of a session is, or will be once completed
+func (f *FileController) Location(c *gin.Context) {
+	meta, err := readMeta(c.Param("id"))
+	if !f.checkReadMeta(c, err) {
+		return
+	}
+	store, err := meta.storage()
+	if err != nil {
+		logrus.Errorf("failed to open storage of %s: %v", meta.FileId, err)
+		f.Write(c, nil, 500, 0, "")
+		return
+	}
+
+	location := Location{
+		FileId:     meta.FileId,
+		StorageKey: meta.StorageKey(),
+		StagingKey: stagingKey(meta.FileId),
+	}
+	if _, err := store.Stat(location.StagingKey); err == nil {
+		location.Staged = true
+	}
+	f.Write(c, location, 200, 0, "")
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileState is where a session is in its lifecycle
+type FileState string
+
+const (
+	StateCreated FileState = "created"
+	// slices are coming in
+	StateUploading FileState = "uploading"
+	// the slices are assembled into the file
+	StateMerging FileState = "merging"
+	// the file is hashed and checked by the pre processors
+	StateVerifying FileState = "verifying"
+	StateComplete  FileState = "complete"
+	// the file was rejected, the session takes no more slices
+	StateFailed FileState = "failed"
+	// the session passed its deadline and was reclaimed
+	StateExpired FileState = "expired"
+)
+
+// transitions are the states each state may move to. A merge or a
+// verification given up, e.g. while storage is unavailable, goes back to
+// uploading so the next slice sent completes the file.
+var transitions = map[FileState][]FileState{
+	StateCreated:   {StateUploading, StateMerging, StateVerifying, StateFailed, StateExpired},
+	StateUploading: {StateMerging, StateVerifying, StateFailed, StateExpired},
+	StateMerging:   {StateVerifying, StateComplete, StateUploading, StateFailed},
+	StateVerifying: {StateComplete, StateUploading, StateFailed},
+}
+
+// StateChange is a transition of a session, its meta keeps all of them
+type StateChange struct {
+	State FileState `json:"state"`
+	// unix seconds
+	At int64 `json:"at"`
+	// why the session failed
+	Reason string `json:"reason,omitempty"`
+}
+
+// TransitionError is a transition the lifecycle doesn't allow
+type TransitionError struct {
+	FileId   string
+	From, To FileState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s can't go from %s to %s", e.FileId, e.From, e.To)
+}
+
+// state of the session, sessions created before states had none
+func (m *FileMeta) state() FileState {
+	if m.State == "" {
+		if m.stored() {
+			return StateComplete
+		}
+		return StateCreated
+	}
+	return m.State
+}
+
+// transition moves the session to state and records when, moving to the
+// state it is in does nothing. The meta has to be saved by the caller.
+func (m *FileMeta) transition(state FileState, reason string) error {
+	from := m.state()
+	if from == state && m.State != "" {
+		return nil
+	}
+	allowed := from == state
+	for _, next := range transitions[from] {
+		allowed = allowed || next == state
+	}
+	if !allowed {
+		return &TransitionError{FileId: m.FileId, From: from, To: state}
+	}
+	m.State = state
+	m.History = append(m.History, StateChange{State: state, At: time.Now().Unix(), Reason: reason})
+	logrus.Debugf("%s is %s", m.FileId, state)
+	logSessionEvent(m.FileId, SessionEvent{Event: "state", State: state, Reason: reason})
+	return nil
+}
+
+// advance moves the session to state and saves its meta
+func (s *session) advance(state FileState, reason string) error {
+	if err := s.meta.transition(state, reason); err != nil {
+		return err
+	}
+	return s.saveMeta()
+}
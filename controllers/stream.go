@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+)
+
+// StreamFrameHeader precedes the bytes of every slice sent to Stream
+type StreamFrameHeader struct {
+	SliceId string `json:"slice_id"`
+	Size    int64  `json:"size"`
+}
+
+type StreamParams struct {
+	CreateParams
+	Mode string `form:"mode" binding:"omitempty,oneof=v1 v2"`
+}
+
+const maxStreamFrameHeaderSize = 4096
+
+// Stream receives many slices over one long-lived request. The body is a
+// sequence of frames, each one is
+//
+//	uint32 (big endian) length of the header
+//	header, StreamFrameHeader as json
+//	size bytes of the slice
+//
+// and every frame is acked as soon as it is stored with a line of json
+// (BatchSliceResult) in the response. The response ends with the status of
+// the file once the body is consumed.
+func (f *FileController) Stream(c *gin.Context) {
+	params := StreamParams{}
+	if !f.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	v2 := params.Mode != "v1"
+	fileId := c.Param("id")
+
+	session := lockSession(fileId)
+	meta, ok := f.checkSessionMeta(c, session, params.CreateParams)
+	session.Unlock()
+	if !ok {
+		return
+	}
+	chunkSize := meta.ChunkSize
+
+	// acks are written while the body is still being read
+	controller := http.NewResponseController(c.Writer)
+	if err := controller.EnableFullDuplex(); err != nil {
+		logrus.Debugf("full duplex not supported: %v", err)
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Language", language(c))
+	c.Status(200)
+	encoder := json.NewEncoder(c.Writer)
+	reader := bufio.NewReader(c.Request.Body)
+
+	status, fileErr := 206, error(nil)
+	for {
+		header, data, err := readStreamFrame(reader, chunkSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logrus.Infof("bad stream frame for %s: %v", fileId, err)
+			fileErr = uploadererrors.ErrInvalidRequest.WithMessage(err.Error())
+			encoder.Encode(sliceResult(c, header.SliceId, fileErr))
+			status, _ = uploadererrors.Status(fileErr)
+			break
+		}
+
+		var sliceErr error
+		status, sliceErr, fileErr = receiveStreamFrame(c.Request.Context(), fileId, params.CreateParams, writerOf(c), header.SliceId, data, v2)
+		encoder.Encode(sliceResult(c, header.SliceId, sliceErr))
+		controller.Flush()
+		if status != 206 {
+			// the file is completed or the session is unusable
+			break
+		}
+	}
+
+	// the trailing line is the status of the file like in other responses
+	var known *uploadererrors.Error
+	code := status
+	if fileErr != nil {
+		status, code, known = answer(fileErr)
+	}
+	trailer := Response{Code: code, Message: localize(c, status, known)}
+	if known != nil {
+		trailer.Error = known.Name
+	}
+	encoder.Encode(trailer)
+	controller.Flush()
+}
+
+func readStreamFrame(reader io.Reader, maxSize int64) (StreamFrameHeader, []byte, error) {
+	var header StreamFrameHeader
+	var headerSize uint32
+	if err := binary.Read(reader, binary.BigEndian, &headerSize); err != nil {
+		return header, nil, err
+	}
+	if headerSize > maxStreamFrameHeaderSize {
+		return header, nil, fmt.Errorf("frame header too large: %d", headerSize)
+	}
+	headerBytes := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, headerBytes); err != nil {
+		return header, nil, io.ErrUnexpectedEOF
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return header, nil, fmt.Errorf("invalid frame header: %w", err)
+	}
+	if header.Size <= 0 || header.Size > maxSize {
+		return header, nil, fmt.Errorf("invalid frame size: %d", header.Size)
+	}
+	data := make([]byte, header.Size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return header, nil, io.ErrUnexpectedEOF
+	}
+	return header, data, nil
+}
+
+// receiveStreamFrame stores one slice of the stream, it returns the status of
+// the file, 206 while slices are missing and 200 once it is completed, the
+// error failing the slice and the one failing the file
+func receiveStreamFrame(ctx context.Context, fileId string, params CreateParams, writer writer, sliceId string, data []byte, v2 bool) (int, error, error) {
+	session := lockSession(fileId)
+	defer session.Unlock()
+
+	meta, _, err := writableSessionMeta(session, params, writer.token)
+	if err != nil {
+		status, _ := uploadererrors.Status(err)
+		return status, err, err
+	}
+	slice, ok := meta.Slices[sliceId]
+	if !ok {
+		return 206, uploadererrors.ErrUnknownSlice, nil
+	}
+	if slice.claimedByOther(writer.client) {
+		return 206, uploadererrors.ErrSliceClaimed, nil
+	}
+	err = receiveSlice(ctx, session, sliceId, data, v2)
+	if ctx.Err() != nil {
+		return 206, uploadererrors.ErrClientGone, nil
+	}
+	if err != nil {
+		_, err = sliceFailure(meta, sliceId, err)
+		return 206, err, nil
+	}
+	if !meta.Uploaded() {
+		return 206, nil, nil
+	}
+	if _, err := complete(ctx, session, v2); err != nil {
+		status, _ := uploadererrors.Status(err)
+		return status, nil, err
+	}
+	return 200, nil, nil
+}
@@ -0,0 +1,227 @@
+package controllers_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/controllers"
+	"github.com/louis-she/simple-uploader/utils"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeStreamFrame(w io.Writer, sliceId int64, data []byte) {
+	header, _ := json.Marshal(controllers.StreamFrameHeader{SliceId: strconv.FormatInt(sliceId, 10), Size: int64(len(data))})
+	binary.Write(w, binary.BigEndian, uint32(len(header)))
+	w.Write(header)
+	w.Write(data)
+}
+
+func TestFileUploadStream(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(3*1024*1024+10, 1024*1024)
+	defer os.Remove(file.Name())
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	query := url.Values{}
+	query.Set("file_name", meta.FileName)
+	query.Set("file_type", meta.FileType)
+	query.Set("file_size", strconv.FormatInt(meta.FileSize, 10))
+	query.Set("chunk_size", strconv.FormatInt(meta.ChunkSize, 10))
+
+	bodyReader, bodyWriter := io.Pipe()
+	req, _ := http.NewRequest("POST", server.URL+"/files/"+meta.FileId+"/stream?"+query.Encode(), bodyReader)
+	responses := make(chan *http.Response)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		responses <- res
+	}()
+
+	// a slice the session doesn't have fails on its own
+	writeStreamFrame(bodyWriter, 9, []byte("unknown"))
+	res := <-responses
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	acks := bufio.NewScanner(res.Body)
+	assert.True(acks.Scan())
+	var unknown controllers.BatchSliceResult
+	json.Unmarshal(acks.Bytes(), &unknown)
+	assert.Equal(controllers.BatchSliceResult{SliceId: "9", Code: 400, Message: "unknown slice", Error: "unknown_slice"}, unknown)
+
+	// every frame is acked before the next one is sent
+	for slice := int64(0); slice < 4; slice++ {
+		buf := make([]byte, utils.Min(meta.FileSize-slice*meta.ChunkSize, meta.ChunkSize))
+		file.ReadAt(buf, slice*meta.ChunkSize)
+		writeStreamFrame(bodyWriter, slice, buf)
+
+		assert.True(acks.Scan())
+		var ack controllers.BatchSliceResult
+		json.Unmarshal(acks.Bytes(), &ack)
+		assert.Equal(strconv.FormatInt(slice, 10), ack.SliceId)
+		assert.Equal(200, ack.Code)
+	}
+	bodyWriter.Close()
+
+	assert.True(acks.Scan())
+	var trailer controllers.Response
+	json.Unmarshal(acks.Bytes(), &trailer)
+	assert.Equal(200, trailer.Code)
+
+	localBytes, _ := os.ReadFile(file.Name())
+	serverBytes, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.Equal(sha1.Sum(localBytes), sha1.Sum(serverBytes))
+}
+
+func TestFileUploadContentRange(t *testing.T) {
+	assert := assert.New(t)
+	file, meta := createRandomFile(2560, 1024)
+	defer os.Remove(file.Name())
+	content, _ := os.ReadFile(file.Name())
+
+	put := func(contentRange string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", "/files/"+meta.FileId+"/content", bytes.NewReader(body))
+		req.Header.Set("Content-Range", contentRange)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, put("bytes 0-99/4096", content[:100]).Code)
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, put("bytes 0-2560/2560", content).Code)
+
+	// slice 1 is only partly in the range, its bytes are dropped
+	w := put("bytes 0-1499/2560", content[:1500])
+	assert.Equal(308, w.Code)
+	assert.Equal("bytes=0-1023", w.Header().Get("Range"))
+
+	w = put("bytes */2560", nil)
+	assert.Equal(308, w.Code)
+	assert.Equal("bytes=0-1023", w.Header().Get("Range"))
+
+	w = put("bytes 1024-2559/*", content[1024:])
+	assert.Equal(http.StatusOK, w.Code)
+	serverBytes, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), meta.FileName))
+	assert.Equal(content, serverBytes)
+}
+
+func TestFileUploadResumable(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.adaptive_chunk.min", 64*1024)
+	viper.Set("uploader.adaptive_chunk.max", 300*1024)
+	defer viper.Set("uploader.adaptive_chunk.min", nil)
+	defer viper.Set("uploader.adaptive_chunk.max", nil)
+	content := make([]byte, 600*1024)
+	rand.Read(content)
+
+	req, _ := http.NewRequest("POST", "/files/resumable?uploadType=resumable", bytes.NewBufferString(`{"name": "resumable.bin"}`))
+	req.Host = "uploader.example.com"
+	req.Header.Set("X-Upload-Content-Length", strconv.Itoa(len(content)))
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusOK, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(err)
+	assert.Equal("uploader.example.com", location.Host)
+	var response controllers.Response
+	var meta controllers.FileMeta
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &meta)
+	assert.Equal("/files/"+meta.FileId+"/content", location.Path)
+	assert.Equal("application/octet-stream", meta.FileType)
+	assert.Equal(int64(256*1024), meta.ChunkSize)
+
+	put := func(contentRange string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", location.String(), bytes.NewReader(body))
+		req.Header.Set("Content-Range", contentRange)
+		c, w := prepareContext(req)
+		r.HandleContext(c)
+		return w
+	}
+	w = put("bytes 0-524287/614400", content[:512*1024])
+	assert.Equal(308, w.Code)
+	assert.Equal("bytes=0-524287", w.Header().Get("Range"))
+	w = put("bytes */614400", nil)
+	assert.Equal(308, w.Code)
+	assert.Equal("bytes=0-524287", w.Header().Get("Range"))
+	assert.Equal(http.StatusOK, put("bytes 524288-614399/614400", content[512*1024:]).Code)
+	assert.Equal(http.StatusOK, put("bytes */614400", nil).Code)
+
+	serverBytes, _ := os.ReadFile(path.Join(viper.GetString("uploader.upload_dir"), "resumable.bin"))
+	assert.Equal(content, serverBytes)
+
+	// without a size there is no session to start
+	req, _ = http.NewRequest("POST", "/files/resumable?uploadType=resumable", bytes.NewBufferString(`{"name": "resumable.bin"}`))
+	c, w = prepareContext(req)
+	r.HandleContext(c)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestFileProgress(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.progress.interval", "10ms")
+	defer viper.Set("uploader.progress.interval", nil)
+	file, meta := createRandomFile(4096, 1024)
+	defer os.Remove(file.Name())
+	uploadSlice(0, meta, file, assert, "v2")
+	uploadSlice(1, meta, file, assert, "v2")
+
+	req, _ := http.NewRequest("GET", "/files/"+meta.FileId+"/progress", nil)
+	c, w := prepareContext(req)
+	r.HandleContext(c)
+	var response controllers.Response
+	var progress controllers.Progress
+	json.Unmarshal(w.Body.Bytes(), &response)
+	json.Unmarshal(response.Data, &progress)
+	assert.Equal(int64(2048), progress.UploadedBytes)
+	assert.Equal(int64(4096), progress.TotalBytes)
+	assert.Equal(2, progress.UploadedSlices)
+	assert.Equal(controllers.StateUploading, progress.State)
+	assert.Greater(progress.Throughput, 0.0)
+	assert.NotNil(progress.ETA)
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+	req, _ = http.NewRequest("GET", server.URL+"/files/"+meta.FileId+"/progress", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+	events := bufio.NewScanner(res.Body)
+	next := func() controllers.Progress {
+		var progress controllers.Progress
+		for events.Scan() {
+			if data, ok := strings.CutPrefix(events.Text(), "data:"); ok {
+				json.Unmarshal([]byte(data), &progress)
+				return progress
+			}
+		}
+		return progress
+	}
+	assert.Equal(2, next().UploadedSlices)
+
+	uploadSlice(2, meta, file, assert, "v2")
+	uploadSlice(3, meta, file, assert, "v2")
+	for progress = next(); progress.State != controllers.StateComplete && progress.FileId != ""; progress = next() {
+	}
+	assert.Equal(controllers.StateComplete, progress.State)
+	assert.Equal(int64(0), *progress.ETA)
+	// the stream ends with the session
+	assert.Equal(controllers.Progress{}, next())
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const (
+	throughputWeight     = 0.2
+	maxTrackedClients    = 10000
+	defaultChunkSize     = 10 * 1024 * 1024
+	defaultMinChunkSize  = 1024 * 1024
+	defaultMaxChunkSize  = 128 * 1024 * 1024
+	defaultTargetSeconds = 10
+)
+
+// clientStats are exponentially weighted averages over the slice uploads of
+// a client
+type clientStats struct {
+	throughput float64
+	errorRate  float64
+	samples    int
+	lastSeen   time.Time
+}
+
+type throughputTracker struct {
+	sync.Mutex
+	clients map[string]*clientStats
+}
+
+var throughput = &throughputTracker{clients: make(map[string]*clientStats)}
+
+func (t *throughputTracker) record(client string, bytes int64, duration time.Duration, failed bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	stats, ok := t.clients[client]
+	if !ok {
+		t.evict()
+		stats = &clientStats{}
+		t.clients[client] = stats
+	}
+	stats.lastSeen = time.Now()
+
+	errorSample := 0.0
+	if failed {
+		errorSample = 1
+	}
+	if stats.samples == 0 {
+		stats.errorRate = errorSample
+	} else {
+		stats.errorRate += throughputWeight * (errorSample - stats.errorRate)
+	}
+	stats.samples++
+
+	if failed || duration <= 0 {
+		return
+	}
+	bytesPerSecond := float64(bytes) / duration.Seconds()
+	if stats.throughput == 0 {
+		stats.throughput = bytesPerSecond
+	} else {
+		stats.throughput += throughputWeight * (bytesPerSecond - stats.throughput)
+	}
+}
+
+// make room for a new client by dropping the ones not seen for an hour, or
+// an arbitrary one when all of them are active
+func (t *throughputTracker) evict() {
+	if len(t.clients) < maxTrackedClients {
+		return
+	}
+	for client, stats := range t.clients {
+		if time.Since(stats.lastSeen) > time.Hour {
+			delete(t.clients, client)
+		}
+	}
+	for client := range t.clients {
+		if len(t.clients) < maxTrackedClients {
+			break
+		}
+		delete(t.clients, client)
+	}
+}
+
+type ChunkSizeRecommendation struct {
+	RecommendedChunkSize int64   `json:"recommended_chunk_size"`
+	Throughput           float64 `json:"throughput"`
+	ErrorRate            float64 `json:"error_rate"`
+	Samples              int     `json:"samples"`
+}
+
+// recommend a chunk size which takes the client about
+// `uploader.adaptive_chunk.target_duration` to upload, halved when more than
+// one in ten slices fails
+func (t *throughputTracker) recommend(client string) ChunkSizeRecommendation {
+	t.Lock()
+	stats := clientStats{}
+	if s, ok := t.clients[client]; ok {
+		stats = *s
+	}
+	t.Unlock()
+
+	minSize := viper.GetInt64("uploader.adaptive_chunk.min")
+	if minSize <= 0 {
+		minSize = defaultMinChunkSize
+	}
+	maxSize := viper.GetInt64("uploader.adaptive_chunk.max")
+	if maxSize <= 0 {
+		maxSize = defaultMaxChunkSize
+	}
+	target := viper.GetDuration("uploader.adaptive_chunk.target_duration")
+	if target <= 0 {
+		target = defaultTargetSeconds * time.Second
+	}
+
+	size := float64(defaultChunkSize)
+	if stats.throughput > 0 {
+		size = stats.throughput * target.Seconds()
+	}
+	if stats.errorRate > 0.1 {
+		size /= 2
+	}
+	size = math.Max(float64(minSize), math.Min(float64(maxSize), size))
+
+	// round down to whole MiB so the numbers stay friendly
+	recommended := int64(size)
+	if recommended >= 1024*1024 {
+		recommended -= recommended % (1024 * 1024)
+	}
+	return ChunkSizeRecommendation{
+		RecommendedChunkSize: recommended,
+		Throughput:           stats.throughput,
+		ErrorRate:            stats.errorRate,
+		Samples:              stats.samples,
+	}
+}
+
+// ChunkSize recommends the chunk size for the next sessions of the client
+func (f *FileController) ChunkSize(c *gin.Context) {
+	f.Write(c, throughput.recommend(c.ClientIP()), 200, 0, "")
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultSliceBodyTimeout  = 5 * time.Minute
+	defaultBodyIdleTimeout   = 30 * time.Second
+)
+
+func timeout(key string, fallback time.Duration) time.Duration {
+	if d := viper.GetDuration("uploader.timeouts." + key); d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// NewServer serves handler with the timeouts of `uploader.timeouts`, the
+// bodies of the upload routes are guarded by slowClientGuard instead of a
+// server wide read timeout which would cut long streams
+func NewServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeout("read_header", defaultReadHeaderTimeout),
+		IdleTimeout:       timeout("idle", defaultIdleTimeout),
+	}
+}
+
+// guardedBody fails reads once the client stays silent for the idle timeout,
+// the whole body takes longer than the deadline or, past the idle timeout, the
+// client averages less than minRate bytes per second
+type guardedBody struct {
+	io.ReadCloser
+	c        *gin.Context
+	start    time.Time
+	deadline time.Time
+	idle     time.Duration
+	minRate  int64
+	read     int64
+}
+
+func (b *guardedBody) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(b.idle)
+	if !b.deadline.IsZero() && b.deadline.Before(deadline) {
+		deadline = b.deadline
+	}
+	http.NewResponseController(b.c.Writer).SetReadDeadline(deadline)
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	elapsed := time.Since(b.start)
+	if err == nil && b.minRate > 0 && elapsed > b.idle && float64(b.read)/elapsed.Seconds() < float64(b.minRate) {
+		err = uploadererrors.ErrSlowClient
+	}
+	if errors.Is(err, uploadererrors.ErrSlowClient) || errors.Is(err, os.ErrDeadlineExceeded) {
+		logrus.Warningf("dropping slow client %s after %d bytes in %s", b.c.ClientIP(), b.read, elapsed)
+		// the response is still to be written by the handler
+		b.c.Header("Connection", "close")
+	}
+	return n, err
+}
+
+// slowClientGuard protects the routes receiving slice data from clients
+// trickling bytes, their connection is closed after the response. Whole
+// slices must arrive within `slice_body`, streams only get the idle and rate
+// checks.
+func slowClientGuard(perSlice bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := &guardedBody{
+			ReadCloser: c.Request.Body,
+			c:          c,
+			start:      time.Now(),
+			idle:       timeout("body_idle", defaultBodyIdleTimeout),
+			minRate:    viper.GetInt64("uploader.timeouts.min_body_rate"),
+		}
+		if perSlice {
+			body.deadline = body.start.Add(timeout("slice_body", defaultSliceBodyTimeout))
+		}
+		c.Request.Body = body
+		c.Next()
+	}
+}
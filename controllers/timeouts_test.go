@@ -0,0 +1,55 @@
+package controllers_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowClientDropped(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("uploader.timeouts.body_idle", "200ms")
+	defer viper.Set("uploader.timeouts.body_idle", nil)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	file, meta := createRandomFile(1024*1024, 1024*1024)
+	defer os.Remove(file.Name())
+	sliceReq := newSliceRequest(0, meta, file, "v2")
+	body, _ := io.ReadAll(sliceReq.Body)
+
+	// send half of the slice then stall
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write(body[:len(body)/2])
+		time.Sleep(3 * time.Second)
+		writer.Close()
+	}()
+	req, _ := http.NewRequest("POST", server.URL+sliceReq.URL.Path, reader)
+	req.Header.Set("Content-Type", sliceReq.Header.Get("Content-Type"))
+	req.ContentLength = int64(len(body))
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+		assert.True(resp.Close)
+	}
+	assert.Less(time.Since(start), 2*time.Second)
+
+	// a client sending at a normal pace goes through
+	req, _ = http.NewRequest("POST", server.URL+sliceReq.URL.Path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", sliceReq.Header.Get("Content-Type"))
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+	}
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/spf13/viper"
+)
+
+// UploadDirs is `uploader.upload_dir`, one directory or a list of them, e.g.
+// the mount points of several disks no single one of which fits the files
+func UploadDirs() []string {
+	switch dirs := viper.Get("uploader.upload_dir").(type) {
+	case nil:
+		return []string{""}
+	case string:
+		return []string{dirs}
+	}
+	dirs := viper.GetStringSlice("uploader.upload_dir")
+	if len(dirs) == 0 {
+		return []string{""}
+	}
+	return dirs
+}
+
+// CreateDirs creates the slice cache, the metafile dir and the upload dirs
+// unless they are there, with the modes of `uploader.permissions`
+func CreateDirs() error {
+	dirs := append([]string{viper.GetString("uploader.slice_cache_dir"), viper.GetString("uploader.metafile_dir")}, UploadDirs()...)
+	for _, dir := range dirs {
+		if err := permissions().MkdirAll(dir); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// uploadDirOf is the upload dir holding key, the first one when none does
+func uploadDirOf(key string) string {
+	if dir, ok := holdingUploadDir(key); ok {
+		return dir
+	}
+	return UploadDirs()[0]
+}
+
+func holdingUploadDir(key string) (string, bool) {
+	for _, dir := range UploadDirs() {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key))); err == nil {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// sessionStorage is the storage config of the session fileId of a file of
+// size bytes at key. With several upload dirs, the files stored there are
+// spread across them by the hash of their file id, but for a file replacing
+// one stored already, which stays on its disk. The session records the dir
+// it got, so the file is found there once completed.
+func sessionStorage(prefix string, key string, size int64, fileId string) storage.Config {
+	config := storageConfig(prefix, size)
+	dirs := UploadDirs()
+	if len(dirs) < 2 || config.Driver != "local" || config.Root != dirs[0] {
+		return config
+	}
+	if dir, ok := holdingUploadDir(key); ok {
+		config.Root = dir
+		return config
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(fileId))
+	config.Root = dirs[hash.Sum32()%uint32(len(dirs))]
+	return config
+}
+
+// commonDir is the deepest directory containing every one of dirs
+func commonDir(dirs []string) string {
+	common := filepath.Clean(dirs[0])
+	for _, dir := range dirs[1:] {
+		dir = filepath.Clean(dir)
+		for common != filepath.Dir(common) {
+			if relative, err := filepath.Rel(common, dir); err == nil && filepath.IsLocal(relative) {
+				break
+			}
+			common = filepath.Dir(common)
+		}
+	}
+	return common
+}
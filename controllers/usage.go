@@ -0,0 +1,309 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/louis-she/simple-uploader/security"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// usage is flushed to disk this often in the background, whenever it is
+// queried and at shutdown
+const usageFlushInterval = 10 * time.Second
+
+// longest range of days queried at once
+const maxUsageRange = 366 * 24 * time.Hour
+
+// requests without an API key are accounted to this key
+const anonymousKey = "anonymous"
+
+// APIKey identifies the team sending a request with the `X-Api-Key` header,
+// usage is accounted to the Id. It is also the format of the admin tokens.
+type APIKey struct {
+	Id  string `mapstructure:"id"`
+	Key string `mapstructure:"key"`
+	// RFC 3339 time the key is refused from, while rotating it
+	Expires string `mapstructure:"expires"`
+}
+
+type parsedKeyring struct {
+	config any
+	keys   []security.Key
+}
+
+// by config key, parsed again when the config changes
+var keyrings sync.Map
+
+// keyring reads a list of APIKey from config, keys with an invalid expiry
+// are left out
+func keyring(configKey string) []security.Key {
+	config := viper.Get(configKey)
+	if parsed, ok := keyrings.Load(configKey); ok && reflect.DeepEqual(parsed.(*parsedKeyring).config, config) {
+		return parsed.(*parsedKeyring).keys
+	}
+	var configured []APIKey
+	if err := viper.UnmarshalKey(configKey, &configured); err != nil {
+		logrus.Errorf("failed to parse %s: %v", configKey, err)
+	}
+	keys := make([]security.Key, 0, len(configured))
+	for _, apiKey := range configured {
+		key := security.Key{Id: apiKey.Id, Secret: apiKey.Key}
+		if apiKey.Expires != "" {
+			expires, err := time.Parse(time.RFC3339, apiKey.Expires)
+			if err != nil {
+				logrus.Errorf("ignored key %s of %s, invalid expires: %v", apiKey.Id, configKey, err)
+				continue
+			}
+			key.Expires = expires
+		}
+		keys = append(keys, key)
+	}
+	// callers append to it
+	keys = slices.Clip(keys)
+	keyrings.Store(configKey, &parsedKeyring{config: config, keys: keys})
+	return keys
+}
+
+// Usage is the traffic of an API key on a day (UTC)
+type Usage struct {
+	Date         string `json:"date"`
+	KeyId        string `json:"key_id"`
+	Requests     int64  `json:"requests"`
+	IngressBytes int64  `json:"ingress_bytes"`
+	EgressBytes  int64  `json:"egress_bytes"`
+}
+
+type usageMeter struct {
+	sync.Mutex
+	// date -> key id -> usage metered since the last flush
+	days map[string]map[string]*Usage
+}
+
+var usage = &usageMeter{days: map[string]map[string]*Usage{}}
+
+func usageDir() string {
+	return path.Join(viper.GetString("uploader.metafile_dir"), "usage")
+}
+
+func readUsageDay(date string) (map[string]*Usage, error) {
+	day := map[string]*Usage{}
+	content, err := os.ReadFile(path.Join(usageDir(), date+".json"))
+	if os.IsNotExist(err) {
+		return day, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var usages []*Usage
+	if err := json.Unmarshal(content, &usages); err != nil {
+		return nil, err
+	}
+	for _, u := range usages {
+		day[u.KeyId] = u
+	}
+	return day, nil
+}
+
+func (m *usageMeter) record(keyId string, ingress int64, egress int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.add(Usage{Date: time.Now().UTC().Format(time.DateOnly), KeyId: keyId, Requests: 1, IngressBytes: ingress, EgressBytes: egress})
+}
+
+// add counts u in its day, the meter is locked
+func (m *usageMeter) add(u Usage) {
+	day, ok := m.days[u.Date]
+	if !ok {
+		day = map[string]*Usage{}
+		m.days[u.Date] = day
+	}
+	if metered, ok := day[u.KeyId]; ok {
+		metered.Requests += u.Requests
+		metered.IngressBytes += u.IngressBytes
+		metered.EgressBytes += u.EgressBytes
+		return
+	}
+	day[u.KeyId] = &u
+}
+
+// flush adds the usage metered since the last flush to the daily rollups,
+// requests are metered meanwhile. Each rollup is read and written again under
+// the lock of `<date>.json.lock`, so the servers sharing metafile_dir add up
+// their counts and the counts of a server flushed before a restart stay.
+// Usage which can't be written is kept for the next flush.
+func (m *usageMeter) flush() {
+	m.Lock()
+	days := m.days
+	m.days = map[string]map[string]*Usage{}
+	m.Unlock()
+
+	for date, day := range days {
+		if err := addUsageDay(date, day); err != nil {
+			logrus.Errorf("failed to write usage of %s: %v", date, err)
+			m.Lock()
+			for _, u := range day {
+				m.add(*u)
+			}
+			m.Unlock()
+		}
+	}
+}
+
+// addUsageDay adds the usage of day to the rollup of date
+func addUsageDay(date string, day map[string]*Usage) error {
+	if err := permissions().MkdirAll(usageDir()); err != nil {
+		return err
+	}
+	name := path.Join(usageDir(), date+".json")
+	lock, err := permissions().AppendFile(name + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := fileio.Lock(lock); err != nil {
+		return err
+	}
+	rollup, err := readUsageDay(date)
+	if err != nil {
+		return err
+	}
+	for keyId, u := range day {
+		total := *u
+		if flushed, ok := rollup[keyId]; ok {
+			total.Requests += flushed.Requests
+			total.IngressBytes += flushed.IngressBytes
+			total.EgressBytes += flushed.EgressBytes
+		}
+		rollup[keyId] = &total
+	}
+	usages := make([]*Usage, 0, len(rollup))
+	for _, u := range rollup {
+		usages = append(usages, u)
+	}
+	content, _ := json.Marshal(usages)
+	return permissions().WriteFile(name, content)
+}
+
+// StartUsageFlush writes the usage metered every usageFlushInterval in the
+// background until ctx is done, idle or not
+func StartUsageFlush(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				usage.flush()
+			}
+		}
+	}()
+}
+
+// FlushUsage writes the usage metered so far, servers call it once they
+// stopped serving so nothing is lost on restarts
+func FlushUsage() {
+	usage.flush()
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// Accounting meters the bytes received and sent for the API key of every
+// request, requests with an unknown key are refused
+func Accounting(c *gin.Context) {
+	keyId := anonymousKey
+	if key := c.GetHeader("X-Api-Key"); key != "" {
+		var ok bool
+		if keyId, ok = security.Match(keyring("uploader.api_keys"), key, time.Now()); !ok {
+			logrus.Infof("refused api key %s", security.Redact(key))
+			(&BaseController{}).WriteError(c, nil, uploadererrors.ErrUnknownAPIKey)
+			c.Abort()
+			return
+		}
+	}
+	c.Set("api_key_id", keyId)
+
+	body := &countingReader{ReadCloser: c.Request.Body}
+	if c.Request.Body != nil {
+		c.Request.Body = body
+	}
+	c.Next()
+	// offloaded downloads are sent by the proxy
+	egress := int64(max(c.Writer.Size(), 0)) + c.GetInt64("offloaded_bytes")
+	usage.record(keyId, body.count, egress)
+}
+
+type UsageParams struct {
+	From  string `form:"from" binding:"omitempty,datetime=2006-01-02"`
+	To    string `form:"to" binding:"omitempty,datetime=2006-01-02"`
+	KeyId string `form:"key_id"`
+}
+
+// Usage returns the daily usage of the API keys between from and to (both
+// included, UTC dates, default today), optionally of a single key
+func (a *AdminController) Usage(c *gin.Context) {
+	params := UsageParams{}
+	if !a.bind(c, &params, c.ShouldBindQuery) {
+		return
+	}
+	today := time.Now().UTC().Format(time.DateOnly)
+	if params.To == "" {
+		params.To = today
+	}
+	if params.From == "" {
+		params.From = params.To
+	}
+
+	usage.flush()
+
+	from, _ := time.Parse(time.DateOnly, params.From)
+	to, _ := time.Parse(time.DateOnly, params.To)
+	if to.Sub(from) > maxUsageRange {
+		a.WriteError(c, nil, uploadererrors.ErrRangeTooLong)
+		return
+	}
+	usages := []*Usage{}
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		day, err := readUsageDay(date.Format(time.DateOnly))
+		if err != nil {
+			logrus.Errorf("failed to read usage: %v", err)
+			a.Write(c, nil, 500, 0, "")
+			return
+		}
+		for _, u := range day {
+			if params.KeyId == "" || u.KeyId == params.KeyId {
+				usages = append(usages, u)
+			}
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Date != usages[j].Date {
+			return usages[i].Date < usages[j].Date
+		}
+		return usages[i].KeyId < usages[j].KeyId
+	})
+	a.Write(c, usages, 200, 0, "")
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/louis-she/simple-uploader/uploadererrors"
+)
+
+// ValidateConfig is the policy the files uploaded under a prefix must follow
+// whatever type the client claims. It is checked on the first slice, so
+// clients learn early, and on the complete file before it is stored.
+type ValidateConfig struct {
+	// largest jpeg, png or gif accepted, 0 for no limit
+	MaxImageWidth  int `mapstructure:"max_image_width"`
+	MaxImageHeight int `mapstructure:"max_image_height"`
+	// files of a type matching one of the rules must start with its bytes
+	Magic []MagicRule `mapstructure:"magic"`
+	// reject svg files with scripts, event handlers or javascript: urls
+	SVGNoScripts bool `mapstructure:"svg_no_scripts"`
+}
+
+type MagicRule struct {
+	// pattern of the file type given at Create, e.g. `application/pdf`
+	Type string `mapstructure:"type"`
+	// hex of the bytes the file must start with, one of them when several
+	Hex []string `mapstructure:"hex"`
+}
+
+// ValidationError is a file violating the policy of its prefix, answered
+// with 422
+type ValidationError struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+func (e *ValidationError) Error() string {
+	return "file rejected by " + e.Rule + ": " + e.Detail
+}
+
+// Unwrap answers the rejection with its rule and detail
+func (e *ValidationError) Unwrap() error {
+	return uploadererrors.ErrFileRejected.WithMessage(e.Error())
+}
+
+var svgScript = regexp.MustCompile(`(?i)<script|\son[a-z]+\s*=|javascript:`)
+
+// validateHead checks the beginning of a file against the policy of its
+// prefix, image dimensions are checked when the header is complete in it
+func validateHead(meta *FileMeta, head []byte) error {
+	config := prefixConfig(meta.Prefix).Validate
+	if err := config.checkMagic(meta, head); err != nil {
+		return err
+	}
+	if err := config.checkImage(bytes.NewReader(head)); err != nil {
+		return err
+	}
+	if config.SVGNoScripts && isSVG(meta) && svgScript.Match(head) {
+		return &ValidationError{Rule: "svg_no_scripts", Detail: "svg contains a script"}
+	}
+	return nil
+}
+
+// validate is the pre processor checking the complete file, it runs before
+// the file is converted or sanitized
+func validate(meta *FileMeta, name string) (bool, error) {
+	config := prefixConfig(meta.Prefix).Validate
+	if config.MaxImageWidth <= 0 && config.MaxImageHeight <= 0 && len(config.Magic) == 0 && !config.SVGNoScripts {
+		return false, nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	if err := config.checkMagic(meta, head[:n]); err != nil {
+		return false, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := config.checkImage(file); err != nil {
+		return false, err
+	}
+	if config.SVGNoScripts && isSVG(meta) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		found, err := containsSVGScript(file)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return false, &ValidationError{Rule: "svg_no_scripts", Detail: "svg contains a script"}
+		}
+	}
+	return false, nil
+}
+
+func (config ValidateConfig) checkMagic(meta *FileMeta, head []byte) error {
+	for _, rule := range config.Magic {
+		if ok, _ := path.Match(rule.Type, meta.FileType); !ok {
+			continue
+		}
+		for _, magic := range rule.Hex {
+			if prefix, err := hex.DecodeString(magic); err == nil && bytes.HasPrefix(head, prefix) {
+				return nil
+			}
+		}
+		return &ValidationError{Rule: "magic", Detail: fmt.Sprintf("content is not %s", meta.FileType)}
+	}
+	return nil
+}
+
+// checkImage checks the dimensions of jpeg, png and gif images, the type is
+// sniffed from the content as the client may lie about it
+func (config ValidateConfig) checkImage(reader io.Reader) error {
+	if config.MaxImageWidth <= 0 && config.MaxImageHeight <= 0 {
+		return nil
+	}
+	imageConfig, format, err := image.DecodeConfig(reader)
+	if err != nil {
+		// not an image, or its header is not complete yet
+		return nil
+	}
+	if config.MaxImageWidth > 0 && imageConfig.Width > config.MaxImageWidth ||
+		config.MaxImageHeight > 0 && imageConfig.Height > config.MaxImageHeight {
+		return &ValidationError{
+			Rule:   "max_image_size",
+			Detail: fmt.Sprintf("%s is %dx%d", format, imageConfig.Width, imageConfig.Height),
+		}
+	}
+	return nil
+}
+
+func isSVG(meta *FileMeta) bool {
+	return meta.FileType == "image/svg+xml" || strings.EqualFold(path.Ext(meta.FileName), ".svg")
+}
+
+// containsSVGScript scans the reader in blocks, overlapping so a match
+// spanning two blocks is found
+func containsSVGScript(reader io.Reader) (bool, error) {
+	const overlap = 64
+	buffer := make([]byte, 64*1024)
+	kept := 0
+	for {
+		n, err := reader.Read(buffer[kept:])
+		if svgScript.Match(buffer[:kept+n]) {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if kept+n > overlap {
+			kept = copy(buffer, buffer[kept+n-overlap:kept+n])
+		} else {
+			kept += n
+		}
+	}
+}
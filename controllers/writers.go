@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+	"github.com/louis-she/simple-uploader/security"
+	"github.com/louis-she/simple-uploader/uploadererrors"
+)
+
+// clients identify themselves with this header to claim slices
+const clientIdHeader = "X-Client-Id"
+
+// writers of a session send the token returned by Create, the writer token
+// of multi writer sessions is the same as the upload token
+const (
+	uploadTokenHeader = "X-Upload-Token"
+	writerTokenHeader = "X-Writer-Token"
+)
+
+// writer is the client sending slices of a session
+type writer struct {
+	client string
+	token  string
+}
+
+func writerOf(c *gin.Context) writer {
+	return writer{
+		client: c.GetHeader(clientIdHeader),
+		token:  uploadToken(c),
+	}
+}
+
+func uploadToken(c *gin.Context) string {
+	if token := c.GetHeader(uploadTokenHeader); token != "" {
+		return token
+	}
+	if token := c.GetHeader(writerTokenHeader); token != "" {
+		return token
+	}
+	// the session URI of a resumable upload carries it, see Resumable
+	return c.Query("upload_id")
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// writerAllowed tells whether the token grants writing into the session,
+// sessions created without a token (neither multi_writer nor
+// uploader.upload_token) are open to anybody knowing the id
+func (m *FileMeta) writerAllowed(token string) bool {
+	return m.WriterTokenHash == "" || security.Equal(hashToken(token), m.WriterTokenHash)
+}
+
+// readerAllowed tells whether the token grants reading the meta of the
+// session, only sessions created with uploader.upload_token hide it until
+// all the slices are uploaded
+func (m *FileMeta) readerAllowed(token string) bool {
+	return !m.UploadTokenRequired || m.Uploaded() || m.writerAllowed(token)
+}
+
+// write 403 to the response unless the request may read the meta, returns
+// whether it may
+func (f *FileController) checkReader(c *gin.Context, meta *FileMeta) bool {
+	if meta.readerAllowed(uploadToken(c)) {
+		return true
+	}
+	f.WriteError(c, nil, uploadererrors.ErrInvalidUploadToken)
+	return false
+}
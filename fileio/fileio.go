@@ -0,0 +1,69 @@
+// Package fileio is the IO layer writing uploaded data to local files:
+// positional writers for the target files of sessions and buffered copies
+// for merging. Built with the `iouring` tag on Linux, positional writes go
+// through io_uring.
+package fileio
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// WriterAt writes at offsets of an open file
+type WriterAt interface {
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// OpenWriterAt opens the existing file name for positional writes
+func OpenWriterAt(name string) (WriterAt, error) {
+	return openWriterAt(name)
+}
+
+// WriteFullAt writes all of p at off, a writer writing less of it without an
+// error fails with io.ErrShortWrite
+func WriteFullAt(w io.WriterAt, p []byte, off int64) error {
+	n, err := w.WriteAt(p, off)
+	if err == nil && n != len(p) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// CopyBufferSize is the size of the buffers of Copy, large enough to keep
+// the number of syscalls per merged slice low
+const CopyBufferSize = 1024 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, CopyBufferSize)
+		return &buffer
+	},
+}
+
+// Copy is io.Copy with a pooled buffer of CopyBufferSize
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+	return io.CopyBuffer(dst, src, *buffer)
+}
+
+// CopyContext is Copy failing with the error of ctx once it is done, so
+// copies of large files stop when nobody waits for them anymore
+func CopyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return Copy(dst, &contextReader{ctx: ctx, Reader: src})
+}
+
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,133 @@
+package fileio_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/fileio"
+	"github.com/stretchr/testify/assert"
+)
+
+func createFile(t testing.TB, size int64) string {
+	name := filepath.Join(t.TempDir(), "target")
+	file, _ := os.Create(name)
+	file.Truncate(size)
+	file.Close()
+	return name
+}
+
+func TestWriterAt(t *testing.T) {
+	assert := assert.New(t)
+	name := createFile(t, 3*1024)
+	writer, err := fileio.OpenWriterAt(name)
+	if !assert.NoError(err) {
+		return
+	}
+
+	data := make([]byte, 3*1024)
+	rand.Read(data)
+	for _, offset := range []int64{2048, 0, 1024} {
+		n, err := writer.WriteAt(data[offset:offset+1024], offset)
+		assert.NoError(err)
+		assert.Equal(1024, n)
+	}
+	assert.NoError(writer.Sync())
+	assert.NoError(writer.Close())
+
+	content, _ := os.ReadFile(name)
+	assert.True(bytes.Equal(data, content))
+}
+
+// shortWriter writes at most limit bytes per call and reports no error
+type shortWriter struct {
+	limit int
+}
+
+func (w *shortWriter) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) > w.limit {
+		return w.limit, nil
+	}
+	return len(p), nil
+}
+
+func TestWriteFullAt(t *testing.T) {
+	assert.NoError(t, fileio.WriteFullAt(&shortWriter{limit: 1024}, make([]byte, 1024), 0))
+	assert.ErrorIs(t, fileio.WriteFullAt(&shortWriter{limit: 1000}, make([]byte, 1024), 0), io.ErrShortWrite)
+
+	// a full disk fails with the error of the writer
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no /dev/full")
+	}
+	defer full.Close()
+	assert.ErrorIs(t, fileio.WriteFullAt(full, make([]byte, 1024), 0), syscall.ENOSPC)
+}
+
+func TestCopy(t *testing.T) {
+	data := make([]byte, 3*fileio.CopyBufferSize+100)
+	rand.Read(data)
+	var copied bytes.Buffer
+	n, err := fileio.Copy(&copied, bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.True(t, bytes.Equal(data, copied.Bytes()))
+}
+
+// compare the writer of this build (go test -tags iouring for io_uring)
+// with plain positional writes
+func BenchmarkWriteAt(b *testing.B) {
+	const chunk = 256 * 1024
+	const chunks = 64
+	data := make([]byte, chunk)
+	rand.Read(data)
+
+	open := map[string]func(name string) (fileio.WriterAt, error){
+		"os.File":      func(name string) (fileio.WriterAt, error) { return os.OpenFile(name, os.O_RDWR, 0644) },
+		"OpenWriterAt": fileio.OpenWriterAt,
+	}
+	for _, path := range []string{"os.File", "OpenWriterAt"} {
+		b.Run(path, func(b *testing.B) {
+			name := createFile(b, chunk*chunks)
+			writer, err := open[path](name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer writer.Close()
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := writer.WriteAt(data, int64(i%chunks)*chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	data := make([]byte, 16*1024*1024)
+	rand.Read(data)
+	copies := map[string]func(dst io.Writer, src io.Reader) (int64, error){
+		"io.Copy":     io.Copy,
+		"fileio.Copy": fileio.Copy,
+	}
+	for _, path := range []string{"io.Copy", "fileio.Copy"} {
+		b.Run(path, func(b *testing.B) {
+			dst, _ := os.Create(filepath.Join(b.TempDir(), "merged"))
+			defer dst.Close()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				dst.Seek(0, io.SeekStart)
+				// a plain reader, so io.Copy can't use ReaderFrom/WriterTo
+				if _, err := copies[path](dst, io.LimitReader(bytes.NewReader(data), int64(len(data)))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
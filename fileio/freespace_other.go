@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package fileio
+
+// FreeSpace is -1, the free space is unknown on this platform
+func FreeSpace(dir string) (int64, error) {
+	return -1, nil
+}
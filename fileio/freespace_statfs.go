@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package fileio
+
+import "syscall"
+
+// FreeSpace is the bytes of the filesystem of dir available to the server,
+// the blocks reserved for root don't count
+func FreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
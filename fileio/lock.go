@@ -0,0 +1,10 @@
+package fileio
+
+import "os"
+
+// Lock waits for the exclusive lock of file, held until it is closed.
+// Processes sharing a directory, e.g. replicas of a server, take it around
+// their read-modify-write of a file.
+func Lock(file *os.File) error {
+	return lock(file)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fileio
+
+import "os"
+
+// lock doesn't lock, processes sharing a directory aren't kept apart
+func lock(file *os.File) error {
+	return nil
+}
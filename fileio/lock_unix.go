@@ -0,0 +1,18 @@
+//go:build unix
+
+package fileio
+
+import (
+	"os"
+	"syscall"
+)
+
+// lock is flock, which NFS forwards as a lock of the whole file
+func lock(file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
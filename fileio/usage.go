@@ -0,0 +1,36 @@
+package fileio
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+)
+
+// DiskUsage is the space the files under dir take on disk, as du counts it:
+// the blocks allocated, so the holes of sparse files don't count. A missing
+// dir uses nothing.
+func DiskUsage(dir string) (int64, error) {
+	var usage int64
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed meanwhile
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		usage += allocated(info)
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fileio
+
+import "io/fs"
+
+// allocated is the size of the file, sparse files count whole
+func allocated(info fs.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package fileio
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// allocated is the bytes of the blocks of the file, st_blocks counts 512
+// byte units whatever the block size of the filesystem
+func allocated(info fs.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,9 @@
+//go:build !(linux && iouring)
+
+package fileio
+
+import "os"
+
+func openWriterAt(name string) (WriterAt, error) {
+	return os.OpenFile(name, os.O_RDWR, 0644)
+}
@@ -0,0 +1,22 @@
+package fileio
+
+import "syscall"
+
+// SetXattr sets the extended attribute attr of name, e.g. user.checksum
+func SetXattr(name string, attr string, value []byte) error {
+	return syscall.Setxattr(name, attr, value, 0)
+}
+
+// GetXattr reads the extended attribute attr of name
+func GetXattr(name string, attr string) ([]byte, error) {
+	size, err := syscall.Getxattr(name, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(name, attr, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package fileio
+
+import "errors"
+
+// SetXattr sets the extended attribute attr of name, only on linux
+func SetXattr(name string, attr string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+// GetXattr reads the extended attribute attr of name, only on linux
+func GetXattr(name string, attr string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
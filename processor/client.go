@@ -0,0 +1,62 @@
+// Package processor is the contract of the external processors of the
+// uploader, gRPC servers running out of process which scan, convert or reject
+// uploads, see processor.proto. It has the client the uploader calls them with
+// and a server for processors written in Go, any gRPC server of the service
+// can be used.
+package processor
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative processor.proto
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Service is the full name of the service of processor.proto
+const Service = "uploader.processor.v1.Processor"
+
+// Client calls a processor, connections are opened when needed and shared by
+// concurrent calls
+type Client struct {
+	conn      *grpc.ClientConn
+	processor ProcessorClient
+}
+
+// NewClient returns the client of the processor at endpoint, a host:port or
+// the path of a unix socket as `unix:///path` or `unix:path`
+func NewClient(endpoint string) (*Client, error) {
+	if name, ok := strings.CutPrefix(endpoint, "unix:"); ok {
+		if strings.TrimPrefix(name, "//") == "" {
+			return nil, fmt.Errorf("processor: no socket in endpoint %q", endpoint)
+		}
+	} else if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return nil, fmt.Errorf("processor: invalid endpoint %q: %w", endpoint, err)
+	} else {
+		// the address as it is, not resolved by the dns resolver
+		endpoint = "passthrough:///" + endpoint
+	}
+	// h2c, gRPC without TLS
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("processor: %w", err)
+	}
+	return &Client{conn: conn, processor: NewProcessorClient(conn)}, nil
+}
+
+func (c *Client) Describe(ctx context.Context) (*DescribeResponse, error) {
+	return c.processor.Describe(ctx, &DescribeRequest{})
+}
+
+// Process calls the processor with request, the deadline of ctx is sent along
+func (c *Client) Process(ctx context.Context, request *ProcessRequest) (*ProcessResponse, error) {
+	return c.processor.Process(ctx, request)
+}
+
+func (c *Client) Close() {
+	c.conn.Close()
+}
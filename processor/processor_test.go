@@ -0,0 +1,115 @@
+package processor_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/processor"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// echoServer implements the generated service itself, as processors in other
+// languages do
+type echoServer struct {
+	processor.UnimplementedProcessorServer
+}
+
+func (echoServer) Describe(ctx context.Context, _ *processor.DescribeRequest) (*processor.DescribeResponse, error) {
+	return &processor.DescribeResponse{Name: "echo", Version: "2.1"}, nil
+}
+
+func (echoServer) Process(ctx context.Context, request *processor.ProcessRequest) (*processor.ProcessResponse, error) {
+	if request.Path == "" {
+		return nil, status.Error(codes.InvalidArgument, "no path")
+	}
+	response := &processor.ProcessResponse{Version: "2.1", Metadata: map[string]string{"file_id": request.FileId}}
+	if _, ok := ctx.Deadline(); ok {
+		response.Metadata["deadline"] = "sent"
+	}
+	return response, nil
+}
+
+func serve(t *testing.T, network string, address string) net.Listener {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	processor.RegisterProcessorServer(server, echoServer{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener
+}
+
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+	listener := serve(t, "tcp", "127.0.0.1:0")
+	socket := serve(t, "unix", filepath.Join(t.TempDir(), "echo.sock"))
+
+	for _, endpoint := range []string{listener.Addr().String(), "unix://" + socket.Addr().String(), "unix:" + socket.Addr().String()} {
+		client, err := processor.NewClient(endpoint)
+		if !assert.NoError(err, endpoint) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		description, err := client.Describe(ctx)
+		if assert.NoError(err, endpoint) {
+			assert.Equal("echo", description.Name)
+			assert.Equal("2.1", description.Version)
+		}
+		response, err := client.Process(ctx, &processor.ProcessRequest{FileId: "abc", Path: "/tmp/abc", FileSize: 3})
+		if assert.NoError(err, endpoint) {
+			assert.Equal(map[string]string{"file_id": "abc", "deadline": "sent"}, response.Metadata)
+		}
+		// the status of the processor reaches the uploader
+		_, err = client.Process(ctx, &processor.ProcessRequest{FileId: "abc"})
+		assert.Equal(codes.InvalidArgument, status.Code(err))
+		assert.Equal("no path", status.Convert(err).Message())
+		cancel()
+		client.Close()
+	}
+
+	_, err := processor.NewClient("localhost")
+	assert.ErrorContains(err, "invalid endpoint")
+	_, err = processor.NewClient("unix://")
+	assert.ErrorContains(err, "no socket")
+}
+
+type failingProcessor struct{}
+
+func (failingProcessor) Describe(ctx context.Context) (*processor.DescribeResponse, error) {
+	return &processor.DescribeResponse{Name: "failing"}, nil
+}
+
+func (failingProcessor) Process(ctx context.Context, request *processor.ProcessRequest) (*processor.ProcessResponse, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestServe(t *testing.T) {
+	assert := assert.New(t)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go processor.Serve(listener, failingProcessor{})
+
+	client, err := processor.NewClient(listener.Addr().String())
+	if !assert.NoError(err) {
+		return
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	description, err := client.Describe(ctx)
+	if assert.NoError(err) {
+		assert.Equal("failing", description.Name)
+	}
+	_, err = client.Process(ctx, &processor.ProcessRequest{Path: "/tmp/abc"})
+	assert.Equal(codes.Unknown, status.Code(err))
+	assert.Equal("disk full", status.Convert(err).Message())
+}
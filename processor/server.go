@@ -0,0 +1,40 @@
+package processor
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+)
+
+// Processor is implemented by processors written in Go, see Serve. Errors
+// which are not a gRPC status answer codes.Unknown.
+type Processor interface {
+	Describe(ctx context.Context) (*DescribeResponse, error)
+	Process(ctx context.Context, request *ProcessRequest) (*ProcessResponse, error)
+}
+
+// Serve answers the calls of the uploader to p on listener
+func Serve(listener net.Listener, p Processor) error {
+	server := grpc.NewServer()
+	Register(server, p)
+	return server.Serve(listener)
+}
+
+// Register adds p to the gRPC server of a processor serving more services
+func Register(registrar grpc.ServiceRegistrar, p Processor) {
+	RegisterProcessorServer(registrar, processorServer{p: p})
+}
+
+type processorServer struct {
+	UnimplementedProcessorServer
+	p Processor
+}
+
+func (s processorServer) Describe(ctx context.Context, _ *DescribeRequest) (*DescribeResponse, error) {
+	return s.p.Describe(ctx)
+}
+
+func (s processorServer) Process(ctx context.Context, request *ProcessRequest) (*ProcessResponse, error) {
+	return s.p.Process(ctx, request)
+}
@@ -0,0 +1,70 @@
+// Package security compares the secrets sent by clients (tokens, api keys)
+// without leaking them through timing or logs.
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Equal compares a secret sent by a client with the expected one in constant
+// time, their lengths don't leak either. An empty expected secret matches
+// nothing.
+func Equal(given string, expected string) bool {
+	givenSum := sha256.Sum256([]byte(given))
+	expectedSum := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(givenSum[:], expectedSum[:]) == 1 && expected != ""
+}
+
+// Key is a secret granting access as Id. Keys are rotated by adding a new key
+// with the same id, moving the clients to it and then removing the old one or
+// letting it expire.
+type Key struct {
+	Id     string
+	Secret string
+	// the key is refused from then on, never when zero
+	Expires time.Time
+}
+
+// Match finds the id of the key secret is, every key is compared so the time
+// taken doesn't tell which one matched
+func Match(keys []Key, secret string, now time.Time) (string, bool) {
+	id, found := "", false
+	for _, key := range keys {
+		if Equal(secret, key.Secret) && (key.Expires.IsZero() || now.Before(key.Expires)) {
+			id, found = key.Id, true
+		}
+	}
+	return id, found
+}
+
+// Redact shortens a secret to what is enough to tell keys apart in logs
+func Redact(secret string) string {
+	if len(secret) <= 8 {
+		return "[redacted]"
+	}
+	return secret[:4] + "…[redacted]"
+}
+
+// headers carrying secrets, canonical form
+var secretHeaders = []string{"Authorization", "Cookie", "X-Api-Key", "X-Upload-Token", "X-Writer-Token"}
+
+// RedactHeaders returns a copy of header fit for logs, the values of the
+// headers carrying secrets are redacted
+func RedactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range secretHeaders {
+		values := redacted.Values(name)
+		for i, value := range values {
+			if scheme, credentials, ok := strings.Cut(value, " "); ok && name == "Authorization" {
+				values[i] = scheme + " " + Redact(credentials)
+			} else {
+				values[i] = Redact(value)
+			}
+		}
+	}
+	return redacted
+}
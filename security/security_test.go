@@ -0,0 +1,48 @@
+package security_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEqual(t *testing.T) {
+	assert.True(t, security.Equal("s3cret", "s3cret"))
+	assert.False(t, security.Equal("s3cre", "s3cret"))
+	assert.False(t, security.Equal("s3cret-", "s3cret"))
+	assert.False(t, security.Equal("", ""))
+}
+
+func TestMatch(t *testing.T) {
+	now := time.Now()
+	keys := []security.Key{
+		{Id: "team-a", Secret: "old-key", Expires: now.Add(-time.Minute)},
+		{Id: "team-a", Secret: "new-key"},
+		{Id: "team-b", Secret: "other-key", Expires: now.Add(time.Hour)},
+	}
+	for secret, expected := range map[string]string{"new-key": "team-a", "other-key": "team-b", "old-key": "", "unknown": ""} {
+		id, ok := security.Match(keys, secret, now)
+		assert.Equal(t, expected, id, secret)
+		assert.Equal(t, expected != "", ok, secret)
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer 0123456789abcdef")
+	header.Set("X-Upload-Token", "fedcba9876543210")
+	header.Set("X-Api-Key", "short")
+	header.Set("Content-Type", "application/json")
+
+	redacted := security.RedactHeaders(header)
+	assert.Equal(t, "Bearer 0123…[redacted]", redacted.Get("Authorization"))
+	assert.Equal(t, "fedc…[redacted]", redacted.Get("X-Upload-Token"))
+	assert.Equal(t, "[redacted]", redacted.Get("X-Api-Key"))
+	assert.Equal(t, "application/json", redacted.Get("Content-Type"))
+	// the original is untouched
+	assert.True(t, strings.HasSuffix(header.Get("Authorization"), "abcdef"))
+}
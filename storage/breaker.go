@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerPolicy tells when a backend is given up on and for how long
+type BreakerPolicy struct {
+	// consecutive failures opening the circuit, 0 never opens it
+	Threshold int
+	// how long an open circuit rejects calls before one is let through to
+	// test the backend
+	Cooldown time.Duration
+}
+
+var DefaultBreakerPolicy = BreakerPolicy{Threshold: 5, Cooldown: 30 * time.Second}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// CircuitOpenError rejects a call to a backend given up on
+type CircuitOpenError struct {
+	Backend    string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("storage: %s is unavailable, retry in %s", e.Backend, e.RetryAfter.Round(time.Second))
+}
+
+// Breaker counts the consecutive failures of a backend, only errors
+// IsRetryable accepts are failures of the backend itself
+type Breaker struct {
+	mu       sync.Mutex
+	name     string
+	policy   BreakerPolicy
+	state    string
+	failures int
+	openedAt time.Time
+	// a half open circuit lets one call through at a time
+	probing bool
+}
+
+// BreakerStatus is the state of the breaker of a backend
+type BreakerStatus struct {
+	Backend  string `json:"backend"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	// unix seconds, 0 unless open
+	OpenedAt int64 `json:"opened_at,omitempty"`
+}
+
+var breakers = struct {
+	sync.Mutex
+	byName map[string]*Breaker
+}{byName: map[string]*Breaker{}}
+
+// BreakerFor returns the breaker of the backend name, shared by all the
+// storages of the backend, with policy
+func BreakerFor(name string, policy BreakerPolicy) *Breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	breaker, ok := breakers.byName[name]
+	if !ok {
+		breaker = &Breaker{name: name, state: BreakerClosed}
+		breakers.byName[name] = breaker
+	}
+	breaker.mu.Lock()
+	breaker.policy = policy
+	breaker.mu.Unlock()
+	return breaker
+}
+
+// Breakers returns the status of the breakers of all the backends used so
+// far, by backend
+func Breakers() []BreakerStatus {
+	breakers.Lock()
+	defer breakers.Unlock()
+	statuses := make([]BreakerStatus, 0, len(breakers.byName))
+	for _, breaker := range breakers.byName {
+		breaker.mu.Lock()
+		status := BreakerStatus{Backend: breaker.name, State: breaker.state, Failures: breaker.failures}
+		if breaker.state != BreakerClosed {
+			status.OpenedAt = breaker.openedAt.Unix()
+		}
+		breaker.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Backend < statuses[j].Backend })
+	return statuses
+}
+
+// allow returns a *CircuitOpenError unless a call may go to the backend
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if elapsed := time.Since(b.openedAt); elapsed < b.policy.Cooldown {
+			return &CircuitOpenError{Backend: b.name, RetryAfter: b.policy.Cooldown - elapsed}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{Backend: b.name, RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record counts the outcome of a call made with ctx, the failures of calls
+// given up by their caller say nothing about the backend
+func (b *Breaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil || !IsRetryable(err) {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.policy.Threshold > 0 && b.failures >= b.policy.Threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *Breaker) do(ctx context.Context, operation func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := operation()
+	b.record(ctx, err)
+	return err
+}
+
+// Guarded calls the storage it wraps through the breaker of its backend, so
+// calls fail fast while the backend is down instead of piling up
+type Guarded struct {
+	Storage
+	Breaker *Breaker
+}
+
+func NewGuarded(s Storage, breaker *Breaker) *Guarded {
+	return &Guarded{Storage: s, Breaker: breaker}
+}
+
+func (g *Guarded) Unwrap() Storage {
+	return g.Storage
+}
+
+func (g *Guarded) Put(key string, src string) error {
+	return g.Breaker.do(context.Background(), func() error { return g.Storage.Put(key, src) })
+}
+
+func (g *Guarded) PutContext(ctx context.Context, key string, src string) error {
+	return g.Breaker.do(ctx, func() error { return PutContext(ctx, g.Storage, key, src) })
+}
+
+func (g *Guarded) Stat(key string) (info os.FileInfo, err error) {
+	err = g.Breaker.do(context.Background(), func() error {
+		info, err = g.Storage.Stat(key)
+		return err
+	})
+	return info, err
+}
+
+func (g *Guarded) Rename(from string, to string) error {
+	return g.Breaker.do(context.Background(), func() error { return g.Storage.Rename(from, to) })
+}
+
+func (g *Guarded) Delete(key string) error {
+	return g.Breaker.do(context.Background(), func() error { return g.Storage.Delete(key) })
+}
+
+func (g *Guarded) Erase(key string) error {
+	return g.Breaker.do(context.Background(), func() error { return Erase(g.Storage, key) })
+}
+
+func (g *Guarded) Open(key string) (reader io.ReadCloser, err error) {
+	err = g.Breaker.do(context.Background(), func() error {
+		reader, err = Open(g.Storage, key)
+		return err
+	})
+	return reader, err
+}
@@ -0,0 +1,66 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/storage/s3test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	assert := assert.New(t)
+	inner := &flaky{Local: storage.NewLocal(t.TempDir()), failures: 3, err: &storage.S3Error{StatusCode: 503, Code: "SlowDown"}}
+	breaker := storage.BreakerFor(t.Name(), storage.BreakerPolicy{Threshold: 2, Cooldown: 50 * time.Millisecond})
+	guarded := storage.NewGuarded(inner, breaker)
+
+	for i := 0; i < 2; i++ {
+		assert.Error(guarded.Put("a.txt", writeTempFile(t, "a")))
+	}
+	// open, the backend isn't called anymore
+	var open *storage.CircuitOpenError
+	assert.ErrorAs(guarded.Put("a.txt", writeTempFile(t, "a")), &open)
+	assert.Equal(2, inner.calls)
+	assert.Greater(open.RetryAfter, time.Duration(0))
+
+	// after the cooldown a failing probe opens it again
+	time.Sleep(60 * time.Millisecond)
+	assert.NotErrorIs(guarded.Put("a.txt", writeTempFile(t, "a")), open)
+	assert.Equal(3, inner.calls)
+	assert.ErrorAs(guarded.Put("a.txt", writeTempFile(t, "a")), &open)
+
+	// a successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(guarded.Put("a.txt", writeTempFile(t, "a")))
+	assert.NoError(guarded.Put("b.txt", writeTempFile(t, "b")))
+	for _, status := range storage.Breakers() {
+		if status.Backend == t.Name() {
+			assert.Equal(storage.BreakerClosed, status.State)
+		}
+	}
+}
+
+func TestBreakerIgnoresAbandonedCalls(t *testing.T) {
+	assert := assert.New(t)
+	server := s3test.NewServer()
+	defer server.Close()
+	server.Fail(10, 503)
+	breaker := storage.BreakerFor(t.Name(), storage.BreakerPolicy{Threshold: 1, Cooldown: time.Minute})
+	retry := storage.NewRetry(server.Storage("bucket"), storage.RetryPolicy{Attempts: 3, BaseDelay: time.Minute, MaxDelay: time.Minute})
+	guarded := storage.NewGuarded(retry, breaker)
+
+	// the caller leaves during the wait for the first retry
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Error(storage.PutContext(ctx, guarded, "a.txt", writeTempFile(t, "a")))
+	assert.Less(time.Since(start), time.Second)
+	assert.Len(server.Requests(), 1)
+	for _, status := range storage.Breakers() {
+		if status.Backend == t.Name() {
+			assert.Equal(storage.BreakerStatus{Backend: t.Name(), State: storage.BreakerClosed}, status)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import "fmt"
+
+// Config selects and configures a storage, it is recorded in the meta of
+// sessions so it must not hold credentials, drivers read those from their
+// own settings.
+type Config struct {
+	Driver  string            `mapstructure:"driver" json:"driver"`
+	Root    string            `mapstructure:"root" json:"root,omitempty"`
+	Options map[string]string `mapstructure:"options" json:"options,omitempty"`
+}
+
+type Factory func(config Config) (Storage, error)
+
+var drivers = map[string]Factory{
+	"local": func(config Config) (Storage, error) {
+		if config.Root == "" {
+			return nil, fmt.Errorf("storage: local driver needs a root")
+		}
+		return NewLocal(config.Root), nil
+	},
+	"s3": func(config Config) (Storage, error) {
+		return NewS3(config)
+	},
+	"sftp": func(config Config) (Storage, error) {
+		return NewSFTP(config)
+	},
+	"hdfs": func(config Config) (Storage, error) {
+		return NewHDFS(config)
+	},
+}
+
+// Register makes a driver available to New
+func Register(driver string, factory Factory) {
+	drivers[driver] = factory
+}
+
+func New(config Config) (Storage, error) {
+	factory, ok := drivers[config.Driver]
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown driver %q", config.Driver)
+	}
+	return factory(config)
+}
+
+// Backend names the service config stores into, storages of the same backend
+// share its breaker
+func (c Config) Backend() string {
+	if endpoint := c.Options["endpoint"]; endpoint != "" {
+		return c.Driver + ":" + endpoint + "/" + c.Root
+	}
+	return c.Driver + ":" + c.Root
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HDFS stores keys as files under Root in a Hadoop cluster, through the
+// WebHDFS REST API of its namenode. Data goes straight to the datanodes the
+// namenode redirects to.
+type HDFS struct {
+	// url of the namenode, e.g. http://namenode:9870
+	Endpoint string
+	// absolute directory of the keys
+	Root string
+	// user of the requests with simple authentication
+	User string
+	// delegation token of the requests, instead of User
+	Token string
+	// replication factor of the files put, the default of the cluster when 0
+	Replication int
+	Client      *http.Client
+}
+
+// NewHDFS creates the storage of a `hdfs` config: Root is the directory in
+// the cluster, the options endpoint (the http address of the namenode), user
+// and replication configure the files put. A delegation token is read from
+// HDFS_DELEGATION_TOKEN.
+func NewHDFS(config Config) (*HDFS, error) {
+	if !path.IsAbs(config.Root) {
+		return nil, fmt.Errorf("storage: hdfs driver needs an absolute directory as root")
+	}
+	h := &HDFS{Endpoint: config.Options["endpoint"], User: config.Options["user"], Root: config.Root,
+		Token: os.Getenv("HDFS_DELEGATION_TOKEN")}
+	if h.Endpoint == "" {
+		return nil, fmt.Errorf("storage: hdfs driver needs the endpoint option")
+	}
+	if !strings.Contains(h.Endpoint, "://") {
+		h.Endpoint = "http://" + h.Endpoint
+	}
+	if h.User == "" && h.Token == "" {
+		return nil, fmt.Errorf("storage: hdfs driver needs the user option or HDFS_DELEGATION_TOKEN")
+	}
+	if value := config.Options["replication"]; value != "" {
+		replication, err := strconv.Atoi(value)
+		// replication is a short in HDFS
+		if err != nil || replication < 1 || replication > 32767 {
+			return nil, fmt.Errorf("storage: invalid hdfs replication %q", value)
+		}
+		h.Replication = replication
+	}
+	return h, nil
+}
+
+// HDFSError is a RemoteException answered by the cluster
+type HDFSError struct {
+	StatusCode int
+	Exception  string `json:"exception"`
+	Message    string `json:"message"`
+}
+
+func (e *HDFSError) Error() string {
+	return fmt.Sprintf("hdfs: %d %s: %s", e.StatusCode, e.Exception, e.Message)
+}
+
+func readHDFSError(resp *http.Response, op string, name string) error {
+	defer resp.Body.Close()
+	var body struct {
+		RemoteException HDFSError
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+	err := &body.RemoteException
+	err.StatusCode = resp.StatusCode
+	switch {
+	case resp.StatusCode == http.StatusNotFound || err.Exception == "FileNotFoundException":
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	case err.Exception == "AccessControlException":
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return err
+}
+
+func (h *HDFS) client() *http.Client {
+	client := http.DefaultClient
+	if h.Client != nil {
+		client = h.Client
+	}
+	// redirects to the datanodes are followed by hand, so the file is only
+	// sent to them
+	return &http.Client{
+		Transport: client.Transport,
+		Timeout:   client.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (h *HDFS) path(key string) string {
+	return path.Join(h.Root, key)
+}
+
+// url is the WebHDFS url of op on the file name
+func (h *HDFS) url(name string, op string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("op", op)
+	if h.Token != "" {
+		query.Set("delegation", h.Token)
+	} else {
+		query.Set("user.name", h.User)
+	}
+	u := url.URL{Path: "/webhdfs/v1" + name, RawQuery: query.Encode()}
+	return strings.TrimSuffix(h.Endpoint, "/") + u.String()
+}
+
+// do sends the request of op on name, answers other than success and
+// redirects are returned as errors
+func (h *HDFS) do(ctx context.Context, method string, target string, op string, name string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, readHDFSError(resp, op, name)
+	}
+	return resp, nil
+}
+
+// redirect asks the namenode which datanode serves op on name
+func (h *HDFS) redirect(ctx context.Context, method string, name string, op string, query url.Values) (string, error) {
+	resp, err := h.do(ctx, method, h.url(name, op, query), strings.ToLower(op), name, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusTemporaryRedirect || location == "" {
+		return "", fmt.Errorf("hdfs: %s of %s answered %d without a datanode", op, name, resp.StatusCode)
+	}
+	return location, nil
+}
+
+// call sends op on name to the namenode and decodes the json answered into
+// result
+func (h *HDFS) call(ctx context.Context, method string, name string, op string, query url.Values, result interface{}) error {
+	resp, err := h.do(ctx, method, h.url(name, op, query), strings.ToLower(op), name, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (h *HDFS) Put(key string, src string) error {
+	return h.PutContext(context.Background(), key, src)
+}
+
+// PutContext writes src next to key, hidden from the jobs reading the
+// directory, and renames it to key once complete. The upload is abandoned
+// once ctx is done.
+func (h *HDFS) PutContext(ctx context.Context, key string, src string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	name := h.path(key)
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	temporary := path.Join(path.Dir(name), "."+path.Base(name)+"."+hex.EncodeToString(suffix)+".part")
+
+	query := url.Values{"overwrite": {"false"}}
+	if h.Replication > 0 {
+		query.Set("replication", strconv.Itoa(h.Replication))
+	}
+	location, err := h.redirect(ctx, "PUT", temporary, "CREATE", query)
+	if err != nil {
+		return err
+	}
+	resp, err := h.do(ctx, "PUT", location, "create", temporary, file, info.Size())
+	if err == nil {
+		resp.Body.Close()
+		err = h.rename(ctx, temporary, name)
+	}
+	if err != nil {
+		// the datanode may have created it before failing
+		h.call(context.Background(), "DELETE", temporary, "DELETE", nil, nil)
+		return err
+	}
+	file.Close()
+	return os.Remove(src)
+}
+
+// rename replaces to with from, creating the directory of to
+func (h *HDFS) rename(ctx context.Context, from string, to string) error {
+	if err := h.call(ctx, "PUT", path.Dir(to), "MKDIRS", nil, nil); err != nil {
+		return err
+	}
+	return h.call(ctx, "PUT", from, "RENAME", url.Values{"destination": {to}, "renameoptions": {"OVERWRITE"}}, nil)
+}
+
+func (h *HDFS) Stat(key string) (os.FileInfo, error) {
+	var result struct {
+		FileStatus struct {
+			Length           int64  `json:"length"`
+			ModificationTime int64  `json:"modificationTime"`
+			Type             string `json:"type"`
+		}
+	}
+	if err := h.call(context.Background(), "GET", h.path(key), "GETFILESTATUS", nil, &result); err != nil {
+		return nil, err
+	}
+	if result.FileStatus.Type != "FILE" {
+		return nil, &fs.PathError{Op: "getfilestatus", Path: h.path(key), Err: fs.ErrNotExist}
+	}
+	return &objectInfo{
+		name:    path.Base(key),
+		size:    result.FileStatus.Length,
+		modTime: time.UnixMilli(result.FileStatus.ModificationTime),
+	}, nil
+}
+
+func (h *HDFS) Open(key string) (io.ReadCloser, error) {
+	name := h.path(key)
+	location, err := h.redirect(context.Background(), "GET", name, "OPEN", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.do(context.Background(), "GET", location, "open", name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (h *HDFS) Rename(from string, to string) error {
+	return h.rename(context.Background(), h.path(from), h.path(to))
+}
+
+func (h *HDFS) Delete(key string) error {
+	var result struct {
+		Boolean bool `json:"boolean"`
+	}
+	if err := h.call(context.Background(), "DELETE", h.path(key), "DELETE", nil, &result); err != nil {
+		return err
+	}
+	if !result.Boolean {
+		return &fs.PathError{Op: "delete", Path: h.path(key), Err: fs.ErrNotExist}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package storage_test
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/storage/hdfstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHDFS(t *testing.T) {
+	assert := assert.New(t)
+	server := hdfstest.NewServer(t.TempDir())
+	defer server.Close()
+	config := server.Config("/datasets")
+	config.Options["replication"] = "2"
+	s, err := storage.New(config)
+	if !assert.NoError(err) {
+		return
+	}
+
+	content := make([]byte, 1024*1024)
+	rand.Read(content)
+	src := writeTempFile(t, string(content))
+	assert.NoError(s.Put("train/part 0.bin", src))
+	assert.NoFileExists(src)
+	stored, _ := os.ReadFile(filepath.Join(server.Dir, "datasets", "train", "part 0.bin"))
+	assert.Equal(content, stored)
+	assert.Equal(2, server.Replication("/datasets/train/part 0.bin"))
+	// written beside its name and renamed once complete
+	entries, _ := os.ReadDir(filepath.Join(server.Dir, "datasets", "train"))
+	assert.Len(entries, 1)
+
+	info, err := s.Stat("train/part 0.bin")
+	if assert.NoError(err) {
+		assert.Equal(int64(len(content)), info.Size())
+	}
+	reader, err := storage.Open(s, "train/part 0.bin")
+	if assert.NoError(err) {
+		read, err := io.ReadAll(reader)
+		assert.NoError(err)
+		assert.Equal(content, read)
+		assert.NoError(reader.Close())
+	}
+
+	// renames replace the file at their target
+	assert.NoError(s.Put("test/part 0.bin", writeTempFile(t, "old")))
+	assert.NoError(s.Rename("train/part 0.bin", "test/part 0.bin"))
+	_, err = s.Stat("train/part 0.bin")
+	assert.True(os.IsNotExist(err))
+	info, _ = s.Stat("test/part 0.bin")
+	assert.Equal(int64(len(content)), info.Size())
+	assert.NoError(s.Delete("test/part 0.bin"))
+	assert.True(os.IsNotExist(s.Delete("test/part 0.bin")))
+	_, err = storage.Open(s, "test/part 0.bin")
+	assert.True(os.IsNotExist(err))
+
+	// a namenode failing over is retried
+	s = storage.NewRetry(s, storage.RetryPolicy{Attempts: 2})
+	server.Fail(1)
+	assert.NoError(s.Put("b.txt", writeTempFile(t, "world")))
+	stored, _ = os.ReadFile(filepath.Join(server.Dir, "datasets", "b.txt"))
+	assert.Equal("world", string(stored))
+
+	for _, options := range []map[string]string{
+		{"user": hdfstest.User},
+		{"endpoint": server.URL, "user": hdfstest.User, "replication": "0"},
+	} {
+		_, err := storage.New(storage.Config{Driver: "hdfs", Root: "/datasets", Options: options})
+		assert.Error(err)
+	}
+	_, err = storage.New(storage.Config{Driver: "hdfs", Root: "datasets", Options: config.Options})
+	assert.Error(err)
+}
@@ -0,0 +1,192 @@
+// Package hdfstest runs a WebHDFS namenode and datanode over a local
+// directory for tests, serving the requests the hdfs storage sends.
+package hdfstest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/louis-she/simple-uploader/storage"
+)
+
+const User = "hadoop"
+
+type Server struct {
+	*httptest.Server
+	// files are kept under Dir, the root of the file system
+	Dir string
+	mu  sync.Mutex
+	// by path in the file system
+	replication map[string]int
+	// requests served, e.g. "PUT CREATE /data/a.csv"
+	requests []string
+	// the next failures requests are answered by a namenode in standby
+	failures int
+}
+
+func NewServer(dir string) *Server {
+	s := &Server{Dir: dir, replication: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Config returns the config of a hdfs storage of root on the server
+func (s *Server) Config(root string) storage.Config {
+	return storage.Config{Driver: "hdfs", Root: root, Options: map[string]string{
+		"endpoint": s.URL,
+		"user":     User,
+	}}
+}
+
+// Replication returns the replication factor the file at name was created
+// with
+func (s *Server) Replication(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replication[name]
+}
+
+// Requests returns the requests served so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Fail makes the next n requests answer a StandbyException, as a namenode
+// does while failing over
+func (s *Server) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+func remoteException(w http.ResponseWriter, status int, exception string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"RemoteException": map[string]string{
+		"exception":     exception,
+		"javaClassName": "org.apache.hadoop." + exception,
+		"message":       message,
+	}})
+}
+
+func reply(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/webhdfs/v1"))
+	query := r.URL.Query()
+	op := strings.ToUpper(query.Get("op"))
+	s.requests = append(s.requests, r.Method+" "+op+" "+name)
+	if s.failures > 0 {
+		s.failures--
+		remoteException(w, http.StatusForbidden, "StandbyException", "Operation category READ is not supported in state standby")
+		return
+	}
+	if query.Get("user.name") != User {
+		remoteException(w, http.StatusUnauthorized, "SecurityException", "Failed to obtain user group information")
+		return
+	}
+	local := filepath.Join(s.Dir, filepath.FromSlash(name))
+	datanode := query.Get("datanode") == "true"
+	redirect := func() {
+		query.Set("datanode", "true")
+		location := url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: query.Encode()}
+		http.Redirect(w, r, location.String(), http.StatusTemporaryRedirect)
+	}
+
+	switch {
+	case r.Method == "PUT" && op == "CREATE" && !datanode:
+		if _, err := os.Stat(local); err == nil && query.Get("overwrite") != "true" {
+			remoteException(w, http.StatusForbidden, "FileAlreadyExistsException", name+" already exists")
+			return
+		}
+		redirect()
+	case r.Method == "PUT" && op == "CREATE":
+		os.MkdirAll(filepath.Dir(local), 0755)
+		file, err := os.Create(local)
+		if err != nil {
+			remoteException(w, http.StatusInternalServerError, "IOException", err.Error())
+			return
+		}
+		_, err = io.Copy(file, r.Body)
+		file.Close()
+		if err != nil {
+			os.Remove(local)
+			remoteException(w, http.StatusInternalServerError, "IOException", err.Error())
+			return
+		}
+		s.replication[name] = 3
+		if replication, err := strconv.Atoi(query.Get("replication")); err == nil {
+			s.replication[name] = replication
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET" && op == "OPEN" && !datanode:
+		if _, err := os.Stat(local); err != nil {
+			remoteException(w, http.StatusNotFound, "FileNotFoundException", "File "+name+" does not exist.")
+			return
+		}
+		redirect()
+	case r.Method == "GET" && op == "OPEN":
+		http.ServeFile(w, r, local)
+	case r.Method == "GET" && op == "GETFILESTATUS":
+		info, err := os.Stat(local)
+		if err != nil {
+			remoteException(w, http.StatusNotFound, "FileNotFoundException", "File does not exist: "+name)
+			return
+		}
+		typ := "FILE"
+		if info.IsDir() {
+			typ = "DIRECTORY"
+		}
+		reply(w, map[string]interface{}{"FileStatus": map[string]interface{}{
+			"length":           info.Size(),
+			"modificationTime": info.ModTime().UnixMilli(),
+			"type":             typ,
+			"replication":      s.replication[name],
+		}})
+	case r.Method == "PUT" && op == "MKDIRS":
+		reply(w, map[string]bool{"boolean": os.MkdirAll(local, 0755) == nil})
+	case r.Method == "PUT" && op == "RENAME":
+		destination := path.Clean(query.Get("destination"))
+		target := filepath.Join(s.Dir, filepath.FromSlash(destination))
+		if _, err := os.Stat(local); err != nil {
+			remoteException(w, http.StatusNotFound, "FileNotFoundException", "rename source "+name+" is not found.")
+			return
+		}
+		if _, err := os.Stat(target); err == nil && query.Get("renameoptions") != "OVERWRITE" {
+			reply(w, map[string]bool{"boolean": false})
+			return
+		}
+		if err := os.Rename(local, target); err != nil {
+			remoteException(w, http.StatusInternalServerError, "IOException", err.Error())
+			return
+		}
+		s.replication[destination] = s.replication[name]
+		delete(s.replication, name)
+		if query.Get("renameoptions") != "" {
+			// renames with options answer nothing
+			return
+		}
+		reply(w, map[string]bool{"boolean": true})
+	case r.Method == "DELETE" && op == "DELETE":
+		delete(s.replication, name)
+		reply(w, map[string]bool{"boolean": os.Remove(local) == nil})
+	default:
+		remoteException(w, http.StatusBadRequest, "IllegalArgumentException", "Invalid value for webhdfs parameter \"op\"")
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/louis-she/simple-uploader/fileio"
+)
+
+type Local struct {
+	Root string
+	// of the files and directories put, nil for the defaults
+	Permissions *Permissions
+}
+
+func NewLocal(root string) *Local {
+	return &Local{Root: root}
+}
+
+func (l *Local) Path(key string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(key))
+}
+
+func (l *Local) Put(key string, src string) error {
+	return l.PutContext(context.Background(), key, src)
+}
+
+// PutContext is Put giving up on a copy across devices once ctx is done
+func (l *Local) PutContext(ctx context.Context, key string, src string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dst := l.Path(key)
+	if err := l.Permissions.MkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := l.Permissions.ApplyFile(src); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	// src is on another device, copy it next to dst under the name of src,
+	// which follows the partial file convention of the caller, or as
+	// `<dst>.part`, and rename from there so dst never holds a partially
+	// written file
+	tmp := filepath.Join(filepath.Dir(dst), filepath.Base(src))
+	if tmp == dst {
+		tmp = dst + ".part"
+	}
+	if err := copyFile(ctx, src, tmp, l.Permissions); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (l *Local) Stat(key string) (os.FileInfo, error) {
+	return os.Stat(l.Path(key))
+}
+
+func (l *Local) Rename(from string, to string) error {
+	dst := l.Path(to)
+	if err := l.Permissions.MkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	return os.Rename(l.Path(from), dst)
+}
+
+func (l *Local) Delete(key string) error {
+	return os.Remove(l.Path(key))
+}
+
+// Erase overwrites the file with zeros before unlinking it
+func (l *Local) Erase(key string) error {
+	if err := OverwriteFile(l.Path(key)); err != nil {
+		return err
+	}
+	return l.Delete(key)
+}
+
+func OverwriteFile(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 1024*1024)
+	for offset := int64(0); offset < info.Size(); offset += int64(len(zeros)) {
+		n := info.Size() - offset
+		if n > int64(len(zeros)) {
+			n = int64(len(zeros))
+		}
+		if _, err := file.WriteAt(zeros[:n], offset); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+func copyFile(ctx context.Context, src string, dst string, permissions *Permissions) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := permissions.CreateFile(dst, false)
+	if err != nil {
+		return err
+	}
+	n, err := fileio.CopyContext(ctx, out, in)
+	if err == nil && n != info.Size() {
+		err = fmt.Errorf("storage: copied %d bytes of %s instead of %d", n, src, info.Size())
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// the modes of files and directories left out of Permissions
+const (
+	DefaultFileMode fs.FileMode = 0644
+	DefaultDirMode  fs.FileMode = 0755
+)
+
+// Permissions are given to the files and directories created through them,
+// with chmod so the umask can't take bits away. A nil Permissions gives the
+// default modes, owned by the user of the process.
+type Permissions struct {
+	FileMode fs.FileMode
+	DirMode  fs.FileMode
+	// -1 keeps the user or group of the process
+	Uid int
+	Gid int
+}
+
+func (p *Permissions) fileMode() fs.FileMode {
+	if p == nil || p.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return p.FileMode
+}
+
+func (p *Permissions) dirMode() fs.FileMode {
+	if p == nil || p.DirMode == 0 {
+		return DefaultDirMode
+	}
+	return p.DirMode
+}
+
+// ApplyFile gives name the file mode and owner of p
+func (p *Permissions) ApplyFile(name string) error {
+	return p.apply(name, p.fileMode())
+}
+
+// MkdirAll is os.MkdirAll giving the directories it creates the directory
+// mode and owner of p, existing ones are left alone
+func (p *Permissions) MkdirAll(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := p.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, p.dirMode()); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return nil
+		}
+		return err
+	}
+	return p.apply(dir, p.dirMode())
+}
+
+// CreateFile opens name for writing with the file mode and owner of p,
+// creating its parent directories. An exclusive create fails with
+// fs.ErrExist when name exists, otherwise name is truncated.
+func (p *Permissions) CreateFile(name string, exclusive bool) (*os.File, error) {
+	if err := p.MkdirAll(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	file, err := os.OpenFile(name, flag, p.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	if err := p.ApplyFile(name); err != nil {
+		file.Close()
+		if exclusive {
+			os.Remove(name)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// AppendFile opens name for appending, it is created with the file mode and
+// owner of p unless it exists
+func (p *Permissions) AppendFile(name string) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	if file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, p.fileMode()); err != nil {
+		return nil, err
+	}
+	if err := p.ApplyFile(name); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// WriteFile writes data to a temporary file next to name and renames it over
+// name, readers see either the old or the new content
+func (p *Permissions) WriteFile(name string, data []byte) error {
+	if err := p.MkdirAll(filepath.Dir(name)); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = p.ApplyFile(tmp)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// CreateFile is Permissions.CreateFile with the default modes
+func CreateFile(name string, exclusive bool) (*os.File, error) {
+	return (*Permissions)(nil).CreateFile(name, exclusive)
+}
+
+// WriteFile is Permissions.WriteFile with the default modes
+func WriteFile(name string, data []byte) error {
+	return (*Permissions)(nil).WriteFile(name, data)
+}
+
+func (p *Permissions) apply(name string, mode fs.FileMode) error {
+	if err := os.Chmod(name, mode); err != nil {
+		return err
+	}
+	if p != nil && (p.Uid >= 0 || p.Gid >= 0) {
+		return os.Lchown(name, p.Uid, p.Gid)
+	}
+	return nil
+}
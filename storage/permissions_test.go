@@ -0,0 +1,89 @@
+//go:build unix
+
+package storage_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// restrictiveUmask sets a umask taking every bit but the owner's until the
+// test ends
+func restrictiveUmask(t *testing.T) {
+	old := syscall.Umask(0077)
+	t.Cleanup(func() { syscall.Umask(old) })
+}
+
+func mode(name string) fs.FileMode {
+	info, _ := os.Stat(name)
+	return info.Mode().Perm()
+}
+
+func TestCreateFile(t *testing.T) {
+	assert := assert.New(t)
+	restrictiveUmask(t)
+	dir := t.TempDir()
+
+	name := filepath.Join(dir, "a", "b", "file")
+	file, err := storage.CreateFile(name, true)
+	assert.NoError(err)
+	file.Write([]byte("hello"))
+	file.Close()
+	assert.Equal(storage.DefaultFileMode, mode(name))
+	assert.Equal(storage.DefaultDirMode, mode(filepath.Join(dir, "a", "b")))
+
+	_, err = storage.CreateFile(name, true)
+	assert.True(errors.Is(err, fs.ErrExist))
+
+	permissions := &storage.Permissions{FileMode: 0664, Uid: -1, Gid: -1}
+	file, err = permissions.CreateFile(name, false)
+	assert.NoError(err)
+	file.Close()
+	assert.Equal(fs.FileMode(0664), mode(name))
+	info, _ := os.Stat(name)
+	assert.Equal(int64(0), info.Size())
+}
+
+func TestWriteFile(t *testing.T) {
+	assert := assert.New(t)
+	restrictiveUmask(t)
+	dir := t.TempDir()
+
+	name := filepath.Join(dir, "usage", "day.json")
+	assert.NoError(storage.WriteFile(name, []byte("old")))
+	assert.Equal(storage.DefaultFileMode, mode(name))
+
+	permissions := &storage.Permissions{FileMode: 0640, DirMode: 0750, Uid: -1, Gid: -1}
+	assert.NoError(permissions.WriteFile(name, []byte("new")))
+	content, _ := os.ReadFile(name)
+	assert.Equal("new", string(content))
+	assert.Equal(fs.FileMode(0640), mode(name))
+
+	// no temporary file is left behind
+	entries, _ := os.ReadDir(filepath.Dir(name))
+	assert.Len(entries, 1)
+}
+
+func TestAppendFile(t *testing.T) {
+	assert := assert.New(t)
+	restrictiveUmask(t)
+	name := filepath.Join(t.TempDir(), "session.log")
+
+	permissions := &storage.Permissions{FileMode: 0640, Uid: -1, Gid: -1}
+	for _, line := range []string{"a\n", "b\n"} {
+		file, err := permissions.AppendFile(name)
+		assert.NoError(err)
+		file.Write([]byte(line))
+		file.Close()
+	}
+	content, _ := os.ReadFile(name)
+	assert.Equal("a\nb\n", string(content))
+	assert.Equal(fs.FileMode(0640), mode(name))
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy tells how often and how patiently failed operations are tried
+// again, only errors IsRetryable accepts are retried
+type RetryPolicy struct {
+	// tries in total, 1 never retries
+	Attempts int
+	// wait before the first retry, doubled on every following one up to
+	// MaxDelay, each wait is randomly between half of it and all of it
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+// Retry tries the operations of the storage it wraps again while they fail
+// with a transient error, such as a 503 of S3 or a connection reset
+type Retry struct {
+	Storage
+	Policy RetryPolicy
+}
+
+func NewRetry(s Storage, policy RetryPolicy) *Retry {
+	return &Retry{Storage: s, Policy: policy}
+}
+
+func (r *Retry) Unwrap() Storage {
+	return r.Storage
+}
+
+// delay is the wait before retry n, counted from 0
+func (p RetryPolicy) delay(n int) time.Duration {
+	delay := p.BaseDelay << n
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (r *Retry) do(ctx context.Context, op string, key string, operation func() error) error {
+	attempts := r.Policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(r.Policy.delay(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		if err = operation(); err == nil || !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("storage: %s %s failed after %d attempts: %w", op, key, attempts, err)
+}
+
+func (r *Retry) Put(key string, src string) error {
+	return r.do(context.Background(), "put", key, func() error { return r.Storage.Put(key, src) })
+}
+
+// PutContext is Put waiting for retries only while ctx isn't done
+func (r *Retry) PutContext(ctx context.Context, key string, src string) error {
+	return r.do(ctx, "put", key, func() error { return PutContext(ctx, r.Storage, key, src) })
+}
+
+func (r *Retry) Stat(key string) (info os.FileInfo, err error) {
+	err = r.do(context.Background(), "stat", key, func() error {
+		info, err = r.Storage.Stat(key)
+		return err
+	})
+	return info, err
+}
+
+func (r *Retry) Rename(from string, to string) error {
+	return r.do(context.Background(), "rename", from, func() error { return r.Storage.Rename(from, to) })
+}
+
+func (r *Retry) Delete(key string) error {
+	return r.do(context.Background(), "delete", key, func() error { return r.Storage.Delete(key) })
+}
+
+func (r *Retry) Erase(key string) error {
+	return r.do(context.Background(), "erase", key, func() error { return Erase(r.Storage, key) })
+}
+
+func (r *Retry) Open(key string) (reader io.ReadCloser, err error) {
+	err = r.do(context.Background(), "open", key, func() error {
+		reader, err = Open(r.Storage, key)
+		return err
+	})
+	return reader, err
+}
+
+// IsRetryable tells whether err is likely transient: throttling and server
+// errors of S3, failovers and server errors of HDFS, network timeouts and
+// dropped connections, of SFTP as well
+func IsRetryable(err error) bool {
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) {
+		switch s3Err.Code {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+			return true
+		}
+		return s3Err.StatusCode >= 500 || s3Err.StatusCode == 429
+	}
+	var hdfsErr *HDFSError
+	if errors.As(err, &hdfsErr) {
+		switch hdfsErr.Exception {
+		// a namenode in standby or starting up
+		case "StandbyException", "RetriableException", "SafeModeException":
+			return true
+		}
+		return hdfsErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errSFTPConnection) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
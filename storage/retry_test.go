@@ -0,0 +1,59 @@
+package storage_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// flaky fails the first operations with err
+type flaky struct {
+	*storage.Local
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flaky) Put(key string, src string) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return f.Local.Put(key, src)
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+	policy := storage.RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond}
+	unavailable := &storage.S3Error{StatusCode: 503, Code: "SlowDown"}
+
+	inner := &flaky{Local: storage.NewLocal(t.TempDir()), failures: 2, err: unavailable}
+	assert.NoError(storage.NewRetry(inner, policy).Put("a.txt", writeTempFile(t, "a")))
+	assert.Equal(3, inner.calls)
+
+	inner = &flaky{Local: storage.NewLocal(t.TempDir()), failures: 3, err: unavailable}
+	err := storage.NewRetry(inner, policy).Put("b.txt", writeTempFile(t, "b"))
+	assert.ErrorIs(err, unavailable)
+	assert.Contains(err.Error(), "put b.txt failed after 3 attempts")
+	assert.Equal(3, inner.calls)
+
+	// errors which won't go away are returned at once
+	forbidden := &storage.S3Error{StatusCode: 403, Code: "AccessDenied"}
+	inner = &flaky{Local: storage.NewLocal(t.TempDir()), failures: 1, err: forbidden}
+	assert.Equal(forbidden, storage.NewRetry(inner, policy).Put("c.txt", writeTempFile(t, "c")))
+	assert.Equal(1, inner.calls)
+	_, err = storage.NewRetry(inner, policy).Stat("missing.txt")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, storage.IsRetryable(&storage.S3Error{StatusCode: 500, Code: "InternalError"}))
+	assert.True(t, storage.IsRetryable(&storage.S3Error{StatusCode: 429, Code: "TooManyRequests"}))
+	assert.False(t, storage.IsRetryable(&storage.S3Error{StatusCode: 404, Code: "NoSuchKey"}))
+	assert.False(t, storage.IsRetryable(storage.ErrObjectLocked))
+	assert.False(t, storage.IsRetryable(errors.New("disk full")))
+}
@@ -0,0 +1,586 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 stores keys as objects of a bucket of S3 or of a compatible service.
+// Objects larger than PartSize are put and copied as multipart uploads, a
+// single request is limited to 5 GB.
+type S3 struct {
+	// scheme and host of the service, https://s3.<region>.amazonaws.com by
+	// default
+	Endpoint string
+	Region   string
+	Bucket   string
+	// address the bucket as <bucket>.<host> instead of <host>/<bucket>
+	VirtualHost  bool
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// size of the parts of multipart puts and copies, 64 MB when 0
+	PartSize int64
+	Client   *http.Client
+	// time of the signatures, time.Now when nil
+	Clock func() time.Time
+}
+
+// NewS3 creates the storage of a `s3` config: Root is the bucket, the options
+// endpoint, region and virtual_host configure the service, part_size (bytes,
+// at least 5 MB) the multipart puts and copies. Credentials are
+// read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+func NewS3(config Config) (*S3, error) {
+	if config.Root == "" {
+		return nil, fmt.Errorf("storage: s3 driver needs a bucket as root")
+	}
+	s := &S3{
+		Endpoint:     config.Options["endpoint"],
+		Region:       config.Options["region"],
+		Bucket:       config.Root,
+		VirtualHost:  config.Options["virtual_host"] == "true",
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	if value := config.Options["part_size"]; value != "" {
+		partSize, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || partSize < minS3PartSize || partSize > maxS3PartSize {
+			return nil, fmt.Errorf("storage: invalid s3 part_size %q", value)
+		}
+		s.PartSize = partSize
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("storage: s3 driver needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+const (
+	defaultS3PartSize = 64 * 1024 * 1024
+	minS3PartSize     = 5 * 1024 * 1024
+	maxS3PartSize     = 5 * 1024 * 1024 * 1024
+	maxS3Parts        = 10000
+)
+
+// S3Error is an error answered by the service
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (s *S3) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// objectURL is the url of key, with the given query
+func (s *S3) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("storage: invalid s3 endpoint: %w", err)
+	}
+	if s.VirtualHost {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	} else {
+		u.Path = "/" + path.Join(s.Bucket, key)
+	}
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+	return u, nil
+}
+
+// do sends a signed request to key and returns the response with a 2xx
+// status, other ones are returned as *S3Error
+func (s *S3) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp)
+	}
+	return resp, nil
+}
+
+func readS3Error(resp *http.Response) error {
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(content, s3Err) != nil || s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+	}
+	return s3Err
+}
+
+// call sends a request and decodes its xml answer into result unless nil
+func (s *S3) call(method string, key string, query url.Values, header http.Header, body []byte, result any) error {
+	resp, err := s.do(context.Background(), method, key, query, header, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// some requests answer 200 with an error, e.g. a failed complete
+	if bytes.Contains(content, []byte("<Error>")) {
+		s3Err := &S3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(content, s3Err)
+		return s3Err
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(content, result)
+}
+
+func (s *S3) Put(key string, src string) error {
+	return s.PutContext(context.Background(), key, src)
+}
+
+// PutContext is Put abandoning the upload once ctx is done
+func (s *S3) PutContext(ctx context.Context, key string, src string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > s.partSize(info.Size()) {
+		err = s.putParts(ctx, key, file, info.Size())
+	} else {
+		var resp *http.Response
+		resp, err = s.do(ctx, "PUT", key, nil, nil, file, info.Size())
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(src)
+}
+
+// partSize is the size of the parts of an object of size, large enough to
+// fit in 10000 parts
+func (s *S3) partSize(size int64) int64 {
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+	if size > partSize*maxS3Parts {
+		partSize = (size + maxS3Parts - 1) / maxS3Parts
+	}
+	return partSize
+}
+
+// multipart runs a multipart upload of key of size, uploading each part
+// with upload, and aborts it on failure so its parts aren't kept
+func (s *S3) multipart(key string, size int64, upload func(uploadId string, number int, offset int64, length int64) (string, error)) error {
+	uploadId, err := s.CreateMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	partSize := s.partSize(size)
+	var parts []Part
+	for offset := int64(0); offset < size; offset += partSize {
+		number, length := len(parts)+1, min(partSize, size-offset)
+		etag, err := upload(uploadId, number, offset, length)
+		if err != nil {
+			s.AbortMultipartUpload(key, uploadId)
+			return err
+		}
+		parts = append(parts, Part{Number: number, ETag: etag})
+	}
+	if _, err := s.CompleteMultipartUpload(key, uploadId, parts); err != nil {
+		s.AbortMultipartUpload(key, uploadId)
+		return err
+	}
+	return nil
+}
+
+// putParts uploads file of size to key in parts
+func (s *S3) putParts(ctx context.Context, key string, file *os.File, size int64) error {
+	return s.multipart(key, size, func(uploadId string, number int, offset int64, length int64) (string, error) {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+		resp, err := s.do(ctx, "PUT", key, query, nil, io.NewSectionReader(file, offset, length), length)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag"), nil
+	})
+}
+
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (o *objectInfo) Name() string       { return o.name }
+func (o *objectInfo) Size() int64        { return o.size }
+func (o *objectInfo) Mode() fs.FileMode  { return 0644 }
+func (o *objectInfo) ModTime() time.Time { return o.modTime }
+func (o *objectInfo) IsDir() bool        { return false }
+func (o *objectInfo) Sys() any           { return nil }
+
+func (s *S3) Stat(key string) (os.FileInfo, error) {
+	resp, err := s.do(context.Background(), "HEAD", key, nil, nil, nil, 0)
+	if s3Err, ok := err.(*S3Error); ok && s3Err.StatusCode == 404 {
+		return nil, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &objectInfo{name: path.Base(key), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (s *S3) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do(context.Background(), "GET", key, nil, nil, nil, 0)
+	if s3Err, ok := err.(*S3Error); ok && s3Err.StatusCode == 404 {
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Rename copies the object and deletes the original, objects can't be moved.
+// Objects larger than a part are copied part by part, a single copy request
+// is limited to 5 GB.
+func (s *S3) Rename(from string, to string) error {
+	info, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", awsEscape("/"+path.Join(s.Bucket, from), true))
+	if info.Size() > s.partSize(info.Size()) {
+		err = s.multipart(to, info.Size(), func(uploadId string, number int, offset int64, length int64) (string, error) {
+			header := header.Clone()
+			header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+			var result struct {
+				ETag string `xml:"ETag"`
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+			err := s.call("PUT", to, query, header, nil, &result)
+			return result.ETag, err
+		})
+	} else {
+		err = s.call("PUT", to, nil, header, nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(from)
+}
+
+func (s *S3) Delete(key string) error {
+	resp, err := s.do(context.Background(), "DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type objectVersion struct {
+	Key       string `xml:"Key"`
+	VersionId string `xml:"VersionId"`
+}
+
+// Erase deletes every version of key and its delete markers, a plain delete
+// of a versioned bucket only hides the object behind a new marker. Buckets
+// without versioning list the object as version `null`.
+func (s *S3) Erase(key string) error {
+	var versions []objectVersion
+	keyMarker, versionMarker := "", ""
+	for {
+		var result struct {
+			Versions            []objectVersion `xml:"Version"`
+			DeleteMarkers       []objectVersion `xml:"DeleteMarker"`
+			IsTruncated         bool            `xml:"IsTruncated"`
+			NextKeyMarker       string          `xml:"NextKeyMarker"`
+			NextVersionIdMarker string          `xml:"NextVersionIdMarker"`
+		}
+		query := url.Values{"versions": {""}, "prefix": {key}}
+		if keyMarker != "" {
+			query.Set("key-marker", keyMarker)
+			query.Set("version-id-marker", versionMarker)
+		}
+		if err := s.call("GET", "", query, nil, nil, &result); err != nil {
+			return err
+		}
+		// the prefix also lists longer keys
+		for _, version := range append(result.Versions, result.DeleteMarkers...) {
+			if version.Key == key {
+				versions = append(versions, version)
+			}
+		}
+		if !result.IsTruncated || result.NextKeyMarker == "" {
+			break
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIdMarker
+	}
+	if len(versions) == 0 {
+		return &fs.PathError{Op: "erase", Path: key, Err: fs.ErrNotExist}
+	}
+	for _, version := range versions {
+		resp, err := s.do(context.Background(), "DELETE", key, url.Values{"versionId": {version.VersionId}}, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *S3) CreateMultipartUpload(key string) (string, error) {
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err := s.call("POST", key, url.Values{"uploads": {""}}, nil, nil, &result)
+	return result.UploadId, err
+}
+
+func (s *S3) PresignPart(key string, uploadId string, number int, expires time.Time) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return "", err
+	}
+	return s.presign("PUT", u, expires), nil
+}
+
+func (s *S3) PresignGet(key string, expires time.Time) (string, error) {
+	u, err := s.objectURL(key, nil)
+	if err != nil {
+		return "", err
+	}
+	return s.presign("GET", u, expires), nil
+}
+
+func (s *S3) ListParts(key string, uploadId string) ([]Part, error) {
+	var parts []Part
+	marker := ""
+	for {
+		var result struct {
+			Parts                []Part `xml:"Part"`
+			IsTruncated          bool   `xml:"IsTruncated"`
+			NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+		}
+		query := url.Values{"uploadId": {uploadId}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		if err := s.call("GET", key, query, nil, nil, &result); err != nil {
+			return nil, err
+		}
+		parts = append(parts, result.Parts...)
+		if !result.IsTruncated || result.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+func (s *S3) CompleteMultipartUpload(key string, uploadId string, parts []Part) (string, error) {
+	request := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []Part   `xml:"Part"`
+	}{Parts: parts}
+	body, _ := xml.Marshal(request)
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	err := s.call("POST", key, url.Values{"uploadId": {uploadId}}, nil, body, &result)
+	return result.ETag, err
+}
+
+func (s *S3) AbortMultipartUpload(key string, uploadId string) error {
+	resp, err := s.do(context.Background(), "DELETE", key, url.Values{"uploadId": {uploadId}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds the AWS signature v4 headers to req, the payload isn't signed
+func (s *S3) sign(req *http.Request) {
+	now := s.now()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, unsignedPayload,
+	}, "\n")
+	scope, signature := s.signature(now, canonicalRequest)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// presign returns u signed in its query for method until expires, at most a
+// week from now
+func (s *S3) presign(method string, u *url.URL, expires time.Time) string {
+	now := s.now()
+	ttl := int64(expires.Sub(now).Seconds())
+	if ttl > 7*24*3600 {
+		ttl = 7 * 24 * 3600
+	}
+	query, _ := url.ParseQuery(u.RawQuery)
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.FormatInt(ttl, 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if s.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	rawQuery := canonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		method, u.EscapedPath(), rawQuery,
+		"host:" + u.Host + "\n", "host", unsignedPayload,
+	}, "\n")
+	_, signature := s.signature(now, canonicalRequest)
+	signed := *u
+	signed.RawQuery = rawQuery + "&X-Amz-Signature=" + signature
+	return signed.String()
+}
+
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// signature signs the canonical request, returns the credential scope and the
+// hex signature
+func (s *S3) signature(now time.Time, canonicalRequest string) (string, string) {
+	scope := s.scope(now)
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, the way it is signed
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, and
+// slashes in paths
+func awsEscape(s string, isPath bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && isPath:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,285 @@
+// Package s3test runs an in-memory S3 for tests, it serves the requests the s3
+// storage sends without checking their signatures.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+)
+
+type version struct {
+	id           string
+	deleteMarker bool
+	data         []byte
+}
+
+type Server struct {
+	*httptest.Server
+	// keep the versions of the objects, as a bucket with versioning enabled
+	Versioning bool
+	mu         sync.Mutex
+	// by <bucket>/<key>
+	objects map[string][]byte
+	// by <bucket>/<key>, oldest first, while Versioning
+	versions map[string][]version
+	uploads  map[string]map[int][]byte
+	// requests served, e.g. "PUT bucket/photos/a.jpg"
+	requests []string
+	// the next failures requests answer failureStatus
+	failures      int
+	failureStatus int
+}
+
+func NewServer() *Server {
+	s := &Server{objects: map[string][]byte{}, versions: map[string][]version{}, uploads: map[string]map[int][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Storage returns a s3 storage of bucket on the server
+func (s *Server) Storage(bucket string) *storage.S3 {
+	return &storage.S3{Endpoint: s.URL, Region: "us-east-1", Bucket: bucket, AccessKey: "test", SecretKey: "test"}
+}
+
+// Object returns the content of <bucket>/<key>
+func (s *Server) Object(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	return data, ok
+}
+
+// Versions returns how many versions and delete markers <bucket>/<key> has
+func (s *Server) Versions(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.Versioning {
+		if _, ok := s.objects[name]; ok {
+			return 1
+		}
+		return 0
+	}
+	return len(s.versions[name])
+}
+
+// Requests returns the requests served so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Fail makes the next n requests answer status, as an overloaded S3 does
+func (s *Server) Fail(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures, s.failureStatus = n, status
+}
+
+// put makes data the current version of key
+func (s *Server) put(key string, data []byte) {
+	s.objects[key] = data
+	if s.Versioning {
+		s.versions[key] = append(s.versions[key], version{id: strconv.FormatInt(time.Now().UnixNano(), 36), data: data})
+	}
+}
+
+// remove hides key behind a delete marker, or the version given
+func (s *Server) remove(key string, versionId string) {
+	if !s.Versioning {
+		if versionId == "" || versionId == "null" {
+			delete(s.objects, key)
+		}
+		return
+	}
+	if versionId == "" {
+		delete(s.objects, key)
+		s.versions[key] = append(s.versions[key], version{id: strconv.FormatInt(time.Now().UnixNano(), 36), deleteMarker: true})
+		return
+	}
+	versions := s.versions[key]
+	for i, v := range versions {
+		if v.id == versionId {
+			versions = append(versions[:i:i], versions[i+1:]...)
+			break
+		}
+	}
+	s.versions[key] = versions
+	delete(s.objects, key)
+	if len(versions) == 0 {
+		delete(s.versions, key)
+	} else if latest := versions[len(versions)-1]; !latest.deleteMarker {
+		s.objects[key] = latest.data
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// <bucket>/<key>
+	key, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	query := r.URL.Query()
+	s.requests = append(s.requests, r.Method+" "+key)
+	body, _ := io.ReadAll(r.Body)
+	if s.failures > 0 {
+		s.failures--
+		s.error(w, s.failureStatus, "SlowDown")
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && query.Has("uploads"):
+		uploadId := strconv.FormatInt(time.Now().UnixNano(), 36)
+		s.uploads[uploadId] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadId)
+	case r.Method == "PUT" && query.Has("partNumber"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.error(w, 404, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			from, _ := url.PathUnescape(strings.TrimPrefix(source, "/"))
+			data, ok := s.objects[from]
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); !ok || err != nil || end >= len(data) {
+				s.error(w, 400, "InvalidRequest")
+				return
+			}
+			parts[number] = data[start : end+1]
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", etag(parts[number]))
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET" && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.error(w, 404, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		fmt.Fprint(w, "<ListPartsResult><IsTruncated>false</IsTruncated>")
+		for _, number := range numbers {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>", number, etag(parts[number]), len(parts[number]))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case r.Method == "POST" && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.error(w, 404, "NoSuchUpload")
+			return
+		}
+		var request struct {
+			Parts []storage.Part `xml:"Part"`
+		}
+		xml.Unmarshal(body, &request)
+		var object []byte
+		for _, part := range request.Parts {
+			if data, ok := parts[part.Number]; !ok || etag(data) != part.ETag {
+				s.error(w, 400, "InvalidPart")
+				return
+			}
+			object = append(object, parts[part.Number]...)
+		}
+		s.put(key, object)
+		delete(s.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", etag(object))
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(204)
+	case r.Method == "PUT":
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			from, _ := url.PathUnescape(strings.TrimPrefix(source, "/"))
+			data, ok := s.objects[from]
+			if !ok {
+				s.error(w, 404, "NoSuchKey")
+				return
+			}
+			s.put(key, data)
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", etag(data))
+			return
+		}
+		s.put(key, body)
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET" && query.Has("versions"):
+		s.listVersions(w, key+"/"+query.Get("prefix"))
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := s.objects[key]
+		if !ok {
+			s.error(w, 404, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(data)
+	case r.Method == "DELETE":
+		s.remove(key, query.Get("versionId"))
+		w.WriteHeader(204)
+	default:
+		s.error(w, 405, "MethodNotAllowed")
+	}
+}
+
+// listVersions answers the versions of the keys starting with prefix,
+// <bucket>/<prefix>, in a single page
+func (s *Server) listVersions(w http.ResponseWriter, prefix string) {
+	bucket, _, _ := strings.Cut(prefix, "/")
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	for name := range s.versions {
+		if _, ok := s.objects[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprint(w, "<ListVersionsResult><IsTruncated>false</IsTruncated>")
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(name, bucket+"/")
+		if !s.Versioning {
+			fmt.Fprintf(w, "<Version><Key>%s</Key><VersionId>null</VersionId></Version>", key)
+			continue
+		}
+		for _, v := range s.versions[name] {
+			element := "Version"
+			if v.deleteMarker {
+				element = "DeleteMarker"
+			}
+			fmt.Fprintf(w, "<%s><Key>%s</Key><VersionId>%s</VersionId></%s>", element, key, v.id, element)
+		}
+	}
+	fmt.Fprint(w, "</ListVersionsResult>")
+}
+
+func (s *Server) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
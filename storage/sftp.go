@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// idle pooled connections are closed after this long
+	sftpIdleTimeout        = time.Minute
+	sftpDefaultConnections = 4
+	sftpPosixRename        = "posix-rename@openssh.com"
+)
+
+// errSFTPConnection is a connection to the server which broke, the operation
+// can be tried again on a new one
+var errSFTPConnection = errors.New("storage: sftp connection lost")
+
+// SFTP stores keys as files under Root on a server reached over SSH, e.g. an
+// archive exposing nothing else. Connections are pooled per server, user and
+// host key, at most MaxConnections are busy at once.
+type SFTP struct {
+	// host:port
+	Addr string
+	User string
+	// directory of the keys on the server, relative to the home of User
+	// unless absolute
+	Root    string
+	Auth    []ssh.AuthMethod
+	HostKey ssh.PublicKey
+	// 4 when 0
+	MaxConnections int
+}
+
+// NewSFTP creates the storage of a `sftp` config: Root is the directory on
+// the server, the options endpoint (host:port), user and host_key (as in
+// authorized_keys) configure the server and max_connections the pool. The
+// password is read from SFTP_PASSWORD, the private key from the file at
+// SFTP_KEY_FILE.
+func NewSFTP(config Config) (*SFTP, error) {
+	if config.Root == "" {
+		return nil, fmt.Errorf("storage: sftp driver needs a directory as root")
+	}
+	s := &SFTP{Addr: config.Options["endpoint"], User: config.Options["user"], Root: config.Root}
+	if s.Addr == "" || s.User == "" {
+		return nil, fmt.Errorf("storage: sftp driver needs the endpoint and user options")
+	}
+	if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		s.Addr = net.JoinHostPort(s.Addr, "22")
+	}
+	if config.Options["host_key"] == "" {
+		return nil, fmt.Errorf("storage: sftp driver needs the host_key of the server")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.Options["host_key"]))
+	if err != nil {
+		return nil, fmt.Errorf("storage: invalid sftp host_key: %w", err)
+	}
+	s.HostKey = hostKey
+	if value := config.Options["max_connections"]; value != "" {
+		if s.MaxConnections, err = strconv.Atoi(value); err != nil || s.MaxConnections < 1 {
+			return nil, fmt.Errorf("storage: invalid sftp max_connections %q", value)
+		}
+	}
+	if password := os.Getenv("SFTP_PASSWORD"); password != "" {
+		s.Auth = append(s.Auth, ssh.Password(password))
+	}
+	if keyFile := os.Getenv("SFTP_KEY_FILE"); keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("storage: failed to read SFTP_KEY_FILE: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("storage: invalid SFTP_KEY_FILE: %w", err)
+		}
+		s.Auth = append(s.Auth, ssh.PublicKeys(signer))
+	}
+	if len(s.Auth) == 0 {
+		return nil, fmt.Errorf("storage: sftp driver needs SFTP_PASSWORD or SFTP_KEY_FILE")
+	}
+	return s, nil
+}
+
+func (s *SFTP) path(key string) string {
+	return path.Join(s.Root, key)
+}
+
+// sftpConn is an SFTP client over its own SSH connection, used by one
+// operation at a time
+type sftpConn struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	used   time.Time
+}
+
+func dialSFTP(addr string, config *ssh.ClientConfig) (*sftpConn, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sftpConn{ssh: conn, client: client}, nil
+}
+
+func (c *sftpConn) Close() error {
+	c.client.Close()
+	return c.ssh.Close()
+}
+
+// rename replaces to by from, with the posix-rename extension when the
+// server has it since plain renames don't replace files
+func (c *sftpConn) rename(from string, to string) error {
+	if _, ok := c.client.HasExtension(sftpPosixRename); ok {
+		return c.client.PosixRename(from, to)
+	}
+	if err := c.client.Remove(to); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return c.client.Rename(from, to)
+}
+
+// sftpBroken tells a connection which broke from an answer of the server
+func sftpBroken(err error) bool {
+	var status *sftp.StatusError
+	return err != nil && err != io.EOF && !errors.As(err, &status) && !errors.Is(err, fs.ErrNotExist) &&
+		!errors.Is(err, fs.ErrPermission) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// sftpError marks the errors of a connection which broke with
+// errSFTPConnection, for retries
+func sftpError(err error) error {
+	if sftpBroken(err) {
+		return fmt.Errorf("%w: %v", errSFTPConnection, err)
+	}
+	return err
+}
+
+// sftpPool holds the idle connections to a server, slots has a token per
+// connection which may be busy
+type sftpPool struct {
+	mu    sync.Mutex
+	idle  []*sftpConn
+	slots chan struct{}
+}
+
+var (
+	sftpPoolsMu sync.Mutex
+	sftpPools   = map[string]*sftpPool{}
+)
+
+func (s *SFTP) pool() *sftpPool {
+	sftpPoolsMu.Lock()
+	defer sftpPoolsMu.Unlock()
+	// connections are only shared by storages trusting the same host key
+	name := s.User + "@" + s.Addr + " " + ssh.FingerprintSHA256(s.HostKey)
+	pool, ok := sftpPools[name]
+	if !ok {
+		size := s.MaxConnections
+		if size < 1 {
+			size = sftpDefaultConnections
+		}
+		pool = &sftpPool{slots: make(chan struct{}, size)}
+		sftpPools[name] = pool
+	}
+	return pool
+}
+
+// acquire returns an idle connection of the pool or a new one, waiting while
+// the pool is busy
+func (s *SFTP) acquire(ctx context.Context) (*sftpPool, *sftpConn, error) {
+	pool := s.pool()
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	pool.mu.Lock()
+	for len(pool.idle) > 0 {
+		conn := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if time.Since(conn.used) < sftpIdleTimeout {
+			pool.mu.Unlock()
+			return pool, conn, nil
+		}
+		conn.Close()
+	}
+	pool.mu.Unlock()
+
+	conn, err := dialSFTP(s.Addr, &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            s.Auth,
+		HostKeyCallback: ssh.FixedHostKey(s.HostKey),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		<-pool.slots
+		return nil, nil, err
+	}
+	return pool, conn, nil
+}
+
+// release gives conn back to the pool, or closes it when broken
+func (pool *sftpPool) release(conn *sftpConn, broken bool) {
+	if broken {
+		conn.Close()
+	} else {
+		conn.used = time.Now()
+		pool.mu.Lock()
+		pool.idle = append(pool.idle, conn)
+		pool.mu.Unlock()
+	}
+	<-pool.slots
+}
+
+// with runs operation on a connection of the pool, connections left in an
+// unknown state are closed
+func (s *SFTP) with(ctx context.Context, operation func(conn *sftpConn) error) error {
+	pool, conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = sftpError(operation(conn))
+	pool.release(conn, errors.Is(err, errSFTPConnection) || ctx.Err() != nil)
+	return err
+}
+
+func (s *SFTP) Put(key string, src string) error {
+	return s.PutContext(context.Background(), key, src)
+}
+
+// PutContext uploads src next to key and renames it to key once complete, so
+// key is never seen partially written. The upload is abandoned once ctx is
+// done.
+func (s *SFTP) PutContext(ctx context.Context, key string, src string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	name := s.path(key)
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	temporary := path.Join(path.Dir(name), "."+path.Base(name)+"."+hex.EncodeToString(suffix)+".part")
+	err = s.with(ctx, func(conn *sftpConn) error {
+		if err := conn.client.MkdirAll(path.Dir(name)); err != nil {
+			return err
+		}
+		remote, err := conn.client.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		// several writes in flight, like the file was sent at once
+		_, err = remote.ReadFromWithConcurrency(contextReader{ctx, file}, 0)
+		if closeErr := remote.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = conn.rename(temporary, name)
+		}
+		if err != nil && !sftpBroken(err) {
+			conn.client.Remove(temporary)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(src)
+}
+
+func (s *SFTP) Stat(key string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := s.with(context.Background(), func(conn *sftpConn) (err error) {
+		info, err = conn.client.Stat(s.path(key))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &objectInfo{name: path.Base(key), size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// Open reads key, the connection stays busy until the reader is closed
+func (s *SFTP) Open(key string) (io.ReadCloser, error) {
+	pool, conn, err := s.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	file, err := conn.client.Open(s.path(key))
+	if err != nil {
+		err = sftpError(err)
+		pool.release(conn, errors.Is(err, errSFTPConnection))
+		return nil, err
+	}
+	return &sftpReader{pool: pool, conn: conn, file: file}, nil
+}
+
+type sftpReader struct {
+	pool *sftpPool
+	conn *sftpConn
+	file *sftp.File
+	err  error
+}
+
+func (r *sftpReader) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	if err != nil && err != io.EOF {
+		err = sftpError(err)
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *sftpReader) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := sftpError(r.file.Close())
+	r.pool.release(r.conn, errors.Is(r.err, errSFTPConnection) || errors.Is(err, errSFTPConnection))
+	r.conn = nil
+	return err
+}
+
+func (s *SFTP) Rename(from string, to string) error {
+	return s.with(context.Background(), func(conn *sftpConn) error {
+		if err := conn.client.MkdirAll(path.Dir(s.path(to))); err != nil {
+			return err
+		}
+		return conn.rename(s.path(from), s.path(to))
+	})
+}
+
+func (s *SFTP) Delete(key string) error {
+	return s.with(context.Background(), func(conn *sftpConn) error {
+		return conn.client.Remove(s.path(key))
+	})
+}
+
+// contextReader stops reading once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
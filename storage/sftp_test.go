@@ -0,0 +1,102 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/louis-she/simple-uploader/storage/sftptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSFTP(t *testing.T) {
+	assert := assert.New(t)
+	server := sftptest.NewServer(t.TempDir())
+	defer server.Close()
+	s := server.Storage("/archive")
+
+	// larger than the writes in flight at once
+	content := make([]byte, 2*1024*1024+1)
+	rand.Read(content)
+	src := writeTempFile(t, string(content))
+	assert.NoError(s.Put("a/b c.bin", src))
+	assert.NoFileExists(src)
+	stored, _ := os.ReadFile(filepath.Join(server.Dir, "archive", "a", "b c.bin"))
+	assert.Equal(content, stored)
+	entries, _ := os.ReadDir(filepath.Join(server.Dir, "archive", "a"))
+	assert.Len(entries, 1)
+
+	info, err := s.Stat("a/b c.bin")
+	if assert.NoError(err) {
+		assert.Equal(int64(len(content)), info.Size())
+	}
+	reader, err := storage.Open(s, "a/b c.bin")
+	if assert.NoError(err) {
+		read, err := io.ReadAll(reader)
+		assert.NoError(err)
+		assert.Equal(content, read)
+		assert.NoError(reader.Close())
+	}
+
+	// renames replace the file at their target
+	assert.NoError(s.Put("d/e.txt", writeTempFile(t, "old")))
+	assert.NoError(s.Rename("a/b c.bin", "d/e.txt"))
+	_, err = s.Stat("a/b c.bin")
+	assert.True(os.IsNotExist(err))
+	info, _ = s.Stat("d/e.txt")
+	assert.Equal(int64(len(content)), info.Size())
+	assert.NoError(s.Delete("d/e.txt"))
+	_, err = s.Open("d/e.txt")
+	assert.True(os.IsNotExist(err))
+
+	// one connection served all of them
+	assert.Equal(1, server.Accepted())
+}
+
+func TestSFTPReconnects(t *testing.T) {
+	assert := assert.New(t)
+	server := sftptest.NewServer(t.TempDir())
+	defer server.Close()
+	t.Setenv("SFTP_PASSWORD", sftptest.Password)
+	s, err := storage.New(server.Config("archive"))
+	if !assert.NoError(err) {
+		return
+	}
+	s = storage.NewRetry(s, storage.RetryPolicy{Attempts: 2})
+	assert.NoError(s.Put("a.txt", writeTempFile(t, "hello")))
+
+	// pooled connections closed by the server are replaced
+	server.Drop()
+	info, err := s.Stat("a.txt")
+	if assert.NoError(err) {
+		assert.Equal(int64(5), info.Size())
+	}
+	assert.Equal(2, server.Accepted())
+	server.Fail(1)
+	assert.NoError(s.Put("b.txt", writeTempFile(t, "world")))
+	assert.Equal(3, server.Accepted())
+	stored, _ := os.ReadFile(filepath.Join(server.Dir, "archive", "b.txt"))
+	assert.Equal("world", string(stored))
+
+	// an abandoned upload leaves the key as it was
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := writeTempFile(t, "again")
+	assert.ErrorIs(storage.PutContext(ctx, s, "b.txt", src), context.Canceled)
+	assert.FileExists(src)
+	stored, _ = os.ReadFile(filepath.Join(server.Dir, "archive", "b.txt"))
+	assert.Equal("world", string(stored))
+
+	// servers are only trusted with their host key
+	impostor := sftptest.NewServer(t.TempDir())
+	defer impostor.Close()
+	config := server.Config("archive")
+	config.Options["host_key"] = impostor.Config("archive").Options["host_key"]
+	s, _ = storage.New(config)
+	_, err = s.Stat("a.txt")
+	assert.ErrorContains(err, "host key mismatch")
+}
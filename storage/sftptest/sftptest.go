@@ -0,0 +1,279 @@
+// Package sftptest runs an SSH server with an SFTP subsystem over a local
+// directory for tests.
+package sftptest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	User     = "uploader"
+	Password = "secret"
+)
+
+type Server struct {
+	// files are kept under Dir, the root of the server
+	Dir      string
+	listener net.Listener
+	hostKey  ssh.Signer
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+	// the next failures requests are answered by closing the connection
+	failures int
+}
+
+func NewServer(dir string) *Server {
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(private)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{Dir: dir, listener: listener, hostKey: hostKey}
+	go s.accept()
+	return s
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Config returns the config of a sftp storage of root on the server, its
+// password is Password
+func (s *Server) Config(root string) storage.Config {
+	return storage.Config{Driver: "sftp", Root: root, Options: map[string]string{
+		"endpoint": s.Addr(),
+		"user":     User,
+		"host_key": string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey())),
+	}}
+}
+
+// Storage returns a sftp storage of root on the server
+func (s *Server) Storage(root string) *storage.SFTP {
+	return &storage.SFTP{
+		Addr:    s.Addr(),
+		User:    User,
+		Root:    root,
+		Auth:    []ssh.AuthMethod{ssh.Password(Password)},
+		HostKey: s.hostKey.PublicKey(),
+	}
+}
+
+// Accepted is the number of connections accepted so far
+func (s *Server) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Drop closes the open connections, as a server restarting would
+func (s *Server) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Fail drops the connections receiving the next n requests
+func (s *Server) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+func (s *Server) Close() error {
+	s.Drop()
+	return s.listener.Close()
+}
+
+func (s *Server) accept() {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == User && string(password) == Password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(s.hostKey)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.accepted++
+		s.mu.Unlock()
+		go s.serveConn(conn, config)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range requests {
+				// the subsystem request has the name of the subsystem as a string
+				ok := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if ok {
+					go s.serveSFTP(conn, channel)
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) local(name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *Server) serveSFTP(conn net.Conn, channel ssh.Channel) {
+	h := handlers{s, conn}
+	server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+	defer server.Close()
+	server.Serve()
+}
+
+var errDropped = errors.New("connection dropped")
+
+// handlers serve the requests of a connection from the files under Dir
+type handlers struct {
+	s    *Server
+	conn net.Conn
+}
+
+// fail closes the connection when it should fail the request
+func (h handlers) fail() error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if h.s.failures == 0 {
+		return nil
+	}
+	h.s.failures--
+	h.conn.Close()
+	return errDropped
+}
+
+func (h handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if err := h.fail(); err != nil {
+		return nil, err
+	}
+	return os.Open(h.s.local(r.Filepath))
+}
+
+func (h handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if err := h.fail(); err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY
+	if r.Pflags().Creat {
+		flags |= os.O_CREATE
+	}
+	if r.Pflags().Trunc {
+		flags |= os.O_TRUNC
+	}
+	return os.OpenFile(h.s.local(r.Filepath), flags, 0644)
+}
+
+func (h handlers) Filecmd(r *sftp.Request) error {
+	if err := h.fail(); err != nil {
+		return err
+	}
+	name := h.s.local(r.Filepath)
+	switch r.Method {
+	case "Remove":
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			return errors.New("is a directory")
+		}
+		return os.Remove(name)
+	case "Mkdir":
+		return os.Mkdir(name, 0755)
+	case "Rename":
+		// plain renames don't replace files
+		if _, err := os.Stat(h.s.local(r.Target)); err == nil {
+			return fs.ErrExist
+		}
+		return os.Rename(name, h.s.local(r.Target))
+	case "Setstat":
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h handlers) PosixRename(r *sftp.Request) error {
+	if err := h.fail(); err != nil {
+		return err
+	}
+	return os.Rename(h.s.local(r.Filepath), h.s.local(r.Target))
+}
+
+func (h handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if err := h.fail(); err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "Stat", "Lstat":
+		info, err := os.Stat(h.s.local(r.Filepath))
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	case "List":
+		entries, err := os.ReadDir(h.s.local(r.Filepath))
+		if err != nil {
+			return nil, err
+		}
+		infos := make(listerAt, 0, len(entries))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrObjectLocked = errors.New("storage: object is locked")
+	ErrNotReadable  = errors.New("storage: keys can't be read")
+)
+
+// Storage is where completed uploads are placed, addressed by key
+// (prefix + file name).
+type Storage interface {
+	// Put moves the local file src to key
+	Put(key string, src string) error
+	Stat(key string) (os.FileInfo, error)
+	Rename(from string, to string) error
+	Delete(key string) error
+}
+
+// Eraser is implemented by storages that can destroy the content of a key
+// beyond a plain delete
+type Eraser interface {
+	Erase(key string) error
+}
+
+// Erase destroys key with the storage's Eraser, or deletes it when the
+// storage has none
+func Erase(s Storage, key string) error {
+	if eraser, ok := s.(Eraser); ok {
+		return eraser.Erase(key)
+	}
+	return s.Delete(key)
+}
+
+// ContextPutter is implemented by storages whose puts can be abandoned
+type ContextPutter interface {
+	PutContext(ctx context.Context, key string, src string) error
+}
+
+// PutContext puts src at key with the ContextPutter of the storage, giving up
+// once ctx is done, storages without one are only called while ctx isn't done
+func PutContext(ctx context.Context, s Storage, key string, src string) error {
+	if putter, ok := s.(ContextPutter); ok {
+		return putter.PutContext(ctx, key, src)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Put(key, src)
+}
+
+// Locker is implemented by storages that can refuse changes to a key
+type Locker interface {
+	Locked(key string) bool
+}
+
+func IsLocked(s Storage, key string) bool {
+	if locker, ok := s.(Locker); ok {
+		return locker.Locked(key)
+	}
+	return false
+}
+
+// LocalPath returns the path of key on local disk, if the storage, or the one
+// it wraps, keeps files there
+func LocalPath(s Storage, key string) (string, bool) {
+	if local, ok := Unwrapped(s).(*Local); ok {
+		return local.Path(key), true
+	}
+	return "", false
+}
+
+// Unwrapped returns the storage under the retries, breakers and WORM
+// wrapping s
+func Unwrapped(s Storage) Storage {
+	for {
+		wrapper, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			return s
+		}
+		s = wrapper.Unwrap()
+	}
+}
+
+// Part is a part of a multipart upload, numbered from 1
+type Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+	Size   int64  `xml:"Size,omitempty"`
+}
+
+// Multipart is implemented by storages clients can upload into directly, as
+// the parts of a multipart upload put at urls presigned by the storage
+type Multipart interface {
+	CreateMultipartUpload(key string) (string, error)
+	PresignPart(key string, uploadId string, number int, expires time.Time) (string, error)
+	ListParts(key string, uploadId string) ([]Part, error)
+	// CompleteMultipartUpload assembles the parts into key, returns its etag
+	CompleteMultipartUpload(key string, uploadId string, parts []Part) (string, error)
+	AbortMultipartUpload(key string, uploadId string) error
+}
+
+// Reader is implemented by remote storages which can read keys
+type Reader interface {
+	Open(key string) (io.ReadCloser, error)
+}
+
+// Open reads key from local disk or through the Reader of the storage
+func Open(s Storage, key string) (io.ReadCloser, error) {
+	if name, ok := LocalPath(s, key); ok {
+		return os.Open(name)
+	}
+	if reader, ok := unwrap[Reader](s); ok {
+		return reader.Open(key)
+	}
+	return nil, ErrNotReadable
+}
+
+// Presigner is implemented by storages clients can download from directly
+type Presigner interface {
+	PresignGet(key string, expires time.Time) (string, error)
+}
+
+// AsMultipart returns the storage, or the one it wraps, supporting multipart
+// uploads
+func AsMultipart(s Storage) (Multipart, bool) {
+	return unwrap[Multipart](s)
+}
+
+// AsPresigner returns the storage, or the one it wraps, presigning downloads
+func AsPresigner(s Storage) (Presigner, bool) {
+	return unwrap[Presigner](s)
+}
+
+func unwrap[T any](s Storage) (T, bool) {
+	for {
+		if found, ok := s.(T); ok {
+			return found, true
+		}
+		wrapper, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			var none T
+			return none, false
+		}
+		s = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,67 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "src")
+	os.WriteFile(file, []byte(content), 0644)
+	return file
+}
+
+func TestLocalPut(t *testing.T) {
+	assert := assert.New(t)
+	local := storage.NewLocal(t.TempDir())
+
+	src := writeTempFile(t, "hello")
+	assert.NoError(local.Put("a/b/file.txt", src))
+	assert.NoFileExists(src)
+
+	content, _ := os.ReadFile(local.Path("a/b/file.txt"))
+	assert.Equal("hello", string(content))
+}
+
+func TestLocalPermissions(t *testing.T) {
+	assert := assert.New(t)
+	local := storage.NewLocal(t.TempDir())
+	local.Permissions = &storage.Permissions{FileMode: 0640, DirMode: 0750, Uid: -1, Gid: -1}
+	os.MkdirAll(local.Path("a"), 0700)
+
+	assert.NoError(local.Put("a/b/file.txt", writeTempFile(t, "hello")))
+	info, _ := os.Stat(local.Path("a/b/file.txt"))
+	assert.Equal(os.FileMode(0640), info.Mode().Perm())
+	info, _ = os.Stat(local.Path("a/b"))
+	assert.Equal(os.FileMode(0750), info.Mode().Perm())
+	// directories already there are left alone
+	info, _ = os.Stat(local.Path("a"))
+	assert.Equal(os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestWORM(t *testing.T) {
+	assert := assert.New(t)
+	worm := storage.NewWORM(storage.NewLocal(t.TempDir()), func(key string) time.Duration {
+		if filepath.Dir(key) == "locked" {
+			return time.Hour
+		}
+		return 0
+	})
+
+	assert.NoError(worm.Put("locked/file.txt", writeTempFile(t, "v1")))
+	assert.NoError(worm.Put("open/file.txt", writeTempFile(t, "v1")))
+	assert.True(storage.IsLocked(worm, "locked/file.txt"))
+	assert.False(storage.IsLocked(worm, "open/file.txt"))
+
+	assert.ErrorIs(worm.Put("locked/file.txt", writeTempFile(t, "v2")), storage.ErrObjectLocked)
+	assert.ErrorIs(worm.Rename("locked/file.txt", "open/other.txt"), storage.ErrObjectLocked)
+	assert.ErrorIs(worm.Delete("locked/file.txt"), storage.ErrObjectLocked)
+
+	assert.NoError(worm.Put("open/file.txt", writeTempFile(t, "v2")))
+	assert.NoError(worm.Delete("open/file.txt"))
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// WORM refuses to overwrite, rename or delete keys while they are within
+// their retention period, counted from the time the object was written.
+type WORM struct {
+	Storage
+	// Retention returns how long key stays locked, zero means never locked
+	Retention func(key string) time.Duration
+}
+
+func NewWORM(s Storage, retention func(key string) time.Duration) *WORM {
+	return &WORM{Storage: s, Retention: retention}
+}
+
+func (w *WORM) Unwrap() Storage {
+	return w.Storage
+}
+
+func (w *WORM) Locked(key string) bool {
+	retention := w.Retention(key)
+	if retention <= 0 {
+		return false
+	}
+	info, err := w.Storage.Stat(key)
+	if err != nil {
+		return false
+	}
+	return time.Since(info.ModTime()) < retention
+}
+
+func (w *WORM) Put(key string, src string) error {
+	if w.Locked(key) {
+		return ErrObjectLocked
+	}
+	return w.Storage.Put(key, src)
+}
+
+func (w *WORM) PutContext(ctx context.Context, key string, src string) error {
+	if w.Locked(key) {
+		return ErrObjectLocked
+	}
+	return PutContext(ctx, w.Storage, key, src)
+}
+
+func (w *WORM) Rename(from string, to string) error {
+	if w.Locked(from) || w.Locked(to) {
+		return ErrObjectLocked
+	}
+	return w.Storage.Rename(from, to)
+}
+
+func (w *WORM) Delete(key string) error {
+	if w.Locked(key) {
+		return ErrObjectLocked
+	}
+	return w.Storage.Delete(key)
+}
+
+func (w *WORM) Erase(key string) error {
+	if w.Locked(key) {
+		return ErrObjectLocked
+	}
+	return Erase(w.Storage, key)
+}
@@ -0,0 +1,227 @@
+// Package e2e runs the real server binary and talks to it through the Go
+// client, the way it is deployed.
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/clients/golang/uploader"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var binary string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		os.Exit(0)
+	}
+	dir, err := os.MkdirTemp("", "e2e")
+	if err != nil {
+		panic(err)
+	}
+	binary = filepath.Join(dir, "server")
+	build := exec.Command("go", "build", "-o", binary, "../../cmd/server")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type server struct {
+	t      *testing.T
+	root   string
+	listen string
+	cmd    *exec.Cmd
+}
+
+// newServer writes a config under a temp root and starts the binary with it
+func newServer(t *testing.T) *server {
+	root := t.TempDir()
+	return newReplica(t, root, filepath.Join(root, "meta"), "")
+}
+
+// newReplica starts a server under root keeping its metas in metafileDir,
+// which replicas share, with extra appended to the uploader config
+func newReplica(t *testing.T, root string, metafileDir string, extra string) *server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listen := listener.Addr().String()
+	listener.Close()
+
+	config := fmt.Sprintf(`uploader:
+  listen: %s
+  slice_cache_dir: %s
+  upload_dir: %s
+  metafile_dir: %s
+`, listen, filepath.Join(root, "cache"), filepath.Join(root, "data"), metafileDir) + extra
+	require.NoError(t, os.WriteFile(filepath.Join(root, "config.yaml"), []byte(config), 0644))
+
+	s := &server{t: t, root: root, listen: listen}
+	s.start()
+	t.Cleanup(s.kill)
+	return s
+}
+
+func (s *server) start() {
+	s.cmd = exec.Command(binary, "-config", filepath.Join(s.root, "config.yaml"))
+	require.NoError(s.t, s.cmd.Start())
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get("http://" + s.listen + "/files/chunk_size"); err == nil {
+			resp.Body.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.t.Fatal("server did not start")
+}
+
+func (s *server) kill() {
+	if s.cmd.ProcessState == nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+}
+
+func (s *server) client() *uploader.Client {
+	return uploader.NewClient("http://" + s.listen + "/files")
+}
+
+func randomFile(t *testing.T, size int) (string, []byte) {
+	content := make([]byte, size)
+	rand.Read(content)
+	name := filepath.Join(t.TempDir(), "source.bin")
+	require.NoError(t, os.WriteFile(name, content, 0644))
+	return name, content
+}
+
+func assertDownload(t *testing.T, client *uploader.Client, fileId string, content []byte) {
+	dest := filepath.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.DownloadFile(context.Background(), fileId, dest, uploader.DownloadOptions{SegmentSize: 256 * 1024}))
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, content, downloaded)
+}
+
+func TestUploadDownload(t *testing.T) {
+	s := newServer(t)
+	name, content := randomFile(t, 5*1024*1024+123)
+
+	session, err := s.client().UploadFile(context.Background(), name, uploader.UploadOptions{ChunkSize: 1024 * 1024})
+	require.NoError(t, err)
+	stored, _ := os.ReadFile(filepath.Join(s.root, "data", "source.bin"))
+	assert.Equal(t, content, stored)
+	assertDownload(t, s.client(), session.FileId, content)
+}
+
+func TestAbortAndResume(t *testing.T) {
+	s := newServer(t)
+	name, content := randomFile(t, 6*1024*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := s.client().UploadFile(ctx, name, uploader.UploadOptions{
+		ChunkSize: 1024 * 1024,
+		OnProgress: func(uploaded int, total int) {
+			if uploaded == 3 {
+				cancel()
+			}
+		},
+	})
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(s.root, "data", "source.bin"))
+
+	uploaded := 0
+	second, err := s.client().UploadFile(context.Background(), name, uploader.UploadOptions{
+		ChunkSize:  1024 * 1024,
+		OnProgress: func(int, int) { uploaded++ },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, first.FileId, second.FileId)
+	assert.Equal(t, 3, uploaded)
+	assertDownload(t, s.client(), second.FileId, content)
+}
+
+func TestServerRestartMidUpload(t *testing.T) {
+	s := newServer(t)
+	name, content := randomFile(t, 6*1024*1024)
+
+	first, err := s.client().UploadFile(context.Background(), name, uploader.UploadOptions{
+		ChunkSize: 1024 * 1024,
+		OnProgress: func(uploaded int, total int) {
+			if uploaded == 2 {
+				s.kill()
+			}
+		},
+	})
+	assert.Error(t, err)
+
+	s.start()
+	second, err := s.client().UploadFile(context.Background(), name, uploader.UploadOptions{ChunkSize: 1024 * 1024})
+	require.NoError(t, err)
+	assert.Equal(t, first.FileId, second.FileId)
+	assertDownload(t, s.client(), second.FileId, content)
+}
+
+func TestUsageOfReplicas(t *testing.T) {
+	metafileDir := t.TempDir()
+	extra := `  admin_token: secret
+  api_keys:
+    - id: team
+      key: team-key
+`
+	replicas := []*server{newReplica(t, t.TempDir(), metafileDir, extra), newReplica(t, t.TempDir(), metafileDir, extra)}
+	send := func(s *server) *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+s.listen+"/files/chunk_size", nil)
+		req.Header.Set("X-Api-Key", "team-key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	// each query flushes the usage of the replica queried
+	requests := func(s *server) int64 {
+		req, _ := http.NewRequest("GET", "http://"+s.listen+"/admin/usage?key_id=team", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var response struct {
+			Data []struct {
+				Requests int64 `json:"requests"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		if len(response.Data) != 1 {
+			return 0
+		}
+		return response.Data[0].Requests
+	}
+
+	for i, s := range replicas {
+		for j := 0; j <= i; j++ {
+			assert.Equal(t, http.StatusOK, send(s).StatusCode)
+		}
+	}
+	requests(replicas[0])
+	assert.Equal(t, int64(3), requests(replicas[1]))
+
+	// a restart carries on from the counts flushed
+	replicas[0].kill()
+	replicas[0].start()
+	send(replicas[0])
+	assert.Equal(t, int64(4), requests(replicas[0]))
+}
@@ -0,0 +1,137 @@
+// Package uploadererrors holds the errors simple-uploader answers requests
+// with, for embedders of the controllers and clients to tell failures apart
+// with errors.Is instead of statuses and messages.
+package uploadererrors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Error is a failure of a request, answered with Status and Code (Status
+// when 0). Name is sent as `error` in the response, Message as `message`.
+type Error struct {
+	Name    string
+	Status  int
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is holds for the errors of the same name, whatever their message
+func (e *Error) Is(target error) bool {
+	known, ok := target.(*Error)
+	return ok && known.Name == e.Name
+}
+
+// WithMessage is e answered with message, e.g. with the details of a failure
+func (e *Error) WithMessage(message string) *Error {
+	copied := *e
+	copied.Message = message
+	return &copied
+}
+
+var (
+	ErrSessionNotFound = &Error{Name: "session_not_found", Status: 404, Message: "session not found"}
+	ErrSessionExpired  = &Error{Name: "session_expired", Status: 410, Message: "session expired"}
+	ErrMetaMismatch    = &Error{Name: "meta_mismatch", Status: 422, Message: "meta doesn't match the session"}
+	ErrMetaVersion     = &Error{Name: "meta_version", Status: 503, Message: "meta of a newer version"}
+	ErrFileCompleted   = &Error{Name: "file_completed", Status: 409, Message: "file already completed"}
+	ErrFileLocked      = &Error{Name: "file_locked", Status: 409, Message: "file is locked"}
+	ErrUploadFailed    = &Error{Name: "upload_failed", Status: 409, Message: "upload failed"}
+	ErrSlicesMissing   = &Error{Name: "slices_missing", Status: 409, Message: "slices missing"}
+	// an uploaded slice can be sent again, but only with the same content
+	ErrSliceConflict      = &Error{Name: "slice_conflict", Status: 409, Message: "slice already uploaded with different content"}
+	ErrSliceSizeMismatch  = &Error{Name: "slice_size_mismatch", Status: 400, Code: 4001, Message: "slice size mismatch"}
+	ErrCacheLimit         = &Error{Name: "cache_limit", Status: 413, Message: "session cache limit exceeded"}
+	ErrInvalidWriterToken = &Error{Name: "invalid_writer_token", Status: 403, Message: "invalid writer token"}
+	// the file at the name of the session doesn't meet its precondition
+	ErrPreconditionFailed  = &Error{Name: "precondition_failed", Status: 412, Message: "precondition failed"}
+	ErrNotAppendable       = &Error{Name: "not_appendable", Status: 409, Message: "file can't be appended to"}
+	ErrNotPatchable        = &Error{Name: "not_patchable", Status: 409, Message: "file can't be patched"}
+	ErrInvalidContentRange = &Error{Name: "invalid_content_range", Status: 416, Message: "invalid content range"}
+	ErrSlowClient          = &Error{Name: "slow_client", Status: 408, Message: "client is sending too slowly"}
+	// unlike the 503 of storage unavailable the client waits for the operator
+	ErrMaintenance = &Error{Name: "maintenance", Status: 503, Code: 5031, Message: "read-only maintenance"}
+
+	ErrInvalidRequest         = &Error{Name: "invalid_request", Status: 400, Message: "invalid request"}
+	ErrChecksumMismatch       = &Error{Name: "checksum_mismatch", Status: 400, Message: "checksum mismatch"}
+	ErrUnknownSlice           = &Error{Name: "unknown_slice", Status: 400, Message: "unknown slice"}
+	ErrMissingClientId        = &Error{Name: "missing_client_id", Status: 400, Message: "missing X-Client-Id"}
+	ErrDeadlinePassed         = &Error{Name: "deadline_passed", Status: 400, Message: "deadline already passed"}
+	ErrInvalidNameTemplate    = &Error{Name: "invalid_name_template", Status: 400, Message: "invalid name template"}
+	ErrInvalidUnmodifiedSince = &Error{Name: "invalid_unmodified_since", Status: 400, Message: "invalid If-Unmodified-Since"}
+	ErrContentLengthRequired  = &Error{Name: "upload_content_length_required", Status: 400, Message: "upload content length required"}
+	ErrBodyTooShort           = &Error{Name: "body_too_short", Status: 400, Message: "body shorter than the content range"}
+	ErrInvalidQuery           = &Error{Name: "invalid_query", Status: 400, Message: "invalid query"}
+	ErrInvalidDump            = &Error{Name: "invalid_dump", Status: 400, Message: "invalid metadata dump"}
+	ErrRangeTooLong           = &Error{Name: "range_too_long", Status: 400, Message: "range too long"}
+	ErrUnknownAPIKey          = &Error{Name: "unknown_api_key", Status: 401, Message: "unknown api key"}
+	ErrInvalidUploadToken     = &Error{Name: "invalid_upload_token", Status: 403, Message: "invalid upload token"}
+	ErrNotCompleted           = &Error{Name: "not_completed", Status: 404, Message: "file is not completed"}
+	ErrNoSuchEntry            = &Error{Name: "no_such_entry", Status: 404, Message: "no such entry"}
+	ErrNoPreview              = &Error{Name: "no_preview", Status: 404, Message: "no preview for this type"}
+	ErrSearchDisabled         = &Error{Name: "search_disabled", Status: 404, Message: "search is disabled"}
+	ErrSliceUploaded          = &Error{Name: "slice_uploaded", Status: 409, Message: "slice already uploaded"}
+	// another client claimed the slice, see the Claim route
+	ErrSliceClaimed  = &Error{Name: "slice_claimed", Status: 409, Message: "slice is claimed"}
+	ErrDirectUpload  = &Error{Name: "direct_upload", Status: 409, Message: "file is uploaded directly to storage"}
+	ErrPatchTooLarge = &Error{Name: "patch_too_large", Status: 413, Message: "patch too large"}
+	ErrTooManyChunks = &Error{Name: "too_many_chunks", Status: 413, Message: "too many chunks"}
+	ErrNotZip        = &Error{Name: "not_zip", Status: 415, Message: "file is not a zip"}
+	ErrMisdirected   = &Error{Name: "misdirected", Status: 421, Message: "session is served by another instance"}
+	ErrFileRejected  = &Error{Name: "file_rejected", Status: 422, Message: "file rejected"}
+	// nobody reads it but the access log
+	ErrClientGone         = &Error{Name: "client_gone", Status: 499, Message: "client closed request"}
+	ErrPreviewFailed      = &Error{Name: "preview_failed", Status: 500, Message: "failed to generate preview"}
+	ErrStorageNotLocal    = &Error{Name: "storage_not_local", Status: 501, Message: "storage is not local"}
+	ErrCDNNotConfigured   = &Error{Name: "cdn_not_configured", Status: 501, Message: "cdn is not configured"}
+	ErrStorageUnavailable = &Error{Name: "storage_unavailable", Status: 503, Message: "storage unavailable"}
+	// the slice can be sent again, after Retry-After
+	ErrSliceNotWritten     = &Error{Name: "slice_not_written", Status: 503, Message: "slice not written"}
+	ErrInsufficientStorage = &Error{Name: "insufficient_storage", Status: 507, Message: "insufficient storage"}
+	ErrQuotaExceeded       = &Error{Name: "quota_exceeded", Status: 507, Message: "quota exceeded"}
+	// the range sent didn't complete the file, the client sends the rest as
+	// with Google resumable uploads
+	ErrResumeIncomplete = &Error{Name: "resume_incomplete", Status: 308, Message: "resume incomplete"}
+)
+
+// Status is the status and code answering err, 500 unless err is or wraps
+// an Error
+func Status(err error) (int, int) {
+	var e *Error
+	if !errors.As(err, &e) {
+		return 500, 500
+	}
+	if e.Code == 0 {
+		return e.Status, e.Status
+	}
+	return e.Status, e.Code
+}
+
+// ResponseError is a failure answered by the server, it is the Error named
+// in the response so errors.Is(err, ErrSliceConflict) holds for the one
+// answering a conflicting slice
+type ResponseError struct {
+	Status  int
+	Code    int
+	Name    string
+	Message string
+	Data    json.RawMessage
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d", e.Status)
+	}
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+func (e *ResponseError) Is(target error) bool {
+	known, ok := target.(*Error)
+	return ok && e.Name != "" && known.Name == e.Name
+}
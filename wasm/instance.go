@@ -0,0 +1,216 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+var (
+	ErrTimeout     = errors.New("wasm: call timed out")
+	ErrMemoryLimit = errors.New("wasm: memory limit exceeded")
+)
+
+// Trap is a call stopped by the module, e.g. reaching unreachable or
+// accessing memory out of bounds
+type Trap struct {
+	Reason string
+}
+
+func (t *Trap) Error() string {
+	return "wasm: trap: " + t.Reason
+}
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultMemory  = 256
+)
+
+type Limits struct {
+	// how long a call may run, 10s when 0
+	Timeout time.Duration
+	// 64KiB pages of memory the module may grow to, 256 (16MiB) when 0
+	MaxMemoryPages uint32
+}
+
+// HostFunc is a function the module imports, it gets the arguments and
+// returns the results of the type of the import
+type HostFunc struct {
+	Type FuncType
+	Call func(instance *Instance, args []uint64) ([]uint64, error)
+}
+
+// Imports are the host functions by module and name
+type Imports map[string]map[string]HostFunc
+
+// Instance is an instance of a module in a runtime of its own, closed with
+// Close
+type Instance struct {
+	runtime wazero.Runtime
+	module  api.Module
+	limits  Limits
+}
+
+// Instantiate creates an instance of m with its own memory and globals,
+// every import of m must be in imports with the same type. Its start
+// function runs within the timeout of limits.
+func (m *Module) Instantiate(imports Imports, limits Limits) (*Instance, error) {
+	if limits.Timeout <= 0 {
+		limits.Timeout = defaultTimeout
+	}
+	if limits.MaxMemoryPages == 0 {
+		limits.MaxMemoryPages = defaultMemory
+	}
+	for _, imported := range m.imports {
+		host, ok := imports[imported.module][imported.name]
+		if !ok {
+			return nil, fmt.Errorf("wasm: unknown import %s.%s", imported.module, imported.name)
+		}
+		if !host.Type.equal(imported.typ.Params, imported.typ.Results) {
+			return nil, fmt.Errorf("wasm: import %s.%s has another type", imported.module, imported.name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+	config := wazero.NewRuntimeConfig().
+		WithCompilationCache(compilationCache).
+		WithMemoryLimitPages(limits.MaxMemoryPages).
+		WithCloseOnContextDone(true)
+	i := &Instance{runtime: wazero.NewRuntimeWithConfig(ctx, config), limits: limits}
+	if err := i.instantiate(ctx, m, imports); err != nil {
+		i.runtime.Close(context.Background())
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *Instance) instantiate(ctx context.Context, m *Module, imports Imports) error {
+	builders := map[string]wazero.HostModuleBuilder{}
+	for _, imported := range m.imports {
+		builder, ok := builders[imported.module]
+		if !ok {
+			builder = i.runtime.NewHostModuleBuilder(imported.module)
+			builders[imported.module] = builder
+		}
+		host := imports[imported.module][imported.name]
+		call := func(ctx context.Context, _ api.Module, stack []uint64) {
+			results, err := host.Call(i, stack[:len(host.Type.Params)])
+			if err != nil {
+				panic(hostError{err})
+			}
+			copy(stack, results)
+		}
+		builder.NewFunctionBuilder().
+			WithGoModuleFunction(api.GoModuleFunc(call), host.Type.Params, host.Type.Results).
+			Export(imported.name)
+	}
+	for _, builder := range builders {
+		if _, err := builder.Instantiate(ctx); err != nil {
+			return fmt.Errorf("wasm: %w", err)
+		}
+	}
+	// the module compiled once already, only its memory can be refused
+	compiled, err := i.runtime.CompileModule(ctx, m.binary)
+	if err != nil {
+		return ErrMemoryLimit
+	}
+	// the start section of the module only, not the _start of WASI
+	i.module, err = i.runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithStartFunctions())
+	if err != nil {
+		return callError(err)
+	}
+	return nil
+}
+
+// Close releases the instance and its memory
+func (i *Instance) Close() error {
+	return i.runtime.Close(context.Background())
+}
+
+// Memory is the exported memory of the instance, it is replaced when the
+// module grows it
+func (i *Instance) Memory() []byte {
+	memory := i.module.Memory()
+	if memory == nil {
+		return nil
+	}
+	data, _ := memory.Read(0, memory.Size())
+	return data
+}
+
+// Read returns the n bytes of memory at offset
+func (i *Instance) Read(offset uint32, n uint32) ([]byte, error) {
+	memory := i.module.Memory()
+	if memory == nil {
+		return nil, &Trap{Reason: "no memory"}
+	}
+	data, ok := memory.Read(offset, n)
+	if !ok {
+		return nil, &Trap{Reason: "out of bounds memory access"}
+	}
+	return data, nil
+}
+
+// Write copies data into memory at offset
+func (i *Instance) Write(offset uint32, data []byte) error {
+	memory := i.module.Memory()
+	if memory == nil || !memory.Write(offset, data) {
+		return &Trap{Reason: "out of bounds memory access"}
+	}
+	return nil
+}
+
+// Call calls the exported function name with args, the values of i32 and
+// i64 as uint64 and floats as their bits. The call has the timeout of the
+// limits of the instance, the instance is closed once it ran out of time.
+func (i *Instance) Call(name string, args ...uint64) ([]uint64, error) {
+	function := i.module.ExportedFunction(name)
+	if function == nil {
+		return nil, fmt.Errorf("wasm: no function %s", name)
+	}
+	if params := len(function.Definition().ParamTypes()); len(args) != params {
+		return nil, fmt.Errorf("wasm: %s takes %d arguments", name, params)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), i.limits.Timeout)
+	defer cancel()
+	results, err := function.Call(ctx, args...)
+	if err != nil {
+		return nil, callError(err)
+	}
+	return results, nil
+}
+
+// hostError carries the error of a host function through wazero
+type hostError struct {
+	err error
+}
+
+func (e hostError) Error() string {
+	return e.err.Error()
+}
+
+// callError is the error of a call which failed: the error of a host
+// function, the timeout, or a trap
+func callError(err error) error {
+	var host hostError
+	if errors.As(err, &host) {
+		return host.err
+	}
+	var exit *sys.ExitError
+	if errors.As(err, &exit) {
+		if exit.ExitCode() == sys.ExitCodeDeadlineExceeded {
+			return ErrTimeout
+		}
+		return &Trap{Reason: fmt.Sprintf("exited with %d", exit.ExitCode())}
+	}
+	// wazero adds the stack trace after the first line
+	reason, _, _ := strings.Cut(err.Error(), "\n")
+	return &Trap{Reason: strings.TrimPrefix(reason, "wasm error: ")}
+}
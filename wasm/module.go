@@ -0,0 +1,68 @@
+// Package wasm runs WebAssembly modules in a sandbox on wazero: a module only
+// reaches the host functions it is given, and a call stops once it ran out of
+// time or when it would grow its memory past a limit.
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ValueType is the type of a param or result, api.ValueType of wazero
+type ValueType = api.ValueType
+
+const (
+	I32 = api.ValueTypeI32
+	I64 = api.ValueTypeI64
+	F32 = api.ValueTypeF32
+	F64 = api.ValueTypeF64
+)
+
+type FuncType struct {
+	Params  []ValueType
+	Results []ValueType
+}
+
+func (t FuncType) equal(params []ValueType, results []ValueType) bool {
+	return string(t.Params) == string(params) && string(t.Results) == string(results)
+}
+
+type importedFunc struct {
+	module string
+	name   string
+	typ    FuncType
+}
+
+// the machine code of the modules, shared by the runtimes of their instances
+var compilationCache = wazero.NewCompilationCache()
+
+// Module is a validated module, instantiated as many times as needed
+type Module struct {
+	binary  []byte
+	imports []importedFunc
+}
+
+// Compile validates a module in the binary format. Modules importing a
+// memory are refused.
+func Compile(binary []byte) (*Module, error) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCompilationCache(compilationCache))
+	defer runtime.Close(ctx)
+	compiled, err := runtime.CompileModule(ctx, binary)
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+	if len(compiled.ImportedMemories()) > 0 {
+		return nil, errors.New("wasm: modules importing a memory are not supported")
+	}
+	m := &Module{binary: binary}
+	for _, definition := range compiled.ImportedFunctions() {
+		module, name, _ := definition.Import()
+		m.imports = append(m.imports, importedFunc{module: module, name: name, typ: FuncType{Params: definition.ParamTypes(), Results: definition.ResultTypes()}})
+	}
+	return m, nil
+}
@@ -0,0 +1,207 @@
+package wasm_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/louis-she/simple-uploader/wasm"
+	"github.com/louis-she/simple-uploader/wasm/wasmtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// arithmetic is
+//
+//	(memory 2 3)
+//	(func (export "fac") (param i64) (result i64)
+//	  (if (result i64) (i64.eqz (local.get 0)) (then (i64.const 1))
+//	    (else (i64.mul (local.get 0) (call 0 (i64.sub (local.get 0) (i64.const 1)))))))
+//	(func (export "sum") (param i32) (result i32) (local i32)
+//	  (block (loop
+//	    (br_if 1 (i32.eqz (local.get 0)))
+//	    (local.set 1 (i32.add (local.get 1) (local.get 0)))
+//	    (local.set 0 (i32.sub (local.get 0) (i32.const 1)))
+//	    (br 0)))
+//	  (local.get 1))
+//	(func (export "div") (param i32) (result i32) (i32.div_u (i32.const 10) (local.get 0)))
+//	(func (export "spin") (param i32) (result i32) (loop (br 0)) (local.get 0))
+//	(func (export "grow") (param i32) (result i32) (memory.grow (local.get 0)))
+//	(func (export "load") (param i32) (result i32) (i32.load (local.get 0)))
+func arithmetic() []byte {
+	return wasmtest.Module(
+		wasmtest.Section(1, wasmtest.Vec([]byte{0x60, 0x01, 0x7e, 0x01, 0x7e}, wasmtest.FuncType(1, 1))),
+		wasmtest.Section(3, wasmtest.Vec([]byte{0x00}, []byte{0x01}, []byte{0x01}, []byte{0x01}, []byte{0x01}, []byte{0x01})),
+		wasmtest.Section(5, wasmtest.Vec([]byte{0x01, 0x02, 0x03})),
+		wasmtest.Section(7, wasmtest.Vec(
+			wasmtest.Export("fac", 0, 0), wasmtest.Export("sum", 0, 1), wasmtest.Export("div", 0, 2),
+			wasmtest.Export("spin", 0, 3), wasmtest.Export("grow", 0, 4), wasmtest.Export("load", 0, 5),
+		)),
+		wasmtest.Section(10, wasmtest.Vec(
+			wasmtest.Body(0, 0x20, 0x00, 0x50, 0x04, 0x7e, 0x42, 0x01, 0x05,
+				0x20, 0x00, 0x20, 0x00, 0x42, 0x01, 0x7d, 0x10, 0x00, 0x7e, 0x0b, 0x0b),
+			wasmtest.Body(1, 0x02, 0x40, 0x03, 0x40, 0x20, 0x00, 0x45, 0x0d, 0x01,
+				0x20, 0x01, 0x20, 0x00, 0x6a, 0x21, 0x01,
+				0x20, 0x00, 0x41, 0x01, 0x6b, 0x21, 0x00, 0x0c, 0x00, 0x0b, 0x0b,
+				0x20, 0x01, 0x0b),
+			wasmtest.Body(0, 0x41, 0x0a, 0x20, 0x00, 0x6e, 0x0b),
+			wasmtest.Body(0, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x20, 0x00, 0x0b),
+			wasmtest.Body(0, 0x20, 0x00, 0x40, 0x00, 0x0b),
+			wasmtest.Body(0, 0x20, 0x00, 0x28, 0x02, 0x00, 0x0b),
+		)),
+	)
+}
+
+func TestCall(t *testing.T) {
+	assert := assert.New(t)
+	module, err := wasm.Compile(arithmetic())
+	if !assert.NoError(err) {
+		return
+	}
+	instance, err := module.Instantiate(nil, wasm.Limits{Timeout: 500 * time.Millisecond})
+	if !assert.NoError(err) {
+		return
+	}
+	defer instance.Close()
+	results, err := instance.Call("fac", 20)
+	assert.NoError(err)
+	assert.Equal([]uint64{2432902008176640000}, results)
+	results, err = instance.Call("sum", 100)
+	assert.NoError(err)
+	assert.Equal([]uint64{5050}, results)
+	results, err = instance.Call("div", 3)
+	assert.NoError(err)
+	assert.Equal([]uint64{3}, results)
+
+	var trap *wasm.Trap
+	_, err = instance.Call("div", 0)
+	assert.True(errors.As(err, &trap))
+	assert.Equal("integer divide by zero", trap.Reason)
+	_, err = instance.Call("load", 2*64*1024-2)
+	assert.True(errors.As(err, &trap))
+	_, err = instance.Call("fac", 1<<40)
+	assert.True(errors.As(err, &trap))
+	assert.Equal("stack overflow", trap.Reason)
+	_, err = instance.Call("nothing")
+	assert.Error(err)
+
+	// a call out of time closes its instance, a new one runs again
+	_, err = instance.Call("spin", 1)
+	assert.Equal(wasm.ErrTimeout, err)
+	_, err = instance.Call("sum", 100)
+	assert.Error(err)
+	instance, _ = module.Instantiate(nil, wasm.Limits{})
+	defer instance.Close()
+	results, err = instance.Call("sum", 100)
+	assert.NoError(err)
+	assert.Equal([]uint64{5050}, results)
+}
+
+func TestMemoryLimit(t *testing.T) {
+	assert := assert.New(t)
+	module, _ := wasm.Compile(arithmetic())
+	_, err := module.Instantiate(nil, wasm.Limits{MaxMemoryPages: 1})
+	assert.Equal(wasm.ErrMemoryLimit, err)
+
+	// the module can't grow past its own maximum of 3 pages either
+	instance, _ := module.Instantiate(nil, wasm.Limits{MaxMemoryPages: 4})
+	defer instance.Close()
+	results, _ := instance.Call("grow", 1)
+	assert.Equal([]uint64{2}, results)
+	results, _ = instance.Call("grow", 1)
+	assert.Equal([]uint64{0xffffffff}, results)
+	assert.Len(instance.Memory(), 3*64*1024)
+}
+
+func TestMemoryLimitPages(t *testing.T) {
+	assert := assert.New(t)
+	module, _ := wasm.Compile(arithmetic())
+	// the limit is below the maximum of the module
+	instance, err := module.Instantiate(nil, wasm.Limits{MaxMemoryPages: 2})
+	if !assert.NoError(err) {
+		return
+	}
+	defer instance.Close()
+	results, _ := instance.Call("grow", 1)
+	assert.Equal([]uint64{0xffffffff}, results)
+	assert.Len(instance.Memory(), 2*64*1024)
+}
+
+func TestImports(t *testing.T) {
+	assert := assert.New(t)
+	module, err := wasm.Compile(wasmtest.Upper())
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = module.Instantiate(nil, wasm.Limits{})
+	assert.ErrorContains(err, "unknown import uploader.set_output")
+
+	var output, rejected string
+	metadata := map[string]string{}
+	pair := wasm.FuncType{Params: []wasm.ValueType{wasm.I32, wasm.I32}}
+	read := func(instance *wasm.Instance, args []uint64) string {
+		data, _ := instance.Read(uint32(args[0]), uint32(args[1]))
+		return string(data)
+	}
+	imports := wasm.Imports{"uploader": {
+		"set_output": {Type: pair, Call: func(instance *wasm.Instance, args []uint64) ([]uint64, error) {
+			output = read(instance, args)
+			return nil, nil
+		}},
+		"reject": {Type: pair, Call: func(instance *wasm.Instance, args []uint64) ([]uint64, error) {
+			rejected = read(instance, args)
+			return nil, nil
+		}},
+		"set_metadata": {
+			Type: wasm.FuncType{Params: []wasm.ValueType{wasm.I32, wasm.I32, wasm.I32, wasm.I32}},
+			Call: func(instance *wasm.Instance, args []uint64) ([]uint64, error) {
+				metadata[read(instance, args[:2])] = read(instance, args[2:])
+				return nil, nil
+			},
+		},
+	}}
+	process := func(input string) error {
+		instance, err := module.Instantiate(imports, wasm.Limits{MaxMemoryPages: 4})
+		if err != nil {
+			return err
+		}
+		defer instance.Close()
+		results, err := instance.Call("alloc", uint64(len(input)))
+		if err != nil {
+			return err
+		}
+		if err := instance.Write(uint32(results[0]), []byte(input)); err != nil {
+			return err
+		}
+		_, err = instance.Call("process", results[0], uint64(len(input)))
+		return err
+	}
+
+	assert.NoError(process("Hello, World!"))
+	assert.Equal("HELLO, WORLD!", output)
+	assert.Equal(map[string]string{"case": "upper"}, metadata)
+	assert.NoError(process("!hello"))
+	assert.Equal("starts with !", rejected)
+
+	// alloc grows the memory past its limit, the input doesn't fit
+	var trap *wasm.Trap
+	assert.True(errors.As(process(strings.Repeat("a", 4*64*1024)), &trap))
+}
+
+func TestCompile(t *testing.T) {
+	assert := assert.New(t)
+	for _, binary := range [][]byte{
+		nil,
+		[]byte("\x00asm\x02\x00\x00\x00"),
+		arithmetic()[:40],
+		// a vector longer than its section
+		wasmtest.Module(wasmtest.Section(1, []byte{0xff, 0xff, 0x03})),
+		// an import of a memory
+		wasmtest.Module(wasmtest.Section(2, wasmtest.Vec(append(append(wasmtest.Name("env"), wasmtest.Name("memory")...), 0x02, 0x00, 0x01)))),
+		// a function without code
+		wasmtest.Module(wasmtest.Section(1, wasmtest.Vec(wasmtest.FuncType(0, 0))), wasmtest.Section(3, wasmtest.Vec([]byte{0x00}))),
+	} {
+		_, err := wasm.Compile(binary)
+		assert.Error(err)
+	}
+}
@@ -0,0 +1,164 @@
+// Package wasmtest assembles small modules in the binary format for tests,
+// their text format is in the comment of each.
+package wasmtest
+
+// U32 encodes v as an unsigned LEB128
+func U32(v uint32) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// S64 encodes v as a signed LEB128, the immediate of i32.const and
+// i64.const
+func S64(v int64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// Vec is a vector of items, their count then their bytes
+func Vec(items ...[]byte) []byte {
+	b := U32(uint32(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+// Name encodes a string with its length
+func Name(s string) []byte {
+	return append(U32(uint32(len(s))), s...)
+}
+
+func Section(id byte, content []byte) []byte {
+	return append(append([]byte{id}, U32(uint32(len(content)))...), content...)
+}
+
+// FuncType of i32 params and results, the only types of the modules here
+func FuncType(params int, results int) []byte {
+	b := []byte{0x60}
+	b = append(b, U32(uint32(params))...)
+	for i := 0; i < params; i++ {
+		b = append(b, 0x7f)
+	}
+	b = append(b, U32(uint32(results))...)
+	for i := 0; i < results; i++ {
+		b = append(b, 0x7f)
+	}
+	return b
+}
+
+// Body of a function with i32 locals, code ends with the end of the
+// function
+func Body(locals int, code ...byte) []byte {
+	b := Vec()
+	if locals > 0 {
+		b = Vec(append(U32(uint32(locals)), 0x7f))
+	}
+	b = append(b, code...)
+	return append(U32(uint32(len(b))), b...)
+}
+
+func Export(name string, kind byte, index uint32) []byte {
+	return append(append(Name(name), kind), U32(index)...)
+}
+
+// Module puts sections after the header
+func Module(sections ...[]byte) []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	for _, section := range sections {
+		b = append(b, section...)
+	}
+	return b
+}
+
+// Upper is a module of the processor ABI turning ascii letters to upper
+// case, and rejecting files starting with "!":
+//
+//	(import "uploader" "set_output" (func $set_output (param i32 i32)))
+//	(import "uploader" "reject" (func $reject (param i32 i32)))
+//	(import "uploader" "set_metadata" (func $set_metadata (param i32 i32 i32 i32)))
+//	(memory (export "memory") 1)
+//	(data (i32.const 16) "starts with !")
+//	(data (i32.const 32) "caseupper")
+//	(func (export "alloc") (param $size i32) (result i32)
+//	  (drop (memory.grow (i32.shr_u (i32.add (local.get $size) (i32.const 65535)) (i32.const 16))))
+//	  (i32.const 1024))
+//	(func (export "process") (param $ptr i32) (param $len i32) (local $i i32) (local $c i32)
+//	  (if (i32.and (i32.ne (local.get $len) (i32.const 0))
+//	               (i32.eq (i32.load8_u (local.get $ptr)) (i32.const 33)))
+//	    (then (call $reject (i32.const 16) (i32.const 13)) (return)))
+//	  (block (loop
+//	    (br_if 1 (i32.ge_u (local.get $i) (local.get $len)))
+//	    (local.set $c (i32.load8_u (i32.add (local.get $ptr) (local.get $i))))
+//	    (i32.store8 (i32.add (local.get $ptr) (local.get $i))
+//	      (select (i32.sub (local.get $c) (i32.const 32)) (local.get $c)
+//	        (i32.lt_u (i32.sub (local.get $c) (i32.const 97)) (i32.const 26))))
+//	    (local.set $i (i32.add (local.get $i) (i32.const 1)))
+//	    (br 0)))
+//	  (call $set_metadata (i32.const 32) (i32.const 4) (i32.const 36) (i32.const 5))
+//	  (call $set_output (local.get $ptr) (local.get $len)))
+func Upper() []byte {
+	process := Body(2,
+		// reject when the first byte is "!"
+		0x20, 0x01, 0x41, 0x00, 0x47, 0x20, 0x00, 0x2d, 0x00, 0x00, 0x41, 0x21, 0x46, 0x71, 0x04, 0x40,
+		0x41, 0x10, 0x41, 0x0d, 0x10, 0x01, 0x0f, 0x0b,
+		0x02, 0x40, 0x03, 0x40,
+		0x20, 0x02, 0x20, 0x01, 0x4f, 0x0d, 0x01,
+		0x20, 0x00, 0x20, 0x02, 0x6a, 0x2d, 0x00, 0x00, 0x21, 0x03,
+		0x20, 0x00, 0x20, 0x02, 0x6a,
+		0x20, 0x03, 0x41, 0x20, 0x6b, 0x20, 0x03,
+		0x20, 0x03, 0x41, 0xe1, 0x00, 0x6b, 0x41, 0x1a, 0x49, 0x1b, 0x3a, 0x00, 0x00,
+		0x20, 0x02, 0x41, 0x01, 0x6a, 0x21, 0x02, 0x0c, 0x00,
+		0x0b, 0x0b,
+		0x41, 0x20, 0x41, 0x04, 0x41, 0x24, 0x41, 0x05, 0x10, 0x02,
+		0x20, 0x00, 0x20, 0x01, 0x10, 0x00, 0x0b,
+	)
+	return Module(
+		Section(1, Vec(FuncType(2, 0), FuncType(4, 0), FuncType(1, 1))),
+		Section(2, Vec(
+			append(append(Name("uploader"), Name("set_output")...), 0x00, 0x00),
+			append(append(Name("uploader"), Name("reject")...), 0x00, 0x00),
+			append(append(Name("uploader"), Name("set_metadata")...), 0x00, 0x01),
+		)),
+		Section(3, Vec([]byte{0x02}, []byte{0x00})),
+		Section(5, Vec([]byte{0x00, 0x01})),
+		Section(7, Vec(Export("memory", 2, 0), Export("alloc", 0, 3), Export("process", 0, 4))),
+		Section(10, Vec(Body(0,
+			0x20, 0x00, 0x41, 0xff, 0xff, 0x03, 0x6a, 0x41, 0x10, 0x76, 0x40, 0x00, 0x1a,
+			0x41, 0x80, 0x08, 0x0b,
+		), process)),
+		Section(11, Vec(
+			append([]byte{0x00, 0x41, 0x10, 0x0b}, Name("starts with !")...),
+			append([]byte{0x00, 0x41, 0x20, 0x0b}, Name("caseupper")...),
+		)),
+	)
+}
+
+// Spin is a module of the processor ABI never returning from process:
+//
+//	(memory (export "memory") 1)
+//	(func (export "alloc") (param i32) (result i32) (i32.const 0))
+//	(func (export "process") (param i32 i32) (loop (br 0)))
+func Spin() []byte {
+	return Module(
+		Section(1, Vec(FuncType(1, 1), FuncType(2, 0))),
+		Section(3, Vec([]byte{0x00}, []byte{0x01})),
+		Section(5, Vec([]byte{0x00, 0x01})),
+		Section(7, Vec(Export("memory", 2, 0), Export("alloc", 0, 0), Export("process", 0, 1))),
+		Section(10, Vec(Body(0, 0x41, 0x00, 0x0b), Body(0, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b))),
+	)
+}